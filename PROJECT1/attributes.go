@@ -0,0 +1,626 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CUSTOM ATTRIBUTES
+// A category can define typed attributes: Maintenance gets inspection_due (date),
+// Maintenance > Electrical gets wattage (number). Subcategories inherit their parent's definitions.
+// Values live on the Item (custom) and are checked against the definition when set,
+// so a filter like "wattage>=40" can compare numbers as numbers. Required ones have to be there
+// from creation on, and moving an item to another category checks its values against that one.
+// The plain category attributes (categories.go) are free text shared by every item in the category,
+// typed ones are per item. One name can't be both, itemAttributes shows them together.
+//
+// ATTACHMENTS
+// Manuals and photos go into the blob store (blobstore.go), the item only keeps name, hash, size and type.
+
+type attrKind string
+
+const (
+	attrString attrKind = "string"
+	attrNumber attrKind = "number"
+	attrDate   attrKind = "date" // 2006-01-02
+	attrEnum   attrKind = "enum"
+)
+
+const attrDateLayout = "2006-01-02"
+
+var (
+	errUnknownAttribute = errors.New("attribute is not defined for the item's category")
+	errAttributeExists  = errors.New("attribute is already defined on this category or above it")
+	errMissingAttribute = errors.New("required attribute missing")
+	errBadAttribute     = errors.New("attribute value doesn't fit its type")
+	errBadAttrKind      = errors.New("attribute type must be string, number, date or enum")
+	errNoBlobStore      = errors.New("no blob store configured")
+	errNoAttachment     = errors.New("item has no attachment with that name")
+	errBadCondition     = errors.New("condition must look like name=value, name>=10, name~text")
+)
+
+type attributeDef struct {
+	name     string
+	kind     attrKind
+	required bool
+	choices  []string // enum only
+}
+
+func (d attributeDef) info() string {
+	s := fmt.Sprintf("%v (%v)", d.name, d.kind)
+	if d.kind == attrEnum {
+		s += " " + strings.Join(d.choices, "/")
+	}
+	if d.required {
+		s += " required"
+	}
+	return s
+}
+
+// check returns the value the way it gets stored, or why it doesn't fit
+func (d attributeDef) check(value string) (string, error) {
+	value = strings.TrimSpace(value)
+	switch d.kind {
+	case attrNumber:
+		n, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return "", fmt.Errorf("%w: %v wants a number, got %q", errBadAttribute, d.name, value)
+		}
+		return strconv.FormatFloat(n, 'f', -1, 64), nil
+	case attrDate:
+		t, err := time.Parse(attrDateLayout, value)
+		if err != nil {
+			return "", fmt.Errorf("%w: %v wants a date like 2025-03-01, got %q", errBadAttribute, d.name, value)
+		}
+		return t.Format(attrDateLayout), nil
+	case attrEnum:
+		for _, c := range d.choices {
+			if strings.EqualFold(c, value) {
+				return c, nil
+			}
+		}
+		return "", fmt.Errorf("%w: %v must be one of %v, got %q", errBadAttribute, d.name, strings.Join(d.choices, "/"), value)
+	}
+	return value, nil
+}
+
+// compare orders two stored values the way the type says, numbers as numbers, dates as dates
+func (d attributeDef) compare(a, b string) (int, bool) {
+	switch d.kind {
+	case attrNumber:
+		x, err1 := strconv.ParseFloat(a, 64)
+		y, err2 := strconv.ParseFloat(b, 64)
+		if err1 != nil || err2 != nil {
+			return 0, false
+		}
+		switch {
+		case x < y:
+			return -1, true
+		case x > y:
+			return 1, true
+		}
+		return 0, true
+	case attrDate:
+		x, err1 := time.Parse(attrDateLayout, a)
+		y, err2 := time.Parse(attrDateLayout, b)
+		if err1 != nil || err2 != nil {
+			return 0, false
+		}
+		return x.Compare(y), true
+	}
+	return strings.Compare(strings.ToLower(a), strings.ToLower(b)), true
+}
+
+func categoryKey(path string) string {
+	return strings.Join(splitCategoryPath(path), categorySeparator)
+}
+
+// attributeDefsLocked is everything defined on the category and above it, must be called with s.mu held
+func (s *System) attributeDefsLocked(category string) map[string]attributeDef {
+	defs := map[string]attributeDef{}
+	parts := splitCategoryPath(category)
+	for i := range parts {
+		for name, d := range s.attrDefs[strings.Join(parts[:i+1], categorySeparator)] {
+			defs[name] = d
+		}
+	}
+	return defs
+}
+
+func (s *System) attributeDefs(category string) []attributeDef {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var defs []attributeDef
+	for _, d := range s.attributeDefsLocked(category) {
+		defs = append(defs, d)
+	}
+	sort.Slice(defs, func(a, b int) bool { return defs[a].name < defs[b].name })
+	return defs
+}
+
+func (s *System) defineAttribute(category string, def attributeDef) error {
+	switch def.kind {
+	case attrString, attrNumber, attrDate:
+	case attrEnum:
+		if len(def.choices) == 0 {
+			return fmt.Errorf("%w: enum %v has no choices", errBadAttrKind, def.name)
+		}
+	default:
+		return errBadAttrKind
+	}
+	if strings.TrimSpace(def.name) == "" {
+		return errNoName
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.categories.find(category); !ok {
+		return errCategoryNotFound
+	}
+	if _, ok := s.attributeDefsLocked(category)[def.name]; ok {
+		return errAttributeExists
+	}
+	if s.plainAttributeUsedLocked(category, def.name) {
+		return fmt.Errorf("%w: %v is a plain category attribute", errAttributeExists, def.name)
+	}
+	key := categoryKey(category)
+	if s.attrDefs == nil {
+		s.attrDefs = map[string]map[string]attributeDef{}
+	}
+	if s.attrDefs[key] == nil {
+		s.attrDefs[key] = map[string]attributeDef{}
+	}
+	def.choices = append([]string(nil), def.choices...)
+	s.attrDefs[key][def.name] = def
+	if err := s.saveCategoryLocked(category); err != nil {
+		delete(s.attrDefs[key], def.name)
+		return err
+	}
+	return nil
+}
+
+// setAttribute checks the value against the item's category, an empty value removes it
+func (s *System) setAttribute(id int64, name, value string) error {
+	s.mu.Lock()
+	before, ok := s.db.get(id)
+	if !ok {
+		s.mu.Unlock()
+		return errItemNotFound
+	}
+	def, ok := s.attributeDefsLocked(before.Category)[name]
+	if !ok {
+		s.mu.Unlock()
+		return fmt.Errorf("%w: %v on %v", errUnknownAttribute, name, before.Category)
+	}
+	after := before
+	after.custom = map[string]string{}
+	for k, v := range before.custom {
+		after.custom[k] = v
+	}
+	if strings.TrimSpace(value) == "" {
+		if def.required {
+			s.mu.Unlock()
+			return fmt.Errorf("%w: %v can't be removed", errMissingAttribute, name)
+		}
+		delete(after.custom, name)
+	} else {
+		checked, err := def.check(value)
+		if err != nil {
+			s.mu.Unlock()
+			return err
+		}
+		after.custom[name] = checked
+	}
+	err := s.db.update(after)
+	if err == nil {
+		s.emitLocked(itemUpdated{before: before, after: after})
+	}
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	s.flushEvents()
+	return nil
+}
+
+// checkCustomLocked checks a whole set of values against a category: every value needs a definition
+// and has to fit it, every required one has to be there. It returns the values as they get stored,
+// must be called with s.mu held
+func (s *System) checkCustomLocked(category string, custom map[string]string) (map[string]string, error) {
+	defs := s.attributeDefsLocked(category)
+	checked := map[string]string{}
+	for name, value := range custom {
+		def, ok := defs[name]
+		if !ok {
+			return nil, fmt.Errorf("%w: %v on %v", errUnknownAttribute, name, category)
+		}
+		v, err := def.check(value)
+		if err != nil {
+			return nil, err
+		}
+		checked[name] = v
+	}
+	var missing []string
+	for name, d := range defs {
+		if _, ok := checked[name]; d.required && !ok {
+			missing = append(missing, name)
+		}
+	}
+	if len(missing) > 0 {
+		sort.Strings(missing)
+		return nil, fmt.Errorf("%w: %v needs %v", errMissingAttribute, category, strings.Join(missing, ", "))
+	}
+	if len(checked) == 0 {
+		return nil, nil
+	}
+	return checked, nil
+}
+
+// plainAttributeUsedLocked is true when a plain attribute called name is set on the category,
+// above it or below it, so a typed one of that name would clash. Must be called with s.mu held
+func (s *System) plainAttributeUsedLocked(category, name string) bool {
+	node, ok := s.categories.find(category)
+	if !ok {
+		return false
+	}
+	if _, ok := node.inherited()[name]; ok {
+		return true
+	}
+	var below func(n *categoryNode) bool
+	below = func(n *categoryNode) bool {
+		for _, child := range n.children {
+			if _, ok := child.attributes[name]; ok || below(child) {
+				return true
+			}
+		}
+		return false
+	}
+	return below(node)
+}
+
+// typedAttributeUsedLocked is the other way round: a definition on the category, above or below it
+func (s *System) typedAttributeUsedLocked(category, name string) bool {
+	if _, ok := s.attributeDefsLocked(category)[name]; ok {
+		return true
+	}
+	key := categoryKey(category)
+	for k, defs := range s.attrDefs {
+		if _, ok := defs[name]; ok && strings.HasPrefix(k, key+categorySeparator) {
+			return true
+		}
+	}
+	return false
+}
+
+// missingAttributes lists the required attributes the item doesn't have yet
+func (s *System) missingAttributes(id int64) ([]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	item, ok := s.db.get(id)
+	if !ok {
+		return nil, errItemNotFound
+	}
+	var missing []string
+	for name, d := range s.attributeDefsLocked(item.Category) {
+		if _, ok := item.custom[name]; d.required && !ok {
+			missing = append(missing, name)
+		}
+	}
+	sort.Strings(missing)
+	return missing, nil
+}
+
+// FILTER CONDITIONS
+
+type attrCondition struct {
+	name  string
+	op    string // = != < <= > >= ~
+	value string
+}
+
+func (c attrCondition) String() string { return c.name + c.op + c.value }
+
+// longer operators first so ">=" isn't read as ">"
+var conditionOps = []string{">=", "<=", "!=", "=", "<", ">", "~"}
+
+func parseAttrCondition(text string) (attrCondition, error) {
+	at, op := -1, ""
+	for _, o := range conditionOps {
+		if i := strings.Index(text, o); i > 0 && (at == -1 || i < at || (i == at && len(o) > len(op))) {
+			at, op = i, o
+		}
+	}
+	if at == -1 || strings.TrimSpace(text[at+len(op):]) == "" {
+		return attrCondition{}, fmt.Errorf("%w: %q", errBadCondition, text)
+	}
+	return attrCondition{name: strings.TrimSpace(text[:at]), op: op, value: strings.TrimSpace(text[at+len(op):])}, nil
+}
+
+// conditionMatchesLocked must be called with s.mu held, an item without the attribute never matches
+func (s *System) conditionMatchesLocked(c attrCondition, item Item) bool {
+	value, ok := item.custom[c.name]
+	if !ok {
+		return false
+	}
+	if c.op == "~" {
+		return strings.Contains(strings.ToLower(value), strings.ToLower(c.value))
+	}
+	def, ok := s.attributeDefsLocked(item.Category)[c.name]
+	if !ok {
+		def = attributeDef{name: c.name, kind: attrString}
+	}
+	want := c.value
+	if checked, err := def.check(c.value); err == nil {
+		want = checked
+	}
+	cmp, ok := def.compare(value, want)
+	if !ok {
+		return false
+	}
+	switch c.op {
+	case "=":
+		return cmp == 0
+	case "!=":
+		return cmp != 0
+	case "<":
+		return cmp < 0
+	case "<=":
+		return cmp <= 0
+	case ">":
+		return cmp > 0
+	case ">=":
+		return cmp >= 0
+	}
+	return false
+}
+
+// parseQuery turns `fan category=Maintenance wattage>=40` into a filter,
+// plain words search the name, name/category/warehouse conditions set those fields.
+// Tokens can't hold spaces, so category=Maintenance_>_Electrical stands for "Maintenance > Electrical".
+func parseQuery(query string) (itemFilter, error) {
+	var f itemFilter
+	var words []string
+	for _, token := range strings.Fields(query) {
+		if !strings.ContainsAny(token, "=<>~") {
+			words = append(words, token)
+			continue
+		}
+		c, err := parseAttrCondition(token)
+		if err != nil {
+			return f, err
+		}
+		switch {
+		case c.name == "category" && c.op == "=":
+			f.category = strings.ReplaceAll(c.value, "_", " ")
+		case c.name == "warehouse" && c.op == "=":
+			f.warehouse = c.value
+		case c.name == "name" && c.op == "~":
+			words = append(words, c.value)
+		default:
+			f.attrs = append(f.attrs, c)
+		}
+	}
+	f.text = strings.Join(words, " ")
+	return f, nil
+}
+
+// ATTACHMENTS
+
+type attachment struct {
+	name        string
+	hash        string
+	size        int64
+	contentType string
+}
+
+type attachmentRecord struct {
+	Name string `json:"name"`
+	Hash string `json:"hash"`
+	Size int64  `json:"size"`
+	Type string `json:"type,omitempty"`
+}
+
+func (a attachment) info() string {
+	return fmt.Sprintf("%v (%v, %v bytes, %v)", a.name, a.contentType, a.size, a.hash[:12])
+}
+
+func (s *System) useBlobStore(dir string) error {
+	b, err := openBlobStore(dir)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.blobs = b
+	s.mu.Unlock()
+	return nil
+}
+
+// attach stores the bytes first (s.mu isn't held for that), then links them to the item.
+// Attaching under a name the item already has replaces that attachment.
+func (s *System) attach(id int64, name string, r io.Reader) (attachment, error) {
+	s.mu.RLock()
+	blobs := s.blobs
+	s.mu.RUnlock()
+	if blobs == nil {
+		return attachment{}, errNoBlobStore
+	}
+	if strings.TrimSpace(name) == "" {
+		return attachment{}, errNoName
+	}
+	blobs.gcMu.RLock()
+	defer blobs.gcMu.RUnlock()
+	head := make([]byte, 512)
+	n, err := io.ReadFull(r, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return attachment{}, err
+	}
+	head = head[:n]
+	contentType := mime.TypeByExtension(filepath.Ext(name))
+	if contentType == "" {
+		contentType = http.DetectContentType(head)
+	}
+	hash, size, err := blobs.put(io.MultiReader(bytes.NewReader(head), r))
+	if err != nil {
+		return attachment{}, err
+	}
+	a := attachment{name: name, hash: hash, size: size, contentType: contentType}
+
+	s.mu.Lock()
+	before, ok := s.db.get(id)
+	if !ok {
+		s.mu.Unlock()
+		return attachment{}, errItemNotFound
+	}
+	after := before
+	after.attachments = nil
+	for _, old := range before.attachments {
+		if old.name != name {
+			after.attachments = append(after.attachments, old)
+		}
+	}
+	after.attachments = append(after.attachments, a)
+	err = s.db.update(after)
+	if err == nil {
+		s.emitLocked(itemUpdated{before: before, after: after})
+	}
+	s.mu.Unlock()
+	if err != nil {
+		return attachment{}, err
+	}
+	s.flushEvents()
+	return a, nil
+}
+
+func (s *System) openAttachment(id int64, name string) (io.ReadCloser, attachment, error) {
+	s.mu.RLock()
+	item, ok := s.db.get(id)
+	blobs := s.blobs
+	s.mu.RUnlock()
+	if !ok {
+		return nil, attachment{}, errItemNotFound
+	}
+	if blobs == nil {
+		return nil, attachment{}, errNoBlobStore
+	}
+	for _, a := range item.attachments {
+		if a.name == name {
+			rc, err := blobs.open(a.hash)
+			return rc, a, err
+		}
+	}
+	return nil, attachment{}, errNoAttachment
+}
+
+// detach only unlinks, the bytes stay until collectBlobs finds nobody uses them
+func (s *System) detach(id int64, name string) error {
+	s.mu.Lock()
+	before, ok := s.db.get(id)
+	if !ok {
+		s.mu.Unlock()
+		return errItemNotFound
+	}
+	after := before
+	after.attachments = nil
+	for _, a := range before.attachments {
+		if a.name != name {
+			after.attachments = append(after.attachments, a)
+		}
+	}
+	if len(after.attachments) == len(before.attachments) {
+		s.mu.Unlock()
+		return errNoAttachment
+	}
+	err := s.db.update(after)
+	if err == nil {
+		s.emitLocked(itemUpdated{before: before, after: after})
+	}
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	s.flushEvents()
+	return nil
+}
+
+// collectBlobs deletes blobs no item points at any more, attachments on their way in wait for it
+func (s *System) collectBlobs() (int, error) {
+	s.mu.RLock()
+	blobs := s.blobs
+	s.mu.RUnlock()
+	if blobs == nil {
+		return 0, errNoBlobStore
+	}
+	blobs.gcMu.Lock()
+	defer blobs.gcMu.Unlock()
+	s.mu.RLock()
+	referenced := map[string]bool{}
+	for _, item := range s.db.all() {
+		for _, a := range item.attachments {
+			referenced[a.hash] = true
+		}
+	}
+	s.mu.RUnlock()
+	return blobs.gc(referenced)
+}
+
+func init() {
+	commands["find"] = command{
+		usage: "find <word|name~x|category=x|warehouse=x|attr>=x ...>",
+		run: func(s *System, args []string) error {
+			if len(args) == 0 {
+				return errUsage
+			}
+			f, err := parseQuery(strings.Join(args, " "))
+			if err != nil {
+				return err
+			}
+			found := s.filterItems(f)
+			for i, item := range found {
+				fmt.Printf("%v| %v\n", i, item.info())
+			}
+			fmt.Printf("%v item(s) match %v\n", len(found), f)
+			return nil
+		},
+	}
+	commands["blobs-verify"] = command{
+		usage: "blobs-verify <dir>",
+		run: func(_ *System, args []string) error {
+			if len(args) != 1 {
+				return errUsage
+			}
+			b, err := openBlobStore(args[0])
+			if err != nil {
+				return err
+			}
+			checked, bad := 0, 0
+			err = filepath.WalkDir(b.dir, func(p string, d os.DirEntry, err error) error {
+				if err != nil || d.IsDir() || len(d.Name()) != 64 {
+					return err
+				}
+				checked++
+				if err := b.verify(d.Name()); err != nil {
+					bad++
+					fmt.Println(err)
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			fmt.Printf("%v blob(s) checked, %v bad\n", checked, bad)
+			if bad > 0 {
+				return errBlobCorrupt
+			}
+			return nil
+		},
+	}
+}
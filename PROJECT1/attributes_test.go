@@ -0,0 +1,54 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestTypedAttributesAreEnforced(t *testing.T) {
+	s := &System{}
+	if err := s.createDB(); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.addCategory("Maintenance > Electrical", nil); err != nil {
+		t.Fatal(err)
+	}
+	s.defineAttribute("Maintenance", attributeDef{name: "inspection_due", kind: attrDate, required: true})
+	s.defineAttribute("Maintenance > Electrical", attributeDef{name: "wattage", kind: attrNumber})
+
+	if _, err := s.createItem("Fan", "Maintenance > Electrical", "RX01"); !errors.Is(err, errMissingAttribute) {
+		t.Errorf("create without the required date: got %v", err)
+	}
+	fan, err := s.createItemWith("Fan", "Maintenance > Electrical", "RX01", map[string]string{"inspection_due": "2025-03-01", "wattage": "45"}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.setAttribute(fan, "inspection_due", ""); !errors.Is(err, errMissingAttribute) {
+		t.Errorf("removing a required value: got %v", err)
+	}
+
+	// wattage isn't defined on plain Maintenance, the move has to be refused and change nothing
+	if err := s.updateItem(fan, "Fan", "Maintenance"); !errors.Is(err, errUnknownAttribute) {
+		t.Errorf("category change with a value the new category doesn't know: got %v", err)
+	}
+	if item, _ := s.findItem(fan); item.Category != "Maintenance > Electrical" {
+		t.Errorf("category changed anyway: %v", item.Category)
+	}
+	s.setAttribute(fan, "wattage", "")
+	if err := s.updateItem(fan, "Fan", "Maintenance"); err != nil {
+		t.Errorf("category change once the value is gone: %v", err)
+	}
+
+	// one name is either plain or typed
+	if err := s.setCategoryAttribute("Maintenance > Electrical", "wattage", "lots"); !errors.Is(err, errAttributeExists) {
+		t.Errorf("plain attribute over a typed one: got %v", err)
+	}
+	s.setCategoryAttribute("Maintenance", "storage", "dry")
+	if err := s.defineAttribute("Maintenance > Electrical", attributeDef{name: "storage", kind: attrString}); !errors.Is(err, errAttributeExists) {
+		t.Errorf("typed attribute over a plain one: got %v", err)
+	}
+	attrs, _ := s.itemAttributes(fan)
+	if attrs["storage"] != "dry" || attrs["inspection_due"] != "2025-03-01" {
+		t.Errorf("itemAttributes: %v", attrs)
+	}
+}
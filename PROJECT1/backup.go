@@ -0,0 +1,357 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// BACKUPS
+// A backup is a .tar.gz with two files: manifest.json and inventory.json (a normal data file, see datafile.go).
+// The manifest carries the sha256 of inventory.json, restore refuses anything that doesn't match
+// or doesn't load, and only then touches the target file.
+// Writers are only held up while the snapshot is copied, never while compressing or writing.
+
+const (
+	backupManifestName = "manifest.json"
+	backupDataName     = "inventory.json"
+)
+
+var (
+	errBackupChecksum = errors.New("backup checksum doesn't match")
+	errBackupBroken   = errors.New("backup archive is incomplete")
+)
+
+type backupManifest struct {
+	FormatVersion int       `json:"format_version"`
+	CreatedAt     time.Time `json:"created_at"`
+	AsOf          time.Time `json:"as_of"` // differs from created_at for point-in-time exports
+	Items         int       `json:"items"`
+	Size          int       `json:"size"`
+	SHA256        string    `json:"sha256"`
+}
+
+func checksum(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// writeBackup packs an encoded data file into path
+func writeBackup(path string, snap systemSnapshot) (backupManifest, error) {
+	data, err := snap.encode()
+	if err != nil {
+		return backupManifest{}, err
+	}
+	m := backupManifest{
+		FormatVersion: currentDataVersion,
+		CreatedAt:     time.Now().UTC(),
+		AsOf:          snap.at.UTC(),
+		Items:         len(snap.items),
+		Size:          len(data),
+		SHA256:        checksum(data),
+	}
+	manifest, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return m, err
+	}
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(zw)
+	for _, f := range []struct {
+		name string
+		body []byte
+	}{{backupManifestName, manifest}, {backupDataName, data}} {
+		hdr := &tar.Header{Name: f.name, Mode: 0o644, Size: int64(len(f.body)), ModTime: m.CreatedAt}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return m, err
+		}
+		if _, err := tw.Write(f.body); err != nil {
+			return m, err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return m, err
+	}
+	if err := zw.Close(); err != nil {
+		return m, err
+	}
+	return m, writeFileAtomic(path, buf.Bytes())
+}
+
+func (s *System) backup(path string) (backupManifest, error) {
+	return writeBackup(path, s.snapshot())
+}
+
+// readBackup unpacks and checks an archive, the data it returns is verified against the manifest
+func readBackup(path string) (backupManifest, []byte, error) {
+	var m backupManifest
+	f, err := os.Open(path)
+	if err != nil {
+		return m, nil, err
+	}
+	defer f.Close()
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		return m, nil, err
+	}
+	defer zr.Close()
+	tr := tar.NewReader(zr)
+	var manifest, data []byte
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return m, nil, err
+		}
+		body, err := io.ReadAll(tr)
+		if err != nil {
+			return m, nil, err
+		}
+		switch hdr.Name {
+		case backupManifestName:
+			manifest = body
+		case backupDataName:
+			data = body
+		}
+	}
+	if manifest == nil || data == nil {
+		return m, nil, errBackupBroken
+	}
+	if err := json.Unmarshal(manifest, &m); err != nil {
+		return m, nil, fmt.Errorf("manifest: %w", err)
+	}
+	if len(data) != m.Size || checksum(data) != m.SHA256 {
+		return m, nil, fmt.Errorf("%w: manifest says %v (%v bytes), got %v (%v bytes)", errBackupChecksum, m.SHA256, m.Size, checksum(data), len(data))
+	}
+	return m, data, nil
+}
+
+// verifyBackup checks the checksum and that the data really loads, returning the loaded system
+func verifyBackup(path string) (backupManifest, []byte, *System, error) {
+	m, data, err := readBackup(path)
+	if err != nil {
+		return m, nil, nil, err
+	}
+	doc, from, err := parseDataDoc(data)
+	if err != nil {
+		return m, nil, nil, err
+	}
+	if _, err := doc.upgrade(from); err != nil {
+		return m, nil, nil, err
+	}
+	restored, err := decodeDataFile(doc)
+	if err != nil {
+		return m, nil, nil, err
+	}
+	if n := restored.db.count(); n != m.Items {
+		return m, nil, nil, fmt.Errorf("%w: manifest says %v items, archive has %v", errBackupBroken, m.Items, n)
+	}
+	return m, data, restored, nil
+}
+
+// restoreBackup writes the archived data file to target, only after it verified
+func restoreBackup(path, target string) (backupManifest, error) {
+	m, data, _, err := verifyBackup(path)
+	if err != nil {
+		return m, err
+	}
+	return m, writeFileAtomic(target, data)
+}
+
+// POINT IN TIME
+// The history table remembers every item change with its time and the ledger every stock move,
+// both are saved in the backend, so a snapshot can be walked backwards to any moment, also after a restart.
+// Orders placed after that moment are dropped, the older ones keep their current status.
+// Warehouses, suppliers, categories and BOMs have no history and are exported as they are now.
+
+// rewind undoes item events newer than t, newest first
+func (snap *systemSnapshot) rewind(t time.Time, history []eventRecord) {
+	byID := map[int64]int{}
+	for i, it := range snap.items {
+		byID[it.id] = i
+	}
+	put := func(it Item) {
+		if i, ok := byID[it.id]; ok {
+			snap.items[i] = it
+			return
+		}
+		byID[it.id] = len(snap.items)
+		snap.items = append(snap.items, it)
+	}
+	gone := map[int64]bool{}
+	for i := len(history) - 1; i >= 0; i-- {
+		if !history[i].at.After(t) {
+			break
+		}
+		switch e := history[i].event.(type) {
+		case itemCreated:
+			gone[e.item.id] = true
+		case itemDeleted:
+			delete(gone, e.item.id)
+			put(e.item)
+		case itemUpdated:
+			put(e.before)
+		case itemMoved:
+			if at, ok := byID[e.id]; ok {
+				snap.items[at].Warehouse = e.from
+				snap.items[at].bin = e.fromBin
+			}
+		}
+	}
+	var kept []Item
+	for _, it := range snap.items {
+		if !gone[it.id] {
+			kept = append(kept, it)
+		}
+	}
+	snap.items = kept
+
+	// stock: take back every ledger entry after t, deleted items lost their rows so they get summed up again
+	var ledger []ledgerEntry
+	after := map[stockKey]int{}
+	before := map[stockKey]int{}
+	for _, e := range snap.ledger {
+		key := stockKey{e.id, e.warehouse}
+		if e.at.After(t) {
+			after[key] += e.delta
+			continue
+		}
+		before[key] += e.delta
+		ledger = append(ledger, e)
+	}
+	snap.ledger = ledger
+	stock := map[stockKey]int{}
+	for key, qty := range snap.stock {
+		stock[key] = qty - after[key]
+	}
+	for key, qty := range before {
+		if _, ok := snap.stock[key]; !ok {
+			stock[key] = qty
+		}
+	}
+	for key, qty := range stock {
+		if qty == 0 || gone[key.id] {
+			delete(stock, key)
+		}
+	}
+	snap.stock = stock
+
+	var orders []orderRecord
+	for _, o := range snap.orders {
+		if !o.PlacedAt.After(t) {
+			orders = append(orders, o)
+		}
+	}
+	snap.orders = orders
+	var snapshots []stockLevel
+	for _, l := range snap.snapshots {
+		if !l.day.After(t) {
+			snapshots = append(snapshots, l)
+		}
+	}
+	snap.snapshots = snapshots
+	snap.at = t
+}
+
+// snapshotAt is the inventory as it stood at t
+func (s *System) snapshotAt(t time.Time) (systemSnapshot, error) {
+	snap := s.snapshot()
+	if t.After(snap.at) {
+		return snap, fmt.Errorf("%v is in the future", t.Format(time.RFC3339))
+	}
+	history, err := s.historyAfter(t)
+	if err != nil {
+		return snap, err
+	}
+	snap.rewind(t, history)
+	return snap, nil
+}
+
+func init() {
+	commands["backup"] = command{
+		usage: "backup <out.tar.gz>",
+		run: func(s *System, args []string) error {
+			if len(args) != 1 {
+				return errUsage
+			}
+			m, err := s.backup(args[0])
+			if err != nil {
+				return err
+			}
+			fmt.Printf("backed up %v items to %v\nsha256 %v\n", m.Items, args[0], m.SHA256)
+			return nil
+		},
+	}
+	commands["verify-backup"] = command{
+		usage: "verify-backup <backup.tar.gz>",
+		run: func(_ *System, args []string) error {
+			if len(args) != 1 {
+				return errUsage
+			}
+			m, _, _, err := verifyBackup(args[0])
+			if err != nil {
+				return err
+			}
+			fmt.Printf("ok  %v items as of %v, format v%v, sha256 %v\n", m.Items, m.AsOf.Format(time.RFC3339), m.FormatVersion, m.SHA256)
+			return nil
+		},
+	}
+	commands["restore"] = command{
+		usage: "restore <backup.tar.gz> <file.json>",
+		run: func(_ *System, args []string) error {
+			if len(args) != 2 {
+				return errUsage
+			}
+			m, err := restoreBackup(args[0], args[1])
+			if err != nil {
+				return err
+			}
+			fmt.Printf("restored %v items as of %v into %v\n", m.Items, m.AsOf.Format(time.RFC3339), args[1])
+			return nil
+		},
+	}
+	commands["export-at"] = command{
+		usage: "export-at <file.db> <RFC3339 time> <file.json>   (file.db as written by export-sql)",
+		run: func(_ *System, args []string) error {
+			if len(args) != 3 {
+				return errUsage
+			}
+			t, err := time.Parse(time.RFC3339, args[1])
+			if err != nil {
+				return err
+			}
+			store, err := openSQLBackend(args[0])
+			if err != nil {
+				return err
+			}
+			defer store.close()
+			s := &System{store: store}
+			if err := s.createDB(); err != nil {
+				return err
+			}
+			snap, err := s.snapshotAt(t)
+			if err != nil {
+				return err
+			}
+			data, err := snap.encode()
+			if err != nil {
+				return err
+			}
+			if err := writeFileAtomic(args[2], data); err != nil {
+				return err
+			}
+			fmt.Printf("exported %v items as of %v to %v\n", len(snap.items), t.Format(time.RFC3339), args[2])
+			return nil
+		},
+	}
+}
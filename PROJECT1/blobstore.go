@@ -0,0 +1,129 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// BLOB STORE
+// Attachments are stored by the sha256 of their bytes, in dir/ab/abcdef...
+// The same manual attached to ten items is one file, and a blob never changes once written,
+// so writing needs no locking beyond the rename that publishes it. Deleting does: a blob that was
+// just put but isn't linked to its item yet looks unused, so attach holds gcMu shared from put until
+// the link is saved and collectBlobs holds it exclusively while it decides what to delete.
+
+var (
+	errBlobNotFound = errors.New("blob not found")
+	errBlobCorrupt  = errors.New("blob doesn't match its hash")
+	errBadBlobHash  = errors.New("not a sha256 hash")
+)
+
+type blobStore struct {
+	dir  string
+	gcMu sync.RWMutex
+}
+
+func openBlobStore(dir string) (*blobStore, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	return &blobStore{dir: dir}, nil
+}
+
+func (b *blobStore) path(hash string) (string, error) {
+	if len(hash) != 64 || strings.Trim(hash, "0123456789abcdef") != "" {
+		return "", errBadBlobHash
+	}
+	return filepath.Join(b.dir, hash[:2], hash), nil
+}
+
+// put streams r to a temp file while hashing it, then moves it into place under its hash
+func (b *blobStore) put(r io.Reader) (hash string, size int64, err error) {
+	tmp, err := os.CreateTemp(b.dir, "incoming-*")
+	if err != nil {
+		return "", 0, err
+	}
+	defer os.Remove(tmp.Name()) // a no-op once renamed
+	h := sha256.New()
+	size, err = io.Copy(io.MultiWriter(tmp, h), r)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return "", 0, err
+	}
+	hash = hex.EncodeToString(h.Sum(nil))
+	dst, _ := b.path(hash)
+	if _, err := os.Stat(dst); err == nil {
+		return hash, size, nil // already have these bytes
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+		return "", 0, err
+	}
+	return hash, size, os.Rename(tmp.Name(), dst)
+}
+
+func (b *blobStore) open(hash string) (io.ReadCloser, error) {
+	p, err := b.path(hash)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(p)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("%w: %v", errBlobNotFound, hash)
+	}
+	return f, err
+}
+
+func (b *blobStore) has(hash string) bool {
+	p, err := b.path(hash)
+	if err != nil {
+		return false
+	}
+	_, err = os.Stat(p)
+	return err == nil
+}
+
+// verify rehashes a blob, disks do rot
+func (b *blobStore) verify(hash string) error {
+	f, err := b.open(hash)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return err
+	}
+	if got := hex.EncodeToString(h.Sum(nil)); got != hash {
+		return fmt.Errorf("%w: %v is really %v", errBlobCorrupt, hash, got)
+	}
+	return nil
+}
+
+// gc removes every blob nobody references any more, returns how many went
+func (b *blobStore) gc(referenced map[string]bool) (int, error) {
+	removed := 0
+	err := filepath.WalkDir(b.dir, func(p string, d os.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		name := d.Name()
+		if len(name) != 64 || referenced[name] {
+			return nil
+		}
+		if err := os.Remove(p); err != nil {
+			return err
+		}
+		removed++
+		return nil
+	})
+	return removed, err
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// BILL OF MATERIALS
+// A kit is a normal Item whose bill of materials lists other Items and how many of each it takes.
+// "Delivery Kit" = 1 Pizza Box + 1 Napkin Dispenser + 2 Receipt Roll
+// assemble eats the components and produces kits, disassemble does the opposite.
+// Both check everything first and only then touch the stock, under one lock, so it is all or nothing.
+// A backend write failing halfway takes back what was already changed and nothing is emitted.
+
+var (
+	errNoBOM       = errors.New("item has no bill of materials")
+	errEmptyBOM    = errors.New("a bill of materials needs at least one line")
+	errBOMCycle    = errors.New("bill of materials would contain itself")
+	errKitHasStock = errors.New("kit still has stock, disassemble it first")
+	errUsedInBOM   = errors.New("item is a component of a kit")
+)
+
+type bomLine struct {
+	component int64
+	qty       int
+}
+
+type billOfMaterials struct {
+	kit   int64
+	lines []bomLine
+}
+
+// needs merges duplicate lines so the same component listed twice is checked once
+func (b billOfMaterials) needs(kits int) map[int64]int {
+	need := map[int64]int{}
+	for _, line := range b.lines {
+		need[line.component] += line.qty * kits
+	}
+	return need
+}
+
+// components are the distinct component ids, sorted, so ledger lines and events come out the same every run
+func (b billOfMaterials) components() []int64 {
+	var ids []int64
+	for id := range b.needs(1) {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(a, c int) bool { return ids[a] < ids[c] })
+	return ids
+}
+
+func (s *System) defineBOM(kit int64, lines []bomLine) error {
+	if len(lines) == 0 {
+		return errEmptyBOM
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.db.has(kit) {
+		return errItemNotFound
+	}
+	// kits on the shelf were built from the old list, disassembling them later has to give that back
+	if _, ok := s.boms[kit]; ok && s.kitHasStockLocked(kit) {
+		return errKitHasStock
+	}
+	for _, line := range lines {
+		if line.qty <= 0 {
+			return errBadQuantity
+		}
+		if !s.db.has(line.component) {
+			return fmt.Errorf("component %v: %w", line.component, errItemNotFound)
+		}
+		if line.component == kit || s.bomContains(line.component, kit) {
+			return errBOMCycle
+		}
+	}
+	bom := billOfMaterials{kit: kit, lines: append([]bomLine(nil), lines...)}
+	if err := s.saveBOMLocked(bom); err != nil {
+		return err
+	}
+	s.boms[kit] = bom
+	return nil
+}
+
+// bomContains looks through nested kits, must be called with s.mu held
+func (s *System) bomContains(kit, target int64) bool {
+	bom, ok := s.boms[kit]
+	if !ok {
+		return false
+	}
+	for _, line := range bom.lines {
+		if line.component == target || s.bomContains(line.component, target) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *System) removeBOM(kit int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.boms[kit]; !ok {
+		return errNoBOM
+	}
+	if s.kitHasStockLocked(kit) {
+		return errKitHasStock
+	}
+	if err := s.dropBOMLocked(kit); err != nil {
+		return err
+	}
+	delete(s.boms, kit)
+	return nil
+}
+
+func (s *System) kitHasStockLocked(kit int64) bool {
+	for key, qty := range s.stock {
+		if key.id == kit && qty > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *System) bomFor(kit int64) (billOfMaterials, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	bom, ok := s.boms[kit]
+	return bom, ok
+}
+
+// buildable is how many kits the unreserved components in that warehouse are enough for
+func (s *System) buildable(kit int64, warehouse string) (int, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	bom, ok := s.boms[kit]
+	if !ok {
+		return 0, errNoBOM
+	}
+	most := -1
+	for component, qty := range bom.needs(1) {
+		n := s.availableLocked(component, warehouse) / qty
+		if most < 0 || n < most {
+			most = n
+		}
+	}
+	return most, nil
+}
+
+func (s *System) assemble(kit int64, warehouse string, kits int) error {
+	if kits <= 0 {
+		return errBadQuantity
+	}
+	s.mu.Lock()
+	bom, ok := s.boms[kit]
+	if !ok {
+		s.mu.Unlock()
+		return errNoBOM
+	}
+	need := bom.needs(kits)
+	for _, component := range bom.components() {
+		if s.availableLocked(component, warehouse) < need[component] {
+			s.mu.Unlock()
+			return fmt.Errorf("component %v: %w", component, errInsufficientStock)
+		}
+	}
+	reason := fmt.Sprintf("assemble %v x kit %v", kits, kit)
+	var changes []stockChange
+	for _, component := range bom.components() {
+		changes = append(changes, stockChange{component, -need[component]})
+	}
+	done, err := s.adjustAllLocked(append(changes, stockChange{kit, kits}), warehouse, reason)
+	if err != nil {
+		s.mu.Unlock()
+		return err
+	}
+	for _, ev := range done {
+		s.emitLocked(ev)
+	}
+	s.mu.Unlock()
+	s.flushEvents()
+	return nil
+}
+
+func (s *System) disassemble(kit int64, warehouse string, kits int) error {
+	if kits <= 0 {
+		return errBadQuantity
+	}
+	s.mu.Lock()
+	bom, ok := s.boms[kit]
+	if !ok {
+		s.mu.Unlock()
+		return errNoBOM
+	}
+	if s.availableLocked(kit, warehouse) < kits {
+		s.mu.Unlock()
+		return errInsufficientStock
+	}
+	for _, component := range bom.components() {
+		if !s.db.has(component) {
+			s.mu.Unlock()
+			return fmt.Errorf("component %v: %w", component, errItemNotFound)
+		}
+	}
+	reason := fmt.Sprintf("disassemble %v x kit %v", kits, kit)
+	changes := []stockChange{{kit, -kits}}
+	need := bom.needs(kits)
+	for _, component := range bom.components() {
+		changes = append(changes, stockChange{component, need[component]})
+	}
+	done, err := s.adjustAllLocked(changes, warehouse, reason)
+	if err != nil {
+		s.mu.Unlock()
+		return err
+	}
+	for _, ev := range done {
+		s.emitLocked(ev)
+	}
+	s.mu.Unlock()
+	s.flushEvents()
+	return nil
+}
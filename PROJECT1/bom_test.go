@@ -0,0 +1,83 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+// countingBackend fails one put to a table, the one after ok more have gone through, -1 fails none
+type countingBackend struct {
+	backend
+	table string
+	ok    int
+}
+
+func (b *countingBackend) put(table string, key int64, data []byte) error {
+	if table == b.table {
+		if b.ok == 0 {
+			b.ok = -1
+			return errFlaky
+		}
+		b.ok--
+	}
+	return b.backend.put(table, key, data)
+}
+
+func TestAssembleIsAllOrNothing(t *testing.T) {
+	store := &countingBackend{backend: newMemoryBackend(), ok: -1}
+	s := &System{store: store}
+	if err := s.createDB(); err != nil {
+		t.Fatal(err)
+	}
+	box, _ := s.createItem("Pizza Box", "Inventory", "RX01")
+	napkin, _ := s.createItem("Napkin Dispenser", "Inventory", "RX01")
+	kit, _ := s.createItem("Delivery Kit", "Inventory", "RX01")
+	s.receive(box, "RX01", 5, "delivery")
+	s.receive(napkin, "RX01", 5, "delivery")
+	if err := s.defineBOM(kit, []bomLine{{component: box, qty: 1}, {component: napkin, qty: 2}}); err != nil {
+		t.Fatal(err)
+	}
+	sub, _ := s.events.subscribe(subOptions{buffer: 16, policy: dropNewest, replayFrom: liveOnly})
+	ledger := len(s.ledger)
+
+	for _, tc := range []struct {
+		name string
+		run  func() error
+	}{
+		{"assemble", func() error { return s.assemble(kit, "RX01", 2) }},
+		{"disassemble", func() error { return s.disassemble(kit, "RX01", 1) }},
+	} {
+		if tc.name == "disassemble" {
+			if err := s.assemble(kit, "RX01", 1); err != nil {
+				t.Fatal(err)
+			}
+			for len(sub.events) > 0 {
+				<-sub.events
+			}
+			ledger = len(s.ledger)
+		}
+		before := [3]int{s.onHand(box, "RX01"), s.onHand(napkin, "RX01"), s.onHand(kit, "RX01")}
+		store.table, store.ok = stockTable, 2 // the third stock row fails
+		if err := tc.run(); !errors.Is(err, errFlaky) {
+			t.Fatalf("%v: got %v, want errFlaky", tc.name, err)
+		}
+		after := [3]int{s.onHand(box, "RX01"), s.onHand(napkin, "RX01"), s.onHand(kit, "RX01")}
+		if after != before || len(s.ledger) != ledger {
+			t.Errorf("%v: stock %v -> %v, ledger %v -> %v", tc.name, before, after, ledger, len(s.ledger))
+		}
+		if len(sub.events) != 0 {
+			t.Errorf("%v: %v events went out for a failed change", tc.name, len(sub.events))
+		}
+
+		// what the backend holds matches memory after a reload
+		reloaded := &System{store: store}
+		if err := reloaded.createDB(); err != nil {
+			t.Fatal(err)
+		}
+		got := [3]int{reloaded.onHand(box, "RX01"), reloaded.onHand(napkin, "RX01"), reloaded.onHand(kit, "RX01")}
+		if got != before || len(reloaded.ledger) != ledger {
+			t.Errorf("%v: reloaded stock %v ledger %v, want %v and %v", tc.name, got, len(reloaded.ledger), before, ledger)
+		}
+	}
+	s.events.unsubscribe(sub)
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// CATEGORY TREE
+// Item.Category used to be one of 4 flat strings, now it can be a path like
+// "Inventory > Kitchen > Utensils". The 4 old names are just the top level of the tree,
+// so every item created before still points at a valid category.
+// Attributes set on a category are inherited by everything below it unless a child overrides them.
+
+const categorySeparator = " > "
+
+var defaultCategories = [4]string{"Inventory", "Entertainment", "Staff", "Maintenance"}
+
+var (
+	errCategoryExists   = errors.New("category already exists")
+	errCategoryNotFound = errors.New("category not found")
+	errCategoryInUse    = errors.New("category still has subcategories or items")
+)
+
+type categoryNode struct {
+	name       string
+	parent     *categoryNode
+	children   map[string]*categoryNode
+	attributes map[string]string // only what is set on this level, see inherited()
+}
+
+type categoryTree struct {
+	root *categoryNode // unnamed, the 4 top level categories hang off it
+}
+
+func newCategoryTree() *categoryTree {
+	t := &categoryTree{root: &categoryNode{children: map[string]*categoryNode{}}}
+	for _, name := range defaultCategories {
+		t.add(name, nil)
+	}
+	return t
+}
+
+// splitCategoryPath accepts "A > B > C" and is forgiving about spaces around the separator
+func splitCategoryPath(path string) []string {
+	var parts []string
+	for _, p := range strings.Split(path, ">") {
+		if p = strings.TrimSpace(p); p != "" {
+			parts = append(parts, p)
+		}
+	}
+	return parts
+}
+
+func (t *categoryTree) find(path string) (*categoryNode, bool) {
+	parts := splitCategoryPath(path)
+	if len(parts) == 0 {
+		return nil, false
+	}
+	node := t.root
+	for _, p := range parts {
+		child, ok := node.children[p]
+		if !ok {
+			return nil, false
+		}
+		node = child
+	}
+	return node, true
+}
+
+// add creates the category, the parent path has to exist already
+func (t *categoryTree) add(path string, attributes map[string]string) (*categoryNode, error) {
+	parts := splitCategoryPath(path)
+	if len(parts) == 0 {
+		return nil, errCategoryNotFound
+	}
+	parent := t.root
+	if len(parts) > 1 {
+		p, ok := t.find(strings.Join(parts[:len(parts)-1], categorySeparator))
+		if !ok {
+			return nil, errCategoryNotFound
+		}
+		parent = p
+	}
+	name := parts[len(parts)-1]
+	if _, ok := parent.children[name]; ok {
+		return nil, errCategoryExists
+	}
+	node := &categoryNode{name: name, parent: parent, children: map[string]*categoryNode{}, attributes: map[string]string{}}
+	for k, v := range attributes {
+		node.attributes[k] = v
+	}
+	parent.children[name] = node
+	return node, nil
+}
+
+func (t *categoryTree) remove(path string) error {
+	node, ok := t.find(path)
+	if !ok {
+		return errCategoryNotFound
+	}
+	if len(node.children) > 0 {
+		return errCategoryInUse
+	}
+	delete(node.parent.children, node.name)
+	return nil
+}
+
+func (n *categoryNode) path() string {
+	var parts []string
+	for node := n; node.parent != nil; node = node.parent {
+		parts = append([]string{node.name}, parts...)
+	}
+	return strings.Join(parts, categorySeparator)
+}
+
+// inherited walks from the top down so the deepest level wins
+func (n *categoryNode) inherited() map[string]string {
+	var chain []*categoryNode
+	for node := n; node.parent != nil; node = node.parent {
+		chain = append([]*categoryNode{node}, chain...)
+	}
+	attrs := map[string]string{}
+	for _, node := range chain {
+		for k, v := range node.attributes {
+			attrs[k] = v
+		}
+	}
+	return attrs
+}
+
+// within is true when the category at path is n itself or one of its ancestors
+func (n *categoryNode) within(path string) bool {
+	want := strings.Join(splitCategoryPath(path), categorySeparator)
+	for node := n; node.parent != nil; node = node.parent {
+		if node.path() == want {
+			return true
+		}
+	}
+	return false
+}
+
+// list returns every path in the tree, sorted, handy for printing
+func (t *categoryTree) list() []string {
+	var paths []string
+	var walk func(n *categoryNode)
+	walk = func(n *categoryNode) {
+		for _, child := range n.children {
+			paths = append(paths, child.path())
+			walk(child)
+		}
+	}
+	walk(t.root)
+	sort.Strings(paths)
+	return paths
+}
+
+// setCategoryAttribute sets (or replaces) one attribute on an existing category,
+// names taken by typed attributes (attributes.go) are refused
+func (s *System) setCategoryAttribute(path, key, value string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	node, ok := s.categories.find(path)
+	if !ok {
+		return errCategoryNotFound
+	}
+	if s.typedAttributeUsedLocked(path, key) {
+		return fmt.Errorf("%w: %v is a typed attribute", errAttributeExists, key)
+	}
+	old, had := node.attributes[key]
+	node.attributes[key] = value
+	if err := s.saveCategoryLocked(path); err != nil {
+		if had {
+			node.attributes[key] = old
+		} else {
+			delete(node.attributes, key)
+		}
+		return err
+	}
+	return nil
+}
+
+func (s *System) addCategory(path string, attributes map[string]string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for key := range attributes {
+		if s.typedAttributeUsedLocked(path, key) {
+			return fmt.Errorf("%w: %v is a typed attribute", errAttributeExists, key)
+		}
+	}
+	if _, err := s.categories.add(path, attributes); err != nil {
+		return err
+	}
+	if err := s.saveCategoryLocked(path); err != nil {
+		s.categories.remove(path)
+		return err
+	}
+	return nil
+}
+
+// removeCategory refuses while items still use the category or anything under it.
+// Every check comes first, then the tree, the saved row goes last and a failed drop puts the node back
+func (s *System) removeCategory(path string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	node, ok := s.categories.find(path)
+	if !ok {
+		return errCategoryNotFound
+	}
+	for _, item := range s.db.all() {
+		if n, ok := s.categories.find(item.Category); ok && n.within(node.path()) {
+			return errCategoryInUse
+		}
+	}
+	if len(node.children) > 0 {
+		return errCategoryInUse
+	}
+	if err := s.categories.remove(path); err != nil {
+		return err
+	}
+	if err := s.dropCategoryLocked(path); err != nil {
+		node.parent.children[node.name] = node
+		return err
+	}
+	key := categoryKey(path)
+	for k := range s.attrDefs {
+		if k == key || strings.HasPrefix(k, key+categorySeparator) {
+			delete(s.attrDefs, k)
+		}
+	}
+	return nil
+}
+
+// itemsInCategory includes everything in subcategories too
+func (s *System) itemsInCategory(path string) []Item {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var items []Item
+	for _, item := range s.db.all() {
+		if node, ok := s.categories.find(item.Category); ok && node.within(path) {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// itemAttributes is the category attributes, then the item's typed values, then the variant options on top
+func (s *System) itemAttributes(id int64) (map[string]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	item, ok := s.db.get(id)
+	if !ok {
+		return nil, errItemNotFound
+	}
+	attrs := map[string]string{}
+	if node, ok := s.categories.find(item.Category); ok {
+		attrs = node.inherited()
+	}
+	for k, v := range item.custom {
+		attrs[k] = v
+	}
+	for k, v := range item.options {
+		attrs[k] = v
+	}
+	return attrs, nil
+}
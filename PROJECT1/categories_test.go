@@ -0,0 +1,46 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestRemoveCategoryKeepsTreeAndRowTogether(t *testing.T) {
+	store := &flakyBackend{backend: newMemoryBackend()}
+	s := &System{store: store}
+	if err := s.createDB(); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{"Inventory > Kitchen", "Inventory > Kitchen > Knives"} {
+		if err := s.addCategory(path, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	saved := func(path string) bool {
+		_, ok, _ := store.get(categoryTable, rowKey(categoryKey(path)))
+		return ok
+	}
+
+	if err := s.removeCategory("Inventory > Kitchen"); !errors.Is(err, errCategoryInUse) {
+		t.Errorf("with a subcategory: got %v, want errCategoryInUse", err)
+	}
+	if !saved("Inventory > Kitchen") {
+		t.Error("refused remove dropped the saved row")
+	}
+
+	store.failRemove = categoryTable
+	if err := s.removeCategory("Inventory > Kitchen > Knives"); !errors.Is(err, errFlaky) {
+		t.Errorf("failing drop: got %v, want errFlaky", err)
+	}
+	if _, ok := s.categories.find("Inventory > Kitchen > Knives"); !ok || !saved("Inventory > Kitchen > Knives") {
+		t.Error("failed drop lost the category")
+	}
+
+	store.failRemove = ""
+	if err := s.removeCategory("Inventory > Kitchen > Knives"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := s.categories.find("Inventory > Kitchen > Knives"); ok || saved("Inventory > Kitchen > Knives") {
+		t.Error("removed category is still around")
+	}
+}
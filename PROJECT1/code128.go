@@ -0,0 +1,81 @@
+package main
+
+import (
+	"errors"
+	"strings"
+)
+
+// CODE 128
+// A code 128 barcode is a list of symbols, every symbol is 3 bars + 3 spaces (the stop has 7 elements)
+// and the widths always add up to 11 modules. Code set B covers printable ascii,
+// code set C packs two digits per symbol, which is perfect for our numeric ids.
+
+var code128Patterns = [107]string{
+	"212222", "222122", "222221", "121223", "121322", "131222", "122213", "122312", "132212", "221213",
+	"221312", "231212", "112232", "122132", "122231", "113222", "123122", "123221", "223211", "221132",
+	"221231", "213212", "223112", "312131", "311222", "321122", "321221", "312212", "322112", "322211",
+	"212123", "212321", "232121", "111323", "131123", "131321", "112313", "132113", "132311", "211313",
+	"231113", "231311", "112133", "112331", "132131", "113123", "113321", "133121", "313121", "211331",
+	"231131", "213113", "213311", "213131", "311123", "311321", "331121", "312113", "312311", "332111",
+	"314111", "221411", "431111", "111224", "111422", "121124", "121421", "141122", "141221", "112214",
+	"112412", "122114", "122411", "142112", "142211", "241211", "221114", "413111", "241112", "134111",
+	"111242", "121142", "121241", "114212", "124112", "124211", "411212", "421112", "421211", "212141",
+	"214121", "412121", "111143", "111341", "131141", "114113", "114311", "411113", "411311", "113141",
+	"114131", "311141", "411131", "211412", "211214", "211232", "2331112",
+}
+
+const (
+	code128StartB = 104
+	code128StartC = 105
+	code128Stop   = 106
+)
+
+var errCode128Charset = errors.New("code 128: only printable ascii can be encoded")
+
+// code128Symbols picks code set C for even-length digit strings and code set B for everything else,
+// then appends the mod 103 check symbol and the stop symbol
+func code128Symbols(data string) ([]int, error) {
+	if data == "" {
+		return nil, errors.New("code 128: nothing to encode")
+	}
+	var symbols []int
+	if len(data)%2 == 0 && strings.Trim(data, "0123456789") == "" {
+		symbols = append(symbols, code128StartC)
+		for i := 0; i < len(data); i += 2 {
+			symbols = append(symbols, int(data[i]-'0')*10+int(data[i+1]-'0'))
+		}
+	} else {
+		symbols = append(symbols, code128StartB)
+		for i := 0; i < len(data); i++ {
+			c := data[i]
+			if c < 32 || c > 126 {
+				return nil, errCode128Charset
+			}
+			symbols = append(symbols, int(c)-32)
+		}
+	}
+	check := symbols[0]
+	for i, sym := range symbols[1:] {
+		check += (i + 1) * sym
+	}
+	symbols = append(symbols, check%103, code128Stop)
+	return symbols, nil
+}
+
+// code128Modules turns data into a row of modules, true = bar. No quiet zone is added here
+func code128Modules(data string) ([]bool, error) {
+	symbols, err := code128Symbols(data)
+	if err != nil {
+		return nil, err
+	}
+	var modules []bool
+	for _, sym := range symbols {
+		for i, w := range code128Patterns[sym] {
+			bar := i%2 == 0
+			for n := 0; n < int(w-'0'); n++ {
+				modules = append(modules, bar)
+			}
+		}
+	}
+	return modules, nil
+}
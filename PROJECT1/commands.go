@@ -0,0 +1,47 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+)
+
+// COMMANDS
+// `go run . <name> args...` (from this directory, it is its own module) runs one of these
+// against the system instead of the demo printout.
+// Every feature file registers its own command from an init() func.
+
+type command struct {
+	usage string
+	run   func(s *System, args []string) error
+}
+
+var commands = map[string]command{}
+
+var errUsage = errors.New("wrong arguments")
+
+func runCommand(s *System, args []string) int {
+	cmd, ok := commands[args[0]]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unknown command %q, available:\n", args[0])
+		var names []string
+		for name := range commands {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fmt.Fprintf(os.Stderr, "  %v\n", commands[name].usage)
+		}
+		return 2
+	}
+	if err := cmd.run(s, args[1:]); err != nil {
+		if errors.Is(err, errUsage) {
+			fmt.Fprintf(os.Stderr, "usage: %v\n", cmd.usage)
+			return 2
+		}
+		fmt.Fprintf(os.Stderr, "%v: %v\n", args[0], err)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,381 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// CONFORMANCE
+// One suite every backend has to pass, so the sql store behaves exactly like the memory one.
+// `go test` runs it against memory, sqlite in memory and a sqlite file.
+// open gets called more than once, the second call must see what the first one stored.
+
+type backendCase struct {
+	name string
+	open func() (backend, error)
+}
+
+func conformanceCases(dir string) []backendCase {
+	mem := newMemoryBackend()
+	file := filepath.Join(dir, "conformance.db")
+	var memSQL *sqlBackend
+	return []backendCase{
+		{"memory", func() (backend, error) { return mem, nil }},
+		{"sqlite :memory:", func() (backend, error) {
+			if memSQL == nil {
+				b, err := openSQLBackend(":memory:")
+				if err != nil {
+					return nil, err
+				}
+				memSQL = b
+			}
+			return memSQL, nil
+		}},
+		{"sqlite file", func() (backend, error) {
+			return openSQLBackend(file) // a new connection every time, so it reads what is on disk
+		}},
+	}
+}
+
+func TestBackendConformance(t *testing.T) {
+	for _, c := range conformanceCases(t.TempDir()) {
+		t.Run(c.name, func(t *testing.T) { runConformance(t, c) })
+	}
+}
+
+func runConformance(t *testing.T, c backendCase) {
+	check := func(ok bool, format string, args ...any) {
+		t.Helper()
+		if !ok {
+			t.Errorf(format, args...)
+		}
+	}
+
+	store, err := c.open()
+	if err != nil {
+		t.Fatal("open:", err)
+	}
+
+	// raw backend behaviour
+	_, ok, err := store.get("items", 42)
+	check(err == nil && !ok, "get on a missing key should be (nil, false, nil), got ok=%v err=%v", ok, err)
+	check(store.remove("items", 42) == nil, "remove on a missing key should not fail")
+	check(store.put("notes", 7, []byte(`{"text":"hi"}`)) == nil, "put into a table without a schema failed")
+	data, ok, err := store.get("notes", 7)
+	check(err == nil && ok && strings.Contains(string(data), "hi"), "generic table round trip lost data: %q %v %v", data, ok, err)
+
+	// the same system flow on top of it
+	s := &System{store: store}
+	if err := s.createDB(); err != nil {
+		t.Fatal("createDB:", err)
+	}
+	a, errA := s.createItem("Pizza Cutter", "Inventory", "RX01")
+	b, errB := s.createItem("Oven Mitt", "Maintenance", "RX04")
+	shirt, errShirt := s.createItem("Uniform Shirt", "Staff", "RX02")
+	check(errors.Join(errA, errB, errShirt) == nil, "createItem failed: %v", errors.Join(errA, errB, errShirt))
+	_, err = s.createItem("", "Staff", "RX02")
+	check(errors.Is(err, errNoName), "an item without a name should be rejected, got %v", err)
+	_, err = s.createItem("Ghost", "Nowhere", "RX02")
+	check(errors.Is(err, errCategoryNotFound), "an unknown category should be rejected, got %v", err)
+	m, err := s.createVariant(shirt, map[string]string{"size": "M", "color": "red"}, "")
+	check(err == nil, "createVariant: %v", err)
+	check(s.moveItem(a, "CDC1") == nil, "moveItem failed")
+	check(s.updateItem(shirt, "Staff Shirt", "Staff") == nil, "updateItem failed")
+	check(s.deleteItem(b) == nil, "deleteItem failed")
+	check(errors.Is(s.deleteItem(b), errItemNotFound), "deleting twice should say not found")
+	check(errors.Is(s.db.create(Item{item: "x", id: a}), errDuplicateKey), "duplicate keys should be refused")
+	_, err = s.addWarehouse("RX01", "Main", "Downtown")
+	check(err == nil, "addWarehouse: %v", err)
+	_, err = s.addSupplier("Dough Bros", "orders@doughbros.example", 3)
+	check(err == nil, "addSupplier: %v", err)
+	_, err = s.addSupplier("Nobody", "not-an-email", 1)
+	check(err != nil, "a bad supplier should be rejected")
+
+	want := s.db.all()
+	check(len(want) == 3, "expected 3 items, got %v", len(want))
+	check(len(want) == 3 && want[0].id == a && want[1].id == shirt && want[2].id == m, "listing should keep insertion order after updates")
+	check(len(s.db.lookup("parent", fmt.Sprint(shirt))) == 1, "parent index lost the variant")
+	check(len(s.db.lookup("warehouse", "CDC1")) == 1, "warehouse index didn't follow the move")
+
+	// stock, ledger, boms, categories and orders live outside the repositories but must survive too
+	s.clock = func() time.Time { return time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC) }
+	check(s.receive(a, "CDC1", 10, "delivery") == nil, "receive failed")
+	check(s.issue(a, "CDC1", 3, "kitchen") == nil, "issue failed")
+	kit, err := s.createItem("Cutter Kit", "Inventory", "CDC1")
+	check(err == nil, "createItem kit: %v", err)
+	check(s.defineBOM(kit, []bomLine{{a, 2}}) == nil, "defineBOM failed")
+	check(s.assemble(kit, "CDC1", 1) == nil, "assemble failed")
+	check(s.addCategory("Inventory > Kitchen", map[string]string{"aisle": "3"}) == nil, "addCategory failed")
+	check(s.defineAttribute("Inventory > Kitchen", attributeDef{name: "wattage", kind: attrNumber}) == nil, "defineAttribute failed")
+	order, err := s.placeOrder("Luigi", "CDC1", []orderLine{{a, 1}})
+	check(err == nil, "placeOrder: %v", err)
+	check(s.pick(order) == nil, "pick failed")
+	shipped, err := s.placeOrder("Mario", "CDC1", []orderLine{{a, 1}})
+	check(err == nil, "placeOrder: %v", err)
+	check(s.pick(shipped) == nil && s.pack(shipped) == nil && s.ship(shipped) == nil, "shipping failed")
+	want = s.db.all()
+
+	// reopen and compare everything
+	store2, err := c.open()
+	if err != nil {
+		t.Fatal("reopen:", err)
+	}
+	s2 := &System{store: store2}
+	if err := s2.createDB(); err != nil {
+		t.Fatal("reopen createDB:", err)
+	}
+	got := s2.db.all()
+	check(reflect.DeepEqual(got, want), "items changed after reopening:\n  want %v\n  got  %v", want, got)
+	check(reflect.DeepEqual(s2.warehouseDB.all(), s.warehouseDB.all()), "warehouses changed after reopening")
+	check(reflect.DeepEqual(s2.supplierDB.all(), s.supplierDB.all()), "suppliers changed after reopening")
+	variant, _ := s2.findItem(m)
+	check(variant.item == "Staff Shirt" && variant.options["color"] == "red", "variant lost its options or name: %v", variant.variantInfo())
+	check(reflect.DeepEqual(s2.stock, s.stock), "stock changed after reopening:\n  want %v\n  got  %v", s.stock, s2.stock)
+	check(reflect.DeepEqual(s2.ledger, s.ledger), "ledger changed after reopening:\n  want %v\n  got  %v", s.ledger, s2.ledger)
+	check(reflect.DeepEqual(s2.boms, s.boms), "boms changed after reopening")
+	check(reflect.DeepEqual(s2.categories.list(), s.categories.list()), "categories changed after reopening: %v", s2.categories.list())
+	kitchen, _ := s2.categoryRecordLocked("Inventory > Kitchen")
+	check(kitchen.Attributes["aisle"] == "3" && len(kitchen.Custom) == 1, "category attributes lost: %+v", kitchen)
+	check(reflect.DeepEqual(s2.orders, s.orders), "orders changed after reopening")
+	check(reflect.DeepEqual(s2.reservations, s.reservations), "reservations changed after reopening:\n  want %v\n  got  %v", s.reservations, s2.reservations)
+	check(s2.nextOrder == s.nextOrder, "order numbers would repeat after reopening: %v", s2.nextOrder)
+}
+
+// a shop's stock has to be there when the platform is opened again, or the report says 0
+func TestTenantStockSurvivesReopen(t *testing.T) {
+	for _, c := range conformanceCases(t.TempDir()) {
+		t.Run(c.name, func(t *testing.T) {
+			store, err := c.open()
+			if err != nil {
+				t.Fatal(err)
+			}
+			admin := principal{name: "owner", role: roleAdmin}
+			p, err := openPlatform(store)
+			if err != nil {
+				t.Fatal(err)
+			}
+			north, err := p.addTenant(admin, "north", []string{"Inventory > Toppings"}, []string{"NRT1"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			basil, err := north.createItem("Basil", "Inventory > Toppings", "NRT1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := north.receive(basil, "NRT1", 5, "delivery"); err != nil {
+				t.Fatal(err)
+			}
+			store2, err := c.open()
+			if err != nil {
+				t.Fatal(err)
+			}
+			p2, err := openPlatform(store2)
+			if err != nil {
+				t.Fatal(err)
+			}
+			report, err := p2.crossTenantReport(admin)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(report) != 1 || report[0].items != 1 || report[0].onHand != 5 {
+				t.Errorf("report after reopening: %v", report)
+			}
+		})
+	}
+}
+
+// a point-in-time snapshot works from the saved history and ledger, not from what one process remembers
+func TestSnapshotAtAfterReopen(t *testing.T) {
+	for _, c := range conformanceCases(t.TempDir()) {
+		t.Run(c.name, func(t *testing.T) {
+			store, err := c.open()
+			if err != nil {
+				t.Fatal(err)
+			}
+			now := time.Date(2024, 3, 1, 9, 0, 0, 0, time.UTC)
+			s := &System{store: store, clock: func() time.Time { return now }}
+			if err := s.createDB(); err != nil {
+				t.Fatal(err)
+			}
+			flour, _ := s.createItem("Flour Bag", "Inventory", "RX04")
+			cutter, _ := s.createItem("Pizza Cutter", "Inventory", "RX04")
+			s.receive(flour, "RX04", 8, "delivery")
+			then := now
+			now = now.Add(time.Hour)
+			s.updateItem(flour, "Flour Sack", "Inventory")
+			s.receive(flour, "RX04", 4, "delivery")
+			s.deleteItem(cutter)
+			late, _ := s.createItem("Dough Scraper", "Inventory", "RX04")
+
+			store2, err := c.open()
+			if err != nil {
+				t.Fatal(err)
+			}
+			s2 := &System{store: store2, clock: func() time.Time { return now }}
+			if err := s2.createDB(); err != nil {
+				t.Fatal(err)
+			}
+			snap, err := s2.snapshotAt(then)
+			if err != nil {
+				t.Fatal(err)
+			}
+			names := map[int64]string{}
+			for _, it := range snap.items {
+				names[it.id] = it.item
+			}
+			if names[flour] != "Flour Bag" || names[cutter] != "Pizza Cutter" || names[late] != "" {
+				t.Errorf("items back then: %v", names)
+			}
+			if got := snap.stock[stockKey{flour, "RX04"}]; got != 8 {
+				t.Errorf("flour back then: got %v, want 8", got)
+			}
+		})
+	}
+}
+
+// tenant tables are tables of their own in the database, so plain sql works on them
+func TestSQLTenantTablesAreReal(t *testing.T) {
+	store, err := openSQLBackend(filepath.Join(t.TempDir(), "tenants.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.close()
+	p, err := openPlatform(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	north, err := p.addTenant(principal{name: "owner", role: roleAdmin}, "north", nil, []string{"NRT1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"Basil", "Oregano", "Mop"} {
+		category := "Inventory"
+		if name == "Mop" {
+			category = "Maintenance"
+		}
+		id, err := north.createItem(name, category, "NRT1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := north.receive(id, "NRT1", 2, "delivery"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	rows, err := store.db.Query(`SELECT i.category, COUNT(*), SUM(s.qty) FROM north__items i
+		JOIN north__stock s ON s.id = i.id GROUP BY i.category ORDER BY i.category`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	var got []string
+	for rows.Next() {
+		var category string
+		var count, qty int
+		if err := rows.Scan(&category, &count, &qty); err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, fmt.Sprintf("%v %v %v", category, count, qty))
+	}
+	if want := []string{"Inventory 2 4", "Maintenance 1 2"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("per category: got %v, want %v", got, want)
+	}
+	var inRecords int
+	if err := store.db.QueryRow(`SELECT COUNT(*) FROM records WHERE tbl LIKE 'north/%'`).Scan(&inRecords); err != nil || inRecords != 0 {
+		t.Errorf("tenant rows in records: %v %v", inRecords, err)
+	}
+}
+
+// a tenant that fails to open takes its tables with it, the next one of that name starts empty
+func TestAddTenantRollbackDropsTables(t *testing.T) {
+	for _, c := range conformanceCases(t.TempDir()) {
+		t.Run(c.name, func(t *testing.T) {
+			inner, err := c.open()
+			if err != nil {
+				t.Fatal(err)
+			}
+			flaky := &countingBackend{backend: inner, table: "north/warehouses", ok: 0}
+			var store backend = flaky
+			if d, ok := inner.(tableDropper); ok {
+				store = struct {
+					*countingBackend
+					tableDropper
+				}{flaky, d}
+			}
+			p, err := openPlatform(store)
+			if err != nil {
+				t.Fatal(err)
+			}
+			admin := principal{name: "owner", role: roleAdmin}
+			if _, err := p.addTenant(admin, "north", []string{"Inventory > Toppings"}, []string{"NRT1"}); !errors.Is(err, errFlaky) {
+				t.Fatalf("addTenant: got %v, want errFlaky", err)
+			}
+			if _, ok := p.tenant("north"); ok {
+				t.Error("the failed tenant was kept")
+			}
+			// before the scan below, which would make the tables again
+			if sb, ok := inner.(*sqlBackend); ok {
+				var left int
+				sb.db.QueryRow(`SELECT COUNT(*) FROM sqlite_master WHERE name LIKE 'north\_\_%' ESCAPE '\'`).Scan(&left)
+				if left != 0 {
+					t.Errorf("%v north tables left in the database", left)
+				}
+			}
+			for _, table := range allTables {
+				n := 0
+				inner.scan("north/"+table, func(int64, []byte) error {
+					n++
+					return nil
+				})
+				if n > 0 {
+					t.Errorf("%v rows left in north/%v", n, table)
+				}
+			}
+			north, err := p.addTenant(admin, "north", nil, []string{"NRT1"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, ok := north.categoryRecordLocked("Inventory > Toppings"); ok {
+				t.Error("the new tenant got the failed one's category")
+			}
+		})
+	}
+}
+
+func TestTenantConfigIsEnforced(t *testing.T) {
+	p, err := openPlatform(newMemoryBackend())
+	if err != nil {
+		t.Fatal(err)
+	}
+	admin := principal{name: "owner", role: roleAdmin}
+	if _, err := p.addTenant(admin, "east", []string{"Kitchen > Knives"}, []string{"EST1"}); !errors.Is(err, errCategoryNotFound) {
+		t.Errorf("category without its parent: got %v, want errCategoryNotFound", err)
+	}
+	if _, ok := p.tenant("east"); ok {
+		t.Error("a refused tenant was kept")
+	}
+	west, err := p.addTenant(admin, "west", []string{"Kitchen", "Kitchen > Knives"}, []string{"WST1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.crossTenantReport(admin); err != nil {
+		t.Errorf("report: %v", err)
+	}
+	if _, err := west.createItem("Chef Knife", "Kitchen > Knives", "RX01"); !errors.Is(err, errNotTenantSite) {
+		t.Errorf("create outside the tenant's warehouses: got %v", err)
+	}
+	knife, err := west.createItem("Chef Knife", "Kitchen > Knives", "WST1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := west.moveItem(knife, "RX01"); !errors.Is(err, errNotTenantSite) {
+		t.Errorf("move outside: got %v", err)
+	}
+	if err := west.receive(knife, "RX01", 2, "delivery"); !errors.Is(err, errNotTenantSite) {
+		t.Errorf("stock outside: got %v", err)
+	}
+}
@@ -0,0 +1,530 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// DATA FILES
+// A saved inventory is one json document with a format_version on top.
+// Every time the shape changes we bump currentDataVersion and register an up-migration
+// from the old version, so files saved by older builds still load.
+// Files from a newer build are refused instead of being half understood.
+//
+// v1  no format_version field, warehouse could hold "RX01/A03" or "RX01-A03" (site and bin in one string)
+// v2  warehouse is only the site, the bin has its own field
+// v3  every item has a category
+// v4  items can carry custom attributes and attachments
+// v5  orders with their reservations, the order counter and the daily stock snapshots are saved too
+
+const currentDataVersion = 5
+
+var errDataTooNew = errors.New("data file was written by a newer version")
+
+// dataDoc is the raw json, migrations edit it before it ever becomes a System
+type dataDoc map[string]any
+
+type dataMigration struct {
+	from int
+	name string
+	up   func(doc dataDoc) error
+}
+
+var dataMigrations = map[int]dataMigration{}
+
+func registerDataMigration(from int, name string, up func(doc dataDoc) error) {
+	if _, ok := dataMigrations[from]; ok {
+		panic(fmt.Sprintf("two data migrations from version %v", from))
+	}
+	dataMigrations[from] = dataMigration{from: from, name: name, up: up}
+}
+
+func init() {
+	// stock is counted per site from v2 on, so two bins of one site become one stock row on load
+	// (decodeDataFile adds them up). The bin stays on every row it came from
+	registerDataMigration(1, "split warehouse into site + bin", func(doc dataDoc) error {
+		for _, section := range []string{"items", "stock", "ledger"} {
+			for _, rec := range doc.records(section) {
+				w, _ := rec["warehouse"].(string)
+				site, bin, ok := strings.Cut(w, "/")
+				if !ok {
+					if site, bin, ok = strings.Cut(w, "-"); !ok {
+						continue
+					}
+				}
+				rec["warehouse"] = site
+				if bin != "" {
+					rec["bin"] = bin
+				}
+			}
+		}
+		return nil
+	})
+	registerDataMigration(2, "backfill missing categories", func(doc dataDoc) error {
+		byID := map[string]map[string]any{}
+		for _, rec := range doc.records("items") {
+			byID[fmt.Sprint(rec["id"])] = rec
+		}
+		for _, rec := range doc.records("items") {
+			if c, _ := rec["category"].(string); strings.TrimSpace(c) != "" {
+				continue
+			}
+			rec["category"] = defaultCategories[0]
+			// variants take whatever their parent has
+			if parent, ok := byID[fmt.Sprint(rec["parent"])]; ok {
+				if c, _ := parent["category"].(string); strings.TrimSpace(c) != "" {
+					rec["category"] = c
+				}
+			}
+		}
+		return nil
+	})
+	// nothing to convert, the bump only keeps older builds from silently dropping the new fields
+	registerDataMigration(3, "custom attributes and attachments", func(doc dataDoc) error {
+		return nil
+	})
+	registerDataMigration(4, "orders, reservations and snapshots", func(doc dataDoc) error {
+		return nil
+	})
+}
+
+// records gives the objects in one section of the document, edits go straight into the doc
+func (doc dataDoc) records(section string) []map[string]any {
+	list, _ := doc[section].([]any)
+	var out []map[string]any
+	for _, v := range list {
+		if rec, ok := v.(map[string]any); ok {
+			out = append(out, rec)
+		}
+	}
+	return out
+}
+
+// version of a document, a missing field means the very first format
+func (doc dataDoc) version() (int, error) {
+	raw, ok := doc["format_version"]
+	if !ok {
+		return 1, nil
+	}
+	n, ok := raw.(json.Number)
+	if !ok {
+		return 0, fmt.Errorf("format_version is not a number: %v", raw)
+	}
+	v, err := n.Int64()
+	return int(v), err
+}
+
+func parseDataDoc(raw []byte) (dataDoc, int, error) {
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.UseNumber() // ids are int64, don't let them go through float64
+	var doc dataDoc
+	if err := dec.Decode(&doc); err != nil {
+		return nil, 0, err
+	}
+	v, err := doc.version()
+	if err != nil {
+		return nil, 0, err
+	}
+	if v > currentDataVersion {
+		return nil, v, fmt.Errorf("%w: file is v%v, this build understands up to v%v", errDataTooNew, v, currentDataVersion)
+	}
+	return doc, v, nil
+}
+
+// upgrade runs the migrations one version at a time
+func (doc dataDoc) upgrade(from int) ([]string, error) {
+	var applied []string
+	for v := from; v < currentDataVersion; v++ {
+		m, ok := dataMigrations[v]
+		if !ok {
+			return applied, fmt.Errorf("no migration registered from v%v", v)
+		}
+		if err := m.up(doc); err != nil {
+			return applied, fmt.Errorf("migration v%v -> v%v (%v): %w", v, v+1, m.name, err)
+		}
+		applied = append(applied, fmt.Sprintf("v%v -> v%v %v", v, v+1, m.name))
+	}
+	doc["format_version"] = json.Number(fmt.Sprint(currentDataVersion))
+	return applied, nil
+}
+
+// SAVING
+
+type categoryFileRecord struct {
+	Path       string               `json:"path"`
+	Attributes map[string]string    `json:"attributes,omitempty"`
+	Custom     []attributeDefRecord `json:"custom_attributes,omitempty"`
+}
+
+type attributeDefRecord struct {
+	Name     string   `json:"name"`
+	Kind     attrKind `json:"kind"`
+	Required bool     `json:"required,omitempty"`
+	Choices  []string `json:"choices,omitempty"`
+}
+
+type stockFileRecord struct {
+	ID        int64  `json:"id"`
+	Warehouse string `json:"warehouse"`
+	Bin       string `json:"bin,omitempty"` // only on rows migrated from v1, where stock was kept per bin
+	Qty       int    `json:"qty"`
+}
+
+type ledgerFileRecord struct {
+	At        time.Time `json:"at"`
+	ID        int64     `json:"id"`
+	Warehouse string    `json:"warehouse"`
+	Bin       string    `json:"bin,omitempty"` // same as on stock rows
+	Delta     int       `json:"delta"`
+	Reason    string    `json:"reason"`
+}
+
+type snapshotFileRecord struct {
+	Day       string `json:"day"` // 2006-01-02, local time like the snapshots themselves
+	ID        int64  `json:"id"`
+	Warehouse string `json:"warehouse"`
+	Qty       int    `json:"qty"`
+	Used      int    `json:"used"`
+	Received  int    `json:"received"`
+}
+
+type bomFileRecord struct {
+	Kit   int64           `json:"kit"`
+	Lines []bomLineRecord `json:"lines"`
+}
+
+type bomLineRecord struct {
+	Component int64 `json:"component"`
+	Qty       int   `json:"qty"`
+}
+
+type dataFile struct {
+	FormatVersion int                  `json:"format_version"`
+	SavedAt       time.Time            `json:"saved_at"`
+	Items         []json.RawMessage    `json:"items"`
+	Warehouses    []json.RawMessage    `json:"warehouses"`
+	Suppliers     []json.RawMessage    `json:"suppliers"`
+	Categories    []categoryFileRecord `json:"categories"`
+	Stock         []stockFileRecord    `json:"stock"`
+	Ledger        []ledgerFileRecord   `json:"ledger"`
+	BOMs          []bomFileRecord      `json:"boms"`
+	Orders        []orderRecord        `json:"orders"`
+	NextOrder     int64                `json:"next_order"`
+	Snapshots     []snapshotFileRecord `json:"snapshots"`
+}
+
+func marshalAll[T entity](list []T) ([]json.RawMessage, error) {
+	out := []json.RawMessage{}
+	for _, v := range list {
+		data, err := v.marshal()
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, data)
+	}
+	return out, nil
+}
+
+// systemSnapshot is a private copy of everything that goes into a data file.
+// Taking one only holds the read lock for the copying, encoding and compressing happen after.
+type systemSnapshot struct {
+	at         time.Time
+	items      []Item
+	warehouses []Warehouse
+	suppliers  []Supplier
+	categories []categoryFileRecord
+	stock      map[stockKey]int
+	ledger     []ledgerEntry
+	boms       map[int64]billOfMaterials
+	orders     []orderRecord
+	nextOrder  int64
+	snapshots  []stockLevel
+}
+
+func (s *System) snapshot() systemSnapshot {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	snap := systemSnapshot{
+		at:         s.now(),
+		items:      s.db.all(),
+		warehouses: s.warehouseDB.all(),
+		suppliers:  s.supplierDB.all(),
+		stock:      make(map[stockKey]int, len(s.stock)),
+		ledger:     append([]ledgerEntry(nil), s.ledger...),
+		boms:       make(map[int64]billOfMaterials, len(s.boms)),
+		nextOrder:  s.nextOrder,
+		snapshots:  append([]stockLevel(nil), s.snapshots...),
+	}
+	for _, o := range s.orders {
+		snap.orders = append(snap.orders, s.orderRecordLocked(o))
+	}
+	sort.Slice(snap.orders, func(a, b int) bool { return snap.orders[a].ID < snap.orders[b].ID })
+	for _, path := range s.categories.list() {
+		rec, _ := s.categoryRecordLocked(path)
+		snap.categories = append(snap.categories, rec)
+	}
+	for key, qty := range s.stock {
+		snap.stock[key] = qty
+	}
+	for kit, bom := range s.boms {
+		bom.lines = append([]bomLine(nil), bom.lines...)
+		snap.boms[kit] = bom
+	}
+	return snap
+}
+
+func (snap systemSnapshot) encode() ([]byte, error) {
+	f := dataFile{FormatVersion: currentDataVersion, SavedAt: snap.at.UTC(), Categories: snap.categories}
+	var err error
+	if f.Items, err = marshalAll(snap.items); err != nil {
+		return nil, err
+	}
+	if f.Warehouses, err = marshalAll(snap.warehouses); err != nil {
+		return nil, err
+	}
+	if f.Suppliers, err = marshalAll(snap.suppliers); err != nil {
+		return nil, err
+	}
+	for key, qty := range snap.stock {
+		f.Stock = append(f.Stock, stockFileRecord{ID: key.id, Warehouse: key.warehouse, Qty: qty})
+	}
+	sort.Slice(f.Stock, func(a, b int) bool {
+		if f.Stock[a].ID != f.Stock[b].ID {
+			return f.Stock[a].ID < f.Stock[b].ID
+		}
+		return f.Stock[a].Warehouse < f.Stock[b].Warehouse
+	})
+	for _, e := range snap.ledger {
+		f.Ledger = append(f.Ledger, ledgerFileRecord{At: e.at, ID: e.id, Warehouse: e.warehouse, Delta: e.delta, Reason: e.reason})
+	}
+	for _, bom := range snap.boms {
+		rec := bomFileRecord{Kit: bom.kit}
+		for _, l := range bom.lines {
+			rec.Lines = append(rec.Lines, bomLineRecord{Component: l.component, Qty: l.qty})
+		}
+		f.BOMs = append(f.BOMs, rec)
+	}
+	sort.Slice(f.BOMs, func(a, b int) bool { return f.BOMs[a].Kit < f.BOMs[b].Kit })
+	f.Orders, f.NextOrder = snap.orders, snap.nextOrder
+	for _, l := range snap.snapshots {
+		f.Snapshots = append(f.Snapshots, snapshotFileRecord{
+			Day: l.day.Format(time.DateOnly), ID: l.key.id, Warehouse: l.key.warehouse, Qty: l.qty, Used: l.used, Received: l.received,
+		})
+	}
+	return json.MarshalIndent(f, "", "  ")
+}
+
+func (s *System) encodeDataFile() ([]byte, error) {
+	return s.snapshot().encode()
+}
+
+// writeFileAtomic writes next to the target and renames, so a crash never leaves half a file
+func writeFileAtomic(path string, data []byte) error {
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func (s *System) saveDataFile(path string) error {
+	data, err := s.encodeDataFile()
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, data)
+}
+
+// LOADING
+
+// decodeDataFile builds a fresh in-memory System out of an up to date document
+func decodeDataFile(doc dataDoc) (*System, error) {
+	raw, err := json.Marshal(doc)
+	if err != nil {
+		return nil, err
+	}
+	var f dataFile
+	if err := json.Unmarshal(raw, &f); err != nil {
+		return nil, err
+	}
+	s := &System{}
+	if err := s.createDB(); err != nil {
+		return nil, err
+	}
+	for _, data := range f.Items {
+		item, err := decodeItem(data)
+		if err != nil {
+			return nil, err
+		}
+		if err := s.db.create(item); err != nil {
+			return nil, fmt.Errorf("item %v: %w", item.id, err)
+		}
+	}
+	for _, data := range f.Warehouses {
+		w, err := decodeWarehouse(data)
+		if err != nil {
+			return nil, err
+		}
+		if err := s.warehouseDB.create(w); err != nil {
+			return nil, fmt.Errorf("warehouse %v: %w", w.code, err)
+		}
+	}
+	for _, data := range f.Suppliers {
+		sup, err := decodeSupplier(data)
+		if err != nil {
+			return nil, err
+		}
+		if err := s.supplierDB.create(sup); err != nil {
+			return nil, fmt.Errorf("supplier %v: %w", sup.name, err)
+		}
+	}
+	// sorted paths put every parent before its children
+	sort.Slice(f.Categories, func(a, b int) bool { return f.Categories[a].Path < f.Categories[b].Path })
+	for _, c := range f.Categories {
+		if err := s.restoreCategory(c); err != nil {
+			return nil, err
+		}
+	}
+	// v1 files kept stock per bin, after the migration those are several rows for one site
+	for _, st := range f.Stock {
+		s.stock[stockKey{st.ID, st.Warehouse}] += st.Qty
+	}
+	for _, e := range f.Ledger {
+		s.ledger = append(s.ledger, ledgerEntry{at: e.At, id: e.ID, warehouse: e.Warehouse, delta: e.Delta, reason: e.Reason})
+	}
+	for _, b := range f.BOMs {
+		bom := billOfMaterials{kit: b.Kit}
+		for _, l := range b.Lines {
+			bom.lines = append(bom.lines, bomLine{component: l.Component, qty: l.Qty})
+		}
+		s.boms[b.Kit] = bom
+	}
+	for _, o := range f.Orders {
+		s.restoreOrder(o)
+	}
+	s.nextOrder = max(s.nextOrder, f.NextOrder)
+	for _, l := range f.Snapshots {
+		day, err := time.ParseInLocation(time.DateOnly, l.Day, time.Local)
+		if err != nil {
+			return nil, fmt.Errorf("snapshot %v: %w", l.Day, err)
+		}
+		s.snapshots = append(s.snapshots, stockLevel{day: day, key: stockKey{l.ID, l.Warehouse}, qty: l.Qty, used: l.Used, received: l.Received})
+	}
+	// the maps were filled directly, the backend under them gets the same rows
+	if err := s.saveStateLocked(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// loadDataFile reads any version up to ours, migrating in memory only (the file is left alone)
+func loadDataFile(path string) (*System, int, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, 0, err
+	}
+	doc, from, err := parseDataDoc(raw)
+	if err != nil {
+		return nil, from, err
+	}
+	if _, err := doc.upgrade(from); err != nil {
+		return nil, from, err
+	}
+	s, err := decodeDataFile(doc)
+	return s, from, err
+}
+
+// migrateDataFile upgrades the file in place, the original bytes are kept next to it first
+func migrateDataFile(path string) (from int, applied []string, backup string, err error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return 0, nil, "", err
+	}
+	doc, from, err := parseDataDoc(raw)
+	if err != nil {
+		return from, nil, "", err
+	}
+	if from == currentDataVersion {
+		return from, nil, "", nil
+	}
+	if applied, err = doc.upgrade(from); err != nil {
+		return from, applied, "", err
+	}
+	s, err := decodeDataFile(doc)
+	if err != nil {
+		return from, applied, "", fmt.Errorf("migrated data doesn't load, file left untouched: %w", err)
+	}
+	backup = fmt.Sprintf("%v.v%v.bak", path, from)
+	if _, err := os.Stat(backup); err == nil {
+		backup = fmt.Sprintf("%v.v%v.%v.bak", path, from, time.Now().Format("20060102-150405"))
+	}
+	if err := os.WriteFile(backup, raw, 0o644); err != nil {
+		return from, applied, "", err
+	}
+	// re-encode from the loaded system so the file comes out in the exact current shape
+	out, err := s.encodeDataFile()
+	if err != nil {
+		return from, applied, backup, err
+	}
+	return from, applied, backup, writeFileAtomic(path, out)
+}
+
+func init() {
+	commands["save"] = command{
+		usage: "save <file.json>",
+		run: func(s *System, args []string) error {
+			if len(args) != 1 {
+				return errUsage
+			}
+			if err := s.saveDataFile(args[0]); err != nil {
+				return err
+			}
+			fmt.Printf("saved %v items to %v (format v%v)\n", s.db.count(), args[0], currentDataVersion)
+			return nil
+		},
+	}
+	commands["load"] = command{
+		usage: "load <file.json>",
+		run: func(_ *System, args []string) error {
+			if len(args) != 1 {
+				return errUsage
+			}
+			loaded, from, err := loadDataFile(args[0])
+			if err != nil {
+				return err
+			}
+			if from < currentDataVersion {
+				fmt.Printf("(file is v%v, upgraded in memory, run `migrate` to upgrade it on disk)\n", from)
+			}
+			fmt.Print(loaded.readItems())
+			return nil
+		},
+	}
+	commands["migrate"] = command{
+		usage: "migrate <file.json>",
+		run: func(_ *System, args []string) error {
+			if len(args) != 1 {
+				return errUsage
+			}
+			from, applied, backup, err := migrateDataFile(args[0])
+			if err != nil {
+				return err
+			}
+			if len(applied) == 0 {
+				fmt.Printf("%v is already v%v, nothing to do\n", args[0], from)
+				return nil
+			}
+			for _, a := range applied {
+				fmt.Println("applied", a)
+			}
+			fmt.Printf("%v upgraded v%v -> v%v, original kept at %v\n", args[0], from, currentDataVersion, backup)
+			return nil
+		},
+	}
+}
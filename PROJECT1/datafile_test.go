@@ -0,0 +1,92 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// two bins of one site in a v1 file are one stock row afterwards, with both quantities
+func TestV1BinsAddUp(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "v1.json")
+	v1 := `{
+  "items": [{"id": 7, "item": "Flour Bag", "category": "Inventory", "warehouse": "RX01/A03"}],
+  "stock": [
+    {"id": 7, "warehouse": "RX01-A03", "qty": 7},
+    {"id": 7, "warehouse": "RX01-A04", "qty": 3}
+  ],
+  "ledger": [
+    {"at": "2024-01-01T00:00:00Z", "id": 7, "warehouse": "RX01-A03", "delta": 7, "reason": "delivery"},
+    {"at": "2024-01-01T00:00:00Z", "id": 7, "warehouse": "RX01-A04", "delta": 3, "reason": "delivery"}
+  ]
+}`
+	if err := os.WriteFile(path, []byte(v1), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	s, from, err := loadDataFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if from != 1 {
+		t.Errorf("version: got %v, want 1", from)
+	}
+	if got := s.onHand(7, "RX01"); got != 10 {
+		t.Errorf("RX01 on hand: got %v, want 10", got)
+	}
+	if item, _ := s.findItem(7); item.Warehouse != "RX01" || item.bin != "A03" {
+		t.Errorf("item kept %q / %q", item.Warehouse, item.bin)
+	}
+	doc, _, _ := parseDataDoc([]byte(v1))
+	doc.upgrade(1)
+	if bins := []any{doc.records("stock")[0]["bin"], doc.records("stock")[1]["bin"]}; !reflect.DeepEqual(bins, []any{"A03", "A04"}) {
+		t.Errorf("stock rows lost their bins: %v", bins)
+	}
+}
+
+// orders, reservations, the order counter and snapshots make it through save and load
+func TestDataFileKeepsOrders(t *testing.T) {
+	s := &System{}
+	if err := s.createDB(); err != nil {
+		t.Fatal(err)
+	}
+	day := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	s.clock = func() time.Time { return day }
+	cooler, err := s.createItem("Drink Cooler", "Inventory", "RX04")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.receive(cooler, "RX04", 5, "delivery")
+	open, _ := s.placeOrder("Luigi", "RX04", []orderLine{{cooler, 2}})
+	picked, _ := s.placeOrder("Mario", "RX04", []orderLine{{cooler, 1}})
+	if err := s.pick(picked); err != nil {
+		t.Fatal(err)
+	}
+	s.takeDailySnapshot()
+
+	path := filepath.Join(t.TempDir(), "inventory.json")
+	if err := s.saveDataFile(path); err != nil {
+		t.Fatal(err)
+	}
+	loaded, _, err := loadDataFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(loaded.orders, s.orders) {
+		t.Errorf("orders: got %v, want %v", loaded.orders, s.orders)
+	}
+	if !reflect.DeepEqual(loaded.reservations, s.reservations) {
+		t.Errorf("reservations: got %v, want %v", loaded.reservations, s.reservations)
+	}
+	if loaded.nextOrder != s.nextOrder || open == picked {
+		t.Errorf("next order: got %v, want %v", loaded.nextOrder, s.nextOrder)
+	}
+	if len(loaded.snapshots) != len(s.snapshots) || len(s.snapshots) == 0 || !loaded.snapshots[0].day.Equal(s.snapshots[0].day) {
+		t.Errorf("snapshots: got %v, want %v", loaded.snapshots, s.snapshots)
+	}
+	loaded.clock = s.clock
+	if got := loaded.availableToPromise(cooler, "RX04"); got != 2 {
+		t.Errorf("available after load: got %v, want 2", got)
+	}
+}
@@ -0,0 +1,523 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// DUPLICATES
+// "Pizza Cutter" and "pizza cutters" in RX01 are the same thing with two ids.
+// Names are normalized (case, punctuation, plurals) and compared by words and by spelling,
+// category and warehouse add to the score. Variants of one parent are never duplicates of each other,
+// neither are names that only differ in a number ("Table 1", "Table 2").
+// createItem refuses a likely duplicate, createItemAnyway is the explicit way past that.
+// mergeItems folds the duplicates into one survivor: stock, ledger, reservations, orders and BOMs
+// all end up pointing at the survivor.
+
+const duplicateThreshold = 0.85
+
+var (
+	errLikelyDuplicate = errors.New("a very similar item already exists")
+	errMergeSelf       = errors.New("can't merge an item into itself")
+	errMergeVariant    = errors.New("a variant can't take over an item that has variants")
+	errMergeParent     = errors.New("a variant can't take over its own parent")
+)
+
+type duplicateMatch struct {
+	item  Item
+	score float64
+}
+
+func (m duplicateMatch) info() string {
+	return fmt.Sprintf("%.2f %v", m.score, m.item.info())
+}
+
+// normalizeName lowercases, drops punctuation and turns plurals into singulars
+func normalizeName(name string) string {
+	var words []string
+	for _, w := range strings.FieldsFunc(strings.ToLower(name), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	}) {
+		switch {
+		case len(w) > 4 && strings.HasSuffix(w, "ies"):
+			w = w[:len(w)-3] + "y"
+		case len(w) > 4 && (strings.HasSuffix(w, "ches") || strings.HasSuffix(w, "shes") || strings.HasSuffix(w, "xes")):
+			w = w[:len(w)-2]
+		case len(w) > 3 && strings.HasSuffix(w, "s") && !strings.HasSuffix(w, "ss"):
+			w = w[:len(w)-1]
+		}
+		words = append(words, w)
+	}
+	return strings.Join(words, " ")
+}
+
+// levenshtein counts single character edits
+func levenshtein(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	prev := make([]int, len(rb)+1)
+	cur := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		cur[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(rb)]
+}
+
+// nameSimilarity is the better of word overlap and spelling distance, 1 means the same name
+func nameSimilarity(a, b string) float64 {
+	a, b = normalizeName(a), normalizeName(b)
+	if a == b {
+		return 1
+	}
+	if a == "" || b == "" {
+		return 0
+	}
+	numbered := numberWords(a) != numberWords(b)
+	wa, wb := map[string]bool{}, map[string]bool{}
+	for _, w := range strings.Fields(a) {
+		wa[w] = true
+	}
+	for _, w := range strings.Fields(b) {
+		wb[w] = true
+	}
+	common := 0
+	for w := range wa {
+		if wb[w] {
+			common++
+		}
+	}
+	jaccard := float64(common) / float64(len(wa)+len(wb)-common)
+	if numbered {
+		return jaccard // one character apart, but table 1 is not table 2
+	}
+	spelling := 1 - float64(levenshtein(a, b))/float64(max(len([]rune(a)), len([]rune(b))))
+	return max(jaccard, spelling)
+}
+
+// numberWords is the words of a normalized name that are numbers, in order
+func numberWords(name string) string {
+	var nums []string
+	for _, w := range strings.Fields(name) {
+		if strings.IndexFunc(w, func(r rune) bool { return !unicode.IsDigit(r) }) < 0 {
+			nums = append(nums, w)
+		}
+	}
+	return strings.Join(nums, " ")
+}
+
+// duplicateScore weighs the name most, then category and warehouse
+func duplicateScore(a, b Item) float64 {
+	if a.id == b.id {
+		return 0
+	}
+	// S and M of the same shirt, or two different variants, are different things
+	if len(a.options) > 0 || len(b.options) > 0 {
+		if optionsString(a.options) != optionsString(b.options) {
+			return 0
+		}
+	}
+	score := 0.7 * nameSimilarity(a.item, b.item)
+	if a.Category == b.Category {
+		score += 0.2
+	} else if splitCategoryPath(a.Category) != nil && splitCategoryPath(b.Category) != nil && splitCategoryPath(a.Category)[0] == splitCategoryPath(b.Category)[0] {
+		score += 0.1
+	}
+	if a.Warehouse == b.Warehouse {
+		score += 0.1
+	}
+	return score
+}
+
+// duplicatesOfLocked compares one (maybe not yet stored) item with everything, must be called with s.mu held
+func (s *System) duplicatesOfLocked(candidate Item) []duplicateMatch {
+	var matches []duplicateMatch
+	for _, item := range s.db.all() {
+		if score := duplicateScore(candidate, item); score >= duplicateThreshold {
+			matches = append(matches, duplicateMatch{item: item, score: score})
+		}
+	}
+	sort.Slice(matches, func(a, b int) bool { return matches[a].score > matches[b].score })
+	return matches
+}
+
+// likelyDuplicates is what createItem would refuse the item for, best match first
+func (s *System) likelyDuplicates(item, Category, Warehouse string) []duplicateMatch {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.duplicatesOfLocked(Item{item: item, Category: Category, Warehouse: Warehouse})
+}
+
+// BATCH SCAN
+
+type duplicateGroup struct {
+	items []Item // oldest first, that one is the suggested survivor
+	score float64
+}
+
+func (g duplicateGroup) info() string {
+	var names []string
+	for _, item := range g.items {
+		names = append(names, fmt.Sprintf("%v (%v, %v)", item.item, item.id, item.Warehouse))
+	}
+	return fmt.Sprintf("%.2f  %v", g.score, strings.Join(names, " = "))
+}
+
+// blockKeys puts an item in a few buckets so only items sharing one get compared,
+// otherwise a scan over 20000 items would be 200 million comparisons
+func blockKeys(item Item) []string {
+	name := normalizeName(item.item)
+	var keys []string
+	for _, w := range strings.Fields(name) {
+		if len(w) >= 3 {
+			keys = append(keys, "w:"+w)
+		}
+	}
+	if len(name) >= 3 {
+		keys = append(keys, "p:"+name[:3])
+	}
+	return keys
+}
+
+// scanDuplicates groups every set of items that look like one thing
+func (s *System) scanDuplicates(threshold float64) []duplicateGroup {
+	s.mu.RLock()
+	items := s.db.all()
+	s.mu.RUnlock()
+
+	buckets := map[string][]int{}
+	for i, item := range items {
+		for _, k := range blockKeys(item) {
+			buckets[k] = append(buckets[k], i)
+		}
+	}
+	// union-find over item positions
+	parent := make([]int, len(items))
+	for i := range parent {
+		parent[i] = i
+	}
+	var find func(int) int
+	find = func(i int) int {
+		if parent[i] != i {
+			parent[i] = find(parent[i])
+		}
+		return parent[i]
+	}
+	best := map[int]float64{}
+	compared := map[[2]int]bool{}
+	for _, bucket := range buckets {
+		if len(bucket) > 200 {
+			continue // "pizza" is in half the names, that bucket says nothing
+		}
+		for x := 0; x < len(bucket); x++ {
+			for y := x + 1; y < len(bucket); y++ {
+				pair := [2]int{bucket[x], bucket[y]}
+				if compared[pair] {
+					continue
+				}
+				compared[pair] = true
+				score := duplicateScore(items[pair[0]], items[pair[1]])
+				if score < threshold {
+					continue
+				}
+				ra, rb := find(pair[0]), find(pair[1])
+				if ra != rb {
+					parent[max(ra, rb)] = min(ra, rb)
+				}
+				root := find(pair[0])
+				best[root] = max(best[root], best[ra], best[rb], score)
+			}
+		}
+	}
+	members := map[int][]Item{}
+	for i, item := range items {
+		members[find(i)] = append(members[find(i)], item)
+	}
+	var groups []duplicateGroup
+	for root, group := range members {
+		if len(group) > 1 {
+			groups = append(groups, duplicateGroup{items: group, score: best[root]})
+		}
+	}
+	sort.Slice(groups, func(a, b int) bool {
+		if groups[a].score != groups[b].score {
+			return groups[a].score > groups[b].score
+		}
+		return groups[a].items[0].item < groups[b].items[0].item
+	})
+	return groups
+}
+
+// MERGE
+
+// mergeItems folds every duplicate into survivor. Everything that can be checked is checked first,
+// and a write that still fails puts back what was already changed, in memory and in the backend.
+// An id given twice is merged once.
+func (s *System) mergeItems(survivor int64, duplicates ...int64) error {
+	s.mu.Lock()
+	keep, ok := s.db.get(survivor)
+	if !ok {
+		s.mu.Unlock()
+		return fmt.Errorf("survivor %v: %w", survivor, errItemNotFound)
+	}
+	gone := map[int64]Item{}
+	var ids []int64
+	for _, id := range duplicates {
+		if _, seen := gone[id]; !seen {
+			gone[id] = Item{}
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(a, b int) bool { return ids[a] < ids[b] })
+	for _, id := range ids {
+		if id == survivor {
+			s.mu.Unlock()
+			return errMergeSelf
+		}
+		item, ok := s.db.get(id)
+		if !ok {
+			s.mu.Unlock()
+			return fmt.Errorf("duplicate %v: %w", id, errItemNotFound)
+		}
+		if keep.parent == id {
+			s.mu.Unlock()
+			return errMergeParent
+		}
+		if keep.parent != 0 && len(s.db.lookup("parent", fmt.Sprint(id))) > 0 {
+			s.mu.Unlock()
+			return errMergeVariant
+		}
+		gone[id] = item
+	}
+	to := func(id int64) int64 {
+		if _, ok := gone[id]; ok {
+			return survivor
+		}
+		return id
+	}
+
+	saved := s.stateRowsLocked() // what the backend holds, only rows that differ from it get written
+
+	// BOMs first, on a copy, because merging can close a loop (A holds C, C holds B, B merged into A).
+	// Kits go in id order, so when two gone kits have recipes the lower id's wins, every time
+	boms := map[int64]billOfMaterials{}
+	kits := make([]int64, 0, len(s.boms))
+	for kit := range s.boms {
+		kits = append(kits, kit)
+	}
+	sort.Slice(kits, func(a, b int) bool { return kits[a] < kits[b] })
+	for _, kit := range kits {
+		bom := s.boms[kit]
+		if _, ok := gone[kit]; ok {
+			_, own := s.boms[survivor]
+			if _, taken := boms[survivor]; own || taken {
+				continue // the survivor's own recipe wins
+			}
+			kit = survivor
+		}
+		merged := billOfMaterials{kit: kit}
+		at := map[int64]int{}
+		for _, line := range bom.lines {
+			c := to(line.component)
+			if i, ok := at[c]; ok {
+				merged.lines[i].qty += line.qty
+				continue
+			}
+			at[c] = len(merged.lines)
+			merged.lines = append(merged.lines, bomLine{component: c, qty: line.qty})
+		}
+		boms[kit] = merged
+	}
+	old := s.boms
+	s.boms = boms
+	for kit := range boms {
+		if s.bomContains(kit, kit) {
+			s.boms = old
+			s.mu.Unlock()
+			return errBOMCycle
+		}
+	}
+
+	// copies of everything the merge rewrites, for undo
+	oldStock := make(map[stockKey]int, len(s.stock))
+	for key, qty := range s.stock {
+		oldStock[key] = qty
+	}
+	oldLedger := append([]ledgerEntry(nil), s.ledger...)
+	oldReservations := append([]reservation(nil), s.reservations...)
+	oldLines := map[int64][]orderLine{}
+	for id, o := range s.orders {
+		oldLines[id] = append([]orderLine(nil), o.lines...)
+	}
+	oldSnapshots := s.snapshots
+	var written []Item // rows as they were before db.update, put back newest first
+	var deleted []Item
+	undo := func(err error) error {
+		for i := len(deleted) - 1; i >= 0; i-- {
+			s.db.create(deleted[i])
+		}
+		for i := len(written) - 1; i >= 0; i-- {
+			s.db.update(written[i])
+		}
+		written := s.stateRowsLocked() // every row the merge may have written is in here
+		s.stock, s.ledger, s.reservations, s.snapshots, s.boms = oldStock, oldLedger, oldReservations, oldSnapshots, old
+		for id, lines := range oldLines {
+			s.orders[id].lines = lines
+		}
+		if saveErr := s.saveChangedLocked(written); saveErr != nil {
+			err = errors.Join(err, saveErr)
+		}
+		s.mu.Unlock()
+		return err
+	}
+
+	var events []changeEvent
+	for _, id := range ids {
+		for _, v := range s.db.lookup("parent", fmt.Sprint(id)) {
+			before := v
+			v.parent = survivor
+			if err := s.db.update(v); err != nil {
+				return undo(err)
+			}
+			written = append(written, before)
+			events = append(events, itemUpdated{before: before, after: v})
+		}
+	}
+	s.stock = make(map[stockKey]int, len(oldStock))
+	for key, qty := range oldStock {
+		s.stock[key] = qty
+	}
+	s.ledger = append([]ledgerEntry(nil), oldLedger...)
+	s.reservations = append([]reservation(nil), oldReservations...)
+	for key, qty := range s.stock {
+		if _, ok := gone[key.id]; ok {
+			s.stock[stockKey{survivor, key.warehouse}] += qty
+			delete(s.stock, key)
+		}
+	}
+	for i := range s.ledger {
+		s.ledger[i].id = to(s.ledger[i].id)
+	}
+	for i := range s.reservations {
+		s.reservations[i].item = to(s.reservations[i].item)
+	}
+	for _, o := range s.orders {
+		o.lines = append([]orderLine(nil), o.lines...)
+		for i := range o.lines {
+			o.lines[i].item = to(o.lines[i].item)
+		}
+	}
+	// two snapshots of the same day now describe one item, add them up
+	var snapshots []stockLevel
+	at := map[[2]any]int{}
+	for _, l := range s.snapshots {
+		l.key.id = to(l.key.id)
+		k := [2]any{l.day, l.key}
+		if i, ok := at[k]; ok {
+			snapshots[i].qty += l.qty
+			snapshots[i].used += l.used
+			snapshots[i].received += l.received
+			continue
+		}
+		at[k] = len(snapshots)
+		snapshots = append(snapshots, l)
+	}
+	s.snapshots = snapshots
+	if err := s.saveChangedLocked(saved); err != nil {
+		return undo(err)
+	}
+	// the survivor keeps its own custom values and attachments, and picks up the ones it lacks
+	before := keep
+	kept := keep
+	kept.custom = map[string]string{}
+	for k, v := range keep.custom {
+		kept.custom[k] = v
+	}
+	kept.attachments = append([]attachment(nil), keep.attachments...)
+	changed := false
+	for _, id := range ids {
+		for k, v := range gone[id].custom {
+			if _, ok := kept.custom[k]; !ok {
+				kept.custom[k] = v
+				changed = true
+			}
+		}
+		for _, a := range gone[id].attachments {
+			have := false
+			for _, k := range kept.attachments {
+				have = have || k.name == a.name
+			}
+			if !have {
+				kept.attachments = append(kept.attachments, a)
+				changed = true
+			}
+		}
+	}
+	if changed {
+		if err := s.db.update(kept); err != nil {
+			return undo(err)
+		}
+		written = append(written, before)
+		events = append(events, itemUpdated{before: before, after: kept})
+	}
+
+	for _, id := range ids {
+		if err := s.db.delete(id); err != nil {
+			return undo(err)
+		}
+		deleted = append(deleted, gone[id])
+		events = append(events, itemDeleted{item: gone[id]})
+	}
+	events = append(events, itemMerged{survivor: survivor, merged: ids})
+	for _, ev := range events {
+		s.emitLocked(ev)
+	}
+	s.mu.Unlock()
+	s.flushEvents()
+	return nil
+}
+
+// itemMerged comes after the itemDeleted events of the duplicates
+type itemMerged struct {
+	survivor int64
+	merged   []int64
+}
+
+func (e itemMerged) itemID() int64 { return e.survivor }
+func (e itemMerged) describe() string {
+	return fmt.Sprintf("merged %v into id: %v", e.merged, e.survivor)
+}
+
+func init() {
+	commands["duplicates"] = command{
+		usage: "duplicates [threshold]",
+		run: func(s *System, args []string) error {
+			threshold := duplicateThreshold
+			if len(args) == 1 {
+				if _, err := fmt.Sscan(args[0], &threshold); err != nil {
+					return errUsage
+				}
+			} else if len(args) > 1 {
+				return errUsage
+			}
+			groups := s.scanDuplicates(threshold)
+			for i, g := range groups {
+				fmt.Printf("%v| %v\n", i, g.info())
+			}
+			fmt.Printf("%v group(s) at threshold %v\n", len(groups), threshold)
+			return nil
+		},
+	}
+}
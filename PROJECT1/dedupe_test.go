@@ -0,0 +1,170 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// flakyBackend fails removes from one table while armed
+type flakyBackend struct {
+	backend
+	failRemove string
+}
+
+var errFlaky = errors.New("disk went away")
+
+func (b *flakyBackend) remove(table string, key int64) error {
+	if table == b.failRemove {
+		return errFlaky
+	}
+	return b.backend.remove(table, key)
+}
+
+func TestCreateRefusesDuplicates(t *testing.T) {
+	s := &System{}
+	if err := s.createDB(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.createItem("Pizza Cutter", "Inventory", "RX01"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.createItem("Pizza-Cutter", "Inventory", "RX01"); !errors.Is(err, errLikelyDuplicate) {
+		t.Errorf("second cutter: got %v, want errLikelyDuplicate", err)
+	}
+	if _, err := s.createItemAnyway("Pizza-Cutter", "Inventory", "RX01"); err != nil {
+		t.Errorf("create anyway: %v", err)
+	}
+	if _, err := s.createItem("Table 1", "Inventory", "RX01"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.createItem("Table 2", "Inventory", "RX01"); err != nil {
+		t.Errorf("numbered tables are different items: %v", err)
+	}
+}
+
+func TestMergeRollsBackAndTakesIDsOnce(t *testing.T) {
+	store := &flakyBackend{backend: newMemoryBackend()}
+	s := &System{store: store}
+	if err := s.createDB(); err != nil {
+		t.Fatal(err)
+	}
+	keep, _ := s.createItem("Pizza Cutter", "Inventory", "RX01")
+	dup, _ := s.createItemAnyway("pizza cutters", "Inventory", "RX01")
+	s.receive(keep, "RX01", 2, "delivery")
+	s.receive(dup, "RX01", 3, "delivery")
+
+	store.failRemove = "items"
+	if err := s.mergeItems(keep, dup); !errors.Is(err, errFlaky) {
+		t.Fatalf("merge with a failing delete: got %v", err)
+	}
+	if s.onHand(keep, "RX01") != 2 || s.onHand(dup, "RX01") != 3 || !s.db.has(dup) {
+		t.Errorf("failed merge left keep=%v dup=%v", s.onHand(keep, "RX01"), s.onHand(dup, "RX01"))
+	}
+	reopened := &System{store: store}
+	if err := reopened.createDB(); err != nil {
+		t.Fatal(err)
+	}
+	if reopened.onHand(dup, "RX01") != 3 {
+		t.Errorf("backend after the failed merge: dup has %v", reopened.onHand(dup, "RX01"))
+	}
+
+	store.failRemove = ""
+	if err := s.mergeItems(keep, dup, dup); err != nil {
+		t.Fatalf("merge with the id twice: %v", err)
+	}
+	if s.onHand(keep, "RX01") != 5 || s.db.has(dup) {
+		t.Errorf("after merge: keep has %v, dup still there %v", s.onHand(keep, "RX01"), s.db.has(dup))
+	}
+}
+
+// two merged kits with recipes, the lower id's recipe is the one that stays
+func TestMergeBOMPickIsStable(t *testing.T) {
+	for round := 0; round < 20; round++ {
+		s := &System{}
+		if err := s.createDB(); err != nil {
+			t.Fatal(err)
+		}
+		keep, _ := s.createItem("Delivery Kit", "Inventory", "RX01")
+		a, _ := s.createItemAnyway("delivery kits", "Inventory", "RX01")
+		b, _ := s.createItemAnyway("Delivery-Kit", "Inventory", "RX01")
+		box, _ := s.createItem("Pizza Box", "Inventory", "RX01")
+		bag, _ := s.createItem("Thermal Bag", "Inventory", "RX01")
+		s.defineBOM(a, []bomLine{{component: box, qty: 1}})
+		s.defineBOM(b, []bomLine{{component: bag, qty: 1}})
+		if err := s.mergeItems(keep, a, b); err != nil {
+			t.Fatal(err)
+		}
+		want := box
+		if b < a {
+			want = bag
+		}
+		if got := s.boms[keep].lines[0].component; got != want {
+			t.Fatalf("round %v: survivor got recipe with %v, want %v", round, got, want)
+		}
+	}
+}
+
+// a variant merged with its parent would end up as its own parent
+func TestMergeRefusesItsOwnParent(t *testing.T) {
+	s := &System{}
+	if err := s.createDB(); err != nil {
+		t.Fatal(err)
+	}
+	shirt, _ := s.createItem("Uniform Shirt", "Staff", "RX02")
+	m, err := s.createVariant(shirt, map[string]string{"size": "M"}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.mergeItems(m, shirt); !errors.Is(err, errMergeParent) {
+		t.Fatalf("variant taking over its parent: got %v, want errMergeParent", err)
+	}
+	if v, _ := s.findItem(m); v.parent != shirt || !s.db.has(shirt) {
+		t.Errorf("after the refused merge: variant parent %v, shirt there %v", v.parent, s.db.has(shirt))
+	}
+}
+
+// putCounter counts the puts per table
+type putCounter struct {
+	backend
+	puts map[string]int
+}
+
+func (b *putCounter) put(table string, key int64, data []byte) error {
+	b.puts[table]++
+	return b.backend.put(table, key, data)
+}
+
+// a merge writes the rows it changed, the rest of the shop's stock and ledger stays as it is
+func TestMergeWritesOnlyChangedRows(t *testing.T) {
+	store := &putCounter{backend: newMemoryBackend(), puts: map[string]int{}}
+	s := &System{store: store, clock: func() time.Time { return time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC) }}
+	if err := s.createDB(); err != nil {
+		t.Fatal(err)
+	}
+	keep, _ := s.createItem("Pizza Cutter", "Inventory", "RX01")
+	dup, _ := s.createItemAnyway("pizza cutters", "Inventory", "RX01")
+	flour, _ := s.createItem("Flour Bag", "Inventory", "RX04")
+	for i := 0; i < 10; i++ {
+		s.receive(flour, "RX04", 1, "delivery")
+	}
+	s.receive(keep, "RX01", 2, "delivery")
+	s.receive(dup, "RX01", 3, "delivery")
+	clear(store.puts)
+
+	if err := s.mergeItems(keep, dup); err != nil {
+		t.Fatal(err)
+	}
+	// the dup's one ledger line gets the survivor's id, the survivor's stock row its new number
+	if store.puts[ledgerTable] != 1 || store.puts[stockTable] != 1 {
+		t.Errorf("rows written: %v", store.puts)
+	}
+	reopened := &System{store: store}
+	if err := reopened.createDB(); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(reopened.stock, s.stock) || !reflect.DeepEqual(reopened.ledger, s.ledger) {
+		t.Errorf("backend after the merge:\n  stock %v\n  ledger %v", reopened.stock, reopened.ledger)
+	}
+}
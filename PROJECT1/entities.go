@@ -0,0 +1,202 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ENTITIES
+// Everything the repository stores. Each type brings its own key, validation and json encoding,
+// the fields stay unexported so every type has a small record struct just for json.
+
+var (
+	errNoName   = errors.New("name can't be empty")
+	errBadID    = errors.New("id must be positive")
+	errBadCode  = errors.New("warehouse code must be 4 letters/digits")
+	errBadEmail = errors.New("supplier email looks wrong")
+	errLeadTime = errors.New("lead time can't be negative")
+)
+
+// ITEM
+
+type itemRecord struct {
+	Item        string             `json:"item"`
+	Category    string             `json:"category"`
+	Warehouse   string             `json:"warehouse"`
+	ID          int64              `json:"id"`
+	Parent      int64              `json:"parent,omitempty"`
+	Options     map[string]string  `json:"options,omitempty"`
+	Bin         string             `json:"bin,omitempty"`
+	Custom      map[string]string  `json:"custom,omitempty"`
+	Attachments []attachmentRecord `json:"attachments,omitempty"`
+}
+
+func (i Item) key() int64 { return i.id }
+
+func (i Item) validate() error {
+	if strings.TrimSpace(i.item) == "" {
+		return errNoName
+	}
+	if i.id <= 0 {
+		return errBadID
+	}
+	return nil
+}
+
+func (i Item) marshal() ([]byte, error) {
+	r := itemRecord{Item: i.item, Category: i.Category, Warehouse: i.Warehouse, ID: i.id, Parent: i.parent, Options: i.options, Bin: i.bin, Custom: i.custom}
+	for _, a := range i.attachments {
+		r.Attachments = append(r.Attachments, attachmentRecord{Name: a.name, Hash: a.hash, Size: a.size, Type: a.contentType})
+	}
+	return json.Marshal(r)
+}
+
+func decodeItem(data []byte) (Item, error) {
+	var r itemRecord
+	if err := json.Unmarshal(data, &r); err != nil {
+		return Item{}, err
+	}
+	item := Item{item: r.Item, Category: r.Category, Warehouse: r.Warehouse, id: r.ID, parent: r.Parent, options: r.Options, bin: r.Bin, custom: r.Custom}
+	for _, a := range r.Attachments {
+		item.attachments = append(item.attachments, attachment{name: a.Name, hash: a.Hash, size: a.Size, contentType: a.Type})
+	}
+	return item, nil
+}
+
+// WAREHOUSE
+
+type Warehouse struct {
+	id   int64
+	code string // RX01, CDC1...
+	name string
+	site string // street address or whatever the shop calls it
+}
+
+type warehouseRecord struct {
+	ID   int64  `json:"id"`
+	Code string `json:"code"`
+	Name string `json:"name"`
+	Site string `json:"site"`
+}
+
+func (w Warehouse) info() string {
+	return fmt.Sprintf("warehouse: %v | name: %v | site: %v | id: %v", w.code, w.name, w.site, w.id)
+}
+func (w Warehouse) Storable() bool { return true }
+func (w Warehouse) key() int64     { return w.id }
+
+func (w Warehouse) validate() error {
+	if w.id <= 0 {
+		return errBadID
+	}
+	if len(w.code) != 4 || strings.Trim(w.code, "ABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789") != "" {
+		return errBadCode
+	}
+	return nil
+}
+
+func (w Warehouse) marshal() ([]byte, error) {
+	return json.Marshal(warehouseRecord{ID: w.id, Code: w.code, Name: w.name, Site: w.site})
+}
+
+func decodeWarehouse(data []byte) (Warehouse, error) {
+	var r warehouseRecord
+	if err := json.Unmarshal(data, &r); err != nil {
+		return Warehouse{}, err
+	}
+	return Warehouse{id: r.ID, code: r.Code, name: r.Name, site: r.Site}, nil
+}
+
+// SUPPLIER
+
+type Supplier struct {
+	id           int64
+	name         string
+	email        string
+	leadTimeDays int
+}
+
+type supplierRecord struct {
+	ID           int64  `json:"id"`
+	Name         string `json:"name"`
+	Email        string `json:"email"`
+	LeadTimeDays int    `json:"lead_time_days"`
+}
+
+func (s Supplier) info() string {
+	return fmt.Sprintf("supplier: %v | email: %v | lead time: %v days | id: %v", s.name, s.email, s.leadTimeDays, s.id)
+}
+func (s Supplier) Storable() bool { return true }
+func (s Supplier) key() int64     { return s.id }
+
+func (s Supplier) validate() error {
+	if s.id <= 0 {
+		return errBadID
+	}
+	if strings.TrimSpace(s.name) == "" {
+		return errNoName
+	}
+	if s.email != "" && (!strings.Contains(s.email, "@") || strings.HasPrefix(s.email, "@") || strings.HasSuffix(s.email, "@")) {
+		return errBadEmail
+	}
+	if s.leadTimeDays < 0 {
+		return errLeadTime
+	}
+	return nil
+}
+
+func (s Supplier) marshal() ([]byte, error) {
+	return json.Marshal(supplierRecord{ID: s.id, Name: s.name, Email: s.email, LeadTimeDays: s.leadTimeDays})
+}
+
+func decodeSupplier(data []byte) (Supplier, error) {
+	var r supplierRecord
+	if err := json.Unmarshal(data, &r); err != nil {
+		return Supplier{}, err
+	}
+	return Supplier{id: r.ID, name: r.Name, email: r.Email, leadTimeDays: r.LeadTimeDays}, nil
+}
+
+// addWarehouse checks the code and creates under one lock, two callers can't both add RX01
+func (s *System) addWarehouse(code, name, site string) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.warehouseDB.lookup("code", code)) > 0 {
+		return 0, errDuplicateKey
+	}
+	w := Warehouse{id: s.newID(), code: code, name: name, site: site}
+	for s.warehouseDB.has(w.id) {
+		w.id = s.newID()
+	}
+	if err := s.warehouseDB.create(w); err != nil {
+		return 0, err
+	}
+	return w.id, nil
+}
+
+func (s *System) warehouseByCode(code string) (Warehouse, bool) {
+	found := s.warehouseDB.lookup("code", code)
+	if len(found) == 0 {
+		return Warehouse{}, false
+	}
+	return found[0], true
+}
+
+func (s *System) addSupplier(name, email string, leadTimeDays int) (int64, error) {
+	sup := Supplier{id: s.newID(), name: name, email: email, leadTimeDays: leadTimeDays}
+	if err := s.supplierDB.create(sup); err != nil {
+		return 0, err
+	}
+	return sup.id, nil
+}
+
+// readAll prints any repository the same way readItems prints items
+func readAll[T entity](r *repository[T]) string {
+	wholeStr := ""
+	for i, v := range r.all() {
+		wholeStr += fmt.Sprintf("%v| %v\n", i, v.info())
+	}
+	return wholeStr
+}
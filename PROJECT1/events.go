@@ -0,0 +1,412 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// CHANGE EVENTS
+// Every mutation on System (create, update, delete, move) is turned into a typed event
+// and published on an eventBus. Subscribers get their events over a go channel.
+// Same trick as the notification interface in part3 -> use a type switch to tell them apart.
+
+type changeEvent interface {
+	itemID() int64
+	describe() string
+}
+
+type itemCreated struct {
+	item Item
+}
+
+type itemUpdated struct {
+	before Item
+	after  Item
+}
+
+type itemDeleted struct {
+	item Item
+}
+
+type itemMoved struct {
+	id      int64
+	from    string
+	to      string
+	fromBin string // the bin it left, moving to another warehouse clears it
+}
+
+func (e itemCreated) itemID() int64 { return e.item.id }
+func (e itemUpdated) itemID() int64 { return e.after.id }
+func (e itemDeleted) itemID() int64 { return e.item.id }
+func (e itemMoved) itemID() int64   { return e.id }
+
+func (e itemCreated) describe() string { return "created " + e.item.info() }
+func (e itemUpdated) describe() string {
+	return fmt.Sprintf("updated %v -> %v", e.before.info(), e.after.info())
+}
+func (e itemDeleted) describe() string { return "deleted " + e.item.info() }
+func (e itemMoved) describe() string {
+	return fmt.Sprintf("moved id: %v from %v to %v", e.id, e.from, e.to)
+}
+
+// eventRecord is what subscribers actually receive, the offset is the position in the bus log
+type eventRecord struct {
+	offset int64
+	at     time.Time
+	event  changeEvent
+}
+
+// backpressure decides what happens when a subscriber's buffer is full
+type backpressure int
+
+const (
+	// writers wait until the subscriber catches up. A subscriber with this policy mustn't change the
+	// system from its own receive loop: once its buffer is full it would be waiting on itself
+	blockPublisher backpressure = iota
+	dropNewest                  // the incoming event is thrown away
+	dropOldest                  // the oldest buffered event is thrown away to make room
+	disconnectSlow              // the subscriber gets closed
+)
+
+// liveOnly as replayFrom means "don't replay anything, just give me new events"
+const liveOnly int64 = -1
+
+// defaultRetain is how much of the log newEventBus(0) keeps for replay, enough for a consumer
+// that restarts, without the log growing for as long as the process runs
+const defaultRetain = 10000
+
+var (
+	errOffsetTrimmed = errors.New("offset is older than the retained event log")
+	errOffsetAhead   = errors.New("offset is past the end of the event log")
+)
+
+type subOptions struct {
+	buffer     int          // channel capacity, 0 is treated as 1
+	policy     backpressure // what to do when the buffer is full
+	replayFrom int64        // first offset to deliver, or liveOnly
+}
+
+type subscription struct {
+	events  <-chan eventRecord
+	ch      chan eventRecord
+	policy  backpressure
+	done    chan struct{}
+	once    sync.Once
+	wg      sync.WaitGroup
+	dropped int64 // only touched under the bus lock
+
+	sendMu sync.Mutex // held while sending, finish takes it before closing ch
+	closed bool
+
+	// while replaying, live events wait here so nothing is skipped or reordered.
+	// The backlog is as big as the buffer and the policy applies to it like to the channel
+	replaying bool
+	backlog   []eventRecord
+}
+
+type eventBus struct {
+	mu      sync.Mutex
+	room    *sync.Cond // a replaying backlog got shorter or a subscriber went away
+	log     []eventRecord
+	base    int64 // offset of log[0]
+	next    int64 // offset the next event will get
+	routed  int64 // everything below this has been handed to the subscribers
+	pending []eventRecord
+	retain  int // how many records to keep for replay
+	subs    map[*subscription]bool
+
+	sendMu sync.Mutex // one flush at a time, so subscribers see offsets in order
+}
+
+func newEventBus(retain int) *eventBus {
+	if retain <= 0 {
+		retain = defaultRetain
+	}
+	b := &eventBus{retain: retain, subs: map[*subscription]bool{}}
+	b.room = sync.NewCond(&b.mu)
+	return b
+}
+
+// emitLocked must be called with s.mu held, right where the change is applied, so offsets follow
+// the order changes really happened in. It never blocks, the caller runs flushEvents after unlocking.
+// The event is also written to the history table (statetables.go), if that write fails the change
+// stands and only the point-in-time export misses it
+func (s *System) emitLocked(ev changeEvent) {
+	if s.store != nil {
+		s.saveHistoryLocked(s.now(), ev)
+	}
+	if s.events != nil {
+		s.events.append(ev)
+	}
+}
+
+// flushEvents hands queued events to the subscribers, call it with s.mu released
+func (s *System) flushEvents() {
+	if s.events != nil {
+		s.events.flush()
+	}
+}
+
+// append gives the event its offset and queues it for flush
+func (b *eventBus) append(ev changeEvent) eventRecord {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	rec := eventRecord{offset: b.next, at: time.Now(), event: ev}
+	b.next++
+	b.log = append(b.log, rec)
+	if len(b.log) >= 2*b.retain {
+		// trimmed in one go every retain records, not one copy per event
+		trim := len(b.log) - b.retain
+		b.log = append([]eventRecord(nil), b.log[trim:]...)
+		b.base += int64(trim)
+	}
+	b.pending = append(b.pending, rec)
+	return rec
+}
+
+// publish is append and flush in one go, for callers that hold no lock of their own
+func (b *eventBus) publish(ev changeEvent) eventRecord {
+	rec := b.append(ev)
+	b.flush()
+	return rec
+}
+
+// flush delivers everything pending, oldest first, and returns once the caller's events are out.
+// A flush already running may have taken them, waiting for it is what makes blockPublisher block
+// every writer and not only the one that happened to start flushing
+func (b *eventBus) flush() {
+	b.sendMu.Lock()
+	defer b.sendMu.Unlock()
+	for {
+		b.mu.Lock()
+		batch := b.pending
+		b.pending = nil
+		b.mu.Unlock()
+		if len(batch) == 0 {
+			return
+		}
+		for _, rec := range batch {
+			for _, sub := range b.route(rec) {
+				b.deliver(sub, rec)
+			}
+		}
+	}
+}
+
+// route parks rec in the backlog of replaying subscribers and returns the live ones
+func (b *eventBus) route(rec eventRecord) []*subscription {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.routed = rec.offset + 1
+	subs := make([]*subscription, 0, len(b.subs))
+	for sub := range b.subs {
+		subs = append(subs, sub)
+	}
+	var live []*subscription
+	for _, sub := range subs {
+		if !b.subs[sub] {
+			continue // went away while we waited on someone else's backlog
+		}
+		if !sub.replaying {
+			live = append(live, sub)
+			continue
+		}
+		b.backlogLocked(sub, rec)
+	}
+	return live
+}
+
+// backlogLocked applies the subscriber's policy to its replay backlog, b.mu must be held
+func (b *eventBus) backlogLocked(sub *subscription, rec eventRecord) {
+	limit := cap(sub.ch)
+	for sub.replaying && len(sub.backlog) >= limit {
+		switch sub.policy {
+		case blockPublisher:
+			select {
+			case <-sub.done:
+				return
+			default:
+			}
+			b.room.Wait()
+			continue
+		case dropNewest:
+			sub.dropped++
+			return
+		case dropOldest:
+			sub.backlog = sub.backlog[1:]
+			sub.dropped++
+			continue
+		case disconnectSlow:
+			sub.dropped++
+			b.disconnectLocked(sub)
+			return
+		}
+	}
+	if !sub.replaying {
+		// the replay finished while we waited, the channel is the right place now
+		b.mu.Unlock()
+		b.deliver(sub, rec)
+		b.mu.Lock()
+		return
+	}
+	sub.backlog = append(sub.backlog, rec)
+}
+
+// disconnectLocked drops a subscriber from the bus, b.mu must be held
+func (b *eventBus) disconnectLocked(sub *subscription) {
+	if !b.subs[sub] {
+		return
+	}
+	delete(b.subs, sub)
+	sub.once.Do(func() { close(sub.done) })
+	b.room.Broadcast()
+	go b.finish(sub)
+}
+
+// deliver runs without b.mu (a blocked subscriber mustn't stall subscribe and friends),
+// the subscription's own sendMu keeps it from racing finish closing the channel
+func (b *eventBus) deliver(sub *subscription, rec eventRecord) {
+	sub.sendMu.Lock()
+	defer sub.sendMu.Unlock()
+	if sub.closed {
+		return
+	}
+	switch sub.policy {
+	case blockPublisher:
+		select {
+		case sub.ch <- rec:
+		case <-sub.done:
+		}
+	case dropNewest:
+		select {
+		case sub.ch <- rec:
+		default:
+			b.countDrop(sub)
+		}
+	case dropOldest:
+		for {
+			select {
+			case sub.ch <- rec:
+				return
+			default:
+			}
+			select {
+			case <-sub.ch:
+				b.countDrop(sub)
+			default:
+			}
+		}
+	case disconnectSlow:
+		select {
+		case sub.ch <- rec:
+		default:
+			b.mu.Lock()
+			sub.dropped++
+			b.disconnectLocked(sub)
+			b.mu.Unlock()
+		}
+	}
+}
+
+func (b *eventBus) countDrop(sub *subscription) {
+	b.mu.Lock()
+	sub.dropped++
+	b.mu.Unlock()
+}
+
+// subscribe registers a new consumer. With replayFrom set, everything from that offset
+// is sent first (this is for consumers that restart and remember where they were)
+func (b *eventBus) subscribe(opts subOptions) (*subscription, error) {
+	if opts.buffer < 1 {
+		opts.buffer = 1
+	}
+	ch := make(chan eventRecord, opts.buffer)
+	sub := &subscription{events: ch, ch: ch, policy: opts.policy, done: make(chan struct{})}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if opts.replayFrom == liveOnly {
+		b.subs[sub] = true
+		return sub, nil
+	}
+	if opts.replayFrom < b.base {
+		return nil, errOffsetTrimmed
+	}
+	if opts.replayFrom > b.next {
+		return nil, errOffsetAhead
+	}
+	// history stops where routing is, anything after that reaches us through the backlog
+	var history []eventRecord
+	if opts.replayFrom < b.routed {
+		history = append(history, b.log[opts.replayFrom-b.base:b.routed-b.base]...)
+	}
+	sub.replaying = true
+	b.subs[sub] = true
+	sub.wg.Add(1)
+	go b.replay(sub, history)
+	return sub, nil
+}
+
+// replay pushes history, then whatever piled up in the backlog, then hands the sub back to flush
+func (b *eventBus) replay(sub *subscription, history []eventRecord) {
+	defer sub.wg.Done()
+	pending := history
+	for {
+		for _, rec := range pending {
+			select {
+			case sub.ch <- rec:
+			case <-sub.done:
+				return
+			}
+		}
+		b.mu.Lock()
+		if len(sub.backlog) == 0 {
+			sub.replaying = false
+			b.room.Broadcast()
+			b.mu.Unlock()
+			return
+		}
+		pending = sub.backlog
+		sub.backlog = nil
+		b.room.Broadcast()
+		b.mu.Unlock()
+	}
+}
+
+// unsubscribe stops delivery and closes the events channel
+func (b *eventBus) unsubscribe(sub *subscription) {
+	sub.once.Do(func() { close(sub.done) })
+	b.mu.Lock()
+	_, live := b.subs[sub]
+	delete(b.subs, sub)
+	b.room.Broadcast()
+	b.mu.Unlock()
+	if live {
+		b.finish(sub)
+	}
+}
+
+// finish waits for a running replay and any send in flight to bail out, then closes the channel
+func (b *eventBus) finish(sub *subscription) {
+	sub.wg.Wait()
+	sub.sendMu.Lock()
+	sub.closed = true
+	close(sub.ch)
+	sub.sendMu.Unlock()
+}
+
+// droppedCount tells how many events this subscriber lost to back-pressure
+func (b *eventBus) droppedCount(sub *subscription) int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return sub.dropped
+}
+
+// headOffset is the offset the next published event will get
+func (b *eventBus) headOffset() int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.next
+}
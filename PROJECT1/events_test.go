@@ -0,0 +1,151 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// writers racing each other still hand every subscriber the events in offset order, none missing
+func TestEventOrderAcrossWriters(t *testing.T) {
+	s := &System{}
+	if err := s.createDB(); err != nil {
+		t.Fatal(err)
+	}
+	const writers, each = 8, 25
+	sub, err := s.events.subscribe(subOptions{buffer: writers * each, policy: blockPublisher, replayFrom: liveOnly})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < each; i++ {
+				if _, err := s.createItemAnyway(fmt.Sprintf("Plate %v-%v", w, i), "Inventory", "RX01"); err != nil {
+					t.Error(err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	s.events.unsubscribe(sub)
+	next, created := int64(-1), 0
+	for rec := range sub.events {
+		if next >= 0 && rec.offset != next {
+			t.Fatalf("offset %v after %v", rec.offset, next-1)
+		}
+		next = rec.offset + 1
+		if _, ok := rec.event.(itemCreated); ok {
+			created++
+		}
+	}
+	if created != writers*each {
+		t.Errorf("created events: got %v, want %v", created, writers*each)
+	}
+}
+
+func returnsWithin(d time.Duration, done <-chan struct{}) bool {
+	select {
+	case <-done:
+		return true
+	case <-time.After(d):
+		return false
+	}
+}
+
+// with blockPublisher every writer waits for the slow subscriber, not only the one that is flushing
+func TestBlockPublisherBlocksEveryWriter(t *testing.T) {
+	b := newEventBus(0)
+	sub, err := b.subscribe(subOptions{buffer: 1, policy: blockPublisher, replayFrom: liveOnly})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.publish(itemDeleted{item: Item{id: 1}}) // fills the buffer
+	first, second := make(chan struct{}), make(chan struct{})
+	go func() {
+		b.publish(itemDeleted{item: Item{id: 2}})
+		close(first)
+	}()
+	go func() {
+		b.publish(itemDeleted{item: Item{id: 3}})
+		close(second)
+	}()
+	if returnsWithin(50*time.Millisecond, first) || returnsWithin(50*time.Millisecond, second) {
+		t.Fatal("a writer went on while the subscriber was full")
+	}
+	var got []int64
+	for len(got) < 3 {
+		got = append(got, (<-sub.events).offset)
+	}
+	if !returnsWithin(time.Second, first) || !returnsWithin(time.Second, second) {
+		t.Fatal("writers still blocked after the subscriber caught up")
+	}
+	for i, off := range got {
+		if off != int64(i) {
+			t.Errorf("got offsets %v, want 0 1 2", got)
+			break
+		}
+	}
+	b.unsubscribe(sub)
+}
+
+func TestBackpressurePolicies(t *testing.T) {
+	for _, tc := range []struct {
+		policy      backpressure
+		wantOffsets []int64
+		wantDropped int64
+	}{
+		{dropNewest, []int64{0, 1}, 3},
+		{dropOldest, []int64{3, 4}, 3},
+		{disconnectSlow, []int64{0, 1}, 1},
+	} {
+		b := newEventBus(0)
+		sub, err := b.subscribe(subOptions{buffer: 2, policy: tc.policy, replayFrom: liveOnly})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 5; i++ {
+			b.publish(itemDeleted{item: Item{id: int64(i)}})
+		}
+		dropped := b.droppedCount(sub)
+		b.unsubscribe(sub)
+		var got []int64
+		for rec := range sub.events {
+			got = append(got, rec.offset)
+		}
+		if fmt.Sprint(got) != fmt.Sprint(tc.wantOffsets) || dropped != tc.wantDropped {
+			t.Errorf("policy %v: got %v dropped %v, want %v dropped %v", tc.policy, got, dropped, tc.wantOffsets, tc.wantDropped)
+		}
+	}
+}
+
+// the log is bounded, replaying from before what is kept is refused
+func TestRetainTrimsTheLog(t *testing.T) {
+	b := newEventBus(10)
+	for i := 0; i < 100; i++ {
+		b.publish(itemDeleted{item: Item{id: int64(i)}})
+	}
+	b.mu.Lock()
+	kept := len(b.log)
+	b.mu.Unlock()
+	if kept >= 20 {
+		t.Errorf("log holds %v records with retain 10", kept)
+	}
+	if _, err := b.subscribe(subOptions{replayFrom: 0}); !errors.Is(err, errOffsetTrimmed) {
+		t.Errorf("replay from 0: got %v, want errOffsetTrimmed", err)
+	}
+	sub, err := b.subscribe(subOptions{buffer: 10, replayFrom: 90})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for want := int64(90); want < 100; want++ {
+		if rec := <-sub.events; rec.offset != want {
+			t.Fatalf("replayed %v, want %v", rec.offset, want)
+		}
+	}
+	b.unsubscribe(sub)
+}
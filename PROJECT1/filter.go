@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// FILTERS
+// One filter type for everything that lists items (the tui, reports...).
+// Empty fields match everything, a category also matches everything under it.
+
+type itemFilter struct {
+	text      string // part of the name or sku, any case
+	category  string
+	warehouse string
+	attrs     []attrCondition // custom attributes, all must hold (attributes.go)
+}
+
+func (f itemFilter) empty() bool {
+	return f.text == "" && f.category == "" && f.warehouse == "" && len(f.attrs) == 0
+}
+
+func (f itemFilter) String() string {
+	var parts []string
+	if f.text != "" {
+		parts = append(parts, fmt.Sprintf("%q", f.text))
+	}
+	if f.category != "" {
+		parts = append(parts, "category: "+f.category)
+	}
+	if f.warehouse != "" {
+		parts = append(parts, "warehouse: "+f.warehouse)
+	}
+	for _, c := range f.attrs {
+		parts = append(parts, c.String())
+	}
+	if len(parts) == 0 {
+		return "everything"
+	}
+	return strings.Join(parts, " | ")
+}
+
+// matchesLocked must be called with s.mu held, the category tree is read
+func (s *System) matchesLocked(f itemFilter, item Item) bool {
+	if f.warehouse != "" && item.Warehouse != f.warehouse {
+		return false
+	}
+	if f.category != "" {
+		node, ok := s.categories.find(item.Category)
+		if !ok {
+			if item.Category != f.category {
+				return false
+			}
+		} else if !node.within(f.category) {
+			return false
+		}
+	}
+	if f.text != "" {
+		text := strings.ToLower(f.text)
+		if !strings.Contains(strings.ToLower(item.item), text) && !strings.Contains(strings.ToLower(item.sku()), text) {
+			return false
+		}
+	}
+	for _, c := range f.attrs {
+		if !s.conditionMatchesLocked(c, item) {
+			return false
+		}
+	}
+	return true
+}
+
+// filterItems lists the matching items in the usual order
+func (s *System) filterItems(f itemFilter) []Item {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var items []Item
+	for _, item := range s.db.all() {
+		if s.matchesLocked(f, item) {
+			items = append(items, item)
+		}
+	}
+	return items
+}
@@ -0,0 +1,354 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// FIXTURES
+// Same seed, same inventory: names, ids, warehouses, variants and stock all come out of
+// seeded sources, and every timestamp is taken from a frozen clock. Good for demos, examples and load tests.
+// The shop main used to hardcode is the "pizza-shop" preset.
+
+var errUnknownPreset = errors.New("unknown fixture preset")
+
+// fixtureEpoch is "now" while fixtures are generated, so ledgers and saved files don't change between runs
+var fixtureEpoch = time.Date(2024, 1, 1, 9, 0, 0, 0, time.UTC)
+
+type weighted struct {
+	value  string
+	weight int
+}
+
+type fixtureItem struct {
+	item      string
+	category  string
+	warehouse string
+}
+
+type fixtureSpec struct {
+	seed         int64
+	items        int        // generated items, on top of the fixed ones
+	categories   []weighted // "Inventory > Toppings" is fine, missing categories get created, none means the 4 defaults
+	warehouses   []weighted // none means evenWarehouses
+	variantShare float64    // share of Staff items that come in S/M/L
+	stockMax     int        // every generated item gets 0..stockMax on hand, 0 means no stock at all
+	fixed        []fixtureItem
+}
+
+var pizzaShopItems = []fixtureItem{
+	{"pizza", "Inventory", ""},
+	{"Pizza Cutter", "Inventory", "RX01"},
+	{"Cheese Grater", "Inventory", "CDC1"},
+	{"Oven Mitt", "Maintenance", "RX04"},
+	{"Pizza Box", "Maintenance", "RX01"},
+	{"Pepperoni Slicer", "Inventory", "RX02"},
+	{"Mozzarella Block", "Inventory", "RX03"},
+	{"Tomato Sauce Can", "Inventory", "CDC1"},
+	{"Delivery Scooter", "Entertainment", "RX04"},
+	{"Cash Register", "Staff", "RX03"},
+	{"Arcade Machine", "Entertainment", "RX01"},
+	{"Uniform Shirt", "Staff", "RX02"},
+	{"Mop Bucket", "Maintenance", "RX01"},
+	{"Flour Bag", "Inventory", "RX04"},
+	{"Sauce Ladle", "Inventory", "RX02"},
+	{"Pizza Peel", "Inventory", "RX03"},
+	{"Rolling Pin", "Inventory", "CDC1"},
+	{"Deep Fryer", "Maintenance", "RX04"},
+	{"Receipt Printer", "Staff", "RX02"},
+	{"Plastic Crates", "Inventory", "RX01"},
+	{"Walkie Talkie", "Staff", "CDC1"},
+	{"First Aid Kit", "Maintenance", "RX03"},
+	{"Cleaning Spray", "Maintenance", "RX01"},
+	{"Loyalty Card Scanner", "Staff", "RX04"},
+	{"Measuring Cup", "Inventory", "RX02"},
+	{"Spatula", "Inventory", "RX03"},
+	{"Apron", "Staff", "CDC1"},
+	{"Sound System", "Entertainment", "RX01"},
+	{"Grease Trap", "Maintenance", "RX03"},
+	{"Serving Tray", "Inventory", "RX02"},
+	{"Fire Extinguisher", "Maintenance", "RX04"},
+	{"Chef Hat", "Staff", "RX01"},
+	{"Cutting Board", "Inventory", "RX03"},
+	{"Timer", "Maintenance", "RX02"},
+	{"Thermometer", "Maintenance", "RX04"},
+	{"Chair", "Inventory", "CDC1"},
+	{"Table", "Inventory", "RX01"},
+	{"Napkin Dispenser", "Inventory", "RX02"},
+	{"Hand Sanitizer", "Maintenance", "RX03"},
+	{"Toolbox", "Maintenance", "RX04"},
+	{"Fan", "Maintenance", "RX01"},
+	{"Light Bulb", "Maintenance", "RX02"},
+	{"Shelf", "Inventory", "RX03"},
+	{"Storage Bin", "Inventory", "RX04"},
+	{"Trash Can", "Maintenance", "RX01"},
+	{"Soap Dispenser", "Maintenance", "CDC1"},
+	{"Credit Card Reader", "Staff", "RX02"},
+	{"Mask Box", "Staff", "RX03"},
+	{"Pizza Dough Ball", "Inventory", "RX01"},
+	{"Drink Cooler", "Inventory", "RX04"},
+	{"Receipt Roll", "Staff", "CDC1"},
+}
+
+var evenWarehouses = []weighted{{"RX01", 1}, {"RX02", 1}, {"RX03", 1}, {"RX04", 1}, {"CDC1", 1}}
+
+var fixturePresets = map[string]fixtureSpec{
+	"pizza-shop": {seed: 51, fixed: pizzaShopItems},
+	"small-shop": {
+		seed: 7, items: 120,
+		categories:   []weighted{{"Inventory", 5}, {"Inventory > Toppings", 3}, {"Maintenance", 2}, {"Staff", 2}, {"Entertainment", 1}},
+		warehouses:   []weighted{{"RX01", 3}, {"RX02", 2}, {"CDC1", 1}},
+		variantShare: 0.3, stockMax: 40,
+	},
+	"load-test": {
+		seed: 1, items: 20000,
+		categories:   []weighted{{"Inventory", 6}, {"Inventory > Toppings", 2}, {"Inventory > Drinks", 2}, {"Maintenance", 3}, {"Staff", 2}, {"Staff > Clothing", 1}, {"Entertainment", 1}},
+		warehouses:   evenWarehouses,
+		variantShare: 0.2, stockMax: 500,
+	},
+}
+
+// words for generated names, keyed by top level category
+var fixtureWords = map[string][2][]string{
+	"Inventory": {
+		{"Fresh", "Frozen", "Large", "Small", "Organic", "Spicy", "Smoked", "Bulk", "Imported", "House"},
+		{"Basil", "Olive Oil", "Flour Bag", "Yeast", "Mozzarella", "Pepperoni", "Mushrooms", "Olives", "Oregano", "Pizza Box", "Napkins", "Soda Crate"},
+	},
+	"Maintenance": {
+		{"Heavy Duty", "Spare", "Industrial", "Compact", "Steel", "Plastic"},
+		{"Mop", "Broom", "Degreaser", "Oven Brush", "Fuse", "Hinge", "Drain Cleaner", "Glove Box", "Filter"},
+	},
+	"Staff": {
+		{"Uniform", "Kitchen", "Delivery", "Branded", "Winter"},
+		{"Shirt", "Cap", "Jacket", "Apron", "Name Tag", "Headset", "Tablet"},
+	},
+	"Entertainment": {
+		{"Retro", "Kids", "Outdoor", "Neon"},
+		{"Arcade Cabinet", "Jukebox", "Board Game", "Speaker", "Dart Board"},
+	},
+}
+
+// pickable is false when pickWeighted could only return ""
+func pickable(choices []weighted) bool {
+	for _, c := range choices {
+		if c.weight > 0 && c.value != "" {
+			return true
+		}
+	}
+	return false
+}
+
+func pickWeighted(rng *rand.Rand, choices []weighted) string {
+	total := 0
+	for _, c := range choices {
+		total += c.weight
+	}
+	if total <= 0 {
+		return ""
+	}
+	n := rng.Intn(total)
+	for _, c := range choices {
+		if n < c.weight {
+			return c.value
+		}
+		n -= c.weight
+	}
+	return choices[len(choices)-1].value
+}
+
+// topCategory is "Inventory" for "Inventory > Toppings", "" for an empty path
+func topCategory(path string) string {
+	if parts := splitCategoryPath(path); len(parts) > 0 {
+		return parts[0]
+	}
+	return ""
+}
+
+func fixtureName(rng *rand.Rand, category string, used map[string]int) string {
+	words, ok := fixtureWords[topCategory(category)]
+	if !ok {
+		words = fixtureWords[defaultCategories[0]]
+	}
+	name := words[0][rng.Intn(len(words[0]))] + " " + words[1][rng.Intn(len(words[1]))]
+	used[name]++
+	if n := used[name]; n > 1 {
+		name = fmt.Sprintf("%v %v", name, n)
+	}
+	return name
+}
+
+// seedFixture fills s from the spec, s must not have been set up yet.
+// Generated names repeat on purpose, so the duplicate check is skipped
+func seedFixture(s *System, spec fixtureSpec) error {
+	s.ids = rand.New(rand.NewSource(spec.seed))
+	rng := rand.New(rand.NewSource(spec.seed ^ 0x5eed))
+	clock := s.clock
+	s.clock = func() time.Time { return fixtureEpoch }
+	defer func() { s.clock = clock }()
+	if err := s.createDB(); err != nil {
+		return err
+	}
+	for _, f := range spec.fixed {
+		if _, err := s.createItemAnyway(f.item, f.category, f.warehouse); err != nil {
+			return fmt.Errorf("fixture item %q: %w", f.item, err)
+		}
+	}
+	if spec.items == 0 {
+		return nil
+	}
+	// presets made for fixed items only (pizza-shop) can still be asked for generated ones
+	if pickable(spec.categories) {
+		var paths []string
+		for _, c := range spec.categories {
+			paths = append(paths, c.value)
+		}
+		for _, path := range sortedCategoryPaths(paths) {
+			if err := s.addCategory(path, nil); err != nil && !errors.Is(err, errCategoryExists) {
+				return fmt.Errorf("fixture category %q: %w", path, err)
+			}
+		}
+	} else {
+		spec.categories = nil
+		for _, name := range defaultCategories {
+			spec.categories = append(spec.categories, weighted{name, 1})
+		}
+	}
+	if !pickable(spec.warehouses) {
+		spec.warehouses = evenWarehouses
+	}
+	for _, w := range spec.warehouses {
+		if _, ok := s.warehouseByCode(w.value); !ok {
+			if _, err := s.addWarehouse(w.value, "Warehouse "+w.value, ""); err != nil {
+				return err
+			}
+		}
+	}
+
+	used := map[string]int{}
+	for i := 0; i < spec.items; i++ {
+		category := pickWeighted(rng, spec.categories)
+		warehouse := pickWeighted(rng, spec.warehouses)
+		id, err := s.createItemAnyway(fixtureName(rng, category, used), category, warehouse)
+		if err != nil {
+			return fmt.Errorf("fixture item %v: %w", i, err)
+		}
+		stocked := []int64{id}
+		if topCategory(category) == "Staff" && rng.Float64() < spec.variantShare {
+			stocked = nil
+			for _, size := range []string{"S", "M", "L"} {
+				v, err := s.createVariant(id, map[string]string{"size": size}, "")
+				if err != nil {
+					return err
+				}
+				stocked = append(stocked, v)
+			}
+		}
+		if spec.stockMax <= 0 {
+			continue
+		}
+		for _, sid := range stocked {
+			if qty := rng.Intn(spec.stockMax + 1); qty > 0 {
+				if err := s.receive(sid, warehouse, qty, "fixture"); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// idOf finds an item by its exact name, 0 when there is none
+func (s *System) idOf(name string) int64 {
+	for _, item := range s.db.all() {
+		if item.item == name {
+			return item.id
+		}
+	}
+	return 0
+}
+
+func presetNames() string {
+	var names []string
+	for name := range fixturePresets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+func init() {
+	commands["fixture"] = command{
+		usage: "fixture <preset> [seed] [items] [out.json]   presets: " + presetNames(),
+		run: func(_ *System, args []string) error {
+			if len(args) < 1 || len(args) > 4 {
+				return errUsage
+			}
+			spec, ok := fixturePresets[args[0]]
+			if !ok {
+				return fmt.Errorf("%w %q, try one of %v", errUnknownPreset, args[0], presetNames())
+			}
+			out := ""
+			var nums []int64
+			for _, a := range args[1:] {
+				n, err := strconv.ParseInt(a, 10, 64)
+				if err != nil {
+					out = a
+					continue
+				}
+				nums = append(nums, n)
+			}
+			if len(nums) > 0 {
+				spec.seed = nums[0]
+			}
+			if len(nums) > 1 {
+				spec.items = int(nums[1])
+			}
+			s := &System{clock: func() time.Time { return fixtureEpoch }}
+			if err := seedFixture(s, spec); err != nil {
+				return err
+			}
+			data, err := s.encodeDataFile()
+			if err != nil {
+				return err
+			}
+			byCategory := map[string]int{}
+			byWarehouse := map[string]int{}
+			for _, item := range s.db.all() {
+				byCategory[item.Category]++
+				byWarehouse[item.Warehouse]++
+			}
+			fmt.Printf("%v: seed %v, %v items, %v stock rows, fingerprint %v\n", args[0], spec.seed, s.db.count(), len(s.stock), checksum(data)[:16])
+			fmt.Println("by category: ", countsString(byCategory))
+			fmt.Println("by warehouse:", countsString(byWarehouse))
+			if out != "" {
+				if err := writeFileAtomic(out, data); err != nil {
+					return err
+				}
+				fmt.Println("written to", out)
+			}
+			return nil
+		},
+	}
+}
+
+func countsString(counts map[string]int) string {
+	var keys []string
+	for k := range counts {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	parts := make([]string, len(keys))
+	for i, k := range keys {
+		name := k
+		if name == "" {
+			name = "(none)"
+		}
+		parts[i] = fmt.Sprintf("%v=%v", name, counts[k])
+	}
+	return strings.Join(parts, " ")
+}
@@ -0,0 +1,325 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+)
+
+// STOCK HISTORY AND FORECASTING
+// Once a day we write down how much of every item sat in every warehouse and how much of it was used.
+// Those snapshots give us a usage series per item, the forecasts turn that series into
+// "flour runs out on the 14th, order 40 bags".
+
+var errNoHistory = errors.New("not enough stock history to forecast")
+
+// stockLevel is one item in one warehouse at the end of one day
+type stockLevel struct {
+	day      time.Time // midnight, local time
+	key      stockKey
+	qty      int
+	used     int // everything that left that day
+	received int
+}
+
+func startOfDay(t time.Time) time.Time {
+	y, m, d := t.Date()
+	return time.Date(y, m, d, 0, 0, 0, 0, t.Location())
+}
+
+// levelsLocked works the closing levels of every day between from and to out of the ledger,
+// must be called with s.mu held
+func (s *System) levelsLocked(from, to time.Time) []stockLevel {
+	from, to = startOfDay(from), startOfDay(to)
+	type dayKey struct {
+		day time.Time
+		key stockKey
+	}
+	moves := map[dayKey]*stockLevel{}
+	balance := map[stockKey]int{}
+	for _, e := range s.ledger {
+		day := startOfDay(e.at)
+		if day.Before(from) {
+			balance[stockKey{e.id, e.warehouse}] += e.delta
+			continue
+		}
+		if day.After(to) {
+			continue
+		}
+		dk := dayKey{day, stockKey{e.id, e.warehouse}}
+		if moves[dk] == nil {
+			moves[dk] = &stockLevel{day: day, key: dk.key}
+		}
+		if e.delta < 0 {
+			moves[dk].used -= e.delta
+		} else {
+			moves[dk].received += e.delta
+		}
+	}
+	for dk := range moves {
+		if _, ok := balance[dk.key]; !ok {
+			balance[dk.key] = 0
+		}
+	}
+	var levels []stockLevel
+	for day := from; !day.After(to); day = day.AddDate(0, 0, 1) {
+		for key, qty := range balance {
+			level := stockLevel{day: day, key: key}
+			if m, ok := moves[dayKey{day, key}]; ok {
+				level = *m
+			}
+			qty += level.received - level.used
+			balance[key] = qty
+			level.qty = qty
+			levels = append(levels, level)
+		}
+	}
+	sort.Slice(levels, func(a, b int) bool {
+		if !levels[a].day.Equal(levels[b].day) {
+			return levels[a].day.Before(levels[b].day)
+		}
+		if levels[a].key.id != levels[b].key.id {
+			return levels[a].key.id < levels[b].key.id
+		}
+		return levels[a].key.warehouse < levels[b].key.warehouse
+	})
+	return levels
+}
+
+// takeDailySnapshot records today's levels, taking it again the same day replaces them
+func (s *System) takeDailySnapshot() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	today := startOfDay(s.now())
+	kept := s.snapshots[:0]
+	for _, l := range s.snapshots {
+		if !l.day.Equal(today) {
+			kept = append(kept, l)
+		}
+	}
+	s.snapshots = kept
+	levels := s.levelsLocked(today, today)
+	for _, l := range levels {
+		// the ledger and the stock map should agree, if they don't the stock map is the truth
+		l.qty = s.stock[l.key]
+		s.snapshots = append(s.snapshots, l)
+	}
+	return len(levels)
+}
+
+// backfillSnapshots fills every day since the first ledger entry that has no snapshot yet
+func (s *System) backfillSnapshots() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.ledger) == 0 {
+		return 0
+	}
+	have := map[time.Time]bool{}
+	for _, l := range s.snapshots {
+		have[l.day] = true
+	}
+	// entries made under a fake clock can be older than the ones before them
+	first := s.ledger[0].at
+	for _, e := range s.ledger {
+		if e.at.Before(first) {
+			first = e.at
+		}
+	}
+	added := 0
+	for _, l := range s.levelsLocked(first, s.now()) {
+		if !have[l.day] {
+			s.snapshots = append(s.snapshots, l)
+			added++
+		}
+	}
+	sort.SliceStable(s.snapshots, func(a, b int) bool { return s.snapshots[a].day.Before(s.snapshots[b].day) })
+	return added
+}
+
+// startSnapshotter takes the daily snapshot in the background, call the returned func to stop it
+func (s *System) startSnapshotter(every time.Duration) (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(every)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				s.takeDailySnapshot()
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() { close(done) }
+}
+
+// usageSeries is the daily usage of one item in one warehouse, oldest day first
+func (s *System) usageSeries(id int64, warehouse string) []int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var series []int
+	for _, l := range s.snapshots {
+		if l.key == (stockKey{id, warehouse}) {
+			series = append(series, l.used)
+		}
+	}
+	return series
+}
+
+type usageStats struct {
+	days   int
+	total  int
+	mean   float64 // per day
+	stddev float64
+	peak   int
+}
+
+func (u usageStats) info() string {
+	return fmt.Sprintf("days: %v | used: %v | per day: %.2f | stddev: %.2f | peak day: %v", u.days, u.total, u.mean, u.stddev, u.peak)
+}
+
+func consumptionStats(series []int) usageStats {
+	st := usageStats{days: len(series)}
+	if len(series) == 0 {
+		return st
+	}
+	for _, v := range series {
+		st.total += v
+		st.peak = max(st.peak, v)
+	}
+	st.mean = float64(st.total) / float64(len(series))
+	for _, v := range series {
+		st.stddev += (float64(v) - st.mean) * (float64(v) - st.mean)
+	}
+	st.stddev = math.Sqrt(st.stddev / float64(len(series)))
+	return st
+}
+
+// FORECASTS
+// Both give the expected usage per day from here on.
+
+type forecastMethod int
+
+const (
+	movingAverage        forecastMethod = iota // mean of the last window days
+	exponentialSmoothing                       // every day weighs alpha, older days fade out
+)
+
+const (
+	forecastWindow      = 7
+	smoothingAlpha      = 0.3
+	forecastHorizonDays = 100 * 365
+)
+
+func (m forecastMethod) String() string {
+	switch m {
+	case movingAverage:
+		return fmt.Sprintf("moving average (%v days)", forecastWindow)
+	case exponentialSmoothing:
+		return fmt.Sprintf("exponential smoothing (alpha %v)", smoothingAlpha)
+	}
+	return "unknown"
+}
+
+func forecastMovingAverage(series []int, window int) float64 {
+	if len(series) == 0 {
+		return 0
+	}
+	if window <= 0 || window > len(series) {
+		window = len(series)
+	}
+	total := 0
+	for _, v := range series[len(series)-window:] {
+		total += v
+	}
+	return float64(total) / float64(window)
+}
+
+func forecastExponential(series []int, alpha float64) float64 {
+	if len(series) == 0 {
+		return 0
+	}
+	level := float64(series[0])
+	for _, v := range series[1:] {
+		level = alpha*float64(v) + (1-alpha)*level
+	}
+	return level
+}
+
+type stockForecast struct {
+	key         stockKey
+	method      forecastMethod
+	perDay      float64
+	onHand      int
+	daysLeft    float64   // +Inf when nothing is being used
+	stockOut    time.Time // zero when nothing is being used or it's further out than forecastHorizonDays
+	reorderQty  int
+	safetyStock int
+}
+
+func (f stockForecast) info() string {
+	out := "never"
+	if !f.stockOut.IsZero() {
+		out = f.stockOut.Format("2006-01-02")
+	}
+	return fmt.Sprintf("id: %v | warehouse: %v | %v | per day: %.2f | on hand: %v | stock out: %v | reorder: %v", f.key.id, f.key.warehouse, f.method, f.perDay, f.onHand, out, f.reorderQty)
+}
+
+// reorderPolicy says how long a delivery takes and how many days one order should cover
+type reorderPolicy struct {
+	leadTimeDays int
+	coverDays    int
+	serviceZ     float64 // safety stock in standard deviations of daily usage, 1.65 is about 95%
+}
+
+var defaultReorderPolicy = reorderPolicy{leadTimeDays: 3, coverDays: 14, serviceZ: 1.65}
+
+func (s *System) forecast(id int64, warehouse string, method forecastMethod, policy reorderPolicy) (stockForecast, error) {
+	series := s.usageSeries(id, warehouse)
+	if len(series) < 2 {
+		return stockForecast{}, errNoHistory
+	}
+	f := stockForecast{key: stockKey{id, warehouse}, method: method, onHand: s.onHand(id, warehouse), daysLeft: math.Inf(1)}
+	switch method {
+	case exponentialSmoothing:
+		f.perDay = forecastExponential(series, smoothingAlpha)
+	default:
+		f.perDay = forecastMovingAverage(series, forecastWindow)
+	}
+	if f.perDay > 0 {
+		f.daysLeft = float64(f.onHand) / f.perDay
+		// a trickle of usage against a big shelf would overflow the Duration, past the horizon it's "never"
+		if f.daysLeft <= forecastHorizonDays {
+			f.stockOut = startOfDay(s.now()).Add(time.Duration(f.daysLeft * float64(24*time.Hour)))
+		}
+	}
+	stats := consumptionStats(series)
+	f.safetyStock = int(math.Ceil(policy.serviceZ * stats.stddev * math.Sqrt(float64(policy.leadTimeDays))))
+	need := f.perDay*float64(policy.leadTimeDays+policy.coverDays) + float64(f.safetyStock)
+	f.reorderQty = max(0, int(math.Ceil(need))-f.onHand)
+	return f, nil
+}
+
+// reorderSuggestions forecasts everything that has been used at all, most urgent first
+func (s *System) reorderSuggestions(method forecastMethod, policy reorderPolicy) []stockForecast {
+	s.mu.RLock()
+	used := map[stockKey]bool{}
+	for _, l := range s.snapshots {
+		if l.used > 0 {
+			used[l.key] = true
+		}
+	}
+	s.mu.RUnlock()
+	var out []stockForecast
+	for key := range used {
+		f, err := s.forecast(key.id, key.warehouse, method, policy)
+		if err == nil && f.reorderQty > 0 {
+			out = append(out, f)
+		}
+	}
+	sort.Slice(out, func(a, b int) bool { return out[a].daysLeft < out[b].daysLeft })
+	return out
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestForecastMaths(t *testing.T) {
+	series := []int{10, 0, 4, 6, 8, 2, 12, 4, 6}
+	for _, tc := range []struct {
+		name string
+		got  float64
+		want float64
+	}{
+		{"moving average, last 7", forecastMovingAverage(series, 7), 42.0 / 7},
+		{"moving average, window past the series", forecastMovingAverage(series, 50), 52.0 / 9},
+		{"moving average, no window", forecastMovingAverage(series, 0), 52.0 / 9},
+		{"moving average, empty", forecastMovingAverage(nil, 7), 0},
+		{"smoothing, one day", forecastExponential([]int{5}, 0.3), 5},
+		{"smoothing, two days", forecastExponential([]int{10, 0}, 0.3), 7},
+		{"smoothing, flat", forecastExponential([]int{3, 3, 3, 3}, 0.3), 3},
+		{"smoothing, empty", forecastExponential(nil, 0.3), 0},
+	} {
+		if math.Abs(tc.got-tc.want) > 1e-9 {
+			t.Errorf("%v: got %v, want %v", tc.name, tc.got, tc.want)
+		}
+	}
+	st := consumptionStats([]int{2, 4, 4, 4, 5, 5, 7, 9})
+	if st.days != 8 || st.total != 40 || st.mean != 5 || st.stddev != 2 || st.peak != 9 {
+		t.Errorf("stats: %v", st.info())
+	}
+	if st := consumptionStats(nil); st.days != 0 || st.mean != 0 {
+		t.Errorf("stats of nothing: %v", st.info())
+	}
+}
+
+// forecastFor gives one item onHand of stock and a usage history of series, one snapshot per day
+func forecastFor(t *testing.T, onHand int, series []int) stockForecast {
+	t.Helper()
+	now := time.Date(2024, 6, 10, 15, 0, 0, 0, time.UTC)
+	s := &System{clock: func() time.Time { return now }}
+	if err := s.createDB(); err != nil {
+		t.Fatal(err)
+	}
+	id, err := s.createItem("Flour Bag", "Inventory", "RX04")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.receive(id, "RX04", onHand, "delivery"); err != nil {
+		t.Fatal(err)
+	}
+	for i, used := range series {
+		day := startOfDay(now).AddDate(0, 0, i-len(series))
+		s.snapshots = append(s.snapshots, stockLevel{day: day, key: stockKey{id, "RX04"}, used: used})
+	}
+	f, err := s.forecast(id, "RX04", movingAverage, reorderPolicy{leadTimeDays: 2, coverDays: 5, serviceZ: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+func TestForecastStockOut(t *testing.T) {
+	f := forecastFor(t, 40, []int{4, 4, 4, 4})
+	if f.perDay != 4 || f.daysLeft != 10 {
+		t.Errorf("per day %v, days left %v", f.perDay, f.daysLeft)
+	}
+	if got := f.stockOut.Format("2006-01-02"); got != "2024-06-20" {
+		t.Errorf("stock out: got %v, want 2024-06-20", got)
+	}
+	// 7 days of 4 a day and no spread for safety stock is 28, the shelf already covers that
+	if f.safetyStock != 0 || f.reorderQty != 0 {
+		t.Errorf("safety %v, reorder %v", f.safetyStock, f.reorderQty)
+	}
+
+	f = forecastFor(t, 10, []int{2, 6, 2, 6})
+	// stddev 2 over a 2 day lead time is ceil(2*sqrt(2)) = 3, 7 days of 4 plus 3 is 31, 21 more than on hand
+	if f.safetyStock != 3 || f.reorderQty != 21 {
+		t.Errorf("safety %v, reorder %v", f.safetyStock, f.reorderQty)
+	}
+}
+
+func TestForecastBeyondHorizon(t *testing.T) {
+	// one unit used in a week against a full warehouse is millions of years, far past what a Duration holds
+	f := forecastFor(t, 1_000_000_000, []int{0, 0, 0, 0, 0, 0, 1})
+	if f.daysLeft <= forecastHorizonDays {
+		t.Fatalf("days left %v, want past the horizon", f.daysLeft)
+	}
+	if !f.stockOut.IsZero() {
+		t.Errorf("stock out %v past the horizon, want none", f.stockOut)
+	}
+
+	f = forecastFor(t, 5, []int{0, 0})
+	if !math.IsInf(f.daysLeft, 1) || !f.stockOut.IsZero() {
+		t.Errorf("nothing used: days left %v, stock out %v", f.daysLeft, f.stockOut)
+	}
+}
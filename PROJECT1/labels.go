@@ -0,0 +1,336 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"os"
+	"strings"
+)
+
+// LABELS
+// Every label has a title line, a QR code and a code 128 barcode.
+// Item labels: QR = SKU, barcode = id. Bin labels: QR and barcode = bin location.
+// Sheets are a grid of labels, rendered to PNG (with a tiny built-in font) or SVG.
+
+// fixed size containers -> arrays, like the header of main.go says
+var warehouses = [5]string{"RX01", "RX02", "RX03", "RX04", "CDC1"}
+var binAisles = [4]string{"A", "B", "C", "D"}
+
+const binsPerAisle = 6
+
+type label struct {
+	title   string
+	qr      string
+	barcode string
+}
+
+// sku is category prefix + zero padded id -> INV-14545521, the prefix is 3 letters and not 3 bytes
+func (i Item) sku() string {
+	prefix := strings.ToUpper(i.Category)
+	if r := []rune(prefix); len(r) > 3 {
+		prefix = string(r[:3])
+	}
+	if prefix == "" {
+		prefix = "UNC"
+	}
+	return fmt.Sprintf("%v-%08d", prefix, i.id)
+}
+
+func binLocations(warehouse string) []string {
+	var locs []string
+	for _, aisle := range binAisles {
+		for n := 1; n <= binsPerAisle; n++ {
+			locs = append(locs, fmt.Sprintf("%v-%v%02d", warehouse, aisle, n))
+		}
+	}
+	return locs
+}
+
+func itemLabel(i Item) label {
+	return label{title: i.item, qr: i.sku(), barcode: fmt.Sprintf("%08d", i.id)}
+}
+
+func binLabel(location string) label {
+	return label{title: "BIN " + location, qr: "BIN:" + location, barcode: location}
+}
+
+// warehouseLabels is every item stored in the warehouse followed by all of its bins
+func (s *System) warehouseLabels(warehouse string) []label {
+	var labels []label
+	for _, item := range s.db.lookup("warehouse", warehouse) {
+		labels = append(labels, itemLabel(item))
+	}
+	for _, loc := range binLocations(warehouse) {
+		labels = append(labels, binLabel(loc))
+	}
+	return labels
+}
+
+// grids, the common shape of both symbologies
+
+func (q *qrCode) grid(quiet int) [][]bool {
+	n := q.size + 2*quiet
+	g := make([][]bool, n)
+	for y := range g {
+		g[y] = make([]bool, n)
+		if y >= quiet && y < quiet+q.size {
+			copy(g[y][quiet:], q.modules[y-quiet])
+		}
+	}
+	return g
+}
+
+func code128Grid(data string, quiet, height int) ([][]bool, error) {
+	modules, err := code128Modules(data)
+	if err != nil {
+		return nil, err
+	}
+	row := make([]bool, len(modules)+2*quiet)
+	copy(row[quiet:], modules)
+	g := make([][]bool, height)
+	for y := range g {
+		g[y] = row
+	}
+	return g, nil
+}
+
+func qrGrid(data string) ([][]bool, error) {
+	q, err := encodeQR([]byte(data))
+	if err != nil {
+		return nil, err
+	}
+	return q.grid(4), nil
+}
+
+// PNG
+
+func fill(img *image.Gray, c color.Gray) {
+	for i := range img.Pix {
+		img.Pix[i] = c.Y
+	}
+}
+
+func blit(img *image.Gray, grid [][]bool, left, top, scale int) {
+	for y, row := range grid {
+		for x, dark := range row {
+			if !dark {
+				continue
+			}
+			for dy := 0; dy < scale; dy++ {
+				for dx := 0; dx < scale; dx++ {
+					img.SetGray(left+x*scale+dx, top+y*scale+dy, color.Gray{0})
+				}
+			}
+		}
+	}
+}
+
+func drawText(img *image.Gray, text string, left, top, scale int) {
+	for i, r := range []rune(strings.ToUpper(text)) {
+		glyph, ok := font5x7[r]
+		if !ok {
+			glyph = font5x7['?']
+		}
+		var g [][]bool
+		for _, bits := range glyph {
+			row := make([]bool, 5)
+			for b := 0; b < 5; b++ {
+				row[b] = bits&(1<<(4-b)) != 0
+			}
+			g = append(g, row)
+		}
+		blit(img, g, left+i*6*scale, top, scale)
+	}
+}
+
+// sheet layout in pixels
+const (
+	labelWidth   = 420
+	labelHeight  = 130
+	labelPadding = 8
+	qrScale      = 3
+	barScale     = 2
+	barHeight    = 30 // in modules, times barScale
+	textScale    = 2
+	titleMaxLen  = 26
+)
+
+func (l label) grids() (qr, bar [][]bool, err error) {
+	if qr, err = qrGrid(l.qr); err != nil {
+		return nil, nil, err
+	}
+	if bar, err = code128Grid(l.barcode, 10, barHeight); err != nil {
+		return nil, nil, err
+	}
+	return qr, bar, nil
+}
+
+// shortTitle counts runes, cutting bytes could split a letter in half
+func shortTitle(title string) string {
+	if r := []rune(title); len(r) > titleMaxLen {
+		return string(r[:titleMaxLen])
+	}
+	return title
+}
+
+func writeSheetPNG(w io.Writer, labels []label, columns int) error {
+	if columns < 1 {
+		columns = 1
+	}
+	rows := (len(labels) + columns - 1) / columns
+	img := image.NewGray(image.Rect(0, 0, columns*labelWidth, max(rows, 1)*labelHeight))
+	fill(img, color.Gray{255})
+	for n, l := range labels {
+		qr, bar, err := l.grids()
+		if err != nil {
+			return fmt.Errorf("label %q: %w", l.title, err)
+		}
+		left, top := (n%columns)*labelWidth, (n/columns)*labelHeight
+		drawText(img, shortTitle(l.title), left+labelPadding, top+labelPadding, textScale)
+		codeTop := top + labelPadding + 7*textScale + labelPadding
+		blit(img, qr, left+labelPadding, codeTop, qrScale)
+		barLeft := left + labelPadding + len(qr)*qrScale + labelPadding
+		blit(img, bar, barLeft, codeTop, barScale)
+		drawText(img, l.barcode, barLeft+10*barScale, codeTop+barHeight*barScale+4, textScale)
+	}
+	return png.Encode(w, img)
+}
+
+// SVG, dark runs on a row are merged into a single rect to keep the files small
+
+func svgRects(b *strings.Builder, grid [][]bool, left, top, scale int) {
+	for y, row := range grid {
+		for x := 0; x < len(row); {
+			if !row[x] {
+				x++
+				continue
+			}
+			start := x
+			for x < len(row) && row[x] {
+				x++
+			}
+			fmt.Fprintf(b, `<rect x="%d" y="%d" width="%d" height="%d"/>`, left+start*scale, top+y*scale, (x-start)*scale, scale)
+		}
+	}
+}
+
+func svgEscape(s string) string {
+	return strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;", `"`, "&quot;").Replace(s)
+}
+
+func writeSheetSVG(w io.Writer, labels []label, columns int) error {
+	if columns < 1 {
+		columns = 1
+	}
+	rows := (len(labels) + columns - 1) / columns
+	width, height := columns*labelWidth, max(rows, 1)*labelHeight
+	var b strings.Builder
+	fmt.Fprintf(&b, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d">`, width, height, width, height)
+	fmt.Fprintf(&b, `<rect width="100%%" height="100%%" fill="#fff"/>`)
+	for n, l := range labels {
+		qr, bar, err := l.grids()
+		if err != nil {
+			return fmt.Errorf("label %q: %w", l.title, err)
+		}
+		left, top := (n%columns)*labelWidth, (n/columns)*labelHeight
+		fmt.Fprintf(&b, `<text x="%d" y="%d" font-family="monospace" font-size="14">%s</text>`, left+labelPadding, top+labelPadding+12, svgEscape(shortTitle(l.title)))
+		codeTop := top + labelPadding + 7*textScale + labelPadding
+		barLeft := left + labelPadding + len(qr)*qrScale + labelPadding
+		b.WriteString(`<g fill="#000">`)
+		svgRects(&b, qr, left+labelPadding, codeTop, qrScale)
+		svgRects(&b, bar, barLeft, codeTop, barScale)
+		b.WriteString("</g>")
+		fmt.Fprintf(&b, `<text x="%d" y="%d" font-family="monospace" font-size="14">%s</text>`, barLeft+10*barScale, codeTop+barHeight*barScale+16, svgEscape(l.barcode))
+	}
+	b.WriteString("</svg>\n")
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// writeLabelSheet picks png or svg from the file extension
+func writeLabelSheet(path string, labels []label, columns int) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	if strings.HasSuffix(strings.ToLower(path), ".svg") {
+		err = writeSheetSVG(w, labels, columns)
+	} else {
+		err = writeSheetPNG(w, labels, columns)
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func init() {
+	commands["labels"] = command{
+		usage: "labels <warehouse> <out.png|out.svg>",
+		run: func(s *System, args []string) error {
+			if len(args) != 2 {
+				return errUsage
+			}
+			labels := s.warehouseLabels(args[0])
+			if err := writeLabelSheet(args[1], labels, 3); err != nil {
+				return err
+			}
+			fmt.Printf("wrote %v labels to %v\n", len(labels), args[1])
+			return nil
+		},
+	}
+}
+
+// 5x7 font, one byte per row, the low 5 bits are the pixels
+var font5x7 = map[rune][7]uint8{
+	' ': {0, 0, 0, 0, 0, 0, 0},
+	'0': {0x0E, 0x11, 0x13, 0x15, 0x19, 0x11, 0x0E},
+	'1': {0x04, 0x0C, 0x04, 0x04, 0x04, 0x04, 0x0E},
+	'2': {0x0E, 0x11, 0x01, 0x02, 0x04, 0x08, 0x1F},
+	'3': {0x1F, 0x02, 0x04, 0x02, 0x01, 0x11, 0x0E},
+	'4': {0x02, 0x06, 0x0A, 0x12, 0x1F, 0x02, 0x02},
+	'5': {0x1F, 0x10, 0x1E, 0x01, 0x01, 0x11, 0x0E},
+	'6': {0x06, 0x08, 0x10, 0x1E, 0x11, 0x11, 0x0E},
+	'7': {0x1F, 0x01, 0x02, 0x04, 0x08, 0x08, 0x08},
+	'8': {0x0E, 0x11, 0x11, 0x0E, 0x11, 0x11, 0x0E},
+	'9': {0x0E, 0x11, 0x11, 0x0F, 0x01, 0x02, 0x0C},
+	'A': {0x0E, 0x11, 0x11, 0x1F, 0x11, 0x11, 0x11},
+	'B': {0x1E, 0x11, 0x11, 0x1E, 0x11, 0x11, 0x1E},
+	'C': {0x0E, 0x11, 0x10, 0x10, 0x10, 0x11, 0x0E},
+	'D': {0x1C, 0x12, 0x11, 0x11, 0x11, 0x12, 0x1C},
+	'E': {0x1F, 0x10, 0x10, 0x1E, 0x10, 0x10, 0x1F},
+	'F': {0x1F, 0x10, 0x10, 0x1E, 0x10, 0x10, 0x10},
+	'G': {0x0E, 0x11, 0x10, 0x17, 0x11, 0x11, 0x0F},
+	'H': {0x11, 0x11, 0x11, 0x1F, 0x11, 0x11, 0x11},
+	'I': {0x0E, 0x04, 0x04, 0x04, 0x04, 0x04, 0x0E},
+	'J': {0x07, 0x02, 0x02, 0x02, 0x02, 0x12, 0x0C},
+	'K': {0x11, 0x12, 0x14, 0x18, 0x14, 0x12, 0x11},
+	'L': {0x10, 0x10, 0x10, 0x10, 0x10, 0x10, 0x1F},
+	'M': {0x11, 0x1B, 0x15, 0x15, 0x11, 0x11, 0x11},
+	'N': {0x11, 0x11, 0x19, 0x15, 0x13, 0x11, 0x11},
+	'O': {0x0E, 0x11, 0x11, 0x11, 0x11, 0x11, 0x0E},
+	'P': {0x1E, 0x11, 0x11, 0x1E, 0x10, 0x10, 0x10},
+	'Q': {0x0E, 0x11, 0x11, 0x11, 0x15, 0x12, 0x0D},
+	'R': {0x1E, 0x11, 0x11, 0x1E, 0x14, 0x12, 0x11},
+	'S': {0x0F, 0x10, 0x10, 0x0E, 0x01, 0x01, 0x1E},
+	'T': {0x1F, 0x04, 0x04, 0x04, 0x04, 0x04, 0x04},
+	'U': {0x11, 0x11, 0x11, 0x11, 0x11, 0x11, 0x0E},
+	'V': {0x11, 0x11, 0x11, 0x11, 0x11, 0x0A, 0x04},
+	'W': {0x11, 0x11, 0x11, 0x15, 0x15, 0x15, 0x0A},
+	'X': {0x11, 0x11, 0x0A, 0x04, 0x0A, 0x11, 0x11},
+	'Y': {0x11, 0x11, 0x11, 0x0A, 0x04, 0x04, 0x04},
+	'Z': {0x1F, 0x01, 0x02, 0x04, 0x08, 0x10, 0x1F},
+	'-': {0, 0, 0, 0x1F, 0, 0, 0},
+	'.': {0, 0, 0, 0, 0, 0x0C, 0x0C},
+	'/': {0, 0x01, 0x02, 0x04, 0x08, 0x10, 0},
+	':': {0, 0x0C, 0x0C, 0, 0x0C, 0x0C, 0},
+	'?': {0x0E, 0x11, 0x01, 0x02, 0x04, 0, 0x04},
+}
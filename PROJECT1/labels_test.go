@@ -0,0 +1,35 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestSKUCutsRunes(t *testing.T) {
+	for _, tc := range []struct {
+		category string
+		want     string
+	}{
+		{"Inventory", "INV-00000007"},
+		{"Ölfass", "ÖLF-00000007"},
+		{"Éé", "ÉÉ-00000007"},
+		{"", "UNC-00000007"},
+	} {
+		if got := (Item{Category: tc.category, id: 7}).sku(); got != tc.want {
+			t.Errorf("%q: got %q, want %q", tc.category, got, tc.want)
+		}
+	}
+}
+
+// the svg sheet cuts long titles like the png one does
+func TestSVGTitleIsShortened(t *testing.T) {
+	title := strings.Repeat("Größe ", 10)
+	var b bytes.Buffer
+	if err := writeSheetSVG(&b, []label{{title: title, qr: "X", barcode: "00000001"}}, 1); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(b.String(), ">"+shortTitle(title)+"</text>") {
+		t.Errorf("title not cut to %q", shortTitle(title))
+	}
+}
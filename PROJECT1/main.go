@@ -14,7 +14,7 @@ Project: Inventory Management System
 **/
 
 package main
-import ("fmt" ; "math/rand"	)
+import ("fmt" ; "math/rand" ; "sync" ; "errors" ; "os" ; "time" ; "path/filepath" ; "strings" ; "sort"	)
 
 
 
@@ -25,6 +25,11 @@ type Item struct{
 	Category string //One of 4 cats -> Inventory, Entertainment, Staff, Maintenance
 	Warehouse string //The different warehouses around -> 5: RX01, RX02, RX03, RX04, CDC1
 	id int64 // unique id -> 4232291121 : this max length
+	parent int64 // id of the base item when this is a variant, 0 otherwise
+	options map[string]string // variant options -> size: M, color: red
+	bin string // spot inside the warehouse -> A03, empty when nobody shelved it yet
+	custom map[string]string // typed per category -> inspection_due: 2025-03-01, see attributes.go
+	attachments []attachment // manuals, photos... the bytes sit in the blob store
 }
 
 func (i Item) info() string{
@@ -42,6 +47,9 @@ func (i Item) info() string{
     if warehouse == "" {
         warehouse = "nil"
 	}
+	if i.bin != "" {
+		warehouse += "/" + i.bin
+	}
 	return fmt.Sprintf("item: %v | category: %v | warehouse: %v | id: %v", item, category, warehouse, id)
 
 }
@@ -55,34 +63,291 @@ func (i Item) Storable() bool{
 
 
 type System struct{
-	db []Item
+	mu sync.RWMutex
+	store backend // where the repositories write through to, memory unless set before createDB
+	db *repository[Item]
+	warehouseDB *repository[Warehouse]
+	supplierDB *repository[Supplier]
 	initializedDB bool
+	events *eventBus // every create/update/delete/move lands here, see events.go
+	historyLen int64 // rows in the history table, the next event gets historyLen+1
+	categories *categoryTree
+	stock map[stockKey]int
+	ledger []ledgerEntry
+	boms map[int64]billOfMaterials // keyed by kit id
+	orders map[int64]*salesOrder
+	reservations []reservation
+	nextOrder int64
+	reservationTTL time.Duration // 0 means defaultReservationTTL
+	clock func() time.Time // nil means time.Now, handy for tests and demos
+	snapshots []stockLevel // daily stock levels, see forecast.go
+	ids *rand.Rand // nil means the global source, fixtures set a seeded one so ids repeat
+	idMu sync.Mutex
+	attrDefs map[string]map[string]attributeDef // category path -> name -> definition, see attributes.go
+	blobs *blobStore // nil until useBlobStore, attachments need it
+	warehouseCodes map[string]bool // nil takes any code, a tenant's System only its own, see tenants.go
 }
 
+var errItemNotFound = errors.New("item not found")
+
 
 
 
 
 
-func (s *System) createItem(item, Category, Warehouse string ){
+// newID hands out a fresh id for any entity, rand.Rand isn't safe to share so it gets its own lock
+func (s *System) newID() int64{
+	s.idMu.Lock()
+	defer s.idMu.Unlock()
+	if s.ids != nil{
+		return s.ids.Int63n(23312231) + 1
+	}
+	return rand.Int63n(23312231) + 1
+}
+
+// freeItemIDLocked draws until the id isn't taken, with thousands of items random ids do collide
+func (s *System) freeItemIDLocked() int64{
+	id := s.newID()
+	for s.db.has(id){
+		id = s.newID()
+	}
+	return id
+}
 
-	id := rand.Int63n(23312231)
-	s.db =append(s.db,Item{item: item, Category:Category, Warehouse:Warehouse, id: id} ) 
+// createItem refuses an item that looks like one we already have, see dedupe.go
+func (s *System) createItem(item, Category, Warehouse string ) (int64, error){
+	return s.createItemWith(item, Category, Warehouse, nil, true)
+}
+
+// createItemAnyway skips the duplicate check, for when somebody confirmed it really is a new item
+func (s *System) createItemAnyway(item, Category, Warehouse string) (int64, error){
+	return s.createItemWith(item, Category, Warehouse, nil, false)
+}
+
+// createItemWith also takes the typed attributes, a category with required ones needs them here
+func (s *System) createItemWith(item, Category, Warehouse string, attrs map[string]string, checkDuplicates bool) (int64, error){
+	s.mu.Lock()
+	if _, ok := s.categories.find(Category); !ok{
+		s.mu.Unlock()
+		return 0, fmt.Errorf("%w: %q", errCategoryNotFound, Category)
+	}
+	if err := s.checkWarehouseLocked(Warehouse); err != nil{
+		s.mu.Unlock()
+		return 0, err
+	}
+	custom, err := s.checkCustomLocked(Category, attrs)
+	if err != nil{
+		s.mu.Unlock()
+		return 0, err
+	}
+	if checkDuplicates{
+		if matches := s.duplicatesOfLocked(Item{item: item, Category: Category, Warehouse: Warehouse}); len(matches) > 0{
+			s.mu.Unlock()
+			return 0, fmt.Errorf("%w: %v", errLikelyDuplicate, matches[0].item.info())
+		}
+	}
+	id := s.freeItemIDLocked()
+	created := Item{item: item, Category:Category, Warehouse:Warehouse, id: id, custom: custom}
+	err = s.db.create(created)
+	if err == nil{
+		s.emitLocked(itemCreated{item: created})
+	}
+	s.mu.Unlock()
+	if err != nil{
+		return 0, err
+	}
+	s.flushEvents()
+	return id, nil
+}
+
+func (s *System) findItem(id int64) (Item, bool){
+	return s.db.get(id)
+}
+
+func (s *System) updateItem(id int64, item, Category string) error{
+	s.mu.Lock()
+	base, ok := s.db.get(id)
+	if !ok{
+		s.mu.Unlock()
+		return errItemNotFound
+	}
+	if base.parent != 0{
+		s.mu.Unlock()
+		return errVariantFollows
+	}
+	if _, ok := s.categories.find(Category); !ok{
+		s.mu.Unlock()
+		return errCategoryNotFound
+	}
+	// variants share the base record, so they follow their parent
+	family := append([]Item{base}, s.db.lookup("parent", fmt.Sprint(id))...)
+	// everything is checked before the first write, and a write that still fails puts the
+	// members already done back, so the family is never half renamed
+	updated := make([]Item, len(family))
+	for i, before := range family{
+		after := before
+		after.item = item
+		after.Category = Category
+		if Category != before.Category{
+			// typed values have to make sense in the new category too
+			custom, err := s.checkCustomLocked(Category, before.custom)
+			if err != nil{
+				s.mu.Unlock()
+				return fmt.Errorf("%v: %w", before.info(), err)
+			}
+			after.custom = custom
+		}
+		if err := after.validate(); err != nil{
+			s.mu.Unlock()
+			return err
+		}
+		updated[i] = after
+	}
+	for i, after := range updated{
+		if err := s.db.update(after); err != nil{
+			for j := i - 1; j >= 0; j--{
+				s.db.update(family[j])
+			}
+			s.mu.Unlock()
+			return err
+		}
+	}
+	for i := range family{
+		s.emitLocked(itemUpdated{before: family[i], after: updated[i]})
+	}
+	s.mu.Unlock()
+	s.flushEvents()
+	return nil
+}
+
+func (s *System) moveItem(id int64, Warehouse string) error{
+	s.mu.Lock()
+	moved, ok := s.db.get(id)
+	if !ok{
+		s.mu.Unlock()
+		return errItemNotFound
+	}
+	if err := s.checkWarehouseLocked(Warehouse); err != nil{
+		s.mu.Unlock()
+		return err
+	}
+	from, fromBin := moved.Warehouse, moved.bin
+	moved.Warehouse = Warehouse
+	if from != Warehouse{
+		moved.bin = "" // bins belong to the old warehouse
+	}
+	err := s.db.update(moved)
+	if err == nil{
+		s.emitLocked(itemMoved{id: id, from: from, to: Warehouse, fromBin: fromBin})
+	}
+	s.mu.Unlock()
+	if err != nil{
+		return err
+	}
+	s.flushEvents()
+	return nil
+}
+
+// shelveItem puts the item in a bin inside its current warehouse
+func (s *System) shelveItem(id int64, bin string) error{
+	s.mu.Lock()
+	before, ok := s.db.get(id)
+	if !ok{
+		s.mu.Unlock()
+		return errItemNotFound
+	}
+	after := before
+	after.bin = bin
+	err := s.db.update(after)
+	if err == nil{
+		s.emitLocked(itemUpdated{before: before, after: after})
+	}
+	s.mu.Unlock()
+	if err != nil{
+		return err
+	}
+	s.flushEvents()
+	return nil
+}
+
+func (s *System) deleteItem(id int64) error{
+	s.mu.Lock()
+	deleted, ok := s.db.get(id)
+	if !ok{
+		s.mu.Unlock()
+		return errItemNotFound
+	}
+	if err := s.canDeleteLocked(id); err != nil{
+		s.mu.Unlock()
+		return err
+	}
+	if _, ok := s.boms[id]; ok{
+		if err := s.dropBOMLocked(id); err != nil{
+			s.mu.Unlock()
+			return err
+		}
+	}
+	if err := s.db.delete(id); err != nil{
+		s.mu.Unlock()
+		return err
+	}
+	// whatever was still on the shelf leaves through the ledger, so the books add up afterwards
+	var held []stockKey
+	for key := range s.stock{
+		if key.id == id{
+			held = append(held, key)
+		}
+	}
+	sort.Slice(held, func(a, b int) bool { return held[a].warehouse < held[b].warehouse })
+	for _, key := range held{
+		qty := s.stock[key]
+		// the item is already gone, a failed write here can't be undone, so it is left for the next save
+		s.dropStockLocked(key)
+		delete(s.stock, key)
+		if qty != 0{
+			entry := ledgerEntry{at: s.now(), id: id, warehouse: key.warehouse, delta: -qty, reason: "item deleted"}
+			s.saveLedgerLocked(len(s.ledger)+1, entry)
+			s.ledger = append(s.ledger, entry)
+			s.emitLocked(stockAdjusted{entry: entry})
+		}
+	}
+	delete(s.boms, id)
+	s.emitLocked(itemDeleted{item: deleted})
+	s.mu.Unlock()
+	s.flushEvents()
+	return nil
+}
 
+// canDeleteLocked says no while something else still points at the item, must be called with s.mu held
+func (s *System) canDeleteLocked(id int64) error{
+	if len(s.db.lookup("parent", fmt.Sprint(id))) > 0{
+		return errHasVariants
+	}
+	for kit := range s.boms{
+		if kit != id && s.bomContains(kit, id){
+			return errUsedInBOM
+		}
+	}
+	for _, r := range s.reservations{
+		if r.item == id{
+			return errReserved
+		}
+	}
+	return nil
 }
 
-func (s System) readItems() string{
+func (s *System) readItems() string{
 	wholeStr :=""
-	for i, item := range s.db{
+	for i, item := range s.db.all(){
 	wholeStr += fmt.Sprintf("%v| %v\n", i, item.info())
 	}
 	return wholeStr
 }
 
-func (s System) readItemByIndex(rowNum int) string{
+func (s *System) readItemByIndex(rowNum int) string{
 	wholeStr :=""
 	counter := 0
-	for i, item := range s.db{
+	for i, item := range s.db.all(){
 		if counter == rowNum{
 	wholeStr = fmt.Sprintf("%v| %v\n", i, item.info())
 		}
@@ -91,10 +356,51 @@ func (s System) readItemByIndex(rowNum int) string{
 	return wholeStr
 }
 
-func (s *System) createDB(){
+func (s *System) createDB() error{
+	fresh := false
 	if !s.initializedDB{
-	s.db = []Item{}
+		if s.store == nil{
+			s.store = newMemoryBackend()
+		}
+		items, err := openRepository("items", s.store, decodeItem)
+		if err != nil{
+			return err
+		}
+		items.addIndex("parent", func(i Item) string { return fmt.Sprint(i.parent) })
+		items.addIndex("warehouse", func(i Item) string { return i.Warehouse })
+		whs, err := openRepository("warehouses", s.store, decodeWarehouse)
+		if err != nil{
+			return err
+		}
+		whs.addIndex("code", func(w Warehouse) string { return w.code })
+		suppliers, err := openRepository("suppliers", s.store, decodeSupplier)
+		if err != nil{
+			return err
+		}
+		s.db, s.warehouseDB, s.supplierDB = items, whs, suppliers
+		s.initializedDB = true
+		fresh = true
+	}
+	if s.events == nil{
+		s.events = newEventBus(defaultRetain)
+	}
+	if s.categories == nil{
+		s.categories = newCategoryTree()
+	}
+	if s.stock == nil{
+		s.stock = map[stockKey]int{}
+	}
+	if s.boms == nil{
+		s.boms = map[int64]billOfMaterials{}
 	}
+	if s.orders == nil{
+		s.orders = map[int64]*salesOrder{}
+	}
+	if fresh{
+		// stock, ledger, boms, categories and orders aren't repositories, see statetables.go
+		return s.loadState()
+	}
+	return nil
 }
 
 type Storable interface{
@@ -109,58 +415,163 @@ type Storable interface{
 
 func main(){
 	system := System{initializedDB: false}
-	system.createDB()
-	system.createItem("pizza","Inventory","")
-	system.createItem("Pizza Cutter", "Inventory", "RX01")
-	system.createItem("Cheese Grater", "Inventory", "CDC1")
-	system.createItem("Oven Mitt", "Maintenance", "RX04")
-	system.createItem("Pizza Box", "Maintenance", "RX01")
-	system.createItem("Pepperoni Slicer", "Inventory", "RX02")
-	system.createItem("Mozzarella Block", "Inventory", "RX03")
-	system.createItem("Tomato Sauce Can", "Inventory", "CDC1")
-	system.createItem("Delivery Scooter", "Entertainment", "RX04")
-	system.createItem("Cash Register", "Staff", "RX03")
-	system.createItem("Arcade Machine", "Entertainment", "RX01")
-	system.createItem("Uniform Shirt", "Staff", "RX02")
-	system.createItem("Mop Bucket", "Maintenance", "RX01")
-	system.createItem("Flour Bag", "Inventory", "RX04")
-	system.createItem("Sauce Ladle", "Inventory", "RX02")
-	system.createItem("Pizza Peel", "Inventory", "RX03")
-	system.createItem("Rolling Pin", "Inventory", "CDC1")
-	system.createItem("Deep Fryer", "Maintenance", "RX04")
-	system.createItem("Receipt Printer", "Staff", "RX02")
-	system.createItem("Plastic Crates", "Inventory", "RX01")
-	system.createItem("Walkie Talkie", "Staff", "CDC1")
-	system.createItem("First Aid Kit", "Maintenance", "RX03")
-	system.createItem("Cleaning Spray", "Maintenance", "RX01")
-	system.createItem("Loyalty Card Scanner", "Staff", "RX04")
-	system.createItem("Measuring Cup", "Inventory", "RX02")
-	system.createItem("Spatula", "Inventory", "RX03")
-	system.createItem("Apron", "Staff", "CDC1")
-	system.createItem("Sound System", "Entertainment", "RX01")
-	system.createItem("Grease Trap", "Maintenance", "RX03")
-	system.createItem("Serving Tray", "Inventory", "RX02")
-	system.createItem("Fire Extinguisher", "Maintenance", "RX04")
-	system.createItem("Chef Hat", "Staff", "RX01")
-	system.createItem("Cutting Board", "Inventory", "RX03")
-	system.createItem("Timer", "Maintenance", "RX02")
-	system.createItem("Thermometer", "Maintenance", "RX04")
-	system.createItem("Chair", "Inventory", "CDC1")
-	system.createItem("Table", "Inventory", "RX01")
-	system.createItem("Napkin Dispenser", "Inventory", "RX02")
-	system.createItem("Hand Sanitizer", "Maintenance", "RX03")
-	system.createItem("Toolbox", "Maintenance", "RX04")
-	system.createItem("Fan", "Maintenance", "RX01")
-	system.createItem("Light Bulb", "Maintenance", "RX02")
-	system.createItem("Shelf", "Inventory", "RX03")
-	system.createItem("Storage Bin", "Inventory", "RX04")
-	system.createItem("Trash Can", "Maintenance", "RX01")
-	system.createItem("Soap Dispenser", "Maintenance", "CDC1")
-	system.createItem("Credit Card Reader", "Staff", "RX02")
-	system.createItem("Mask Box", "Staff", "RX03")
-	system.createItem("Pizza Dough Ball", "Inventory", "RX01")
-	system.createItem("Drink Cooler", "Inventory", "RX04")
-	system.createItem("Receipt Roll", "Staff", "CDC1")
+	// the 51 items of the shop come from the pizza-shop fixture, same ids every run
+	if err := seedFixture(&system, fixturePresets["pizza-shop"]); err != nil{
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	pizzaBox := system.idOf("Pizza Box")
+	shirt := system.idOf("Uniform Shirt")
+	flour := system.idOf("Flour Bag")
+	napkins := system.idOf("Napkin Dispenser")
+	cooler := system.idOf("Drink Cooler")
+	receiptRoll := system.idOf("Receipt Roll")
+	if len(os.Args) > 1{
+		os.Exit(runCommand(&system, os.Args[1:]))
+	}
 	fmt.Println(system.readItems())
 	fmt.Println(system.readItemByIndex(45))
+
+	// warehouses and suppliers go through the same repository machinery as items
+	for _, code := range warehouses{
+		system.addWarehouse(code, "Warehouse "+code, "")
+	}
+	system.addSupplier("Dough Bros", "orders@doughbros.example", 3)
+	fmt.Print(readAll(system.warehouseDB), readAll(system.supplierDB))
+
+	// categories are a tree now and shirts come in sizes
+	system.addCategory("Staff > Clothing", map[string]string{"laundry": "weekly"})
+	system.updateItem(shirt, "Uniform Shirt", "Staff > Clothing")
+	for _, size := range []string{"S", "M", "L"}{
+		id, _ := system.createVariant(shirt, map[string]string{"size": size}, "")
+		system.receive(id, "RX02", 10, "initial count")
+	}
+	for _, v := range system.variantsOf(shirt){
+		attrs, _ := system.itemAttributes(v.id)
+		fmt.Println(v.variantInfo(), "| on hand:", system.onHand(v.id, "RX02"), "|", optionsString(attrs))
+	}
+	fmt.Println("shirts on hand:", system.familyOnHand(shirt))
+
+	// the kitchen builds delivery kits out of things we already stock
+	kit, _ := system.createItem("Delivery Kit", "Inventory", "RX01")
+	system.defineBOM(kit, []bomLine{{pizzaBox, 1}, {napkins, 1}, {receiptRoll, 2}})
+	system.receive(pizzaBox, "RX01", 12, "delivery")
+	system.receive(napkins, "RX01", 8, "delivery")
+	system.receive(receiptRoll, "RX01", 10, "delivery")
+	canBuild, _ := system.buildable(kit, "RX01")
+	fmt.Println("delivery kits we could build:", canBuild)
+	if err := system.assemble(kit, "RX01", canBuild); err != nil{
+		fmt.Println(err)
+	}
+	fmt.Println("kits:", system.onHand(kit, "RX01"), "| pizza boxes left:", system.onHand(pizzaBox, "RX01"))
+	fmt.Println("deleting pizza box:", system.deleteItem(pizzaBox))
+
+	// two orders can't promise the same drink cooler
+	system.receive(cooler, "RX04", 3, "delivery")
+	beforeOrders := time.Now()
+	first, _ := system.placeOrder("Luigi", "RX04", []orderLine{{cooler, 2}})
+	if _, err := system.placeOrder("Mario", "RX04", []orderLine{{cooler, 2}}); err != nil{
+		fmt.Println("second order:", err)
+	}
+	fmt.Println("coolers available to promise:", system.availableToPromise(cooler, "RX04"))
+	system.pick(first)
+	system.pack(first)
+	system.ship(first)
+	shipped, _ := system.order(first)
+	fmt.Println(shipped.info(), "| coolers on hand:", system.onHand(cooler, "RX04"))
+
+	// backups run while the shop keeps going, and the saved history lets us look back in time
+	backupFile := filepath.Join(os.TempDir(), "inventory-backup.tar.gz")
+	if m, err := system.backup(backupFile); err == nil{
+		if _, _, restored, err := verifyBackup(backupFile); err == nil{
+			fmt.Println("backup:", m.Items, "items, sha256", m.SHA256[:12], "| coolers in backup:", restored.onHand(cooler, "RX04"))
+		}
+	}
+	if past, err := system.snapshotAt(beforeOrders); err == nil{
+		fmt.Println("coolers on hand before the orders:", past.stock[stockKey{cooler, "RX04"}], "| items back then:", len(past.items))
+	}
+
+	// three weeks of flour usage, replayed with a clock that starts in the past
+	day := time.Now().AddDate(0, 0, -21)
+	system.clock = func() time.Time { return day }
+	system.receive(flour, "RX04", 120, "opening stock")
+	for i := 0; i < 21; i++{
+		system.issue(flour, "RX04", 3+i%4+i/7, "kitchen")
+		day = day.AddDate(0, 0, 1)
+	}
+	system.clock = nil
+	system.backfillSnapshots()
+	system.takeDailySnapshot()
+	fmt.Println("flour usage:", consumptionStats(system.usageSeries(flour, "RX04")).info())
+	for _, method := range []forecastMethod{movingAverage, exponentialSmoothing}{
+		if f, err := system.forecast(flour, "RX04", method, defaultReorderPolicy); err == nil{
+			fmt.Println(f.info())
+		}
+	}
+	fmt.Println("reorder suggestions:", len(system.reorderSuggestions(exponentialSmoothing, defaultReorderPolicy)))
+
+	// somebody adds the pizza cutters again, create notices, and only an explicit "anyway" gets past it
+	cutter := system.idOf("Pizza Cutter")
+	for _, name := range []string{"pizza cutters", "Pizza-Cutter"}{
+		if _, err := system.createItem(name, "Inventory", "RX01"); err != nil{
+			fmt.Println(err)
+		}
+	}
+	again, _ := system.createItemAnyway("Pizza-Cutter", "Inventory", "RX01")
+	system.receive(again, "RX01", 4, "found in the back")
+	for _, g := range system.scanDuplicates(duplicateThreshold){
+		fmt.Println("duplicates:", g.info())
+	}
+	fmt.Println("merge:", system.mergeItems(cutter, again), "| cutters on hand:", system.onHand(cutter, "RX01"))
+
+	// maintenance gear gets an inspection date and a wattage, then the filter can compare them as numbers
+	system.defineAttribute("Maintenance", attributeDef{name: "inspection_due", kind: attrDate, required: true})
+	system.defineAttribute("Maintenance", attributeDef{name: "wattage", kind: attrNumber})
+	extinguisher, fan := system.idOf("Fire Extinguisher"), system.idOf("Fan")
+	system.setAttribute(extinguisher, "inspection_due", "2025-03-01")
+	system.setAttribute(fan, "wattage", "45")
+	if err := system.setAttribute(fan, "wattage", "loud"); err != nil{
+		fmt.Println(err)
+	}
+	missing, _ := system.missingAttributes(fan)
+	fmt.Println("fan is missing:", missing)
+	hot, _ := parseQuery("category=Maintenance wattage>=40")
+	for _, item := range system.filterItems(hot){
+		fmt.Println("wattage>=40:", item.item)
+	}
+	blobDir, _ := os.MkdirTemp("", "project1-blobs")
+	defer os.RemoveAll(blobDir)
+	system.useBlobStore(blobDir)
+	if a, err := system.attach(fan, "fan-manual.txt", strings.NewReader("Clean the blades monthly.\n")); err == nil{
+		fmt.Println("attached:", a.info())
+	}
+
+	// the north and south shops share this process and storage but never each other's rows
+	shops, _ := openPlatform(newMemoryBackend())
+	admin := principal{name: "owner", role: roleAdmin}
+	north, _ := shops.addTenant(admin, "north", []string{"Inventory > Toppings"}, []string{"NRT1"})
+	south, _ := shops.addTenant(admin, "south", nil, []string{"STH1", "STH2"})
+	basil, _ := north.createItem("Basil", "Inventory > Toppings", "NRT1")
+	north.receive(basil, "NRT1", 5, "delivery")
+	south.createItem("Basil", "Inventory", "STH1")
+	_, found := south.findItem(basil)
+	fmt.Println("south can see north's basil:", found)
+	if _, err := shops.system(principal{name: "gina", role: roleStaff, tenant: "south"}, "north"); err != nil{
+		fmt.Println(err)
+	}
+	report, _ := shops.crossTenantReport(admin)
+	for _, row := range report{
+		fmt.Println(row.info())
+	}
+
+	// a dashboard that restarts just asks for everything since the offset it last saw
+	dashboard, _ := system.events.subscribe(subOptions{buffer: 8, policy: dropOldest, replayFrom: 40})
+	last := system.events.headOffset() - 1
+	for rec := range dashboard.events{
+		fmt.Printf("%v| %v\n", rec.offset, rec.event.describe())
+		if rec.offset == last{
+			break
+		}
+	}
+	system.events.unsubscribe(dashboard)
 }
\ No newline at end of file
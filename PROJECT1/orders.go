@@ -0,0 +1,320 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// SALES ORDERS
+// Placing an order reserves the goods at one warehouse, so two orders can't promise the same Drink Cooler.
+// available to promise (ATP) = on hand - reserved.
+// Reservations expire if the order is not picked in time, after that the order is dead.
+// Flow: placed -> picked -> packed -> shipped. Shipping turns the reservations into real stock issues.
+
+type orderStatus string
+
+const (
+	orderPlaced    orderStatus = "placed"
+	orderPicked    orderStatus = "picked"
+	orderPacked    orderStatus = "packed"
+	orderShipped   orderStatus = "shipped"
+	orderCancelled orderStatus = "cancelled"
+	orderExpired   orderStatus = "expired"
+)
+
+const defaultReservationTTL = 30 * time.Minute
+
+var (
+	errOrderNotFound = errors.New("order not found")
+	errOrderState    = errors.New("order can't do that in its current state")
+	errEmptyOrder    = errors.New("an order needs at least one line")
+	errReserved      = errors.New("item has open reservations")
+)
+
+type orderLine struct {
+	item int64
+	qty  int
+}
+
+type salesOrder struct {
+	id        int64
+	customer  string
+	warehouse string
+	lines     []orderLine
+	status    orderStatus
+	placedAt  time.Time
+}
+
+type reservation struct {
+	order     int64
+	item      int64
+	warehouse string
+	qty       int
+	expires   time.Time // zero once picked, picked goods don't expire
+}
+
+func (o salesOrder) info() string {
+	return fmt.Sprintf("order: %v | customer: %v | warehouse: %v | lines: %v | status: %v", o.id, o.customer, o.warehouse, len(o.lines), o.status)
+}
+
+func (s *System) now() time.Time {
+	if s.clock != nil {
+		return s.clock()
+	}
+	return time.Now()
+}
+
+// reservedLocked must be called with s.mu held
+func (s *System) reservedLocked(id int64, warehouse string) int {
+	total := 0
+	for _, r := range s.reservations {
+		if r.item == id && r.warehouse == warehouse {
+			total += r.qty
+		}
+	}
+	return total
+}
+
+// availableLocked must be called with s.mu held
+func (s *System) availableLocked(id int64, warehouse string) int {
+	return s.stock[stockKey{id, warehouse}] - s.reservedLocked(id, warehouse)
+}
+
+func (s *System) availableToPromise(id int64, warehouse string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.expireLocked()
+	return s.availableLocked(id, warehouse)
+}
+
+// expireLocked drops stale reservations and marks their orders expired, must be called with s.mu held
+func (s *System) expireLocked() int {
+	now := s.now()
+	dead := map[int64]bool{}
+	kept := s.reservations[:0]
+	for _, r := range s.reservations {
+		if !r.expires.IsZero() && !now.Before(r.expires) {
+			dead[r.order] = true
+			continue
+		}
+		kept = append(kept, r)
+	}
+	s.reservations = kept
+	for id := range dead {
+		if o, ok := s.orders[id]; ok && o.status == orderPlaced {
+			o.status = orderExpired
+		}
+		// if this write fails the saved order still has its stale reservations, and those
+		// expire again the first time the order is loaded and looked at
+		s.saveOrderLocked(id)
+	}
+	return len(dead)
+}
+
+// expireReservations can be called from anywhere, it returns how many orders just expired
+func (s *System) expireReservations() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.expireLocked()
+}
+
+// startReservationSweeper expires reservations in the background, call the returned func to stop it
+func (s *System) startReservationSweeper(every time.Duration) (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(every)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				s.expireReservations()
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() { close(done) }
+}
+
+// placeOrder reserves every line or nothing
+func (s *System) placeOrder(customer, warehouse string, lines []orderLine) (int64, error) {
+	if len(lines) == 0 {
+		return 0, errEmptyOrder
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.expireLocked()
+	need := map[int64]int{}
+	for _, line := range lines {
+		if line.qty <= 0 {
+			return 0, errBadQuantity
+		}
+		if !s.db.has(line.item) {
+			return 0, fmt.Errorf("item %v: %w", line.item, errItemNotFound)
+		}
+		need[line.item] += line.qty
+	}
+	for item, qty := range need {
+		if s.availableLocked(item, warehouse) < qty {
+			return 0, fmt.Errorf("item %v: %w", item, errInsufficientStock)
+		}
+	}
+	s.nextOrder++
+	ttl := s.reservationTTL
+	if ttl <= 0 {
+		ttl = defaultReservationTTL
+	}
+	now := s.now()
+	order := &salesOrder{id: s.nextOrder, customer: customer, warehouse: warehouse, lines: append([]orderLine(nil), lines...), status: orderPlaced, placedAt: now}
+	s.orders[order.id] = order
+	items := make([]int64, 0, len(need))
+	for item := range need {
+		items = append(items, item)
+	}
+	sort.Slice(items, func(a, b int) bool { return items[a] < items[b] })
+	for _, item := range items {
+		s.reservations = append(s.reservations, reservation{order: order.id, item: item, warehouse: warehouse, qty: need[item], expires: now.Add(ttl)})
+	}
+	if err := s.saveOrderLocked(order.id); err != nil {
+		delete(s.orders, order.id)
+		s.reservations = s.reservations[:len(s.reservations)-len(items)]
+		s.nextOrder--
+		return 0, err
+	}
+	return order.id, nil
+}
+
+func (s *System) order(id int64) (salesOrder, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.expireLocked()
+	o, ok := s.orders[id]
+	if !ok {
+		return salesOrder{}, false
+	}
+	return *o, true
+}
+
+// orderInLocked finds an order that is in the from state, must be called with s.mu held
+func (s *System) orderInLocked(id int64, from orderStatus) (*salesOrder, error) {
+	s.expireLocked()
+	o, ok := s.orders[id]
+	if !ok {
+		return nil, errOrderNotFound
+	}
+	if o.status != from {
+		return nil, fmt.Errorf("%w: order %v is %v", errOrderState, id, o.status)
+	}
+	return o, nil
+}
+
+// advanceLocked moves an order one step, must be called with s.mu held
+func (s *System) advanceLocked(id int64, from, to orderStatus) (*salesOrder, error) {
+	o, err := s.orderInLocked(id, from)
+	if err != nil {
+		return nil, err
+	}
+	o.status = to
+	if err := s.saveOrderLocked(id); err != nil {
+		o.status = from
+		return nil, err
+	}
+	return o, nil
+}
+
+// pick pins the reservations so they can't expire anymore, status and pins are saved in one write
+func (s *System) pick(id int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	o, err := s.orderInLocked(id, orderPlaced)
+	if err != nil {
+		return err
+	}
+	old := append([]reservation(nil), s.reservations...)
+	o.status = orderPicked
+	for i := range s.reservations {
+		if s.reservations[i].order == id {
+			s.reservations[i].expires = time.Time{}
+		}
+	}
+	if err := s.saveOrderLocked(id); err != nil {
+		o.status, s.reservations = orderPlaced, old
+		return err
+	}
+	return nil
+}
+
+func (s *System) pack(id int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err := s.advanceLocked(id, orderPicked, orderPacked)
+	return err
+}
+
+// ship issues the stock first and only then releases the reservations and marks the order shipped.
+// A failed issue or order write takes the stock changes back and leaves the order packed
+func (s *System) ship(id int64) error {
+	s.mu.Lock()
+	o, err := s.orderInLocked(id, orderPacked)
+	if err != nil {
+		s.mu.Unlock()
+		return err
+	}
+	var changes []stockChange
+	kept := []reservation{}
+	for _, r := range s.reservations {
+		if r.order == id {
+			changes = append(changes, stockChange{r.item, -r.qty})
+			continue
+		}
+		kept = append(kept, r)
+	}
+	done, err := s.adjustAllLocked(changes, o.warehouse, fmt.Sprintf("ship order %v", o.id))
+	if err != nil {
+		s.mu.Unlock()
+		return err
+	}
+	old := s.reservations
+	s.reservations, o.status = kept, orderShipped
+	if err := s.saveOrderLocked(id); err != nil {
+		s.reservations, o.status = old, orderPacked
+		err = errors.Join(err, s.unadjustLocked(done))
+		s.mu.Unlock()
+		return err
+	}
+	for _, ev := range done {
+		s.emitLocked(ev)
+	}
+	s.mu.Unlock()
+	s.flushEvents()
+	return nil
+}
+
+// cancelOrder works until the order ships
+func (s *System) cancelOrder(id int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	o, ok := s.orders[id]
+	if !ok {
+		return errOrderNotFound
+	}
+	switch o.status {
+	case orderShipped, orderCancelled, orderExpired:
+		return fmt.Errorf("%w: order %v is %v", errOrderState, id, o.status)
+	}
+	old, status := s.reservations, o.status
+	kept := []reservation{}
+	for _, r := range s.reservations {
+		if r.order != id {
+			kept = append(kept, r)
+		}
+	}
+	s.reservations, o.status = kept, orderCancelled
+	if err := s.saveOrderLocked(id); err != nil {
+		s.reservations, o.status = old, status
+		return err
+	}
+	return nil
+}
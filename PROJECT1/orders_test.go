@@ -0,0 +1,71 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestFailedWritesLeaveOrdersAsTheyWere(t *testing.T) {
+	store := &countingBackend{backend: newMemoryBackend(), ok: -1}
+	s := &System{store: store}
+	if err := s.createDB(); err != nil {
+		t.Fatal(err)
+	}
+	cooler, _ := s.createItem("Drink Cooler", "Inventory", "RX01")
+	cups, _ := s.createItem("Paper Cups", "Inventory", "RX01")
+	s.receive(cooler, "RX01", 3, "delivery")
+	s.receive(cups, "RX01", 10, "delivery")
+	id, err := s.placeOrder("ana", "RX01", []orderLine{{item: cooler, qty: 1}, {item: cups, qty: 4}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	reserved := func() int {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return s.reservedLocked(cooler, "RX01") + s.reservedLocked(cups, "RX01")
+	}
+
+	store.table, store.ok = orderTable, 0
+	if err := s.pick(id); !errors.Is(err, errFlaky) {
+		t.Fatalf("pick: got %v, want errFlaky", err)
+	}
+	if o, _ := s.order(id); o.status != orderPlaced || reserved() != 5 {
+		t.Errorf("after a failed pick: %v with %v reserved", o.status, reserved())
+	}
+	if err := s.pick(id); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.pack(id); err != nil {
+		t.Fatal(err)
+	}
+
+	ledger := len(s.ledger)
+	for _, fail := range []string{stockTable, orderTable} {
+		store.table, store.ok = fail, 1 // the cups row, or the order after both stock rows
+		if fail == orderTable {
+			store.ok = 0
+		}
+		if err := s.ship(id); !errors.Is(err, errFlaky) {
+			t.Fatalf("ship failing on %v: got %v, want errFlaky", fail, err)
+		}
+		o, _ := s.order(id)
+		if o.status != orderPacked || reserved() != 5 || s.onHand(cooler, "RX01") != 3 || s.onHand(cups, "RX01") != 10 || len(s.ledger) != ledger {
+			t.Errorf("ship failing on %v: %v, %v reserved, stock %v/%v, ledger %v -> %v",
+				fail, o.status, reserved(), s.onHand(cooler, "RX01"), s.onHand(cups, "RX01"), ledger, len(s.ledger))
+		}
+	}
+
+	store.table, store.ok = orderTable, 0
+	if err := s.cancelOrder(id); !errors.Is(err, errFlaky) {
+		t.Fatalf("cancel: got %v, want errFlaky", err)
+	}
+	if o, _ := s.order(id); o.status != orderPacked || reserved() != 5 {
+		t.Errorf("after a failed cancel: %v with %v reserved", o.status, reserved())
+	}
+	if err := s.ship(id); err != nil {
+		t.Fatal(err)
+	}
+	if o, _ := s.order(id); o.status != orderShipped || reserved() != 0 || s.onHand(cups, "RX01") != 6 {
+		t.Errorf("shipped: %v, %v reserved, %v cups", o.status, reserved(), s.onHand(cups, "RX01"))
+	}
+}
@@ -0,0 +1,429 @@
+package main
+
+import (
+	"errors"
+)
+
+// QR CODES
+// Byte mode, error correction level M, versions 1 to 10 (up to 213 bytes).
+// That is way more than an id, a SKU or a bin location will ever need.
+// The steps are the usual ones:
+// 1. encode the data into codewords and pad them
+// 2. split into blocks and add reed-solomon error correction to each block
+// 3. interleave the blocks and zig-zag them into the matrix around the fixed patterns
+// 4. try all 8 masks and keep the one with the lowest penalty
+
+type qrBlocks struct {
+	ecPerBlock int
+	groups     [][2]int // {number of blocks, data codewords per block}
+}
+
+// level M only, index = version
+var qrVersionsM = [11]qrBlocks{
+	{},
+	{10, [][2]int{{1, 16}}},
+	{16, [][2]int{{1, 28}}},
+	{26, [][2]int{{1, 44}}},
+	{18, [][2]int{{2, 32}}},
+	{24, [][2]int{{2, 43}}},
+	{16, [][2]int{{4, 27}}},
+	{18, [][2]int{{4, 31}}},
+	{22, [][2]int{{2, 38}, {2, 39}}},
+	{22, [][2]int{{3, 36}, {2, 37}}},
+	{26, [][2]int{{4, 43}, {1, 44}}},
+}
+
+var qrAlignment = [11][]int{
+	nil, nil,
+	{6, 18}, {6, 22}, {6, 26}, {6, 30}, {6, 34},
+	{6, 22, 38}, {6, 24, 42}, {6, 26, 46}, {6, 28, 50},
+}
+
+var errQRTooLong = errors.New("qr: data does not fit in a version 10-M symbol")
+
+type qrCode struct {
+	size     int
+	modules  [][]bool // [y][x], true = dark
+	function [][]bool // finder/timing/alignment/format areas that masks must not touch
+}
+
+func (v qrBlocks) dataCodewords() int {
+	total := 0
+	for _, g := range v.groups {
+		total += g[0] * g[1]
+	}
+	return total
+}
+
+// encodeQR picks the smallest version that fits and builds the symbol
+func encodeQR(data []byte) (*qrCode, error) {
+	version := 0
+	for v := 1; v < len(qrVersionsM); v++ {
+		countBits := 8
+		if v >= 10 {
+			countBits = 16
+		}
+		if 4+countBits+len(data)*8 <= qrVersionsM[v].dataCodewords()*8 {
+			version = v
+			break
+		}
+	}
+	if version == 0 {
+		return nil, errQRTooLong
+	}
+
+	codewords := qrAddErrorCorrection(qrDataCodewords(data, version), version)
+
+	size := version*4 + 17
+	q := &qrCode{size: size, modules: make([][]bool, size), function: make([][]bool, size)}
+	for y := range q.modules {
+		q.modules[y] = make([]bool, size)
+		q.function[y] = make([]bool, size)
+	}
+	q.drawFunctionPatterns(version)
+	q.drawCodewords(codewords)
+
+	best, bestPenalty := 0, -1
+	for mask := 0; mask < 8; mask++ {
+		q.applyMask(mask)
+		q.drawFormat(mask)
+		if p := q.penalty(); bestPenalty < 0 || p < bestPenalty {
+			best, bestPenalty = mask, p
+		}
+		q.applyMask(mask) // xor twice undoes it
+	}
+	q.applyMask(best)
+	q.drawFormat(best)
+	return q, nil
+}
+
+// qrDataCodewords builds mode + count + bytes + terminator + padding
+func qrDataCodewords(data []byte, version int) []byte {
+	capacity := qrVersionsM[version].dataCodewords()
+	var bits []bool
+	put := func(val, n int) {
+		for i := n - 1; i >= 0; i-- {
+			bits = append(bits, (val>>i)&1 == 1)
+		}
+	}
+	put(0b0100, 4)
+	if version >= 10 {
+		put(len(data), 16)
+	} else {
+		put(len(data), 8)
+	}
+	for _, b := range data {
+		put(int(b), 8)
+	}
+	for i := 0; i < 4 && len(bits) < capacity*8; i++ {
+		bits = append(bits, false)
+	}
+	for len(bits)%8 != 0 {
+		bits = append(bits, false)
+	}
+	out := make([]byte, 0, capacity)
+	for i := 0; i < len(bits); i += 8 {
+		var b byte
+		for j := 0; j < 8; j++ {
+			if bits[i+j] {
+				b |= 1 << (7 - j)
+			}
+		}
+		out = append(out, b)
+	}
+	for pad := byte(0xEC); len(out) < capacity; {
+		out = append(out, pad)
+		pad ^= 0xEC ^ 0x11
+	}
+	return out
+}
+
+func qrAddErrorCorrection(data []byte, version int) []byte {
+	layout := qrVersionsM[version]
+	divisor := rsDivisor(layout.ecPerBlock)
+	var dataBlocks, ecBlocks [][]byte
+	pos := 0
+	for _, g := range layout.groups {
+		for n := 0; n < g[0]; n++ {
+			block := data[pos : pos+g[1]]
+			pos += g[1]
+			dataBlocks = append(dataBlocks, block)
+			ecBlocks = append(ecBlocks, rsRemainder(block, divisor))
+		}
+	}
+	var out []byte
+	longest := layout.groups[len(layout.groups)-1][1]
+	for i := 0; i < longest; i++ {
+		for _, block := range dataBlocks {
+			if i < len(block) {
+				out = append(out, block[i])
+			}
+		}
+	}
+	for i := 0; i < layout.ecPerBlock; i++ {
+		for _, block := range ecBlocks {
+			out = append(out, block[i])
+		}
+	}
+	return out
+}
+
+// gfMul multiplies in GF(256) with the qr polynomial x^8+x^4+x^3+x^2+1
+func gfMul(x, y byte) byte {
+	var z byte
+	for i := 7; i >= 0; i-- {
+		hi := z & 0x80
+		z <<= 1
+		if hi != 0 {
+			z ^= 0x1D
+		}
+		if (y>>i)&1 == 1 {
+			z ^= x
+		}
+	}
+	return z
+}
+
+// rsDivisor is the generator polynomial (x-a^0)(x-a^1)...(x-a^(n-1)), leading 1 dropped
+func rsDivisor(degree int) []byte {
+	result := make([]byte, degree)
+	result[degree-1] = 1
+	root := byte(1)
+	for i := 0; i < degree; i++ {
+		for j := range result {
+			result[j] = gfMul(result[j], root)
+			if j+1 < len(result) {
+				result[j] ^= result[j+1]
+			}
+		}
+		root = gfMul(root, 0x02)
+	}
+	return result
+}
+
+func rsRemainder(data, divisor []byte) []byte {
+	result := make([]byte, len(divisor))
+	for _, b := range data {
+		factor := b ^ result[0]
+		copy(result, result[1:])
+		result[len(result)-1] = 0
+		for i := range result {
+			result[i] ^= gfMul(divisor[i], factor)
+		}
+	}
+	return result
+}
+
+func (q *qrCode) set(x, y int, dark bool) {
+	q.modules[y][x] = dark
+	q.function[y][x] = true
+}
+
+func (q *qrCode) drawFunctionPatterns(version int) {
+	for i := 0; i < q.size; i++ {
+		q.set(6, i, i%2 == 0)
+		q.set(i, 6, i%2 == 0)
+	}
+	for _, c := range [][2]int{{3, 3}, {q.size - 4, 3}, {3, q.size - 4}} {
+		for dy := -4; dy <= 4; dy++ {
+			for dx := -4; dx <= 4; dx++ {
+				x, y := c[0]+dx, c[1]+dy
+				if x < 0 || y < 0 || x >= q.size || y >= q.size {
+					continue
+				}
+				d := max(abs(dx), abs(dy))
+				q.set(x, y, d != 2 && d != 4)
+			}
+		}
+	}
+	pos := qrAlignment[version]
+	last := len(pos) - 1
+	for i := range pos {
+		for j := range pos {
+			if (i == 0 && j == 0) || (i == 0 && j == last) || (i == last && j == 0) {
+				continue // those spots are taken by the finders
+			}
+			for dy := -2; dy <= 2; dy++ {
+				for dx := -2; dx <= 2; dx++ {
+					q.set(pos[i]+dx, pos[j]+dy, max(abs(dx), abs(dy)) != 1)
+				}
+			}
+		}
+	}
+	q.drawFormat(0) // reserves the format area, the real bits are drawn after masking
+	if version >= 7 {
+		rem := version
+		for i := 0; i < 12; i++ {
+			rem = (rem << 1) ^ ((rem >> 11) * 0x1F25)
+		}
+		bits := version<<12 | rem
+		for i := 0; i < 18; i++ {
+			dark := (bits>>i)&1 == 1
+			a, b := q.size-11+i%3, i/3
+			q.set(a, b, dark)
+			q.set(b, a, dark)
+		}
+	}
+}
+
+// drawFormat writes both copies of the 15 format bits, level M is 00
+func (q *qrCode) drawFormat(mask int) {
+	data := mask
+	rem := data
+	for i := 0; i < 10; i++ {
+		rem = (rem << 1) ^ ((rem >> 9) * 0x537)
+	}
+	bits := (data<<10 | rem) ^ 0x5412
+	bit := func(i int) bool { return (bits>>i)&1 == 1 }
+	for i := 0; i <= 5; i++ {
+		q.set(8, i, bit(i))
+	}
+	q.set(8, 7, bit(6))
+	q.set(8, 8, bit(7))
+	q.set(7, 8, bit(8))
+	for i := 9; i < 15; i++ {
+		q.set(14-i, 8, bit(i))
+	}
+	for i := 0; i < 8; i++ {
+		q.set(q.size-1-i, 8, bit(i))
+	}
+	for i := 8; i < 15; i++ {
+		q.set(8, q.size-15+i, bit(i))
+	}
+	q.set(8, q.size-8, true)
+}
+
+// drawCodewords zig-zags two columns at a time from the bottom right corner
+func (q *qrCode) drawCodewords(data []byte) {
+	i := 0
+	for right := q.size - 1; right >= 1; right -= 2 {
+		if right == 6 {
+			right = 5 // skip the vertical timing line
+		}
+		for vert := 0; vert < q.size; vert++ {
+			for j := 0; j < 2; j++ {
+				x := right - j
+				y := vert
+				if (right+1)&2 == 0 {
+					y = q.size - 1 - vert
+				}
+				if !q.function[y][x] && i < len(data)*8 {
+					q.modules[y][x] = (data[i>>3]>>(7-i&7))&1 == 1
+					i++
+				}
+			}
+		}
+	}
+}
+
+func (q *qrCode) applyMask(mask int) {
+	for y := 0; y < q.size; y++ {
+		for x := 0; x < q.size; x++ {
+			if q.function[y][x] {
+				continue
+			}
+			var flip bool
+			switch mask {
+			case 0:
+				flip = (x+y)%2 == 0
+			case 1:
+				flip = y%2 == 0
+			case 2:
+				flip = x%3 == 0
+			case 3:
+				flip = (x+y)%3 == 0
+			case 4:
+				flip = (x/3+y/2)%2 == 0
+			case 5:
+				flip = x*y%2+x*y%3 == 0
+			case 6:
+				flip = (x*y%2+x*y%3)%2 == 0
+			case 7:
+				flip = ((x+y)%2+x*y%3)%2 == 0
+			}
+			if flip {
+				q.modules[y][x] = !q.modules[y][x]
+			}
+		}
+	}
+}
+
+// penalty follows the four rules from the spec: long runs, 2x2 blocks,
+// finder look-alikes and dark/light balance
+func (q *qrCode) penalty() int {
+	n := q.size
+	at := func(x, y int, vertical bool) bool {
+		if vertical {
+			return q.modules[x][y]
+		}
+		return q.modules[y][x]
+	}
+	finderLike := []bool{true, false, true, true, true, false, true}
+	score := 0
+	for _, vertical := range []bool{false, true} {
+		for y := 0; y < n; y++ {
+			run := 1
+			for x := 1; x <= n; x++ {
+				if x < n && at(x, y, vertical) == at(x-1, y, vertical) {
+					run++
+					continue
+				}
+				if run >= 5 {
+					score += 3 + run - 5
+				}
+				run = 1
+			}
+			for x := 0; x+7 <= n; x++ {
+				match := true
+				for k, want := range finderLike {
+					if at(x+k, y, vertical) != want {
+						match = false
+						break
+					}
+				}
+				if !match {
+					continue
+				}
+				lightBefore, lightAfter := true, true
+				for k := 1; k <= 4; k++ {
+					if x-k >= 0 && at(x-k, y, vertical) {
+						lightBefore = false
+					}
+					if x+6+k < n && at(x+6+k, y, vertical) {
+						lightAfter = false
+					}
+				}
+				if lightBefore || lightAfter {
+					score += 40
+				}
+			}
+		}
+	}
+	dark := 0
+	for y := 0; y < n; y++ {
+		for x := 0; x < n; x++ {
+			if q.modules[y][x] {
+				dark++
+			}
+			if x+1 < n && y+1 < n {
+				c := q.modules[y][x]
+				if q.modules[y][x+1] == c && q.modules[y+1][x] == c && q.modules[y+1][x+1] == c {
+					score += 3
+				}
+			}
+		}
+	}
+	total := n * n
+	k := (abs(dark*20-total*10)+total-1)/total - 1
+	if k > 0 {
+		score += k * 10
+	}
+	return score
+}
+
+func abs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
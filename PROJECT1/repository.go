@@ -0,0 +1,306 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// REPOSITORY
+// One generic store for anything Storable, so Items, Warehouses and Suppliers all get the same
+// create/read/update/delete, secondary indexes and listing.
+// The repository keeps decoded rows in memory (in insertion order) and writes every change
+// through to a backend, which only ever sees bytes. Swap the backend, keep the behaviour.
+
+// entity is the richer Storable: it knows its identity, checks itself and turns itself into bytes.
+// decoding lives in a func handed to the repository because an interface can't make a fresh T
+type entity interface {
+	Storable
+	key() int64
+	validate() error
+	marshal() ([]byte, error)
+}
+
+// backend is the raw storage under a repository, one table per entity type.
+// scan must hand rows back in the order they were first put
+type backend interface {
+	put(table string, key int64, data []byte) error
+	get(table string, key int64) ([]byte, bool, error)
+	remove(table string, key int64) error
+	scan(table string, fn func(key int64, data []byte) error) error
+}
+
+var (
+	errRecordNotFound = errors.New("record not found")
+	errDuplicateKey   = errors.New("a record with that key already exists")
+)
+
+type repository[T entity] struct {
+	mu      sync.RWMutex
+	table   string
+	store   backend
+	decode  func([]byte) (T, error)
+	rows    map[int64]T
+	order   []int64
+	indexes map[string]*repoIndex[T]
+}
+
+type repoIndex[T entity] struct {
+	keyFn   func(T) string
+	entries map[string]map[int64]bool
+}
+
+// openRepository loads whatever the backend already holds for the table
+func openRepository[T entity](table string, store backend, decode func([]byte) (T, error)) (*repository[T], error) {
+	r := &repository[T]{table: table, store: store, decode: decode, rows: map[int64]T{}, indexes: map[string]*repoIndex[T]{}}
+	err := store.scan(table, func(key int64, data []byte) error {
+		v, err := decode(data)
+		if err != nil {
+			return fmt.Errorf("%v %v: %w", table, key, err)
+		}
+		r.rows[key] = v
+		r.order = append(r.order, key)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// addIndex builds a secondary index over what is already stored and keeps it up to date after
+func (r *repository[T]) addIndex(name string, keyFn func(T) string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	idx := &repoIndex[T]{keyFn: keyFn, entries: map[string]map[int64]bool{}}
+	for _, key := range r.order {
+		idx.add(key, r.rows[key])
+	}
+	r.indexes[name] = idx
+}
+
+func (idx *repoIndex[T]) add(key int64, v T) {
+	k := idx.keyFn(v)
+	if idx.entries[k] == nil {
+		idx.entries[k] = map[int64]bool{}
+	}
+	idx.entries[k][key] = true
+}
+
+func (idx *repoIndex[T]) remove(key int64, v T) {
+	k := idx.keyFn(v)
+	delete(idx.entries[k], key)
+	if len(idx.entries[k]) == 0 {
+		delete(idx.entries, k)
+	}
+}
+
+func (r *repository[T]) write(v T) error {
+	if err := v.validate(); err != nil {
+		return err
+	}
+	data, err := v.marshal()
+	if err != nil {
+		return err
+	}
+	return r.store.put(r.table, v.key(), data)
+}
+
+func (r *repository[T]) create(v T) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.rows[v.key()]; ok {
+		return errDuplicateKey
+	}
+	if err := r.write(v); err != nil {
+		return err
+	}
+	r.rows[v.key()] = v
+	r.order = append(r.order, v.key())
+	for _, idx := range r.indexes {
+		idx.add(v.key(), v)
+	}
+	return nil
+}
+
+func (r *repository[T]) update(v T) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	old, ok := r.rows[v.key()]
+	if !ok {
+		return errRecordNotFound
+	}
+	if err := r.write(v); err != nil {
+		return err
+	}
+	for _, idx := range r.indexes {
+		idx.remove(v.key(), old)
+		idx.add(v.key(), v)
+	}
+	r.rows[v.key()] = v
+	return nil
+}
+
+func (r *repository[T]) delete(key int64) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	old, ok := r.rows[key]
+	if !ok {
+		return errRecordNotFound
+	}
+	if err := r.store.remove(r.table, key); err != nil {
+		return err
+	}
+	for _, idx := range r.indexes {
+		idx.remove(key, old)
+	}
+	delete(r.rows, key)
+	for i, k := range r.order {
+		if k == key {
+			r.order = append(r.order[:i], r.order[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+func (r *repository[T]) get(key int64) (T, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	v, ok := r.rows[key]
+	return v, ok
+}
+
+func (r *repository[T]) has(key int64) bool {
+	_, ok := r.get(key)
+	return ok
+}
+
+func (r *repository[T]) count() int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return len(r.order)
+}
+
+// list returns rows in insertion order, a nil filter keeps everything
+func (r *repository[T]) list(filter func(T) bool) []T {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	out := make([]T, 0, len(r.order))
+	for _, key := range r.order {
+		if v := r.rows[key]; filter == nil || filter(v) {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+func (r *repository[T]) all() []T {
+	return r.list(nil)
+}
+
+// lookup uses a secondary index, results come back in insertion order
+func (r *repository[T]) lookup(index, value string) []T {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	idx, ok := r.indexes[index]
+	if !ok {
+		return nil
+	}
+	hits := idx.entries[value]
+	var out []T
+	for _, key := range r.order {
+		if hits[key] {
+			out = append(out, r.rows[key])
+		}
+	}
+	return out
+}
+
+// MEMORY BACKEND, the default. Bytes are copied in and out so callers can't poke at stored rows
+
+type memoryBackend struct {
+	mu     sync.RWMutex
+	tables map[string]*memoryTable
+}
+
+type memoryTable struct {
+	rows  map[int64][]byte
+	order []int64
+}
+
+func newMemoryBackend() *memoryBackend {
+	return &memoryBackend{tables: map[string]*memoryTable{}}
+}
+
+func (m *memoryBackend) table(name string) *memoryTable {
+	t, ok := m.tables[name]
+	if !ok {
+		t = &memoryTable{rows: map[int64][]byte{}}
+		m.tables[name] = t
+	}
+	return t
+}
+
+func (m *memoryBackend) put(table string, key int64, data []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	t := m.table(table)
+	if _, ok := t.rows[key]; !ok {
+		t.order = append(t.order, key)
+	}
+	t.rows[key] = append([]byte(nil), data...)
+	return nil
+}
+
+func (m *memoryBackend) get(table string, key int64) ([]byte, bool, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	t, ok := m.tables[table]
+	if !ok {
+		return nil, false, nil
+	}
+	data, ok := t.rows[key]
+	return append([]byte(nil), data...), ok, nil
+}
+
+func (m *memoryBackend) remove(table string, key int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	t, ok := m.tables[table]
+	if !ok {
+		return nil
+	}
+	if _, ok := t.rows[key]; !ok {
+		return nil
+	}
+	delete(t.rows, key)
+	for i, k := range t.order {
+		if k == key {
+			t.order = append(t.order[:i], t.order[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+func (m *memoryBackend) scan(table string, fn func(key int64, data []byte) error) error {
+	m.mu.RLock()
+	t, ok := m.tables[table]
+	if !ok {
+		m.mu.RUnlock()
+		return nil
+	}
+	keys := append([]int64(nil), t.order...)
+	rows := make([][]byte, len(keys))
+	for i, k := range keys {
+		rows[i] = append([]byte(nil), t.rows[k]...)
+	}
+	m.mu.RUnlock()
+	for i, k := range keys {
+		if err := fn(k, rows[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
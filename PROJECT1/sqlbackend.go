@@ -0,0 +1,546 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+// SQL BACKEND
+// Same backend interface as memoryBackend, but rows land in a SQLite database (modernc.org/sqlite,
+// pure go, no cgo) in tables with real columns, so any sqlite tool can open the file and run COUNT,
+// GROUP BY or JOIN on it. The schema is versioned in code below, new versions only ever get appended.
+// Keys are UNIQUE and not the PRIMARY KEY, so rowid stays the insertion order that scan promises.
+// A tenant's tables ("north/items") are real tables too, north__items, made on first use with the
+// current columns of the table they copy. Files are opened in WAL mode, a write is one small transaction.
+
+const sqlDriver = "sqlite"
+
+type sqlColumn struct {
+	name     string // column name, also the json key of the entity record
+	typ      string
+	jsonBlob bool // nested json (maps) is kept as text in the column
+	rowKey   bool // holds the backend key and isn't part of the json, for rows without an id of their own
+}
+
+// sqlTables maps repository and state tables to sql tables, anything not listed goes to the records table.
+// The first column is always the key
+var sqlTables = map[string][]sqlColumn{
+	"items": {
+		{name: "id", typ: "INTEGER"}, {name: "item", typ: "TEXT"}, {name: "category", typ: "TEXT"},
+		{name: "warehouse", typ: "TEXT"}, {name: "parent", typ: "INTEGER"}, {name: "options", typ: "TEXT", jsonBlob: true},
+		{name: "bin", typ: "TEXT"},
+		{name: "custom", typ: "TEXT", jsonBlob: true}, {name: "attachments", typ: "TEXT", jsonBlob: true},
+	},
+	"warehouses": {
+		{name: "id", typ: "INTEGER"}, {name: "code", typ: "TEXT"}, {name: "name", typ: "TEXT"}, {name: "site", typ: "TEXT"},
+	},
+	"suppliers": {
+		{name: "id", typ: "INTEGER"}, {name: "name", typ: "TEXT"}, {name: "email", typ: "TEXT"}, {name: "lead_time_days", typ: "INTEGER"},
+	},
+	"tenants": {
+		{name: "id", typ: "INTEGER"}, {name: "name", typ: "TEXT"}, {name: "categories", typ: "TEXT", jsonBlob: true},
+		{name: "warehouses", typ: "TEXT", jsonBlob: true},
+	},
+	stockTable: {
+		{name: "row_key", typ: "INTEGER", rowKey: true}, {name: "id", typ: "INTEGER"}, {name: "warehouse", typ: "TEXT"}, {name: "qty", typ: "INTEGER"},
+	},
+	ledgerTable: {
+		{name: "seq", typ: "INTEGER", rowKey: true}, {name: "at", typ: "TEXT"}, {name: "id", typ: "INTEGER"},
+		{name: "warehouse", typ: "TEXT"}, {name: "delta", typ: "INTEGER"}, {name: "reason", typ: "TEXT"},
+	},
+	bomTable: {
+		{name: "kit", typ: "INTEGER"}, {name: "lines", typ: "TEXT", jsonBlob: true},
+	},
+	categoryTable: {
+		{name: "row_key", typ: "INTEGER", rowKey: true}, {name: "path", typ: "TEXT"},
+		{name: "attributes", typ: "TEXT", jsonBlob: true}, {name: "custom_attributes", typ: "TEXT", jsonBlob: true},
+	},
+	orderTable: {
+		{name: "id", typ: "INTEGER"}, {name: "customer", typ: "TEXT"}, {name: "warehouse", typ: "TEXT"},
+		{name: "lines", typ: "TEXT", jsonBlob: true}, {name: "status", typ: "TEXT"}, {name: "placed_at", typ: "TEXT"},
+		{name: "reservations", typ: "TEXT", jsonBlob: true},
+	},
+	historyTable: {
+		{name: "seq", typ: "INTEGER", rowKey: true}, {name: "at", typ: "TEXT"}, {name: "kind", typ: "TEXT"}, {name: "id", typ: "INTEGER"},
+		{name: "item", typ: "TEXT", jsonBlob: true}, {name: "item_before", typ: "TEXT", jsonBlob: true},
+		{name: "from_warehouse", typ: "TEXT"}, {name: "to_warehouse", typ: "TEXT"}, {name: "from_bin", typ: "TEXT"},
+	},
+}
+
+type sqlMigration struct {
+	version    int
+	name       string
+	statements []string
+}
+
+var sqlMigrations = []sqlMigration{
+	{1, "create items", []string{
+		`CREATE TABLE items (id INTEGER NOT NULL UNIQUE, item TEXT NOT NULL, category TEXT, warehouse TEXT, parent INTEGER, options TEXT)`,
+	}},
+	{2, "create warehouses and suppliers", []string{
+		`CREATE TABLE warehouses (id INTEGER NOT NULL UNIQUE, code TEXT NOT NULL, name TEXT, site TEXT)`,
+		`CREATE TABLE suppliers (id INTEGER NOT NULL UNIQUE, name TEXT NOT NULL, email TEXT, lead_time_days INTEGER)`,
+	}},
+	{3, "create generic records", []string{
+		`CREATE TABLE records (tbl TEXT NOT NULL, id INTEGER NOT NULL, data TEXT NOT NULL, UNIQUE (tbl, id))`,
+	}},
+	{4, "add item bins", []string{
+		`ALTER TABLE items ADD COLUMN bin TEXT`,
+	}},
+	{5, "add item custom attributes and attachments", []string{
+		`ALTER TABLE items ADD COLUMN custom TEXT`,
+		`ALTER TABLE items ADD COLUMN attachments TEXT`,
+	}},
+	{6, "create stock, ledger, boms, categories and orders", []string{
+		`CREATE TABLE stock (row_key INTEGER NOT NULL UNIQUE, id INTEGER NOT NULL, warehouse TEXT NOT NULL, qty INTEGER NOT NULL)`,
+		`CREATE TABLE ledger (seq INTEGER NOT NULL UNIQUE, at TEXT, id INTEGER NOT NULL, warehouse TEXT, delta INTEGER NOT NULL, reason TEXT)`,
+		`CREATE TABLE boms (kit INTEGER NOT NULL UNIQUE, lines TEXT)`,
+		`CREATE TABLE categories (row_key INTEGER NOT NULL UNIQUE, path TEXT NOT NULL, attributes TEXT, custom_attributes TEXT)`,
+		`CREATE TABLE orders (id INTEGER NOT NULL UNIQUE, customer TEXT, warehouse TEXT, lines TEXT, status TEXT, placed_at TEXT, reservations TEXT)`,
+	}},
+	{7, "create item history", []string{
+		`CREATE TABLE history (seq INTEGER NOT NULL UNIQUE, at TEXT, kind TEXT NOT NULL, id INTEGER NOT NULL, item TEXT, item_before TEXT, from_warehouse TEXT, to_warehouse TEXT, from_bin TEXT)`,
+	}},
+	{8, "create tenants", []string{
+		`CREATE TABLE tenants (id INTEGER NOT NULL UNIQUE, name TEXT NOT NULL, categories TEXT, warehouses TEXT)`,
+		`INSERT INTO tenants (id, name, categories, warehouses)
+			SELECT id, json_extract(data, '$.name'), json_extract(data, '$.categories'), json_extract(data, '$.warehouses')
+			FROM records WHERE tbl = 'tenants' ORDER BY rowid`,
+		`DELETE FROM records WHERE tbl = 'tenants'`,
+	}},
+}
+
+var errSchemaTooNew = errors.New("database schema is newer than this program")
+
+type sqlBackend struct {
+	db *sql.DB
+
+	mu     sync.Mutex
+	tables map[string]bool // tenant tables known to exist with every column
+}
+
+// openSQLBackend opens (or creates) the sqlite file at path, ":memory:" for a throwaway one,
+// and brings its schema up to date
+func openSQLBackend(path string) (*sqlBackend, error) {
+	dsn := path
+	if path != ":memory:" {
+		dsn = "file:" + path + "?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)&_pragma=synchronous(NORMAL)"
+	}
+	db, err := sql.Open(sqlDriver, dsn)
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(1) // ":memory:" databases only live as long as their connection, files get one writer anyway
+	if _, err := migrateSQL(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &sqlBackend{db: db, tables: map[string]bool{}}, nil
+}
+
+func (b *sqlBackend) close() error {
+	return b.db.Close()
+}
+
+// schemaVersion is 0 for a brand new database
+func schemaVersion(db *sql.DB) (int, error) {
+	if _, err := db.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (version INTEGER PRIMARY KEY, name TEXT, applied_at TEXT)`); err != nil {
+		return 0, err
+	}
+	var current int
+	err := db.QueryRow(`SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&current)
+	return current, err
+}
+
+// migrateSQL runs every migration the database hasn't seen yet, each one in its own transaction
+func migrateSQL(db *sql.DB) (applied int, err error) {
+	current, err := schemaVersion(db)
+	if err != nil {
+		return 0, err
+	}
+	latest := sqlMigrations[len(sqlMigrations)-1].version
+	if current > latest {
+		return 0, fmt.Errorf("%w: database is at %v, we know up to %v", errSchemaTooNew, current, latest)
+	}
+	for _, m := range sqlMigrations {
+		if m.version <= current {
+			continue
+		}
+		tx, err := db.Begin()
+		if err != nil {
+			return applied, err
+		}
+		for _, stmt := range m.statements {
+			if _, err := tx.Exec(stmt); err != nil {
+				tx.Rollback()
+				return applied, fmt.Errorf("migration %v (%v): %w", m.version, m.name, err)
+			}
+		}
+		if _, err := tx.Exec(`INSERT INTO schema_migrations (version, name, applied_at) VALUES (?, ?, ?)`, m.version, m.name, time.Now().UTC().Format(time.RFC3339)); err != nil {
+			tx.Rollback()
+			return applied, err
+		}
+		if err := tx.Commit(); err != nil {
+			return applied, err
+		}
+		applied++
+	}
+	return applied, nil
+}
+
+// sqlTable is the table name in the database and its columns, ok is false for tables without a schema.
+// "north/items" becomes north__items with the items columns, tenant names can't hold an underscore
+// so the names can't run into each other
+func sqlTable(table string) (name string, cols []sqlColumn, ok bool) {
+	prefix, base, tenant := strings.Cut(table, "/")
+	if !tenant {
+		cols, ok = sqlTables[table]
+		return table, cols, ok
+	}
+	cols, ok = sqlTables[base]
+	return strings.ReplaceAll(prefix, "-", "_") + "__" + base, cols, ok
+}
+
+func quoteIdent(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
+
+// ensureTable makes a tenant table on first use and adds the columns later migrations gave its base table
+func (b *sqlBackend) ensureTable(table string) error {
+	name, cols, ok := sqlTable(table)
+	if !ok || name == table {
+		return nil // base tables come from the migrations
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.tables[name] {
+		return nil
+	}
+	defs := make([]string, len(cols))
+	for i, c := range cols {
+		defs[i] = quoteIdent(c.name) + " " + c.typ
+		if i == 0 {
+			defs[i] += " NOT NULL UNIQUE"
+		}
+	}
+	if _, err := b.db.Exec(fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %v (%v)`, quoteIdent(name), strings.Join(defs, ", "))); err != nil {
+		return err
+	}
+	rows, err := b.db.Query(`SELECT name FROM pragma_table_info(?)`, name)
+	if err != nil {
+		return err
+	}
+	have := map[string]bool{}
+	for rows.Next() {
+		var col string
+		if err := rows.Scan(&col); err != nil {
+			rows.Close()
+			return err
+		}
+		have[col] = true
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for _, c := range cols {
+		if !have[c.name] {
+			if _, err := b.db.Exec(fmt.Sprintf(`ALTER TABLE %v ADD COLUMN %v %v`, quoteIdent(name), quoteIdent(c.name), c.typ)); err != nil {
+				return err
+			}
+		}
+	}
+	b.tables[name] = true
+	return nil
+}
+
+// dropTables removes every table of a tenant, for a tenant that never got going
+func (b *sqlBackend) dropTables(tenant string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	prefix := strings.ReplaceAll(tenant, "-", "_") + "__"
+	for base := range sqlTables {
+		name := prefix + base
+		if _, err := b.db.Exec(`DROP TABLE IF EXISTS ` + quoteIdent(name)); err != nil {
+			return err
+		}
+		delete(b.tables, name)
+	}
+	_, err := b.db.Exec(`DELETE FROM records WHERE tbl LIKE ? ESCAPE '\'`, strings.NewReplacer("%", `\%`, "_", `\_`).Replace(tenant)+"/%")
+	return err
+}
+
+// toColumns splits an entity's json into column values, a rowKey column gets key
+func toColumns(cols []sqlColumn, key int64, data []byte) ([]any, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var fields map[string]json.RawMessage
+	if err := dec.Decode(&fields); err != nil {
+		return nil, err
+	}
+	vals := make([]any, len(cols))
+	for i, c := range cols {
+		if c.rowKey {
+			vals[i] = key
+			continue
+		}
+		raw, ok := fields[c.name]
+		if !ok || string(raw) == "null" {
+			continue
+		}
+		if c.jsonBlob {
+			vals[i] = string(raw)
+			continue
+		}
+		var v any
+		d := json.NewDecoder(bytes.NewReader(raw))
+		d.UseNumber()
+		if err := d.Decode(&v); err != nil {
+			return nil, err
+		}
+		if n, ok := v.(json.Number); ok {
+			if iv, err := n.Int64(); err == nil {
+				v = iv
+			} else if fv, err := n.Float64(); err == nil {
+				v = fv
+			}
+		}
+		vals[i] = v
+	}
+	return vals, nil
+}
+
+// fromColumns rebuilds the entity json, NULL columns are left out like omitempty would
+func fromColumns(cols []sqlColumn, vals []any) ([]byte, error) {
+	fields := map[string]any{}
+	for i, c := range cols {
+		if c.rowKey {
+			continue
+		}
+		switch v := vals[i].(type) {
+		case nil:
+		case []byte:
+			if c.jsonBlob {
+				fields[c.name] = json.RawMessage(v)
+			} else {
+				fields[c.name] = string(v)
+			}
+		case string:
+			if c.jsonBlob {
+				fields[c.name] = json.RawMessage(v)
+			} else {
+				fields[c.name] = v
+			}
+		default:
+			fields[c.name] = v
+		}
+	}
+	return json.Marshal(fields)
+}
+
+func (b *sqlBackend) put(table string, key int64, data []byte) error {
+	name, cols, ok := sqlTable(table)
+	if !ok {
+		_, err := b.db.Exec(`INSERT INTO records (tbl, id, data) VALUES (?, ?, ?) ON CONFLICT (tbl, id) DO UPDATE SET data = excluded.data`, table, key, string(data))
+		return err
+	}
+	if err := b.ensureTable(table); err != nil {
+		return err
+	}
+	vals, err := toColumns(cols, key, data)
+	if err != nil {
+		return err
+	}
+	names := make([]string, len(cols))
+	marks := make([]string, len(cols))
+	sets := make([]string, 0, len(cols)-1)
+	for i, c := range cols {
+		names[i] = quoteIdent(c.name)
+		marks[i] = "?"
+		if i > 0 {
+			sets = append(sets, names[i]+" = excluded."+names[i])
+		}
+	}
+	// an upsert keeps the rowid of an existing row, and with it its place in the listing
+	_, err = b.db.Exec(fmt.Sprintf(`INSERT INTO %v (%v) VALUES (%v) ON CONFLICT (%v) DO UPDATE SET %v`,
+		quoteIdent(name), strings.Join(names, ", "), strings.Join(marks, ", "), names[0], strings.Join(sets, ", ")), vals...)
+	return err
+}
+
+func (b *sqlBackend) get(table string, key int64) ([]byte, bool, error) {
+	var found []byte
+	err := b.query(table, key, true, func(_ int64, data []byte) error {
+		found = data
+		return nil
+	})
+	return found, found != nil, err
+}
+
+func (b *sqlBackend) remove(table string, key int64) error {
+	name, cols, ok := sqlTable(table)
+	if !ok {
+		_, err := b.db.Exec(`DELETE FROM records WHERE tbl = ? AND id = ?`, table, key)
+		return err
+	}
+	if err := b.ensureTable(table); err != nil {
+		return err
+	}
+	_, err := b.db.Exec(fmt.Sprintf(`DELETE FROM %v WHERE %v = ?`, quoteIdent(name), quoteIdent(cols[0].name)), key)
+	return err
+}
+
+func (b *sqlBackend) scan(table string, fn func(key int64, data []byte) error) error {
+	return b.query(table, 0, false, fn)
+}
+
+// query reads rows in rowid order, only the one with key when byKey is set, and hands them over as entity json
+func (b *sqlBackend) query(table string, key int64, byKey bool, fn func(key int64, data []byte) error) error {
+	name, cols, ok := sqlTable(table)
+	var rows *sql.Rows
+	var err error
+	switch {
+	case !ok && byKey:
+		rows, err = b.db.Query(`SELECT id, data FROM records WHERE tbl = ? AND id = ?`, table, key)
+	case !ok:
+		rows, err = b.db.Query(`SELECT id, data FROM records WHERE tbl = ? ORDER BY rowid`, table)
+	default:
+		if err := b.ensureTable(table); err != nil {
+			return err
+		}
+		names := make([]string, len(cols))
+		for i, c := range cols {
+			names[i] = quoteIdent(c.name)
+		}
+		stmt := fmt.Sprintf(`SELECT %v FROM %v`, strings.Join(names, ", "), quoteIdent(name))
+		if byKey {
+			rows, err = b.db.Query(stmt+` WHERE `+names[0]+` = ?`, key)
+		} else {
+			rows, err = b.db.Query(stmt + ` ORDER BY rowid`)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	type row struct {
+		key  int64
+		data []byte
+	}
+	var all []row
+	for rows.Next() {
+		if !ok {
+			var r row
+			var data string
+			if err := rows.Scan(&r.key, &data); err != nil {
+				rows.Close()
+				return err
+			}
+			r.data = []byte(data)
+			all = append(all, r)
+			continue
+		}
+		vals := make([]any, len(cols))
+		ptrs := make([]any, len(cols))
+		for i := range vals {
+			ptrs[i] = &vals[i]
+		}
+		if err := rows.Scan(ptrs...); err != nil {
+			rows.Close()
+			return err
+		}
+		data, err := fromColumns(cols, vals)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		key, _ := vals[0].(int64)
+		all = append(all, row{key, data})
+	}
+	if err := rows.Close(); err != nil {
+		return err
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	// rows are closed before calling back, so fn is free to use the database
+	for _, r := range all {
+		if err := fn(r.key, r.data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func init() {
+	commands["export-sql"] = command{
+		usage: "export-sql <file.db>",
+		run: func(s *System, args []string) error {
+			if len(args) != 1 {
+				return errUsage
+			}
+			dst, err := openSQLBackend(args[0])
+			if err != nil {
+				return err
+			}
+			defer dst.close()
+			n := 0
+			for _, table := range allTables {
+				err := s.store.scan(table, func(key int64, data []byte) error {
+					n++
+					return dst.put(table, key, data)
+				})
+				if err != nil {
+					return err
+				}
+			}
+			fmt.Printf("exported %v rows to %v\n", n, args[0])
+			return nil
+		},
+	}
+	commands["query"] = command{
+		usage: "query <file.db> \"SELECT a, b FROM t WHERE c = 'x' ORDER BY a\"",
+		run: func(s *System, args []string) error {
+			if len(args) != 2 {
+				return errUsage
+			}
+			b, err := openSQLBackend(args[0])
+			if err != nil {
+				return err
+			}
+			defer b.close()
+			rows, err := b.db.Query(args[1])
+			if err != nil {
+				return err
+			}
+			defer rows.Close()
+			cols, _ := rows.Columns()
+			fmt.Println(strings.Join(cols, " | "))
+			for rows.Next() {
+				vals := make([]any, len(cols))
+				ptrs := make([]any, len(cols))
+				for i := range vals {
+					ptrs[i] = &vals[i]
+				}
+				if err := rows.Scan(ptrs...); err != nil {
+					return err
+				}
+				parts := make([]string, len(vals))
+				for i, v := range vals {
+					if b, ok := v.([]byte); ok {
+						v = string(b)
+					}
+					parts[i] = fmt.Sprint(v)
+				}
+				fmt.Println(strings.Join(parts, " | "))
+			}
+			return rows.Err()
+		},
+	}
+}
@@ -0,0 +1,500 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"reflect"
+	"sort"
+	"time"
+)
+
+// STATE TABLES
+// Items, warehouses and suppliers have repositories. Stock, the ledger, BOMs, categories and orders
+// live in plain maps on System, so they are written through to the same backend here, one row per
+// stock level, ledger line, kit, category and order (reservations ride along with their order).
+// Item events go to the history table too, so a point-in-time export still works after a restart.
+// createDB reads them back, so a System reopened on the same backend has its numbers again.
+// The row formats are the data file's (datafile.go), a row means the same thing in both places.
+
+const (
+	stockTable    = "stock"
+	ledgerTable   = "ledger"
+	bomTable      = "boms"
+	categoryTable = "categories"
+	orderTable    = "orders"
+	historyTable  = "history"
+)
+
+// allTables is every table a System writes, in the order a copy should go
+var allTables = []string{"items", "warehouses", "suppliers", categoryTable, stockTable, ledgerTable, bomTable, orderTable, historyTable}
+
+type orderLineRecord struct {
+	Item int64 `json:"item"`
+	Qty  int   `json:"qty"`
+}
+
+type reservationRecord struct {
+	Item      int64      `json:"item"`
+	Warehouse string     `json:"warehouse"`
+	Qty       int        `json:"qty"`
+	Expires   *time.Time `json:"expires,omitempty"` // nil once picked
+}
+
+type orderRecord struct {
+	ID           int64               `json:"id"`
+	Customer     string              `json:"customer"`
+	Warehouse    string              `json:"warehouse"`
+	Lines        []orderLineRecord   `json:"lines"`
+	Status       orderStatus         `json:"status"`
+	PlacedAt     time.Time           `json:"placed_at"`
+	Reservations []reservationRecord `json:"reservations,omitempty"`
+}
+
+// historyRecord is one item event. Item is the item that was created or deleted, or the state after an update,
+// Before the state before an update
+type historyRecord struct {
+	At      time.Time       `json:"at"`
+	Kind    string          `json:"kind"` // created, updated, deleted, moved
+	ID      int64           `json:"id"`
+	Item    json.RawMessage `json:"item,omitempty"`
+	Before  json.RawMessage `json:"item_before,omitempty"`
+	From    string          `json:"from_warehouse,omitempty"`
+	To      string          `json:"to_warehouse,omitempty"`
+	FromBin string          `json:"from_bin,omitempty"`
+}
+
+// rowKey turns a natural key (item + warehouse, a category path) into the int64 a backend wants
+func rowKey(natural string) int64 {
+	h := fnv.New64a()
+	h.Write([]byte(natural))
+	return int64(h.Sum64() &^ (1 << 63))
+}
+
+func stockRowKey(key stockKey) int64 {
+	return rowKey(fmt.Sprintf("%v/%v", key.id, key.warehouse))
+}
+
+func (s *System) putRow(table string, key int64, v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return s.store.put(table, key, data)
+}
+
+// saveStockLocked and the other save helpers must be called with s.mu held
+func (s *System) saveStockLocked(key stockKey, qty int) error {
+	return s.putRow(stockTable, stockRowKey(key), stockFileRecord{ID: key.id, Warehouse: key.warehouse, Qty: qty})
+}
+
+func (s *System) dropStockLocked(key stockKey) error {
+	return s.store.remove(stockTable, stockRowKey(key))
+}
+
+// saveLedgerLocked writes the entry that will sit at position n (1 based) of s.ledger
+func (s *System) saveLedgerLocked(n int, e ledgerEntry) error {
+	return s.putRow(ledgerTable, int64(n), ledgerFileRecord{At: e.at, ID: e.id, Warehouse: e.warehouse, Delta: e.delta, Reason: e.reason})
+}
+
+func (s *System) saveBOMLocked(bom billOfMaterials) error {
+	rec := bomFileRecord{Kit: bom.kit}
+	for _, l := range bom.lines {
+		rec.Lines = append(rec.Lines, bomLineRecord{Component: l.component, Qty: l.qty})
+	}
+	return s.putRow(bomTable, bom.kit, rec)
+}
+
+func (s *System) dropBOMLocked(kit int64) error {
+	return s.store.remove(bomTable, kit)
+}
+
+// categoryRecordLocked is the category with its own attributes and attribute definitions
+func (s *System) categoryRecordLocked(path string) (categoryFileRecord, bool) {
+	node, ok := s.categories.find(path)
+	if !ok {
+		return categoryFileRecord{}, false
+	}
+	rec := categoryFileRecord{Path: node.path(), Attributes: map[string]string{}}
+	for k, v := range node.attributes {
+		rec.Attributes[k] = v
+	}
+	for _, d := range s.attrDefs[categoryKey(path)] {
+		rec.Custom = append(rec.Custom, attributeDefRecord{Name: d.name, Kind: d.kind, Required: d.required, Choices: d.choices})
+	}
+	sort.Slice(rec.Custom, func(a, b int) bool { return rec.Custom[a].Name < rec.Custom[b].Name })
+	return rec, true
+}
+
+func (s *System) saveCategoryLocked(path string) error {
+	rec, ok := s.categoryRecordLocked(path)
+	if !ok {
+		return errCategoryNotFound
+	}
+	return s.putRow(categoryTable, rowKey(rec.Path), rec)
+}
+
+func (s *System) dropCategoryLocked(path string) error {
+	return s.store.remove(categoryTable, rowKey(categoryKey(path)))
+}
+
+func (s *System) orderRecordLocked(o *salesOrder) orderRecord {
+	rec := orderRecord{ID: o.id, Customer: o.customer, Warehouse: o.warehouse, Status: o.status, PlacedAt: o.placedAt}
+	for _, l := range o.lines {
+		rec.Lines = append(rec.Lines, orderLineRecord{Item: l.item, Qty: l.qty})
+	}
+	for _, r := range s.reservations {
+		if r.order != o.id {
+			continue
+		}
+		rr := reservationRecord{Item: r.item, Warehouse: r.warehouse, Qty: r.qty}
+		if !r.expires.IsZero() {
+			expires := r.expires
+			rr.Expires = &expires
+		}
+		rec.Reservations = append(rec.Reservations, rr)
+	}
+	return rec
+}
+
+func (s *System) saveOrderLocked(id int64) error {
+	o, ok := s.orders[id]
+	if !ok {
+		return errOrderNotFound
+	}
+	return s.putRow(orderTable, id, s.orderRecordLocked(o))
+}
+
+// saveHistoryLocked appends an item event to the history table
+func (s *System) saveHistoryLocked(at time.Time, ev changeEvent) error {
+	rec := historyRecord{At: at, ID: ev.itemID()}
+	var err error
+	switch e := ev.(type) {
+	case itemCreated:
+		rec.Kind = "created"
+		rec.Item, err = e.item.marshal()
+	case itemDeleted:
+		rec.Kind = "deleted"
+		rec.Item, err = e.item.marshal()
+	case itemUpdated:
+		rec.Kind = "updated"
+		if rec.Item, err = e.after.marshal(); err == nil {
+			rec.Before, err = e.before.marshal()
+		}
+	case itemMoved:
+		rec.Kind, rec.From, rec.To, rec.FromBin = "moved", e.from, e.to, e.fromBin
+	default:
+		return nil // stock moves are in the ledger, a merge is already its updates and deletes
+	}
+	if err != nil {
+		return err
+	}
+	if err := s.putRow(historyTable, s.historyLen+1, rec); err != nil {
+		return err
+	}
+	s.historyLen++
+	return nil
+}
+
+// historyAfter reads the item events newer than t back from the history table, oldest first
+func (s *System) historyAfter(t time.Time) ([]eventRecord, error) {
+	var out []eventRecord
+	err := scanRows(s.store, historyTable, func(n int64, h historyRecord) error {
+		if !h.At.After(t) {
+			return nil
+		}
+		rec := eventRecord{offset: n, at: h.At}
+		var err error
+		var item, before Item
+		if len(h.Item) > 0 {
+			if item, err = decodeItem(h.Item); err != nil {
+				return fmt.Errorf("history %v: %w", n, err)
+			}
+		}
+		if len(h.Before) > 0 {
+			if before, err = decodeItem(h.Before); err != nil {
+				return fmt.Errorf("history %v: %w", n, err)
+			}
+		}
+		switch h.Kind {
+		case "created":
+			rec.event = itemCreated{item: item}
+		case "deleted":
+			rec.event = itemDeleted{item: item}
+		case "updated":
+			rec.event = itemUpdated{before: before, after: item}
+		case "moved":
+			rec.event = itemMoved{id: h.ID, from: h.From, to: h.To, fromBin: h.FromBin}
+		default:
+			return fmt.Errorf("history %v: unknown kind %q", n, h.Kind)
+		}
+		out = append(out, rec)
+		return nil
+	})
+	sort.Slice(out, func(a, b int) bool { return out[a].offset < out[b].offset })
+	return out, err
+}
+
+// restoreOrder puts a saved order and its reservations back, must be called with s.mu held
+func (s *System) restoreOrder(rec orderRecord) {
+	o := &salesOrder{id: rec.ID, customer: rec.Customer, warehouse: rec.Warehouse, status: rec.Status, placedAt: rec.PlacedAt}
+	for _, l := range rec.Lines {
+		o.lines = append(o.lines, orderLine{item: l.Item, qty: l.Qty})
+	}
+	s.orders[o.id] = o
+	for _, r := range rec.Reservations {
+		res := reservation{order: o.id, item: r.Item, warehouse: r.Warehouse, qty: r.Qty}
+		if r.Expires != nil {
+			res.expires = *r.Expires
+		}
+		s.reservations = append(s.reservations, res)
+	}
+	s.nextOrder = max(s.nextOrder, o.id)
+}
+
+// restoreCategory adds a saved category, or fills in the attributes of one that exists already
+func (s *System) restoreCategory(c categoryFileRecord) error {
+	for _, d := range c.Custom {
+		if s.attrDefs == nil {
+			s.attrDefs = map[string]map[string]attributeDef{}
+		}
+		key := categoryKey(c.Path)
+		if s.attrDefs[key] == nil {
+			s.attrDefs[key] = map[string]attributeDef{}
+		}
+		s.attrDefs[key][d.Name] = attributeDef{name: d.Name, kind: d.Kind, required: d.Required, choices: d.Choices}
+	}
+	if node, ok := s.categories.find(c.Path); ok {
+		for k, v := range c.Attributes {
+			node.attributes[k] = v
+		}
+		return nil
+	}
+	if _, err := s.categories.add(c.Path, c.Attributes); err != nil {
+		return fmt.Errorf("category %v: %w", c.Path, err)
+	}
+	return nil
+}
+
+// loadState reads the state tables back into a freshly created System
+func (s *System) loadState() error {
+	var categories []categoryFileRecord
+	err := scanRows(s.store, categoryTable, func(_ int64, c categoryFileRecord) error {
+		categories = append(categories, c)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	// sorted paths put every parent before its children
+	sort.Slice(categories, func(a, b int) bool { return categories[a].Path < categories[b].Path })
+	for _, c := range categories {
+		if err := s.restoreCategory(c); err != nil {
+			return err
+		}
+	}
+	err = scanRows(s.store, stockTable, func(_ int64, st stockFileRecord) error {
+		s.stock[stockKey{st.ID, st.Warehouse}] = st.Qty
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	type numbered struct {
+		n int64
+		e ledgerEntry
+	}
+	var ledger []numbered
+	err = scanRows(s.store, ledgerTable, func(n int64, e ledgerFileRecord) error {
+		ledger = append(ledger, numbered{n, ledgerEntry{at: e.At, id: e.ID, warehouse: e.Warehouse, delta: e.Delta, reason: e.Reason}})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	sort.Slice(ledger, func(a, b int) bool { return ledger[a].n < ledger[b].n })
+	for _, l := range ledger {
+		s.ledger = append(s.ledger, l.e)
+	}
+	err = scanRows(s.store, bomTable, func(_ int64, b bomFileRecord) error {
+		bom := billOfMaterials{kit: b.Kit}
+		for _, l := range b.Lines {
+			bom.lines = append(bom.lines, bomLine{component: l.Component, qty: l.Qty})
+		}
+		s.boms[b.Kit] = bom
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	var orders []orderRecord
+	err = scanRows(s.store, orderTable, func(_ int64, o orderRecord) error {
+		orders = append(orders, o)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	sort.Slice(orders, func(a, b int) bool { return orders[a].ID < orders[b].ID })
+	for _, o := range orders {
+		s.restoreOrder(o)
+	}
+	return s.store.scan(historyTable, func(n int64, _ []byte) error {
+		s.historyLen = max(s.historyLen, n)
+		return nil
+	})
+}
+
+// saveStateLocked rewrites every state table from memory, for a System whose maps were filled
+// directly (loading a data file). Rows nobody has any more go too
+func (s *System) saveStateLocked() error {
+	if err := clearTable(s.store, stockTable); err != nil {
+		return err
+	}
+	for key, qty := range s.stock {
+		if err := s.saveStockLocked(key, qty); err != nil {
+			return err
+		}
+	}
+	for i, e := range s.ledger {
+		if err := s.saveLedgerLocked(i+1, e); err != nil {
+			return err
+		}
+	}
+	if err := clearTable(s.store, bomTable); err != nil {
+		return err
+	}
+	for _, bom := range s.boms {
+		if err := s.saveBOMLocked(bom); err != nil {
+			return err
+		}
+	}
+	for _, path := range s.categories.list() {
+		if err := s.saveCategoryLocked(path); err != nil {
+			return err
+		}
+	}
+	for id := range s.orders {
+		if err := s.saveOrderLocked(id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// stateRows is the stock, ledger, BOM and order rows as they stand, to tell later which ones a change touched
+type stateRows struct {
+	stock  map[stockKey]int
+	ledger []ledgerEntry
+	boms   map[int64]billOfMaterials
+	orders map[int64]orderRecord
+}
+
+func (s *System) stateRowsLocked() stateRows {
+	rows := stateRows{
+		stock:  make(map[stockKey]int, len(s.stock)),
+		ledger: append([]ledgerEntry(nil), s.ledger...),
+		boms:   make(map[int64]billOfMaterials, len(s.boms)),
+		orders: make(map[int64]orderRecord, len(s.orders)),
+	}
+	for key, qty := range s.stock {
+		rows.stock[key] = qty
+	}
+	for kit, bom := range s.boms {
+		rows.boms[kit] = bom
+	}
+	for id, o := range s.orders {
+		rows.orders[id] = s.orderRecordLocked(o)
+	}
+	return rows
+}
+
+// saveChangedLocked writes the rows that differ from before and drops the ones memory no longer has,
+// for changes that touch rows all over (merging items renames ids in the ledger, the stock and the orders).
+// Called with what was written last as before, it also puts a half finished write back
+func (s *System) saveChangedLocked(before stateRows) error {
+	now := s.stateRowsLocked()
+	for key, qty := range now.stock {
+		if old, ok := before.stock[key]; !ok || old != qty {
+			if err := s.saveStockLocked(key, qty); err != nil {
+				return err
+			}
+		}
+	}
+	for key := range before.stock {
+		if _, ok := now.stock[key]; !ok {
+			if err := s.dropStockLocked(key); err != nil {
+				return err
+			}
+		}
+	}
+	for i, e := range now.ledger {
+		if i >= len(before.ledger) || !reflect.DeepEqual(before.ledger[i], e) {
+			if err := s.saveLedgerLocked(i+1, e); err != nil {
+				return err
+			}
+		}
+	}
+	for n := len(now.ledger) + 1; n <= len(before.ledger); n++ {
+		if err := s.store.remove(ledgerTable, int64(n)); err != nil {
+			return err
+		}
+	}
+	for kit, bom := range now.boms {
+		if old, ok := before.boms[kit]; !ok || !reflect.DeepEqual(old, bom) {
+			if err := s.saveBOMLocked(bom); err != nil {
+				return err
+			}
+		}
+	}
+	for kit := range before.boms {
+		if _, ok := now.boms[kit]; !ok {
+			if err := s.dropBOMLocked(kit); err != nil {
+				return err
+			}
+		}
+	}
+	for id, rec := range now.orders {
+		if old, ok := before.orders[id]; !ok || !reflect.DeepEqual(old, rec) {
+			if err := s.putRow(orderTable, id, rec); err != nil {
+				return err
+			}
+		}
+	}
+	for id := range before.orders {
+		if _, ok := now.orders[id]; !ok {
+			if err := s.store.remove(orderTable, id); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func clearTable(store backend, table string) error {
+	var keys []int64
+	err := store.scan(table, func(key int64, _ []byte) error {
+		keys = append(keys, key)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if err := store.remove(table, key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// scanRows decodes every row of a table into R
+func scanRows[R any](store backend, table string, fn func(key int64, rec R) error) error {
+	return store.scan(table, func(key int64, data []byte) error {
+		var rec R
+		if err := json.Unmarshal(data, &rec); err != nil {
+			return fmt.Errorf("%v %v: %w", table, key, err)
+		}
+		return fn(key, rec)
+	})
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// STOCK
+// An Item is the record ("Flour Bag"), stock is how many of it sit in each warehouse.
+// Every change goes through the ledger so we always know why a number moved.
+// issue only hands out what is not reserved by a sales order, see orders.go
+
+var (
+	errInsufficientStock = errors.New("not enough stock")
+	errBadQuantity       = errors.New("quantity must be positive")
+)
+
+type stockKey struct {
+	id        int64
+	warehouse string
+}
+
+type ledgerEntry struct {
+	at        time.Time
+	id        int64
+	warehouse string
+	delta     int // + received, - issued
+	reason    string
+}
+
+// stockAdjusted goes out on the event bus for every ledger entry
+type stockAdjusted struct {
+	entry   ledgerEntry
+	balance int
+}
+
+func (e stockAdjusted) itemID() int64 { return e.entry.id }
+func (e stockAdjusted) describe() string {
+	return fmt.Sprintf("stock id: %v | warehouse: %v | %+d (%v) -> %v", e.entry.id, e.entry.warehouse, e.entry.delta, e.entry.reason, e.balance)
+}
+
+// adjustLocked must be called with s.mu held, the caller queues the returned event with emitLocked
+func (s *System) adjustLocked(id int64, warehouse string, delta int, reason string) (stockAdjusted, error) {
+	if !s.db.has(id) {
+		return stockAdjusted{}, errItemNotFound
+	}
+	if err := s.checkWarehouseLocked(warehouse); err != nil {
+		return stockAdjusted{}, err
+	}
+	key := stockKey{id, warehouse}
+	if s.stock[key]+delta < 0 {
+		return stockAdjusted{}, errInsufficientStock
+	}
+	entry := ledgerEntry{at: s.now(), id: id, warehouse: warehouse, delta: delta, reason: reason}
+	// the ledger line goes to the backend first, a stock row without its reason is worse than the other way round
+	if err := s.saveLedgerLocked(len(s.ledger)+1, entry); err != nil {
+		return stockAdjusted{}, err
+	}
+	if err := s.saveStockLocked(key, s.stock[key]+delta); err != nil {
+		s.store.remove(ledgerTable, int64(len(s.ledger)+1))
+		return stockAdjusted{}, err
+	}
+	s.stock[key] += delta
+	s.ledger = append(s.ledger, entry)
+	return stockAdjusted{entry: entry, balance: s.stock[key]}, nil
+}
+
+// unadjustLocked takes back adjustments that are the newest ledger entries, newest first, for callers
+// whose next step failed. The ledger line goes as if it was never written, the stock row gets its old number back
+func (s *System) unadjustLocked(done []stockAdjusted) error {
+	for i := len(done) - 1; i >= 0; i-- {
+		e := done[i].entry
+		key := stockKey{e.id, e.warehouse}
+		if err := s.saveStockLocked(key, s.stock[key]-e.delta); err != nil {
+			return err
+		}
+		if err := s.store.remove(ledgerTable, int64(len(s.ledger))); err != nil {
+			return err
+		}
+		s.stock[key] -= e.delta
+		s.ledger = s.ledger[:len(s.ledger)-1]
+	}
+	return nil
+}
+
+type stockChange struct {
+	id    int64
+	delta int
+}
+
+// adjustAllLocked makes every change or none: when one fails the ones before it are taken back.
+// Nothing is emitted, the caller does that with the returned events once the rest of its work stands
+func (s *System) adjustAllLocked(changes []stockChange, warehouse, reason string) ([]stockAdjusted, error) {
+	var done []stockAdjusted
+	for _, c := range changes {
+		ev, err := s.adjustLocked(c.id, warehouse, c.delta, reason)
+		if err != nil {
+			if uerr := s.unadjustLocked(done); uerr != nil {
+				return nil, errors.Join(fmt.Errorf("item %v: %w", c.id, err), fmt.Errorf("undo: %w", uerr))
+			}
+			return nil, fmt.Errorf("item %v: %w", c.id, err)
+		}
+		done = append(done, ev)
+	}
+	return done, nil
+}
+
+func (s *System) receive(id int64, warehouse string, qty int, reason string) error {
+	if qty <= 0 {
+		return errBadQuantity
+	}
+	s.mu.Lock()
+	ev, err := s.adjustLocked(id, warehouse, qty, reason)
+	if err == nil {
+		s.emitLocked(ev)
+	}
+	s.mu.Unlock()
+	s.flushEvents()
+	return err
+}
+
+func (s *System) issue(id int64, warehouse string, qty int, reason string) error {
+	if qty <= 0 {
+		return errBadQuantity
+	}
+	s.mu.Lock()
+	s.expireLocked()
+	// short on the shelf is errInsufficientStock from adjustLocked, errReserved is only for
+	// stock that is there but promised to an order
+	if s.db.has(id) && s.stock[stockKey{id, warehouse}] >= qty && s.availableLocked(id, warehouse) < qty {
+		s.mu.Unlock()
+		return errReserved
+	}
+	ev, err := s.adjustLocked(id, warehouse, -qty, reason)
+	if err == nil {
+		s.emitLocked(ev)
+	}
+	s.mu.Unlock()
+	s.flushEvents()
+	return err
+}
+
+func (s *System) onHand(id int64, warehouse string) int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.stock[stockKey{id, warehouse}]
+}
+
+// totalOnHand adds up every warehouse
+func (s *System) totalOnHand(id int64) int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	total := 0
+	for key, qty := range s.stock {
+		if key.id == id {
+			total += qty
+		}
+	}
+	return total
+}
+
+// ledgerFor returns a copy of the ledger lines for one item, oldest first
+func (s *System) ledgerFor(id int64) []ledgerEntry {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var entries []ledgerEntry
+	for _, e := range s.ledger {
+		if e.id == id {
+			entries = append(entries, e)
+		}
+	}
+	return entries
+}
@@ -1 +0,0 @@
-z
\ No newline at end of file
@@ -0,0 +1,352 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// TENANTS
+// Every pizza shop gets its own System, all of them living in one process on one backend.
+// A tenant's System only ever sees tables prefixed with its name ("north/items"), so ids,
+// lookups and listings can't reach another shop's rows, even when two shops happen to use the same id.
+// Staff are tied to one tenant, only admins may look across tenants.
+// A tenant's items and stock can only go to the warehouses listed in its configuration.
+
+var (
+	errTenantNotFound = errors.New("tenant not found")
+	errTenantExists   = errors.New("tenant already exists")
+	errBadTenantName  = errors.New("tenant name must be lowercase letters, digits or -")
+	errForbidden      = errors.New("not allowed for this user")
+	errNotTenantSite  = errors.New("warehouse isn't one of the tenant's")
+)
+
+type role int
+
+const (
+	roleStaff role = iota // works inside one tenant
+	roleAdmin             // may open any tenant and run cross-tenant reports
+)
+
+type principal struct {
+	name   string
+	role   role
+	tenant string // only means something for staff
+}
+
+// tenantBackend namespaces every table of the shared backend, it is all the isolation a System needs
+type tenantBackend struct {
+	inner  backend
+	tenant string
+}
+
+func (b tenantBackend) table(name string) string { return b.tenant + "/" + name }
+
+func (b tenantBackend) put(table string, key int64, data []byte) error {
+	return b.inner.put(b.table(table), key, data)
+}
+
+func (b tenantBackend) get(table string, key int64) ([]byte, bool, error) {
+	return b.inner.get(b.table(table), key)
+}
+
+func (b tenantBackend) remove(table string, key int64) error {
+	return b.inner.remove(b.table(table), key)
+}
+
+func (b tenantBackend) scan(table string, fn func(key int64, data []byte) error) error {
+	return b.inner.scan(b.table(table), fn)
+}
+
+// Tenant is the shop's own configuration, stored unprefixed in the shared "tenants" table
+type Tenant struct {
+	id         int64
+	name       string
+	categories []string // extra categories on top of the 4 defaults, "Staff > Clothing" style
+	warehouses []string // warehouse codes the shop works with
+}
+
+type tenantRecord struct {
+	ID         int64    `json:"id"`
+	Name       string   `json:"name"`
+	Categories []string `json:"categories,omitempty"`
+	Warehouses []string `json:"warehouses,omitempty"`
+}
+
+func (t Tenant) info() string {
+	return fmt.Sprintf("tenant: %v | categories: %v | warehouses: %v | id: %v", t.name, strings.Join(t.categories, ", "), strings.Join(t.warehouses, ", "), t.id)
+}
+func (t Tenant) Storable() bool { return true }
+func (t Tenant) key() int64     { return t.id }
+
+func (t Tenant) validate() error {
+	if t.id <= 0 {
+		return errBadID
+	}
+	if t.name == "" || strings.Trim(t.name, "abcdefghijklmnopqrstuvwxyz0123456789-") != "" {
+		return errBadTenantName
+	}
+	// a bad warehouse code should stop the tenant here, not the first time it is opened
+	for _, code := range t.warehouses {
+		if err := (Warehouse{id: 1, code: code}).validate(); err != nil {
+			return fmt.Errorf("%v: %w", code, err)
+		}
+	}
+	// same for categories, every one needs its parent among the defaults or the tenant's own
+	tree := newCategoryTree()
+	for _, path := range sortedCategoryPaths(t.categories) {
+		if _, err := tree.add(path, nil); err != nil && !errors.Is(err, errCategoryExists) {
+			return fmt.Errorf("category %q: %w", path, err)
+		}
+	}
+	return nil
+}
+
+// sortedCategoryPaths puts parents before their children
+func sortedCategoryPaths(paths []string) []string {
+	sorted := append([]string(nil), paths...)
+	sort.Slice(sorted, func(a, b int) bool {
+		return len(splitCategoryPath(sorted[a])) < len(splitCategoryPath(sorted[b]))
+	})
+	return sorted
+}
+
+func (t Tenant) marshal() ([]byte, error) {
+	return json.Marshal(tenantRecord{ID: t.id, Name: t.name, Categories: t.categories, Warehouses: t.warehouses})
+}
+
+func decodeTenant(data []byte) (Tenant, error) {
+	var r tenantRecord
+	if err := json.Unmarshal(data, &r); err != nil {
+		return Tenant{}, err
+	}
+	return Tenant{id: r.ID, name: r.Name, categories: r.Categories, warehouses: r.Warehouses}, nil
+}
+
+// platform holds every tenant of one process
+type platform struct {
+	mu       sync.Mutex
+	store    backend
+	tenantDB *repository[Tenant]
+	systems  map[string]*System // opened lazily, one per tenant
+}
+
+func openPlatform(store backend) (*platform, error) {
+	tenants, err := openRepository("tenants", store, decodeTenant)
+	if err != nil {
+		return nil, err
+	}
+	tenants.addIndex("name", func(t Tenant) string { return t.name })
+	return &platform{store: store, tenantDB: tenants, systems: map[string]*System{}}, nil
+}
+
+func (p *platform) tenant(name string) (Tenant, bool) {
+	found := p.tenantDB.lookup("name", name)
+	if len(found) == 0 {
+		return Tenant{}, false
+	}
+	return found[0], true
+}
+
+// addTenant registers a shop, only admins can
+func (p *platform) addTenant(who principal, name string, categories, warehouses []string) (*System, error) {
+	if who.role != roleAdmin {
+		return nil, errForbidden
+	}
+	p.mu.Lock()
+	if _, ok := p.tenant(name); ok {
+		p.mu.Unlock()
+		return nil, errTenantExists
+	}
+	t := Tenant{id: rand.Int63n(23312231) + 1, name: name, categories: categories, warehouses: warehouses}
+	err := p.tenantDB.create(t)
+	p.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	s, err := p.system(who, name)
+	if err != nil {
+		// validate caught what it could, a tenant that still can't open mustn't stay around,
+		// and neither may the rows createDB wrote for it, a later tenant of that name would find them
+		return nil, errors.Join(err, dropTenantTables(p.store, name), p.tenantDB.delete(t.id))
+	}
+	return s, nil
+}
+
+// tableDropper is a backend that can throw away all of a tenant's tables at once, sqlBackend can
+type tableDropper interface {
+	dropTables(tenant string) error
+}
+
+// dropTenantTables empties every table of the tenant, row by row where the backend can't drop them
+func dropTenantTables(store backend, name string) error {
+	if d, ok := store.(tableDropper); ok {
+		return d.dropTables(name)
+	}
+	tb := tenantBackend{inner: store, tenant: name}
+	for _, table := range allTables {
+		var keys []int64
+		err := tb.scan(table, func(key int64, _ []byte) error {
+			keys = append(keys, key)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, key := range keys {
+			if err := tb.remove(table, key); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// system hands out the tenant's System, staff only get their own
+func (p *platform) system(who principal, name string) (*System, error) {
+	if who.role != roleAdmin && who.tenant != name {
+		return nil, fmt.Errorf("%v on tenant %v: %w", who.name, name, errForbidden)
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if s, ok := p.systems[name]; ok {
+		return s, nil
+	}
+	t, ok := p.tenant(name)
+	if !ok {
+		return nil, errTenantNotFound
+	}
+	s := &System{store: tenantBackend{inner: p.store, tenant: name}}
+	if err := s.createDB(); err != nil {
+		return nil, err
+	}
+	if err := s.applyTenantConfig(t); err != nil {
+		return nil, fmt.Errorf("tenant %v: %w", name, err)
+	}
+	p.systems[name] = s
+	return s, nil
+}
+
+// applyTenantConfig sets up the shop's categories and warehouses, whatever already exists is left alone
+func (s *System) applyTenantConfig(t Tenant) error {
+	for _, path := range sortedCategoryPaths(t.categories) {
+		if err := s.addCategory(path, nil); err != nil && !errors.Is(err, errCategoryExists) {
+			return err
+		}
+	}
+	for _, code := range t.warehouses {
+		if _, ok := s.warehouseByCode(code); ok {
+			continue
+		}
+		if _, err := s.addWarehouse(code, "Warehouse "+code, t.name); err != nil {
+			return err
+		}
+	}
+	codes := map[string]bool{}
+	for _, code := range t.warehouses {
+		codes[code] = true
+	}
+	s.mu.Lock()
+	s.warehouseCodes = codes
+	s.mu.Unlock()
+	return nil
+}
+
+// checkWarehouseLocked refuses codes outside the tenant's list, must be called with s.mu held
+func (s *System) checkWarehouseLocked(code string) error {
+	if s.warehouseCodes != nil && !s.warehouseCodes[code] {
+		return fmt.Errorf("%w: %q", errNotTenantSite, code)
+	}
+	return nil
+}
+
+type tenantSummary struct {
+	tenant     string
+	items      int
+	onHand     int
+	warehouses int
+}
+
+func (t tenantSummary) info() string {
+	return fmt.Sprintf("tenant: %v | items: %v | on hand: %v | warehouses: %v", t.tenant, t.items, t.onHand, t.warehouses)
+}
+
+// crossTenantReport is the only thing that reads every shop at once
+func (p *platform) crossTenantReport(who principal) ([]tenantSummary, error) {
+	if who.role != roleAdmin {
+		return nil, errForbidden
+	}
+	var report []tenantSummary
+	for _, t := range p.tenantDB.all() {
+		s, err := p.system(who, t.name)
+		if err != nil {
+			return nil, err
+		}
+		sum := tenantSummary{tenant: t.name, items: s.db.count(), warehouses: s.warehouseDB.count()}
+		for _, item := range s.db.all() {
+			sum.onHand += s.totalOnHand(item.id)
+		}
+		report = append(report, sum)
+	}
+	sort.Slice(report, func(a, b int) bool { return report[a].tenant < report[b].tenant })
+	return report, nil
+}
+
+func init() {
+	commands["tenant-add"] = command{
+		usage: "tenant-add <file.db> <name> <warehouse,warehouse...> [category,category...]",
+		run: func(_ *System, args []string) error {
+			if len(args) != 3 && len(args) != 4 {
+				return errUsage
+			}
+			store, err := openSQLBackend(args[0])
+			if err != nil {
+				return err
+			}
+			defer store.close()
+			p, err := openPlatform(store)
+			if err != nil {
+				return err
+			}
+			var categories []string
+			if len(args) == 4 {
+				categories = strings.Split(args[3], ",")
+			}
+			if _, err := p.addTenant(principal{name: "cli", role: roleAdmin}, args[1], categories, strings.Split(args[2], ",")); err != nil {
+				return err
+			}
+			t, _ := p.tenant(args[1])
+			fmt.Println(t.info())
+			return nil
+		},
+	}
+	commands["tenant-report"] = command{
+		usage: "tenant-report <file.db>",
+		run: func(_ *System, args []string) error {
+			if len(args) != 1 {
+				return errUsage
+			}
+			store, err := openSQLBackend(args[0])
+			if err != nil {
+				return err
+			}
+			defer store.close()
+			p, err := openPlatform(store)
+			if err != nil {
+				return err
+			}
+			report, err := p.crossTenantReport(principal{name: "cli", role: roleAdmin})
+			if err != nil {
+				return err
+			}
+			for i, row := range report {
+				fmt.Printf("%v| %v\n", i, row.info())
+			}
+			return nil
+		},
+	}
+}
@@ -0,0 +1,819 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// TERMINAL UI
+// `go run . tui` opens a full screen browser: item list on the left, details on the right,
+// stock alerts at the bottom. Everything is plain ANSI escape codes, raw mode lives in tui_term_*.go.
+// The screen redraws after keys and change events, so edits from elsewhere show up live, and only
+// when the frame really changed. Given a data file (datafile.go) it starts from there and saves every change back.
+//
+//   up/down j/k pgup/pgdn  move        /  filter by name or sku
+//   c / w                  cycle category / warehouse filter, x clears all filters
+//   n  new    e  edit    m  move    d  delete    q  quit
+
+var errNoTerminal = errors.New("stdin is not a terminal")
+
+const (
+	ansiClear   = "\x1b[2J"
+	ansiHome    = "\x1b[H"
+	ansiReverse = "\x1b[7m"
+	ansiBold    = "\x1b[1m"
+	ansiYellow  = "\x1b[33m"
+	ansiRed     = "\x1b[31m"
+	ansiReset   = "\x1b[0m"
+	ansiAltOn   = "\x1b[?1049h\x1b[?25l" // alternate screen, hide cursor
+	ansiAltOff  = "\x1b[?25h\x1b[?1049l"
+)
+
+// KEYS
+
+type keyCode int
+
+const (
+	keyRune keyCode = iota
+	keyUp
+	keyDown
+	keyPgUp
+	keyPgDn
+	keyEnter
+	keyTab
+	keyBackspace
+	keyEsc
+	keyCtrlC
+)
+
+type key struct {
+	code keyCode
+	r    rune
+}
+
+// decodeKeys turns what the reads so far returned into keys, arrows arrive as ESC [ A and friends.
+// A rune or escape sequence cut off at the end comes back as rest, to go in front of the next read
+func decodeKeys(b []byte) (keys []key, rest []byte) {
+	for len(b) > 0 {
+		switch {
+		case len(b) >= 2 && b[0] == 0x1b && b[1] == '[':
+			n, k, ok := decodeCSI(b)
+			if n == 0 {
+				return keys, b
+			}
+			if ok {
+				keys = append(keys, k)
+			}
+			b = b[n:]
+		case b[0] == 0x1b:
+			keys = append(keys, key{code: keyEsc})
+			b = b[1:]
+		case b[0] == '\r' || b[0] == '\n':
+			keys = append(keys, key{code: keyEnter})
+			b = b[1:]
+		case b[0] == '\t':
+			keys = append(keys, key{code: keyTab})
+			b = b[1:]
+		case b[0] == 0x7f || b[0] == 0x08:
+			keys = append(keys, key{code: keyBackspace})
+			b = b[1:]
+		case b[0] == 0x03:
+			keys = append(keys, key{code: keyCtrlC})
+			b = b[1:]
+		case b[0] < 0x20:
+			b = b[1:]
+		default:
+			r, n := utf8.DecodeRune(b)
+			if r == utf8.RuneError && n <= 1 {
+				if !utf8.FullRune(b) {
+					return keys, b
+				}
+				b = b[1:] // not utf-8, dropped
+				continue
+			}
+			keys = append(keys, key{code: keyRune, r: r})
+			b = b[n:]
+		}
+	}
+	return keys, nil
+}
+
+// decodeCSI reads one ESC [ sequence: parameter bytes 0x30-0x3F, intermediate bytes 0x20-0x2F and
+// a final byte 0x40-0x7E. n is how many bytes it took, 0 when the final byte hasn't arrived yet.
+// Sequences we have no key for are eaten whole, ok is false for those
+func decodeCSI(b []byte) (n int, k key, ok bool) {
+	i := 2
+	for i < len(b) && b[i] >= 0x30 && b[i] <= 0x3f {
+		i++
+	}
+	for i < len(b) && b[i] >= 0x20 && b[i] <= 0x2f {
+		i++
+	}
+	if i == len(b) {
+		return 0, key{}, false
+	}
+	if b[i] < 0x40 || b[i] > 0x7e {
+		return i, key{}, false // broken off, the byte that broke it is read as itself
+	}
+	switch params := string(b[2:i]); {
+	case b[i] == 'A' && params == "":
+		return i + 1, key{code: keyUp}, true
+	case b[i] == 'B' && params == "":
+		return i + 1, key{code: keyDown}, true
+	case b[i] == '~' && params == "5":
+		return i + 1, key{code: keyPgUp}, true
+	case b[i] == '~' && params == "6":
+		return i + 1, key{code: keyPgDn}, true
+	}
+	return i + 1, key{}, false
+}
+
+// STATE
+
+type tuiMode int
+
+const (
+	modeBrowse tuiMode = iota
+	modeFilter         // typing into the text filter
+	modeForm
+	modeConfirm // waiting for y to delete
+)
+
+type formField struct {
+	label string
+	value string
+}
+
+type tuiForm struct {
+	title  string
+	fields []formField
+	focus  int
+	err    string
+	submit func(values []string) error
+}
+
+type tui struct {
+	s        *System
+	filter   itemFilter
+	query    string // what was typed after "/", words plus conditions like wattage>=40
+	items    []Item
+	cursor   int
+	top      int
+	height   int // rows the list gets, set while rendering
+	mode     tuiMode
+	form     *tuiForm
+	message  string
+	alerts   []string
+	alertsAt time.Time
+	path     string // data file changes go to, "" keeps them in memory
+}
+
+func newTUI(s *System) *tui {
+	t := &tui{s: s, height: 20}
+	t.refresh()
+	return t
+}
+
+// refresh reloads the list, keeping the cursor on the same item when it is still there
+func (t *tui) refresh() {
+	var current int64
+	if item, ok := t.selected(); ok {
+		current = item.id
+	}
+	t.items = t.s.filterItems(t.filter)
+	for i, item := range t.items {
+		if item.id == current {
+			t.cursor = i
+		}
+	}
+	t.cursor = min(t.cursor, max(len(t.items)-1, 0))
+	if time.Since(t.alertsAt) > 5*time.Second {
+		t.alerts = t.s.stockAlerts()
+		t.alertsAt = time.Now()
+	}
+}
+
+// save writes the data file after a change, a failure stays on the status line
+func (t *tui) save() {
+	if t.path == "" {
+		return
+	}
+	if err := t.s.saveDataFile(t.path); err != nil {
+		t.message = "save failed: " + err.Error()
+	}
+}
+
+func (t *tui) selected() (Item, bool) {
+	if t.cursor < 0 || t.cursor >= len(t.items) {
+		return Item{}, false
+	}
+	return t.items[t.cursor], true
+}
+
+// stockAlerts are the items that run out before a delivery could arrive
+func (s *System) stockAlerts() []string {
+	var alerts []string
+	for _, f := range s.reorderSuggestions(exponentialSmoothing, defaultReorderPolicy) {
+		if f.daysLeft > float64(defaultReorderPolicy.leadTimeDays) {
+			continue
+		}
+		name := fmt.Sprint(f.key.id)
+		if item, ok := s.findItem(f.key.id); ok {
+			name = item.item
+		}
+		alerts = append(alerts, fmt.Sprintf("%v@%v out %v", name, f.key.warehouse, f.stockOut.Format("Jan 2")))
+	}
+	return alerts
+}
+
+// cycle steps through "" (no filter) and every value in order
+func cycle(current string, values []string) string {
+	if len(values) == 0 {
+		return ""
+	}
+	if current == "" {
+		return values[0]
+	}
+	for i, v := range values {
+		if v == current {
+			if i+1 < len(values) {
+				return values[i+1]
+			}
+			return ""
+		}
+	}
+	return ""
+}
+
+func (t *tui) warehouseCodes() []string {
+	seen := map[string]bool{}
+	for _, item := range t.s.filterItems(itemFilter{}) {
+		if item.Warehouse != "" {
+			seen[item.Warehouse] = true
+		}
+	}
+	var codes []string
+	for code := range seen {
+		codes = append(codes, code)
+	}
+	sort.Strings(codes)
+	return codes
+}
+
+func (t *tui) categoryPaths() []string {
+	t.s.mu.RLock()
+	defer t.s.mu.RUnlock()
+	return t.s.categories.list()
+}
+
+// FORMS
+// Each form checks its input before calling into System, so bad input never leaves the form.
+
+func (t *tui) validateCategory(path string) error {
+	t.s.mu.RLock()
+	defer t.s.mu.RUnlock()
+	if _, ok := t.s.categories.find(path); !ok {
+		return fmt.Errorf("%w: %v", errCategoryNotFound, path)
+	}
+	return nil
+}
+
+func validateWarehouseCode(code string) error {
+	return Warehouse{id: 1, code: code}.validate()
+}
+
+func (t *tui) newItemForm() *tuiForm {
+	var refused []string // what the duplicate check refused last
+	return &tuiForm{
+		title:  "New item",
+		fields: []formField{{label: "Name"}, {label: "Category", value: defaultCategories[0]}, {label: "Warehouse", value: warehouses[0]}, {label: "Attributes"}},
+		submit: func(v []string) error {
+			if strings.TrimSpace(v[0]) == "" {
+				return errNoName
+			}
+			if err := t.validateCategory(v[1]); err != nil {
+				return err
+			}
+			if err := validateWarehouseCode(v[2]); err != nil {
+				return err
+			}
+			attrs, err := parseAttributeValues(v[3])
+			if err != nil {
+				return err
+			}
+			// the same values again after a refusal mean "create anyway"
+			check := !slices.Equal(refused, v)
+			if _, err := t.s.createItemWith(strings.TrimSpace(v[0]), v[1], v[2], attrs, check); err != nil {
+				if errors.Is(err, errLikelyDuplicate) {
+					refused = append([]string(nil), v...)
+					return fmt.Errorf("%w, enter again to create it anyway", err)
+				}
+				return err
+			}
+			t.message = "created " + v[0]
+			return nil
+		},
+	}
+}
+
+// parseAttributeValues reads "wattage=45 inspection_due=2025-03-01", the form's way to give typed attributes
+func parseAttributeValues(text string) (map[string]string, error) {
+	attrs := map[string]string{}
+	for _, token := range strings.Fields(text) {
+		c, err := parseAttrCondition(token)
+		if err != nil || c.op != "=" {
+			return nil, fmt.Errorf("%w: %q", errBadCondition, token)
+		}
+		attrs[c.name] = c.value
+	}
+	return attrs, nil
+}
+
+func (t *tui) editForm(item Item) *tuiForm {
+	return &tuiForm{
+		title:  "Edit " + item.item,
+		fields: []formField{{label: "Name", value: item.item}, {label: "Category", value: item.Category}},
+		submit: func(v []string) error {
+			if strings.TrimSpace(v[0]) == "" {
+				return errNoName
+			}
+			if err := t.validateCategory(v[1]); err != nil {
+				return err
+			}
+			if err := t.s.updateItem(item.id, strings.TrimSpace(v[0]), v[1]); err != nil {
+				return err
+			}
+			t.message = "saved " + v[0]
+			return nil
+		},
+	}
+}
+
+func (t *tui) moveForm(item Item) *tuiForm {
+	return &tuiForm{
+		title:  "Move " + item.item,
+		fields: []formField{{label: "Warehouse", value: item.Warehouse}, {label: "Bin", value: item.bin}},
+		submit: func(v []string) error {
+			if err := validateWarehouseCode(v[0]); err != nil {
+				return err
+			}
+			if err := t.s.moveItem(item.id, v[0]); err != nil {
+				return err
+			}
+			if v[1] != "" {
+				if err := t.s.shelveItem(item.id, v[1]); err != nil {
+					return err
+				}
+			}
+			t.message = fmt.Sprintf("moved %v to %v", item.item, v[0])
+			return nil
+		},
+	}
+}
+
+// INPUT
+
+// handle applies one key, true means quit
+func (t *tui) handle(k key) bool {
+	if k.code == keyCtrlC {
+		return true
+	}
+	switch t.mode {
+	case modeFilter:
+		t.handleFilter(k)
+	case modeForm:
+		t.handleForm(k)
+	case modeConfirm:
+		if k.code == keyRune && (k.r == 'y' || k.r == 'Y') {
+			if item, ok := t.selected(); ok {
+				if err := t.s.deleteItem(item.id); err != nil {
+					t.message = "delete failed: " + err.Error()
+				} else {
+					t.message = "deleted " + item.item
+				}
+			}
+		} else {
+			t.message = "delete cancelled"
+		}
+		t.mode = modeBrowse
+		t.refresh()
+	default:
+		return t.handleBrowse(k)
+	}
+	return false
+}
+
+func (t *tui) handleBrowse(k key) bool {
+	t.message = ""
+	switch k.code {
+	case keyUp:
+		t.cursor = max(t.cursor-1, 0)
+	case keyDown:
+		t.cursor = min(t.cursor+1, max(len(t.items)-1, 0))
+	case keyPgUp:
+		t.cursor = max(t.cursor-t.height, 0)
+	case keyPgDn:
+		t.cursor = min(t.cursor+t.height, max(len(t.items)-1, 0))
+	case keyEsc:
+		t.filter = itemFilter{}
+		t.refresh()
+	case keyRune:
+		switch k.r {
+		case 'q':
+			return true
+		case 'k':
+			return t.handleBrowse(key{code: keyUp})
+		case 'j':
+			return t.handleBrowse(key{code: keyDown})
+		case '/':
+			t.mode = modeFilter
+		case 'c':
+			t.filter.category = cycle(t.filter.category, t.categoryPaths())
+			t.refresh()
+		case 'w':
+			t.filter.warehouse = cycle(t.filter.warehouse, t.warehouseCodes())
+			t.refresh()
+		case 'x':
+			t.filter = itemFilter{}
+			t.refresh()
+		case 'n':
+			t.form, t.mode = t.newItemForm(), modeForm
+		case 'e':
+			if item, ok := t.selected(); ok {
+				t.form, t.mode = t.editForm(item), modeForm
+			}
+		case 'm':
+			if item, ok := t.selected(); ok {
+				t.form, t.mode = t.moveForm(item), modeForm
+			}
+		case 'd':
+			if item, ok := t.selected(); ok {
+				t.mode = modeConfirm
+				t.message = fmt.Sprintf("delete %v? y/n", item.item)
+			}
+		}
+	}
+	return false
+}
+
+func (t *tui) handleFilter(k key) {
+	switch k.code {
+	case keyEnter:
+		t.mode = modeBrowse
+	case keyEsc:
+		t.query = ""
+		t.mode = modeBrowse
+	case keyBackspace:
+		if r := []rune(t.query); len(r) > 0 {
+			t.query = string(r[:len(r)-1])
+		}
+	case keyRune:
+		t.query += string(k.r)
+	}
+	t.applyQuery()
+}
+
+// applyQuery keeps the last good filter while a condition is half typed ("wattage>")
+func (t *tui) applyQuery() {
+	if f, err := parseQuery(t.query); err == nil {
+		t.filter.text, t.filter.attrs = f.text, f.attrs
+	}
+	t.cursor = 0
+	t.refresh()
+}
+
+func (t *tui) handleForm(k key) {
+	f := t.form
+	field := &f.fields[f.focus]
+	switch k.code {
+	case keyEsc:
+		t.form, t.mode = nil, modeBrowse
+		return
+	case keyTab, keyDown:
+		f.focus = (f.focus + 1) % len(f.fields)
+	case keyUp:
+		f.focus = (f.focus + len(f.fields) - 1) % len(f.fields)
+	case keyBackspace:
+		if r := []rune(field.value); len(r) > 0 {
+			field.value = string(r[:len(r)-1])
+		}
+	case keyRune:
+		field.value += string(k.r)
+	case keyEnter:
+		if f.focus < len(f.fields)-1 {
+			f.focus++
+			return
+		}
+		values := make([]string, len(f.fields))
+		for i, fl := range f.fields {
+			values[i] = fl.value
+		}
+		if err := f.submit(values); err != nil {
+			f.err = err.Error()
+			return
+		}
+		t.form, t.mode = nil, modeBrowse
+		t.alertsAt = time.Time{}
+		t.refresh()
+	}
+}
+
+// DRAWING
+
+// fit cuts or pads s to exactly n columns
+func fit(s string, n int) string {
+	r := []rune(s)
+	if len(r) > n {
+		if n <= 1 {
+			return string(r[:n])
+		}
+		return string(r[:n-1]) + "…"
+	}
+	return s + strings.Repeat(" ", n-len(r))
+}
+
+func (t *tui) detailLines(item Item) []string {
+	lines := []string{ansiBold + item.item + ansiReset, ""}
+	// same fields as Item.info(), one per line
+	for _, part := range strings.Split(item.info(), " | ") {
+		lines = append(lines, part)
+	}
+	lines = append(lines, "sku: "+item.sku())
+	if item.parent != 0 {
+		lines = append(lines, fmt.Sprintf("variant of: %v (%v)", item.parent, optionsString(item.options)))
+	}
+	if attrs, err := t.s.itemAttributes(item.id); err == nil && len(attrs) > 0 {
+		lines = append(lines, "attributes: "+optionsString(attrs))
+	}
+	if len(item.custom) > 0 {
+		lines = append(lines, "custom: "+optionsString(item.custom))
+	}
+	if missing, err := t.s.missingAttributes(item.id); err == nil && len(missing) > 0 {
+		lines = append(lines, ansiRed+"missing: "+strings.Join(missing, ", ")+ansiReset)
+	}
+	for _, a := range item.attachments {
+		lines = append(lines, "attachment: "+a.info())
+	}
+	lines = append(lines, "", "stock:")
+	t.s.mu.RLock()
+	var keys []stockKey
+	for key := range t.s.stock {
+		if key.id == item.id {
+			keys = append(keys, key)
+		}
+	}
+	sort.Slice(keys, func(a, b int) bool { return keys[a].warehouse < keys[b].warehouse })
+	for _, key := range keys {
+		lines = append(lines, fmt.Sprintf("  %v: %v (%v reserved)", key.warehouse, t.s.stock[key], t.s.reservedLocked(key.id, key.warehouse)))
+	}
+	t.s.mu.RUnlock()
+	if len(keys) == 0 {
+		lines = append(lines, "  none")
+	}
+	return lines
+}
+
+func (t *tui) formLines() []string {
+	f := t.form
+	lines := []string{ansiBold + f.title + ansiReset, ""}
+	for i, fl := range f.fields {
+		line := fmt.Sprintf("%-10v %v", fl.label+":", fl.value)
+		if i == f.focus {
+			line = ansiReverse + line + "_" + ansiReset
+		}
+		lines = append(lines, line)
+	}
+	lines = append(lines, "", "tab next  enter save  esc cancel")
+	if f.err != "" {
+		lines = append(lines, "", ansiRed+f.err+ansiReset)
+	}
+	return lines
+}
+
+// visibleWidth ignores escape codes so panes line up
+func visibleWidth(s string) int {
+	n, esc := 0, false
+	for _, r := range s {
+		switch {
+		case r == 0x1b:
+			esc = true
+		case esc:
+			if r >= '@' && r <= '~' && r != '[' {
+				esc = false
+			}
+		default:
+			n++
+		}
+	}
+	return n
+}
+
+func padVisible(s string, n int) string {
+	if w := visibleWidth(s); w < n {
+		return s + strings.Repeat(" ", n-w)
+	}
+	if visibleWidth(s) > n {
+		return fit(stripANSI(s), n)
+	}
+	return s
+}
+
+func stripANSI(s string) string {
+	var b strings.Builder
+	esc := false
+	for _, r := range s {
+		switch {
+		case r == 0x1b:
+			esc = true
+		case esc:
+			if r >= '@' && r <= '~' && r != '[' {
+				esc = false
+			}
+		default:
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// render draws one full frame, it doesn't touch the terminal so it also works for --once
+func (t *tui) render(width, height int) string {
+	width, height = max(width, 40), max(height, 6)
+	left := width * 55 / 100
+	right := width - left - 1
+	t.height = height - 2
+	if t.cursor < t.top {
+		t.top = t.cursor
+	}
+	if t.cursor >= t.top+t.height {
+		t.top = t.cursor - t.height + 1
+	}
+
+	var detail []string
+	if t.mode == modeForm && t.form != nil {
+		detail = t.formLines()
+	} else if item, ok := t.selected(); ok {
+		detail = t.detailLines(item)
+	}
+
+	nameW, catW := max(left*45/100, 8), max(left*35/100, 6)
+	var b strings.Builder
+	title := fmt.Sprintf(" PROJECT1 inventory | filter: %v | %v items", t.filter, len(t.items))
+	if t.mode == modeFilter {
+		title = fmt.Sprintf(" filter: %v_", t.query)
+	}
+	b.WriteString(ansiReverse + fit(title, width) + ansiReset + "\n")
+	for row := 0; row < t.height; row++ {
+		line := ""
+		if i := t.top + row; i < len(t.items) {
+			item := t.items[i]
+			line = fit(" "+fit(item.item, nameW)+" "+fit(item.Category, catW)+" "+item.Warehouse, left)
+			if i == t.cursor {
+				line = ansiReverse + line + ansiReset
+			}
+		} else {
+			line = strings.Repeat(" ", left)
+		}
+		d := ""
+		if row < len(detail) {
+			d = detail[row]
+		}
+		b.WriteString(line + "│" + padVisible(" "+d, right) + "\n")
+	}
+
+	status := t.message
+	if status == "" && len(t.alerts) > 0 {
+		status = ansiYellow + fmt.Sprintf("%v stock alert(s): %v", len(t.alerts), strings.Join(t.alerts, ", ")) + ansiReset
+	}
+	if status == "" {
+		status = "n new  e edit  m move  d delete  / filter  c category  w warehouse  q quit"
+	}
+	b.WriteString(padVisible(status, width))
+	return b.String()
+}
+
+// runTUI owns the terminal until q, changes made elsewhere redraw the screen as they happen
+func runTUI(s *System, path string) error {
+	restore, err := enableRawMode()
+	if err != nil {
+		return err
+	}
+	defer restore()
+	sub, err := s.events.subscribe(subOptions{buffer: 64, policy: dropOldest, replayFrom: liveOnly})
+	if err != nil {
+		return err
+	}
+	defer s.events.unsubscribe(sub)
+
+	in, err := openInput()
+	if err != nil {
+		return err
+	}
+	input, stop := make(chan []byte), make(chan struct{})
+	reader := make(chan struct{})
+	go func() {
+		defer close(reader)
+		defer close(input)
+		buf := make([]byte, 64)
+		for {
+			n, err := in.Read(buf)
+			if err != nil {
+				return
+			}
+			select {
+			case input <- append([]byte(nil), buf[:n]...):
+			case <-stop:
+				return
+			}
+		}
+	}()
+	// closing in wakes the reader if it is waiting for a key, so it is gone before the terminal is given back
+	defer func() {
+		close(stop)
+		in.Close()
+		<-reader
+	}()
+
+	fmt.Print(ansiAltOn)
+	defer fmt.Print(ansiAltOff)
+	t := newTUI(s)
+	t.path = path
+	tick := time.NewTicker(time.Second) // catches resizes and stale alerts
+	defer tick.Stop()
+	shown := ""
+	var pending []byte // the start of a rune or escape sequence the next read finishes
+	for {
+		w, h := terminalSize()
+		if frame := t.render(w, h); frame != shown {
+			fmt.Print(ansiHome + ansiClear + frame)
+			shown = frame
+		}
+		select {
+		case b, ok := <-input:
+			if !ok {
+				return nil
+			}
+			var keys []key
+			keys, pending = decodeKeys(append(pending, b...))
+			for _, k := range keys {
+				if t.handle(k) {
+					return nil
+				}
+			}
+		case <-sub.events:
+			// one save for a burst of changes
+			for drained := false; !drained; {
+				select {
+				case <-sub.events:
+				default:
+					drained = true
+				}
+			}
+			t.refresh()
+			t.save()
+		case <-tick.C:
+			t.refresh()
+		}
+	}
+}
+
+func init() {
+	commands["tui"] = command{
+		usage: "tui [file.json] [--once [filter text|attr>=x ...]]",
+		run: func(s *System, args []string) error {
+			path := ""
+			if len(args) > 0 && args[0] != "--once" {
+				path, args = args[0], args[1:]
+				loaded, _, err := loadDataFile(path)
+				switch {
+				case err == nil:
+					s = loaded
+				case errors.Is(err, os.ErrNotExist):
+					// a new file starts from the shop as it is and is written on the first change
+				default:
+					return err
+				}
+			}
+			if len(args) > 0 && args[0] == "--once" {
+				t := newTUI(s)
+				if len(args) > 1 {
+					t.query = strings.Join(args[1:], " ")
+					t.applyQuery()
+				}
+				w, h := terminalSize()
+				fmt.Println(t.render(w, h))
+				return nil
+			}
+			if len(args) != 0 {
+				return errUsage
+			}
+			return runTUI(s, path)
+		},
+	}
+}
@@ -0,0 +1,19 @@
+//go:build !linux && !darwin && !freebsd && !netbsd && !openbsd && !dragonfly && !windows
+
+package main
+
+// no raw mode here, the tui refuses to start (tui --once still prints a frame)
+
+import "io"
+
+func enableRawMode() (restore func(), err error) {
+	return nil, errNoTerminal
+}
+
+func terminalSize() (width, height int) {
+	return 80, 24
+}
+
+func openInput() (io.ReadCloser, error) {
+	return nil, errNoTerminal
+}
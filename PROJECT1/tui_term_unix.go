@@ -0,0 +1,71 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd || dragonfly
+
+package main
+
+import (
+	"io"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// raw mode by hand: no line buffering, no echo, ctrl-c comes in as a key.
+// Only the ioctl numbers differ between linux and the BSDs, see tui_term_linux.go and tui_term_bsd.go
+
+func ioctl(fd uintptr, req uintptr, arg unsafe.Pointer) error {
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, req, uintptr(arg)); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// enableRawMode switches stdin to raw mode, call restore to get the terminal back
+func enableRawMode() (restore func(), err error) {
+	fd := os.Stdin.Fd()
+	var old syscall.Termios
+	if err := ioctl(fd, ioctlGetTermios, unsafe.Pointer(&old)); err != nil {
+		return nil, errNoTerminal
+	}
+	raw := old
+	raw.Iflag &^= syscall.IGNBRK | syscall.BRKINT | syscall.PARMRK | syscall.ISTRIP | syscall.INLCR | syscall.IGNCR | syscall.ICRNL | syscall.IXON
+	raw.Lflag &^= syscall.ECHO | syscall.ECHONL | syscall.ICANON | syscall.ISIG | syscall.IEXTEN
+	raw.Cflag &^= syscall.CSIZE | syscall.PARENB
+	raw.Cflag |= syscall.CS8
+	raw.Cc[syscall.VMIN] = 1
+	raw.Cc[syscall.VTIME] = 0
+	if err := ioctl(fd, ioctlSetTermios, unsafe.Pointer(&raw)); err != nil {
+		return nil, err
+	}
+	return func() { ioctl(fd, ioctlSetTermios, unsafe.Pointer(&old)) }, nil
+}
+
+// terminalSize falls back to 80x24 when stdout isn't a terminal
+func terminalSize() (width, height int) {
+	var ws struct{ rows, cols, x, y uint16 }
+	if err := ioctl(os.Stdout.Fd(), syscall.TIOCGWINSZ, unsafe.Pointer(&ws)); err != nil || ws.cols == 0 {
+		return 80, 24
+	}
+	return int(ws.cols), int(ws.rows)
+}
+
+// openInput is a non-blocking copy of stdin that the runtime polls, so closing it wakes a Read waiting for a key
+func openInput() (io.ReadCloser, error) {
+	fd, err := syscall.Dup(syscall.Stdin)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.SetNonblock(fd, true); err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+	return polledInput{os.NewFile(uintptr(fd), "stdin")}, nil
+}
+
+type polledInput struct{ *os.File }
+
+// Close puts stdin back to blocking as well, the flag is shared with the copy
+func (in polledInput) Close() error {
+	err := in.File.Close()
+	syscall.SetNonblock(syscall.Stdin, false)
+	return err
+}
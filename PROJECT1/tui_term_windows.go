@@ -0,0 +1,106 @@
+//go:build windows
+
+package main
+
+import (
+	"io"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// the console does raw mode and ANSI escapes itself once the right mode bits are set
+
+const (
+	enableProcessedInput       = 0x0001
+	enableLineInput            = 0x0002
+	enableEchoInput            = 0x0004
+	enableVirtualTerminalInput = 0x0200
+	enableProcessedOutput      = 0x0001
+	enableVirtualTerminalOut   = 0x0004
+)
+
+var (
+	kernel32                       = syscall.NewLazyDLL("kernel32.dll")
+	procSetConsoleMode             = kernel32.NewProc("SetConsoleMode")
+	procGetConsoleScreenBufferInfo = kernel32.NewProc("GetConsoleScreenBufferInfo")
+)
+
+func setConsoleMode(h syscall.Handle, mode uint32) error {
+	if ok, _, err := procSetConsoleMode.Call(uintptr(h), uintptr(mode)); ok == 0 {
+		return err
+	}
+	return nil
+}
+
+// enableRawMode switches the console to raw input with escape sequences, call restore to get it back
+func enableRawMode() (restore func(), err error) {
+	in, out := syscall.Handle(os.Stdin.Fd()), syscall.Handle(os.Stdout.Fd())
+	var oldIn, oldOut uint32
+	if err := syscall.GetConsoleMode(in, &oldIn); err != nil {
+		return nil, errNoTerminal
+	}
+	if err := syscall.GetConsoleMode(out, &oldOut); err != nil {
+		return nil, errNoTerminal
+	}
+	raw := oldIn&^(enableProcessedInput|enableLineInput|enableEchoInput) | enableVirtualTerminalInput
+	if err := setConsoleMode(in, raw); err != nil {
+		return nil, err
+	}
+	if err := setConsoleMode(out, oldOut|enableProcessedOutput|enableVirtualTerminalOut); err != nil {
+		setConsoleMode(in, oldIn)
+		return nil, err
+	}
+	return func() {
+		setConsoleMode(in, oldIn)
+		setConsoleMode(out, oldOut)
+	}, nil
+}
+
+// terminalSize is the visible window, 80x24 when stdout isn't a console
+func terminalSize() (width, height int) {
+	var info struct {
+		size, cursor             struct{ x, y int16 }
+		attributes               uint16
+		left, top, right, bottom int16
+		maxSize                  struct{ x, y int16 }
+	}
+	ok, _, _ := procGetConsoleScreenBufferInfo.Call(os.Stdout.Fd(), uintptr(unsafe.Pointer(&info)))
+	if ok == 0 || info.right <= info.left {
+		return 80, 24
+	}
+	return int(info.right-info.left) + 1, int(info.bottom-info.top) + 1
+}
+
+// openInput reads the console, waiting in short steps so Close doesn't leave a reader behind
+func openInput() (io.ReadCloser, error) {
+	return &consoleInput{h: syscall.Handle(os.Stdin.Fd()), closed: make(chan struct{})}, nil
+}
+
+type consoleInput struct {
+	h      syscall.Handle
+	closed chan struct{}
+}
+
+func (in *consoleInput) Read(b []byte) (int, error) {
+	for {
+		select {
+		case <-in.closed:
+			return 0, os.ErrClosed
+		default:
+		}
+		ev, err := syscall.WaitForSingleObject(in.h, 100)
+		if err != nil {
+			return 0, err
+		}
+		// signalled means something is queued, with virtual terminal input that is almost always a key
+		if ev == syscall.WAIT_OBJECT_0 {
+			return os.Stdin.Read(b)
+		}
+	}
+}
+
+func (in *consoleInput) Close() error {
+	close(in.closed)
+	return nil
+}
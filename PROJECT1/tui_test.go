@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestDecodeKeys(t *testing.T) {
+	up, down := key{code: keyUp}, key{code: keyDown}
+	for _, tc := range []struct {
+		name     string
+		in       string
+		want     []key
+		wantRest string
+	}{
+		{"plain", "jk", []key{{code: keyRune, r: 'j'}, {code: keyRune, r: 'k'}}, ""},
+		{"utf-8", "ü€", []key{{code: keyRune, r: 'ü'}, {code: keyRune, r: '€'}}, ""},
+		{"rune cut off", "a\xe2\x82", []key{{code: keyRune, r: 'a'}}, "\xe2\x82"},
+		{"not utf-8", "\xffa", []key{{code: keyRune, r: 'a'}}, ""},
+		{"stray continuation byte", "\x82\x82b", []key{{code: keyRune, r: 'b'}}, ""},
+		{"arrows", "\x1b[A\x1b[B", []key{up, down}, ""},
+		{"pages", "\x1b[5~\x1b[6~", []key{{code: keyPgUp}, {code: keyPgDn}}, ""},
+		{"unknown sequences are eaten whole", "\x1b[1;5C\x1b[200~x", []key{{code: keyRune, r: 'x'}}, ""},
+		{"modified arrow isn't a plain arrow", "\x1b[1;2A", nil, ""},
+		{"sequence cut off", "q\x1b[1;", []key{{code: keyRune, r: 'q'}}, "\x1b[1;"},
+		{"sequence cut after the bracket", "\x1b[", nil, "\x1b["},
+		{"broken sequence", "\x1b[1\x03", []key{{code: keyCtrlC}}, ""},
+		{"esc alone", "\x1b", []key{{code: keyEsc}}, ""},
+		{"controls", "\r\t\x7f\x03", []key{{code: keyEnter}, {code: keyTab}, {code: keyBackspace}, {code: keyCtrlC}}, ""},
+	} {
+		got, rest := decodeKeys([]byte(tc.in))
+		if fmt.Sprint(got) != fmt.Sprint(tc.want) || string(rest) != tc.wantRest {
+			t.Errorf("%v: got %v rest %q, want %v rest %q", tc.name, got, rest, tc.want, tc.wantRest)
+		}
+	}
+}
+
+// a rune or arrow split over two reads comes out once the second read is in. An ESC that ends a read
+// is the Esc key, that is how the key arrives, so sequences are only cut after their ESC [
+func TestDecodeKeysAcrossReads(t *testing.T) {
+	for _, tc := range []struct {
+		in       string
+		firstCut int
+	}{{"€", 1}, {"\x1b[A", 2}, {"\x1b[5~", 2}} {
+		in := tc.in
+		want, _ := decodeKeys([]byte(in))
+		for cut := tc.firstCut; cut < len(in); cut++ {
+			first, rest := decodeKeys([]byte(in[:cut]))
+			second, rest := decodeKeys(append(rest, in[cut:]...))
+			got := append(first, second...)
+			if fmt.Sprint(got) != fmt.Sprint(want) || len(rest) != 0 {
+				t.Errorf("%q cut at %v: got %v rest %q, want %v", in, cut, got, rest, want)
+			}
+		}
+	}
+}
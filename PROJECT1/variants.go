@@ -0,0 +1,108 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// VARIANTS
+// "Uniform Shirt" in S, M and L is one parent item with three variants.
+// The parent holds the shared record (name, category), every variant is its own Item
+// with its own id, so stock is tracked per variant through the normal stock functions.
+
+var (
+	errNotAParent     = errors.New("variants can only hang off a base item")
+	errDuplicateVar   = errors.New("a variant with those options already exists")
+	errHasVariants    = errors.New("item still has variants")
+	errNoVariantOpts  = errors.New("a variant needs at least one option")
+	errVariantFollows = errors.New("variants take their name and category from the parent, update that instead")
+)
+
+// optionsString prints options in a stable order -> color=red, size=M
+func optionsString(options map[string]string) string {
+	keys := make([]string, 0, len(options))
+	for k := range options {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	parts := make([]string, len(keys))
+	for i, k := range keys {
+		parts[i] = k + "=" + options[k]
+	}
+	return strings.Join(parts, ", ")
+}
+
+// createVariant copies the parent's name and category, the warehouse defaults to the parent's
+func (s *System) createVariant(parentID int64, options map[string]string, warehouse string) (int64, error) {
+	if len(options) == 0 {
+		return 0, errNoVariantOpts
+	}
+	s.mu.Lock()
+	parent, ok := s.db.get(parentID)
+	if !ok {
+		s.mu.Unlock()
+		return 0, errItemNotFound
+	}
+	if parent.parent != 0 {
+		s.mu.Unlock()
+		return 0, errNotAParent
+	}
+	want := optionsString(options)
+	for _, item := range s.db.lookup("parent", fmt.Sprint(parentID)) {
+		if optionsString(item.options) == want {
+			s.mu.Unlock()
+			return 0, errDuplicateVar
+		}
+	}
+	if warehouse == "" {
+		warehouse = parent.Warehouse
+	}
+	if err := s.checkWarehouseLocked(warehouse); err != nil {
+		s.mu.Unlock()
+		return 0, err
+	}
+	opts := make(map[string]string, len(options))
+	for k, v := range options {
+		opts[k] = v
+	}
+	// the typed values come along, a variant has the same inspection date and wattage as its parent
+	custom, err := s.checkCustomLocked(parent.Category, parent.custom)
+	if err != nil {
+		s.mu.Unlock()
+		return 0, err
+	}
+	variant := Item{item: parent.item, Category: parent.Category, Warehouse: warehouse, id: s.freeItemIDLocked(), parent: parentID, options: opts, custom: custom}
+	err = s.db.create(variant)
+	if err == nil {
+		s.emitLocked(itemCreated{item: variant})
+	}
+	s.mu.Unlock()
+	if err != nil {
+		return 0, err
+	}
+	s.flushEvents()
+	return variant.id, nil
+}
+
+func (s *System) variantsOf(parentID int64) []Item {
+	return s.db.lookup("parent", fmt.Sprint(parentID))
+}
+
+// familyOnHand is the parent's own stock plus every variant's stock
+func (s *System) familyOnHand(parentID int64) int {
+	total := s.totalOnHand(parentID)
+	for _, v := range s.variantsOf(parentID) {
+		total += s.totalOnHand(v.id)
+	}
+	return total
+}
+
+// variantInfo is info() plus the options, e.g. for printing a size run
+func (i Item) variantInfo() string {
+	if i.parent == 0 {
+		return i.info()
+	}
+	return fmt.Sprintf("%v | parent: %v | variant: %v", i.info(), i.parent, optionsString(i.options))
+}
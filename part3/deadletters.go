@@ -0,0 +1,406 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DEAD LETTERS
+// A delivery that ran out of retries is kept here with the notification itself, the recipient,
+// the channel that failed and the last error. The queue is a json lines log like the inbox (inbox.go), one line
+// per added, changed or removed letter, so it outlives the process and a change costs one short write:
+//   go run . dlq list dead.json
+//   go run . dlq replay dead.json 3            (or "all")  [smtp=127.0.0.1:2525] [sms=http://gateway/send]
+// Replaying takes the letter out only once the send worked, if it fails again the letter stays
+// with the new attempts and error added, so a crash in the middle of a replay loses nothing.
+
+var (
+	errNoDeadLetter    = errors.New("no dead letter with that id")
+	errUnknownKindData = errors.New("stored notification has an unknown kind")
+)
+
+// storedNotification is any notification flattened for json
+type storedNotification struct {
+	Kind     string `json:"kind"`
+	Sender   string `json:"sender,omitempty"`
+	Group    string `json:"group,omitempty"`
+	Code     string `json:"code,omitempty"`
+	Content  string `json:"content"`
+	Priority int    `json:"priority,omitempty"`
+	Urgent   bool   `json:"urgent,omitempty"`
+}
+
+func storeNotification(n notification) storedNotification {
+	s := storedNotification{Kind: kindOf(n), Content: contentOf(n)}
+	switch v := n.(type) {
+	case directMessage:
+		s.Sender, s.Priority, s.Urgent = v.senderUsername, v.priorityLevel, v.isUrgent
+	case groupMessage:
+		s.Sender, s.Group, s.Priority = v.senderUsername, v.groupName, v.priorityLevel
+	case systemAlert:
+		s.Code = v.alertCode
+	}
+	return s
+}
+
+// notification gives back the original, digests aren't worth keeping so they come back as a plain group note
+func (s storedNotification) notification() (notification, error) {
+	switch s.Kind {
+	case "direct":
+		return directMessage{s.Sender, s.Content, s.Priority, s.Urgent}, nil
+	case "group", "digest":
+		return groupMessage{s.Group, s.Content, s.Priority, s.Sender}, nil
+	case "alert":
+		return systemAlert{s.Code, s.Content}, nil
+	}
+	return nil, fmt.Errorf("%w %q", errUnknownKindData, s.Kind)
+}
+
+type storedRecipient struct {
+	User    string `json:"user"`
+	Email   string `json:"email,omitempty"`
+	Phone   string `json:"phone,omitempty"`
+	Webhook string `json:"webhook,omitempty"`
+	Lang    string `json:"lang,omitempty"`
+}
+
+type deadLetter struct {
+	ID           int                `json:"id"`
+	DeliveryID   string             `json:"delivery_id"` // the idempotency key, replays keep it
+	Channel      string             `json:"channel"`
+	To           storedRecipient    `json:"to"`
+	Notification storedNotification `json:"notification"`
+	Vars         map[string]any     `json:"vars,omitempty"` // the caller's template variables
+	QueuedAt     time.Time          `json:"queued_at"`      // when the delivery was first made
+	DiedAt       time.Time          `json:"died_at"`
+	Attempts     int                `json:"attempts"`
+	LastError    string             `json:"last_error"`
+}
+
+func (dl deadLetter) info() string {
+	return fmt.Sprintf("#%v %v to %v via %v | %v attempt(s), died %v | %v | %.60q",
+		dl.ID, dl.Notification.Kind, dl.To.User, dl.Channel, dl.Attempts, dl.DiedAt.Format(time.DateTime), dl.LastError, dl.Notification.Content)
+}
+
+func (dl deadLetter) delivery() (delivery, error) {
+	n, err := dl.Notification.notification()
+	if err != nil {
+		return delivery{}, err
+	}
+	to := recipient{user: dl.To.User, email: dl.To.Email, phone: dl.To.Phone, webhook: dl.To.Webhook, lang: dl.To.Lang}
+	return delivery{id: dl.DeliveryID, to: to, n: n, at: dl.QueuedAt, vars: dl.Vars}, nil
+}
+
+// letterLine is one line of the log: a letter as it is after a change, or the id of one that left
+type letterLine struct {
+	Letter  *deadLetter `json:"letter,omitempty"`
+	Removed int         `json:"removed,omitempty"`
+}
+
+type deadLetters struct {
+	mu      sync.Mutex
+	path    string // "" keeps them in memory
+	log     *os.File
+	lines   int                // lines in the log, compaction starts when they far outnumber the letters
+	letters map[int]deadLetter // by id
+	nextID  int
+	clock   func() time.Time
+}
+
+func openDeadLetters(path string, clock func() time.Time) (*deadLetters, error) {
+	if clock == nil {
+		clock = time.Now
+	}
+	q := &deadLetters{path: path, letters: map[int]deadLetter{}, clock: clock}
+	if path == "" {
+		return q, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '[' {
+		// the old format, the whole queue as one array, becomes a log right away
+		var list []deadLetter
+		if err := json.Unmarshal(trimmed, &list); err != nil {
+			return nil, fmt.Errorf("%v: %w", path, err)
+		}
+		for _, dl := range list {
+			q.letters[dl.ID] = dl
+		}
+		if err := q.compactLocked(); err != nil {
+			return nil, err
+		}
+	} else {
+		if cut := bytes.LastIndexByte(data, '\n') + 1; cut < len(data) {
+			// cut off mid write like in the inbox, the change never happened and goes from the file
+			if err := os.Truncate(path, int64(cut)); err != nil {
+				return nil, err
+			}
+			data = data[:cut]
+		}
+		for i, line := range bytes.Split(data, []byte("\n")) {
+			if len(bytes.TrimSpace(line)) == 0 {
+				continue
+			}
+			var l letterLine
+			if err := json.Unmarshal(line, &l); err != nil {
+				return nil, fmt.Errorf("%v line %v: %w", path, i+1, err)
+			}
+			if l.Letter != nil {
+				q.letters[l.Letter.ID] = *l.Letter
+			} else {
+				delete(q.letters, l.Removed)
+			}
+			q.lines++
+		}
+	}
+	for _, dl := range q.letters {
+		q.nextID = max(q.nextID, dl.ID)
+	}
+	if q.log == nil {
+		if q.log, err = os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644); err != nil {
+			return nil, err
+		}
+	}
+	return q, nil
+}
+
+func (q *deadLetters) close() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.log == nil {
+		return nil
+	}
+	err := q.log.Close()
+	q.log = nil
+	return err
+}
+
+// appendLocked writes one change to the log, must be called with q.mu held
+func (q *deadLetters) appendLocked(l letterLine) error {
+	if q.path == "" {
+		return nil
+	}
+	data, err := json.Marshal(l)
+	if err != nil {
+		return err
+	}
+	if _, err := q.log.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	q.lines++
+	if q.lines > 2*len(q.letters)+100 {
+		// a failed compaction still leaves a complete log behind
+		q.compactLocked()
+	}
+	return nil
+}
+
+// compactLocked rewrites the log with one line per letter, must be called with q.mu held
+func (q *deadLetters) compactLocked() error {
+	var buf bytes.Buffer
+	for _, dl := range q.listLocked() {
+		data, err := json.Marshal(letterLine{Letter: &dl})
+		if err != nil {
+			return err
+		}
+		buf.Write(data)
+		buf.WriteByte('\n')
+	}
+	if err := writeFileAtomic(q.path, buf.Bytes()); err != nil {
+		return err
+	}
+	log, err := os.OpenFile(q.path, os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	if q.log != nil {
+		q.log.Close()
+	}
+	q.log, q.lines = log, len(q.letters)
+	return nil
+}
+
+func (q *deadLetters) add(d delivery, channel string, attempts int, cause error) (int, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	dl := deadLetter{
+		ID: q.nextID + 1, DeliveryID: d.id, Channel: channel,
+		To:           storedRecipient{User: d.to.user, Email: d.to.email, Phone: d.to.phone, Webhook: d.to.webhook, Lang: d.to.lang},
+		Notification: storeNotification(d.n),
+		Vars:         d.vars,
+		QueuedAt:     d.at, DiedAt: q.clock(), Attempts: attempts, LastError: cause.Error(),
+	}
+	if err := q.appendLocked(letterLine{Letter: &dl}); err != nil {
+		return 0, err
+	}
+	q.nextID++
+	q.letters[dl.ID] = dl
+	return dl.ID, nil
+}
+
+func (q *deadLetters) list() []deadLetter {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.listLocked()
+}
+
+// listLocked is oldest first
+func (q *deadLetters) listLocked() []deadLetter {
+	out := make([]deadLetter, 0, len(q.letters))
+	for _, dl := range q.letters {
+		out = append(out, dl)
+	}
+	sort.Slice(out, func(a, b int) bool { return out[a].ID < out[b].ID })
+	return out
+}
+
+func (q *deadLetters) get(id int) (deadLetter, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	dl, ok := q.letters[id]
+	if !ok {
+		return deadLetter{}, errNoDeadLetter
+	}
+	return dl, nil
+}
+
+func (q *deadLetters) remove(id int) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if _, ok := q.letters[id]; !ok {
+		return errNoDeadLetter
+	}
+	if err := q.appendLocked(letterLine{Removed: id}); err != nil {
+		return err
+	}
+	delete(q.letters, id)
+	return nil
+}
+
+// failedAgain adds a replay's attempts and error to the letter, channel narrows it down when only one failed
+func (q *deadLetters) failedAgain(id int, channel string, attempts int, cause error) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	dl, ok := q.letters[id]
+	if !ok {
+		return errNoDeadLetter
+	}
+	if channel != "" {
+		dl.Channel = channel
+	}
+	dl.Attempts += attempts
+	dl.DiedAt, dl.LastError = q.clock(), cause.Error()
+	if err := q.appendLocked(letterLine{Letter: &dl}); err != nil {
+		return err
+	}
+	q.letters[id] = dl
+	return nil
+}
+
+// replay sends one letter again through rs, on the channel that failed (all routed channels if none was reached).
+// The letter goes when every channel worked, otherwise it stays with the new error.
+func (q *deadLetters) replay(ctx context.Context, rs *reliableSender, id int) error {
+	dl, err := q.get(id)
+	if err != nil {
+		return err
+	}
+	d, err := dl.delivery()
+	if err != nil {
+		return err
+	}
+	channels := []string{dl.Channel}
+	if dl.Channel == "" {
+		if channels = rs.r.channelsFor(d.n); len(channels) == 0 {
+			return errors.Join(errNoRoute, q.failedAgain(id, "", 0, errNoRoute))
+		}
+	}
+	var errs []error
+	var failedOn []string
+	attempts := 0
+	for _, ch := range channels {
+		res := rs.try(ctx, d, ch)
+		attempts += res.attempts
+		if res.err != nil {
+			errs = append(errs, res.err)
+			failedOn = append(failedOn, ch)
+		}
+	}
+	if len(errs) == 0 {
+		return q.remove(id)
+	}
+	channel := ""
+	if len(failedOn) == 1 {
+		channel = failedOn[0]
+	}
+	cause := errors.Join(errs...)
+	return errors.Join(cause, q.failedAgain(id, channel, attempts, cause))
+}
+
+// replayAll goes oldest first and keeps going past failures, which stay in the queue
+func (q *deadLetters) replayAll(ctx context.Context, rs *reliableSender) (ok, failed int) {
+	for _, dl := range q.list() {
+		if err := q.replay(ctx, rs, dl.ID); err != nil {
+			failed++
+		} else {
+			ok++
+		}
+	}
+	return ok, failed
+}
+
+// runDLQCommand is `go run . dlq ...`, replays go through the default routes with whatever addresses are given
+func runDLQCommand(args []string) error {
+	usage := errors.New("usage: dlq list <file> | dlq replay <file> <id|all> [smtp=host:port] [sms=url]")
+	if len(args) < 2 {
+		return usage
+	}
+	q, err := openDeadLetters(args[1], nil)
+	if err != nil {
+		return err
+	}
+	defer q.close()
+	switch {
+	case args[0] == "list" && len(args) == 2:
+		letters := q.list()
+		for _, dl := range letters {
+			fmt.Println(dl.info())
+		}
+		fmt.Printf("%v dead letter(s)\n", len(letters))
+		return nil
+	case args[0] == "replay" && len(args) >= 3:
+		deliverers := []Deliverer{&consoleDeliverer{w: os.Stdout}, &webhookDeliverer{}}
+		for _, opt := range args[3:] {
+			key, value, _ := strings.Cut(opt, "=")
+			switch key {
+			case "smtp":
+				deliverers = append(deliverers, &smtpDeliverer{addr: value, from: "noreply@part3.local"})
+			case "sms":
+				deliverers = append(deliverers, &smsDeliverer{gateway: value})
+			default:
+				return usage
+			}
+		}
+		rs := newReliableSender(newRouter(defaultRoutes, deliverers...), defaultRetryPolicy, q)
+		if args[2] == "all" {
+			ok, failed := q.replayAll(context.Background(), rs)
+			fmt.Printf("replayed %v, %v failed again\n", ok, failed)
+			return nil
+		}
+		var id int
+		if _, err := fmt.Sscan(args[2], &id); err != nil {
+			return usage
+		}
+		return q.replay(context.Background(), rs, id)
+	}
+	return usage
+}
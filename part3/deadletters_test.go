@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func lineCount(t *testing.T, path string) int {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bytes.Count(data, []byte("\n"))
+}
+
+// every change is one more line, the queue reads back as it was, language and variables included
+func TestDeadLettersAppendAndReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dead.json")
+	now := time.Date(2024, 3, 1, 9, 0, 0, 0, time.UTC)
+	q, err := openDeadLetters(path, func() time.Time { return now })
+	if err != nil {
+		t.Fatal(err)
+	}
+	jonas := recipient{user: "jonas", email: "jonas@example.com", lang: "de"}
+	first, _ := q.add(delivery{id: "d1", to: jonas, n: directMessage{"sam", "hi", 10, false}, at: now, vars: map[string]any{"order": "A-1"}}, "email", 5, errFlaky)
+	second, _ := q.add(delivery{id: "d2", to: jonas, n: systemAlert{"DB-DOWN", "down"}, at: now}, "sms", 5, errFlaky)
+	q.failedAgain(second, "", 2, errors.New("still down"))
+	q.remove(first)
+	if got := lineCount(t, path); got != 4 {
+		t.Errorf("log lines after 2 adds, a change and a remove: got %v, want 4", got)
+	}
+	want := q.list()
+	q.close()
+
+	q, err = openDeadLetters(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.close()
+	if got := q.list(); !reflect.DeepEqual(got, want) {
+		t.Errorf("after reopening:\n  got  %v\n  want %v", got, want)
+	}
+	d, err := q.list()[0].delivery()
+	if err != nil || d.to != jonas || d.id != "d2" {
+		t.Errorf("delivery back: %+v %v", d, err)
+	}
+	if id, _ := q.add(delivery{id: "d3", to: jonas, n: systemAlert{"X", "y"}}, "sms", 1, errFlaky); id != 3 {
+		t.Errorf("next id after reopening: got %v, want 3", id)
+	}
+}
+
+func TestDeadLettersTornLineAndOldFormat(t *testing.T) {
+	dir := t.TempDir()
+	torn := filepath.Join(dir, "torn.json")
+	q, _ := openDeadLetters(torn, nil)
+	q.add(delivery{id: "d1", to: recipient{user: "bo"}, n: systemAlert{"X", "y"}}, "sms", 1, errFlaky)
+	q.close()
+	f, _ := os.OpenFile(torn, os.O_WRONLY|os.O_APPEND, 0o644)
+	f.WriteString(`{"letter":{"id":2,"deliv`)
+	f.Close()
+	q, err := openDeadLetters(torn, nil)
+	if err != nil {
+		t.Fatalf("torn last line: %v", err)
+	}
+	q.add(delivery{id: "d3", to: recipient{user: "bo"}, n: systemAlert{"X", "y"}}, "sms", 1, errFlaky)
+	q.close()
+	if q, err = openDeadLetters(torn, nil); err != nil || len(q.list()) != 2 {
+		t.Fatalf("after appending past the torn line: %v", err)
+	}
+	q.close()
+
+	// a queue written as one json array, before the log
+	old := filepath.Join(dir, "old.json")
+	os.WriteFile(old, []byte(`[{"id":4,"delivery_id":"d4","channel":"sms","to":{"user":"bo"},"notification":{"kind":"alert","code":"X","content":"y"},"attempts":5,"last_error":"down"}]`), 0o644)
+	q, err = openDeadLetters(old, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q.remove(4)
+	q.close()
+	if q, err = openDeadLetters(old, nil); err != nil || len(q.list()) != 0 {
+		t.Errorf("old format after removing its letter: %v %v", q.list(), err)
+	}
+}
@@ -0,0 +1,390 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/smtp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DELIVERY
+// A Deliverer knows one channel (email, sms, webhook, console) and nothing about routing.
+// The router looks at the notification's type and importance and picks the channels,
+// first matching rule wins, so put the specific rules on top.
+// Everything talks to plain addresses, point them at the fakes in fakes.go and it all runs offline.
+
+var (
+	errNoRoute          = errors.New("no routing rule matches")
+	errNoAddress        = errors.New("recipient has no address for this channel")
+	errUnknownChannel   = errors.New("no deliverer for channel")
+	errDeliveryRejected = errors.New("delivery rejected")
+)
+
+// statusError is a rejection with the http status that came back, retries tell 4xx from 5xx by it
+type statusError struct {
+	url    string
+	status string
+	code   int
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("%v: %v answered %v", errDeliveryRejected, e.url, e.status)
+}
+func (e *statusError) Unwrap() error { return errDeliveryRejected }
+
+type recipient struct {
+	user    string
+	email   string
+	phone   string
+	webhook string // url
+	lang    string // for templates, "" means the default language
+}
+
+type delivery struct {
+	id string // unique per notification and recipient
+	to recipient
+	n  notification
+	at time.Time
+
+	vars     map[string]any   // what the caller adds for the templates, {{.order}} and the like
+	rendered *renderedMessage // set per channel by the router when it has templates
+}
+
+// subject and body are the rendered text when there is one, the notification's own otherwise
+func (d delivery) subject() string {
+	if d.rendered != nil {
+		return d.rendered.subject
+	}
+	return subjectOf(d.n)
+}
+
+func (d delivery) body() string {
+	if d.rendered != nil {
+		return d.rendered.body
+	}
+	return contentOf(d.n)
+}
+
+type Deliverer interface {
+	channel() string
+	deliver(ctx context.Context, d delivery) error
+}
+
+// kindOf is the short name routing rules (and everything after them) use
+func kindOf(n notification) string {
+	switch n.(type) {
+	case directMessage:
+		return "direct"
+	case groupMessage:
+		return "group"
+	case systemAlert:
+		return "alert"
+	case digestMessage:
+		return "digest"
+	}
+	return "unknown"
+}
+
+func contentOf(n notification) string {
+	switch v := n.(type) {
+	case directMessage:
+		return v.messageContent
+	case groupMessage:
+		return v.messageContent
+	case systemAlert:
+		return v.messageContent
+	case digestMessage:
+		return v.summary()
+	}
+	return ""
+}
+
+// subjectOf is one line for email subjects and console output
+func subjectOf(n notification) string {
+	name, _ := processNotification(n)
+	switch kindOf(n) {
+	case "direct":
+		return "Message from " + name
+	case "group":
+		return "New in " + name
+	case "alert":
+		return "ALERT " + name
+	case "digest":
+		return "Your " + n.(digestMessage).period + " digest"
+	}
+	return "Notification"
+}
+
+// CONSOLE
+
+type consoleDeliverer struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (c *consoleDeliverer) channel() string { return "console" }
+func (c *consoleDeliverer) deliver(_ context.Context, d delivery) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, err := fmt.Fprintf(c.w, "[%v] to %v: %v: %v\n", d.n.importance(), d.to.user, d.subject(), d.body())
+	return err
+}
+
+// EMAIL
+
+// smtpTimeout bounds a whole SMTP exchange when the caller's context has no deadline
+const smtpTimeout = 30 * time.Second
+
+type smtpDeliverer struct {
+	addr string // host:port
+	from string
+}
+
+func (e *smtpDeliverer) channel() string { return "email" }
+
+// deliver dials with ctx and keeps to its deadline for the whole exchange, cancelling ctx drops the connection.
+// A subject is one header line, line breaks in it become spaces, addresses with line breaks are refused.
+func (e *smtpDeliverer) deliver(ctx context.Context, d delivery) error {
+	if d.to.email == "" {
+		return errNoAddress
+	}
+	if strings.ContainsAny(d.to.email+e.from, "\r\n") {
+		return fmt.Errorf("%w: line break in an address", errDeliveryRejected)
+	}
+	subject := strings.Join(strings.FieldsFunc(d.subject(), func(r rune) bool { return r == '\r' || r == '\n' }), " ")
+	host, _, err := net.SplitHostPort(e.addr)
+	if err != nil {
+		return err
+	}
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", e.addr)
+	if err != nil {
+		return err
+	}
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(smtpTimeout)
+	}
+	conn.SetDeadline(deadline)
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	err = func() error {
+		c, err := smtp.NewClient(conn, host)
+		if err != nil {
+			conn.Close()
+			return err
+		}
+		defer c.Close()
+		if ok, _ := c.Extension("STARTTLS"); ok {
+			if err := c.StartTLS(&tls.Config{ServerName: host}); err != nil {
+				return err
+			}
+		}
+		if err := c.Mail(e.from); err != nil {
+			return err
+		}
+		if err := c.Rcpt(d.to.email); err != nil {
+			return err
+		}
+		w, err := c.Data()
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "From: %v\r\nTo: %v\r\nSubject: %v\r\nMessage-ID: <%v@part3>\r\n\r\n%v\r\n",
+			e.from, d.to.email, subject, d.id, d.body())
+		if err := w.Close(); err != nil {
+			return err
+		}
+		return c.Quit()
+	}()
+	if err != nil && ctx.Err() != nil {
+		return fmt.Errorf("%w (%v)", ctx.Err(), err)
+	}
+	return err
+}
+
+// HTTP (sms gateway, webhooks)
+
+type smsPayload struct {
+	To   string `json:"to"`
+	Body string `json:"body"`
+}
+
+type webhookPayload struct {
+	ID         string    `json:"id"`
+	Kind       string    `json:"kind"`
+	From       string    `json:"from"`
+	Subject    string    `json:"subject"`
+	Body       string    `json:"body"`
+	Importance int       `json:"importance"`
+	At         time.Time `json:"at"`
+}
+
+// postJSON treats anything but a 2xx as a failed delivery.
+// The key goes out as Idempotency-Key, a retry sends the same one so the receiver can drop the repeat.
+func postJSON(ctx context.Context, client *http.Client, url, key string, v any) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Idempotency-Key", key)
+	if client == nil {
+		client = http.DefaultClient
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	io.Copy(io.Discard, res.Body)
+	if res.StatusCode/100 != 2 {
+		return &statusError{url: url, status: res.Status, code: res.StatusCode}
+	}
+	return nil
+}
+
+type smsDeliverer struct {
+	gateway string // url the gateway takes POSTs on
+	client  *http.Client
+	limit   int // runes per text, 0 is smsLimit
+}
+
+func (s *smsDeliverer) channel() string { return "sms" }
+func (s *smsDeliverer) deliver(ctx context.Context, d delivery) error {
+	if d.to.phone == "" {
+		return errNoAddress
+	}
+	body := d.body()
+	if d.rendered == nil {
+		body = d.subject() + ": " + body
+	}
+	limit := s.limit
+	if limit == 0 {
+		limit = smsLimit
+	}
+	body, _ = truncateRunes(body, limit)
+	return postJSON(ctx, s.client, s.gateway, d.id, smsPayload{To: d.to.phone, Body: body})
+}
+
+type webhookDeliverer struct {
+	client *http.Client
+}
+
+func (w *webhookDeliverer) channel() string { return "webhook" }
+func (w *webhookDeliverer) deliver(ctx context.Context, d delivery) error {
+	if d.to.webhook == "" {
+		return errNoAddress
+	}
+	name, importance := processNotification(d.n)
+	return postJSON(ctx, w.client, d.to.webhook, d.id, webhookPayload{
+		ID: d.id, Kind: kindOf(d.n), From: name, Subject: d.subject(),
+		Body: d.body(), Importance: importance, At: d.at,
+	})
+}
+
+// ROUTING
+
+type routeRule struct {
+	kind          string // direct, group, alert, "" for any
+	minImportance int
+	channels      []string
+}
+
+func (r routeRule) matches(n notification) bool {
+	return (r.kind == "" || r.kind == kindOf(n)) && n.importance() >= r.minImportance
+}
+
+// defaultRoutes: alerts go everywhere, urgent dms also text you, group chatter stays on the console,
+// digests of what the rate limits held back come by email. Everything but digests is kept in the inbox.
+var defaultRoutes = []routeRule{
+	{kind: "alert", channels: []string{"email", "sms", "webhook", "console", "inbox"}},
+	{kind: "direct", minImportance: 50, channels: []string{"sms", "email", "inbox"}},
+	{kind: "direct", channels: []string{"email", "inbox"}},
+	{kind: "group", channels: []string{"console", "inbox"}},
+	{kind: "digest", channels: []string{"email", "console"}},
+}
+
+type router struct {
+	rules      []routeRule
+	deliverers map[string]Deliverer
+	templates  *templateSet // nil sends the raw messageContent, see templates.go
+}
+
+func newRouter(rules []routeRule, deliverers ...Deliverer) *router {
+	r := &router{rules: rules, deliverers: map[string]Deliverer{}}
+	for _, d := range deliverers {
+		r.deliverers[d.channel()] = d
+	}
+	return r
+}
+
+func (r *router) channelsFor(n notification) []string {
+	for _, rule := range r.rules {
+		if rule.matches(n) {
+			return rule.channels
+		}
+	}
+	return nil
+}
+
+type deliveryResult struct {
+	channel string
+	err     error
+}
+
+func (res deliveryResult) info() string {
+	if res.err != nil {
+		return res.channel + ": " + res.err.Error()
+	}
+	return res.channel + ": ok"
+}
+
+// dispatch tries every routed channel, one failing doesn't stop the others
+func (r *router) dispatch(ctx context.Context, d delivery) []deliveryResult {
+	channels := r.channelsFor(d.n)
+	if len(channels) == 0 {
+		return []deliveryResult{{err: errNoRoute}}
+	}
+	return r.dispatchOn(ctx, d, channels)
+}
+
+// dispatchOn skips the routing rules, for callers that already narrowed the channels down (preferences.go)
+func (r *router) dispatchOn(ctx context.Context, d delivery, channels []string) []deliveryResult {
+	results := make([]deliveryResult, len(channels))
+	for i, ch := range channels {
+		results[i].channel = ch
+		deliverer, ok := r.deliverers[ch]
+		if !ok {
+			results[i].err = fmt.Errorf("%w %q", errUnknownChannel, ch)
+			continue
+		}
+		sent := d
+		if r.templates != nil {
+			msg, err := r.templates.render(d.n, ch, d.to.lang, d.vars)
+			switch {
+			case err == nil:
+				sent.rendered = &msg
+			case !errors.Is(err, errNoTemplate):
+				results[i].err = err
+				continue
+			}
+		}
+		results[i].err = deliverer.deliver(ctx, sent)
+	}
+	return results
+}
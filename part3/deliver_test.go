@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestRouting(t *testing.T) {
+	r := newRouter(defaultRoutes)
+	for _, tc := range []struct {
+		name string
+		n    notification
+		want []string
+	}{
+		{"alert", systemAlert{"DB-DOWN", "down"}, []string{"email", "sms", "webhook", "console", "inbox"}},
+		{"urgent dm", directMessage{senderUsername: "ana", isUrgent: true}, []string{"sms", "email", "inbox"}},
+		{"dm at the urgent line", directMessage{senderUsername: "ana", priorityLevel: 50}, []string{"sms", "email", "inbox"}},
+		{"plain dm", directMessage{senderUsername: "ana", priorityLevel: 49}, []string{"email", "inbox"}},
+		{"group", groupMessage{groupName: "ops", priorityLevel: 80}, []string{"console", "inbox"}},
+		{"digest", digestMessage{period: "hourly"}, []string{"email", "console"}},
+	} {
+		if got := r.channelsFor(tc.n); fmt.Sprint(got) != fmt.Sprint(tc.want) {
+			t.Errorf("%v: got %v, want %v", tc.name, got, tc.want)
+		}
+	}
+
+	groupsOnly := newRouter([]routeRule{{kind: "group", channels: []string{"console"}}})
+	res := groupsOnly.dispatch(context.Background(), delivery{id: "d1", n: directMessage{senderUsername: "ana"}})
+	if len(res) != 1 || !errors.Is(res[0].err, errNoRoute) {
+		t.Errorf("no matching rule: got %v", res)
+	}
+}
+
+// one dispatch reaches every fake, a channel without an address or deliverer fails on its own
+func TestDispatchToFakes(t *testing.T) {
+	mail, err := startFakeSMTP()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mail.close()
+	web := startFakeHTTP()
+	defer web.close()
+	var console bytes.Buffer
+	r := newRouter(defaultRoutes,
+		&smtpDeliverer{addr: mail.addr(), from: "noreply@example.com"},
+		&smsDeliverer{gateway: web.url("/sms")},
+		&webhookDeliverer{},
+		&consoleDeliverer{w: &console},
+	)
+	to := recipient{user: "bo", email: "bo@example.com", phone: "+15550100", webhook: web.url("/hook")}
+	res := r.dispatch(context.Background(), delivery{id: "d1", to: to, n: systemAlert{"DB-DOWN", "primary unreachable"}})
+	want := map[string]error{"email": nil, "sms": nil, "webhook": nil, "console": nil, "inbox": errUnknownChannel}
+	for _, got := range res {
+		if w := want[got.channel]; !errors.Is(got.err, w) || (w == nil && got.err != nil) {
+			t.Errorf("%v: got %v, want %v", got.channel, got.err, w)
+		}
+	}
+
+	if got := mail.received(); len(got) != 1 || got[0].to[0] != to.email || !strings.Contains(got[0].data, "Subject: ALERT DB-DOWN") {
+		t.Errorf("mail: %+v", got)
+	}
+	paths := map[string]httpRequest{}
+	for _, req := range web.received() {
+		paths[req.path] = req
+		if key := req.header.Get("Idempotency-Key"); key != "d1" {
+			t.Errorf("%v: idempotency key %q, want d1", req.path, key)
+		}
+	}
+	var sms smsPayload
+	if err := json.Unmarshal([]byte(paths["/sms"].body), &sms); err != nil || sms.To != to.phone || sms.Body != "ALERT DB-DOWN: primary unreachable" {
+		t.Errorf("sms: %+v %v", sms, err)
+	}
+	var hook webhookPayload
+	if err := json.Unmarshal([]byte(paths["/hook"].body), &hook); err != nil || hook.Kind != "alert" || hook.Importance != 100 {
+		t.Errorf("webhook: %+v %v", hook, err)
+	}
+	if !strings.Contains(console.String(), "to bo: ALERT DB-DOWN") {
+		t.Errorf("console: %q", console.String())
+	}
+
+	res = r.dispatchOn(context.Background(), delivery{id: "d2", to: recipient{user: "cy"}, n: systemAlert{"DB-DOWN", "again"}}, []string{"email", "sms", "webhook"})
+	for _, got := range res {
+		if !errors.Is(got.err, errNoAddress) {
+			t.Errorf("%v without an address: got %v", got.channel, got.err)
+		}
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"strings"
+	"sync"
+)
+
+// FAKE SERVERS
+// A tiny SMTP sink and an HTTP sink, both on 127.0.0.1 with a random port.
+// They keep everything they receive so a demo (or a test) can look at what would have gone out.
+
+type smtpMessage struct {
+	from string
+	to   []string
+	data string
+}
+
+type fakeSMTP struct {
+	ln       net.Listener
+	mu       sync.Mutex
+	messages []smtpMessage
+	wg       sync.WaitGroup
+}
+
+func startFakeSMTP() (*fakeSMTP, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	f := &fakeSMTP{ln: ln}
+	f.wg.Add(1)
+	go func() {
+		defer f.wg.Done()
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return // closed
+			}
+			f.wg.Add(1)
+			go func() {
+				defer f.wg.Done()
+				f.serve(conn)
+			}()
+		}
+	}()
+	return f, nil
+}
+
+func (f *fakeSMTP) addr() string { return f.ln.Addr().String() }
+
+// serve speaks just enough SMTP for net/smtp.SendMail: no auth, no TLS
+func (f *fakeSMTP) serve(conn net.Conn) {
+	defer conn.Close()
+	tp := textproto.NewConn(conn)
+	tp.PrintfLine("220 fake-smtp ready")
+	var msg smtpMessage
+	for {
+		line, err := tp.ReadLine()
+		if err != nil {
+			return
+		}
+		verb, arg, _ := strings.Cut(line, " ")
+		switch strings.ToUpper(verb) {
+		case "EHLO", "HELO":
+			tp.PrintfLine("250 fake-smtp")
+		case "MAIL":
+			msg = smtpMessage{from: strings.Trim(strings.TrimPrefix(arg, "FROM:"), "<>")}
+			tp.PrintfLine("250 OK")
+		case "RCPT":
+			msg.to = append(msg.to, strings.Trim(strings.TrimPrefix(arg, "TO:"), "<>"))
+			tp.PrintfLine("250 OK")
+		case "DATA":
+			tp.PrintfLine("354 end with <CRLF>.<CRLF>")
+			data, err := tp.ReadDotBytes()
+			if err != nil {
+				return
+			}
+			msg.data = string(data)
+			f.mu.Lock()
+			f.messages = append(f.messages, msg)
+			f.mu.Unlock()
+			tp.PrintfLine("250 OK queued")
+		case "RSET", "NOOP":
+			tp.PrintfLine("250 OK")
+		case "QUIT":
+			tp.PrintfLine("221 bye")
+			return
+		default:
+			tp.PrintfLine("502 not implemented")
+		}
+	}
+}
+
+func (f *fakeSMTP) received() []smtpMessage {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]smtpMessage(nil), f.messages...)
+}
+
+func (f *fakeSMTP) close() {
+	f.ln.Close()
+	f.wg.Wait()
+}
+
+type httpRequest struct {
+	method string
+	path   string
+	header http.Header
+	body   string
+}
+
+type fakeHTTP struct {
+	srv      *httptest.Server
+	mu       sync.Mutex
+	requests []httpRequest
+	failNext []int // status codes to answer with before going back to 200, for trying out failures
+}
+
+func startFakeHTTP() *fakeHTTP {
+	f := &fakeHTTP{}
+	f.srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		f.mu.Lock()
+		status := http.StatusOK
+		if len(f.failNext) > 0 {
+			status, f.failNext = f.failNext[0], f.failNext[1:]
+		} else {
+			f.requests = append(f.requests, httpRequest{method: r.Method, path: r.URL.Path, header: r.Header.Clone(), body: string(body)})
+		}
+		f.mu.Unlock()
+		w.WriteHeader(status)
+	}))
+	return f
+}
+
+func (f *fakeHTTP) url(path string) string { return f.srv.URL + path }
+
+func (f *fakeHTTP) fail(statuses ...int) {
+	f.mu.Lock()
+	f.failNext = append(f.failNext, statuses...)
+	f.mu.Unlock()
+}
+
+// received only counts the requests that were answered with 200
+func (f *fakeHTTP) received() []httpRequest {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]httpRequest(nil), f.requests...)
+}
+
+func (f *fakeHTTP) close() { f.srv.Close() }
@@ -0,0 +1,3 @@
+module part3
+
+go 1.22
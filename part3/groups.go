@@ -0,0 +1,255 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// GROUPS
+// A group knows its members, their role and whether they muted it.
+// fanOut turns one groupMessage into one delivery per member: the member list is copied once under the
+// read lock, then cut into batches that a few workers send in parallel, so a group of 50k members doesn't
+// hold the lock (or one goroutine per member) for the whole send. The sender and muted members are skipped.
+// Every copy goes through the pipeline (pipeline.go) like a direct message would, so the members' rate limits,
+// preferences and quiet hours apply and the inbox gets its copy. The sender pays one token for the whole fan-out.
+
+var (
+	errGroupExists   = errors.New("group already exists")
+	errNoGroup       = errors.New("no such group")
+	errAlreadyMember = errors.New("already a member")
+	errNotMember     = errors.New("not a member of the group")
+	errNotGroupAdmin = errors.New("only group admins can do that")
+	errLastAdmin     = errors.New("the last admin can't leave while others are still in the group")
+)
+
+type groupRole string
+
+const (
+	groupAdmin  groupRole = "admin"
+	groupMember groupRole = "member"
+)
+
+type member struct {
+	to         recipient
+	role       groupRole
+	joined     time.Time
+	muted      bool
+	mutedUntil time.Time // zero with muted set means until they unmute
+}
+
+func (m member) mutedAt(t time.Time) bool {
+	return m.muted && (m.mutedUntil.IsZero() || t.Before(m.mutedUntil))
+}
+
+type group struct {
+	name    string
+	created time.Time
+	members map[string]*member
+}
+
+func (g *group) adminsLocked() int {
+	n := 0
+	for _, m := range g.members {
+		if m.role == groupAdmin {
+			n++
+		}
+	}
+	return n
+}
+
+type groupDirectory struct {
+	mu     sync.RWMutex
+	groups map[string]*group
+	clock  func() time.Time
+}
+
+func newGroupDirectory(clock func() time.Time) *groupDirectory {
+	if clock == nil {
+		clock = time.Now
+	}
+	return &groupDirectory{groups: map[string]*group{}, clock: clock}
+}
+
+// createGroup makes owner the first admin
+func (gd *groupDirectory) createGroup(name string, owner recipient) error {
+	gd.mu.Lock()
+	defer gd.mu.Unlock()
+	if _, ok := gd.groups[name]; ok {
+		return errGroupExists
+	}
+	now := gd.clock()
+	gd.groups[name] = &group{name: name, created: now, members: map[string]*member{
+		owner.user: {to: owner, role: groupAdmin, joined: now},
+	}}
+	return nil
+}
+
+// withGroup runs change under the write lock on an existing group
+func (gd *groupDirectory) withGroup(name string, change func(g *group) error) error {
+	gd.mu.Lock()
+	defer gd.mu.Unlock()
+	g, ok := gd.groups[name]
+	if !ok {
+		return fmt.Errorf("%w %q", errNoGroup, name)
+	}
+	return change(g)
+}
+
+func (gd *groupDirectory) join(name string, r recipient) error {
+	return gd.withGroup(name, func(g *group) error {
+		if _, ok := g.members[r.user]; ok {
+			return errAlreadyMember
+		}
+		g.members[r.user] = &member{to: r, role: groupMember, joined: gd.clock()}
+		return nil
+	})
+}
+
+func (gd *groupDirectory) leave(name, user string) error {
+	return gd.withGroup(name, func(g *group) error {
+		m, ok := g.members[user]
+		if !ok {
+			return errNotMember
+		}
+		if m.role == groupAdmin && g.adminsLocked() == 1 && len(g.members) > 1 {
+			return errLastAdmin
+		}
+		delete(g.members, user)
+		return nil
+	})
+}
+
+// setRole is for admins only, and the group always keeps at least one admin
+func (gd *groupDirectory) setRole(name, by, user string, role groupRole) error {
+	return gd.withGroup(name, func(g *group) error {
+		if admin, ok := g.members[by]; !ok || admin.role != groupAdmin {
+			return errNotGroupAdmin
+		}
+		m, ok := g.members[user]
+		if !ok {
+			return errNotMember
+		}
+		if m.role == groupAdmin && role != groupAdmin && g.adminsLocked() == 1 {
+			return errLastAdmin
+		}
+		m.role = role
+		return nil
+	})
+}
+
+// mute silences the group for the member until the given time, a zero time mutes it for good
+func (gd *groupDirectory) mute(name, user string, until time.Time) error {
+	return gd.withGroup(name, func(g *group) error {
+		m, ok := g.members[user]
+		if !ok {
+			return errNotMember
+		}
+		m.muted, m.mutedUntil = true, until
+		return nil
+	})
+}
+
+func (gd *groupDirectory) unmute(name, user string) error {
+	return gd.withGroup(name, func(g *group) error {
+		m, ok := g.members[user]
+		if !ok {
+			return errNotMember
+		}
+		m.muted, m.mutedUntil = false, time.Time{}
+		return nil
+	})
+}
+
+// members is sorted by user name
+func (gd *groupDirectory) members(name string) ([]member, error) {
+	gd.mu.RLock()
+	defer gd.mu.RUnlock()
+	g, ok := gd.groups[name]
+	if !ok {
+		return nil, fmt.Errorf("%w %q", errNoGroup, name)
+	}
+	out := make([]member, 0, len(g.members))
+	for _, m := range g.members {
+		out = append(out, *m)
+	}
+	sort.Slice(out, func(a, b int) bool { return out[a].to.user < out[b].to.user })
+	return out, nil
+}
+
+type fanOutResult struct {
+	members  int
+	sent     int64
+	muted    int
+	digested int64
+	held     int64
+	declined int64
+	failed   int64
+	took     time.Duration
+}
+
+func (r fanOutResult) info() string {
+	return fmt.Sprintf("%v members: %v sent, %v muted, %v digested, %v held, %v declined, %v failed in %v",
+		r.members, r.sent, r.muted, r.digested, r.held, r.declined, r.failed, r.took.Round(time.Millisecond))
+}
+
+const fanOutBatch = 500
+
+// fanOut sends msg to every member but the sender and those who muted the group.
+// Delivery ids are id:user, so a retried fan-out produces the same ids and receivers can drop repeats.
+func (gd *groupDirectory) fanOut(ctx context.Context, id string, msg groupMessage, workers int, p *pipeline) (fanOutResult, error) {
+	start := time.Now()
+	gd.mu.RLock()
+	g, ok := gd.groups[msg.groupName]
+	if !ok {
+		gd.mu.RUnlock()
+		return fanOutResult{}, fmt.Errorf("%w %q", errNoGroup, msg.groupName)
+	}
+	now := gd.clock()
+	res := fanOutResult{members: len(g.members)}
+	targets := make([]recipient, 0, len(g.members))
+	for user, m := range g.members {
+		switch {
+		case user == msg.senderUsername:
+		case m.mutedAt(now):
+			res.muted++
+		default:
+			targets = append(targets, m.to)
+		}
+	}
+	gd.mu.RUnlock()
+	senderPaid := p.limits == nil || p.limits.admitSender(msg)
+
+	batches := make(chan []recipient)
+	var counts [outFailed + 1]atomic.Int64
+	var wg sync.WaitGroup
+	for w := 0; w < max(workers, 1); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for batch := range batches {
+				for _, to := range batch {
+					out, _ := p.sendMember(ctx, delivery{id: id + ":" + to.user, to: to, n: msg, at: now}, senderPaid)
+					counts[out].Add(1)
+				}
+			}
+		}()
+	}
+	var err error
+	for i := 0; i < len(targets) && err == nil; i += fanOutBatch {
+		select {
+		case batches <- targets[i:min(i+fanOutBatch, len(targets))]:
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+	}
+	close(batches)
+	wg.Wait()
+	res.sent, res.digested, res.held = counts[outDelivered].Load(), counts[outDigested].Load(), counts[outHeld].Load()
+	res.declined, res.failed, res.took = counts[outDeclined].Load(), counts[outFailed].Load(), time.Since(start)
+	return res, err
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// INBOX
+// Every delivered notification also lands in the recipient's inbox (the "inbox" channel),
+// with read/unread and archived flags. The store is an append-only log: one json line per change,
+// holding the message as it is after that change, so a delivery costs one short write however big the inbox is.
+// Loading keeps the last line per message, a line cut off by a crash is the change that didn't happen
+// and is cut from the file, so the next line starts on a fresh one.
+// When the log is mostly old versions it is compacted, written next to the old one and renamed over it.
+// Memory only changes after the line is written, so a failed write leaves nothing behind to confuse a retry.
+// Delivering the same delivery id twice stores it once, retries can't double up the inbox.
+
+var errNoMessage = errors.New("no such message in this inbox")
+
+type inboxMessage struct {
+	ID         string     `json:"id"`
+	User       string     `json:"user"`
+	Kind       string     `json:"kind"`
+	From       string     `json:"from"`
+	Group      string     `json:"group,omitempty"`
+	Subject    string     `json:"subject"`
+	Body       string     `json:"body"`
+	Importance int        `json:"importance"`
+	At         time.Time  `json:"at"`
+	Read       bool       `json:"read"`
+	ReadAt     *time.Time `json:"read_at,omitempty"`
+	Archived   bool       `json:"archived"`
+}
+
+type inboxStore struct {
+	mu       sync.Mutex
+	path     string // "" keeps everything in memory
+	log      *os.File
+	lines    int // lines in the log, compaction starts when they far outnumber the messages
+	messages map[string]*inboxMessage
+	clock    func() time.Time
+}
+
+func openInbox(path string, clock func() time.Time) (*inboxStore, error) {
+	if clock == nil {
+		clock = time.Now
+	}
+	st := &inboxStore{path: path, messages: map[string]*inboxMessage{}, clock: clock}
+	if path == "" {
+		return st, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '[' {
+		// the old format, the whole inbox as one array, becomes a log on the first compaction
+		var list []*inboxMessage
+		if err := json.Unmarshal(trimmed, &list); err != nil {
+			return nil, err
+		}
+		for _, m := range list {
+			st.messages[m.ID] = m
+		}
+		if err := st.compactLocked(); err != nil {
+			return nil, err
+		}
+	} else {
+		if cut := bytes.LastIndexByte(data, '\n') + 1; cut < len(data) {
+			// cut off mid write, the change never happened. It goes from the file too,
+			// or the next line appended would be glued onto it
+			if err := os.Truncate(path, int64(cut)); err != nil {
+				return nil, err
+			}
+			data = data[:cut]
+		}
+		for i, line := range bytes.Split(data, []byte("\n")) {
+			if len(bytes.TrimSpace(line)) == 0 {
+				continue
+			}
+			var m inboxMessage
+			if err := json.Unmarshal(line, &m); err != nil {
+				return nil, fmt.Errorf("%v line %v: %w", path, i+1, err)
+			}
+			st.messages[m.ID] = &m
+			st.lines++
+		}
+	}
+	if st.log == nil {
+		if st.log, err = os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644); err != nil {
+			return nil, err
+		}
+	}
+	return st, nil
+}
+
+func (st *inboxStore) close() error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.log == nil {
+		return nil
+	}
+	err := st.log.Close()
+	st.log = nil
+	return err
+}
+
+// appendLocked writes one message version to the log, must be called with st.mu held
+func (st *inboxStore) appendLocked(m *inboxMessage) error {
+	if st.path == "" {
+		return nil
+	}
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	if _, err := st.log.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	st.lines++
+	if st.lines > 2*len(st.messages)+100 {
+		// a failed compaction still leaves a complete log behind
+		st.compactLocked()
+	}
+	return nil
+}
+
+// compactLocked rewrites the log with one line per message, must be called with st.mu held
+func (st *inboxStore) compactLocked() error {
+	list := make([]*inboxMessage, 0, len(st.messages))
+	for _, m := range st.messages {
+		list = append(list, m)
+	}
+	sort.Slice(list, func(a, b int) bool { return list[a].ID < list[b].ID })
+	var buf bytes.Buffer
+	for _, m := range list {
+		data, err := json.Marshal(m)
+		if err != nil {
+			return err
+		}
+		buf.Write(data)
+		buf.WriteByte('\n')
+	}
+	if err := writeFileAtomic(st.path, buf.Bytes()); err != nil {
+		return err
+	}
+	log, err := os.OpenFile(st.path, os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	if st.log != nil {
+		st.log.Close()
+	}
+	st.log, st.lines = log, len(list)
+	return nil
+}
+
+// writeFileAtomic writes next to the target and renames, so readers see the old file or the new one
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+"-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func (st *inboxStore) add(d delivery) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if _, ok := st.messages[d.id]; ok {
+		return nil
+	}
+	name, importance := processNotification(d.n)
+	m := &inboxMessage{
+		ID: d.id, User: d.to.user, Kind: kindOf(d.n), From: senderOf(d.n),
+		Subject: d.subject(), Body: d.body(), Importance: importance, At: d.at,
+	}
+	if g, ok := d.n.(groupMessage); ok {
+		m.Group = g.groupName
+	} else if m.From == "" {
+		m.From = name
+	}
+	if m.At.IsZero() {
+		m.At = st.clock()
+	}
+	if err := st.appendLocked(m); err != nil {
+		return err
+	}
+	st.messages[m.ID] = m
+	return nil
+}
+
+// update finds the user's message, nobody gets to touch someone else's
+func (st *inboxStore) update(user, id string, change func(m *inboxMessage)) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	m, ok := st.messages[id]
+	if !ok || m.User != user {
+		return errNoMessage
+	}
+	changed := *m
+	change(&changed)
+	if err := st.appendLocked(&changed); err != nil {
+		return err
+	}
+	st.messages[id] = &changed
+	return nil
+}
+
+func (st *inboxStore) markRead(user, id string) error {
+	return st.update(user, id, func(m *inboxMessage) {
+		if !m.Read {
+			now := st.clock()
+			m.Read, m.ReadAt = true, &now
+		}
+	})
+}
+
+func (st *inboxStore) markUnread(user, id string) error {
+	return st.update(user, id, func(m *inboxMessage) { m.Read, m.ReadAt = false, nil })
+}
+
+func (st *inboxStore) archive(user, id string) error {
+	return st.update(user, id, func(m *inboxMessage) { m.Archived = true })
+}
+
+type inboxQuery struct {
+	from       string // sender, exact but any case
+	group      string
+	text       string // in subject or body
+	unreadOnly bool
+	archived   bool // archived messages instead of the current ones
+}
+
+// search gives the newest first
+func (st *inboxStore) search(user string, q inboxQuery) []inboxMessage {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	text := strings.ToLower(q.text)
+	var out []inboxMessage
+	for _, m := range st.messages {
+		switch {
+		case m.User != user, m.Archived != q.archived, q.unreadOnly && m.Read:
+			continue
+		case q.from != "" && !strings.EqualFold(m.From, q.from):
+			continue
+		case q.group != "" && !strings.EqualFold(m.Group, q.group):
+			continue
+		case text != "" && !strings.Contains(strings.ToLower(m.Subject+" "+m.Body), text):
+			continue
+		}
+		out = append(out, *m)
+	}
+	sort.Slice(out, func(a, b int) bool {
+		if !out[a].At.Equal(out[b].At) {
+			return out[a].At.After(out[b].At)
+		}
+		return out[a].ID > out[b].ID
+	})
+	return out
+}
+
+// unreadCounts are per importanceBand, archived messages don't count
+func (st *inboxStore) unreadCounts(user string) (total int, byBand map[string]int) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	byBand = map[string]int{}
+	for _, m := range st.messages {
+		if m.User == user && !m.Read && !m.Archived {
+			total++
+			byBand[importanceBand(m.Importance)]++
+		}
+	}
+	return total, byBand
+}
+
+// inboxDeliverer puts deliveries into the store like any other channel
+type inboxDeliverer struct {
+	store *inboxStore
+}
+
+func (i *inboxDeliverer) channel() string { return "inbox" }
+func (i *inboxDeliverer) deliver(_ context.Context, d delivery) error {
+	if d.to.user == "" {
+		return errNoAddress
+	}
+	return i.store.add(d)
+}
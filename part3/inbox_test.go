@@ -0,0 +1,116 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func inboxDelivery(id, user, text string) delivery {
+	return delivery{id: id, to: recipient{user: user}, n: directMessage{senderUsername: "ana", messageContent: text, priorityLevel: 3}, at: time.Date(2024, 3, 1, 9, 0, 0, 0, time.UTC)}
+}
+
+// a line cut off by a crash is dropped from the file, the next change starts on a line of its own
+func TestInboxTornLineIsCut(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "inbox.log")
+	st, err := openInbox(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := st.add(inboxDelivery("d1", "bo", "first")); err != nil {
+		t.Fatal(err)
+	}
+	st.close()
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"id":"d2","user":"bo","subj`)
+	f.Close()
+
+	st, err = openInbox(path, nil)
+	if err != nil {
+		t.Fatalf("open with a torn last line: %v", err)
+	}
+	if err := st.add(inboxDelivery("d3", "bo", "third")); err != nil {
+		t.Fatal(err)
+	}
+	st.close()
+	st, err = openInbox(path, nil)
+	if err != nil {
+		t.Fatalf("open after appending past the torn line: %v", err)
+	}
+	defer st.close()
+	got := st.search("bo", inboxQuery{})
+	if len(got) != 2 || got[0].ID != "d3" || got[1].ID != "d1" {
+		t.Errorf("messages after reload: %v", got)
+	}
+}
+
+// what was delivered, read and archived comes back the same after a reopen, a redelivery is stored once
+// and the old array format is read and turned into a log
+func TestInboxReload(t *testing.T) {
+	dir := t.TempDir()
+	clock := func() time.Time { return time.Date(2024, 3, 1, 10, 0, 0, 0, time.UTC) }
+	for _, tc := range []struct {
+		name  string
+		setup func(path string) error
+	}{
+		{"log", func(path string) error {
+			st, err := openInbox(path, clock)
+			if err != nil {
+				return err
+			}
+			defer st.close()
+			for _, id := range []string{"d1", "d2", "d3", "d1"} {
+				if err := st.add(inboxDelivery(id, "bo", "text of "+id)); err != nil {
+					return err
+				}
+			}
+			if err := st.markRead("bo", "d1"); err != nil {
+				return err
+			}
+			if err := st.markRead("cy", "d2"); !errors.Is(err, errNoMessage) {
+				t.Errorf("someone else marking bo's message: %v", err)
+			}
+			return st.archive("bo", "d3")
+		}},
+		{"old array", func(path string) error {
+			return os.WriteFile(path, []byte(`[
+				{"id":"d1","user":"bo","kind":"direct","from":"ana","subject":"s","body":"text of d1","importance":3,"at":"2024-03-01T09:00:00Z","read":true,"read_at":"2024-03-01T10:00:00Z","archived":false},
+				{"id":"d2","user":"bo","kind":"direct","from":"ana","subject":"s","body":"text of d2","importance":3,"at":"2024-03-01T09:00:00Z","read":false,"archived":false},
+				{"id":"d3","user":"bo","kind":"direct","from":"ana","subject":"s","body":"text of d3","importance":3,"at":"2024-03-01T09:00:00Z","read":false,"archived":true}
+			]`), 0o644)
+		}},
+	} {
+		path := filepath.Join(dir, tc.name+".log")
+		if err := tc.setup(path); err != nil {
+			t.Fatalf("%v: %v", tc.name, err)
+		}
+		for reopen := 0; reopen < 2; reopen++ {
+			st, err := openInbox(path, clock)
+			if err != nil {
+				t.Fatalf("%v: %v", tc.name, err)
+			}
+			current := st.search("bo", inboxQuery{})
+			archived := st.search("bo", inboxQuery{archived: true})
+			unread, _ := st.unreadCounts("bo")
+			st.close()
+			if len(current) != 2 || current[0].ID != "d2" || current[1].ID != "d1" || !current[1].Read || current[1].ReadAt == nil {
+				t.Errorf("%v, open %v: current %+v", tc.name, reopen+1, current)
+			}
+			if len(archived) != 1 || archived[0].ID != "d3" || unread != 1 {
+				t.Errorf("%v, open %v: archived %+v, unread %v", tc.name, reopen+1, archived, unread)
+			}
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if data[0] != '{' {
+			t.Errorf("%v: still not a log: %.20q", tc.name, data)
+		}
+	}
+}
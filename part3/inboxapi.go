@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+)
+
+// INBOX API
+//   GET  /users/{user}/inbox              ?from=sam &group=book+club &q=oven &unread=1 &archived=1
+//   GET  /users/{user}/inbox/unread       {"total": 3, "by_band": {"high": 1, "low": 2}}
+//   POST /users/{user}/inbox/{id}/read
+//   POST /users/{user}/inbox/{id}/unread
+//   POST /users/{user}/inbox/{id}/archive
+// There is no auth here, put it behind whatever already knows who the user is.
+
+type unreadResponse struct {
+	Total  int            `json:"total"`
+	ByBand map[string]int `json:"by_band"`
+}
+
+type apiError struct {
+	Error string `json:"error"`
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func inboxHandler(st *inboxStore) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /users/{user}/inbox", func(w http.ResponseWriter, r *http.Request) {
+		v := r.URL.Query()
+		msgs := st.search(r.PathValue("user"), inboxQuery{
+			from: v.Get("from"), group: v.Get("group"), text: v.Get("q"),
+			unreadOnly: v.Get("unread") == "1", archived: v.Get("archived") == "1",
+		})
+		if msgs == nil {
+			msgs = []inboxMessage{}
+		}
+		writeJSON(w, http.StatusOK, msgs)
+	})
+	mux.HandleFunc("GET /users/{user}/inbox/unread", func(w http.ResponseWriter, r *http.Request) {
+		total, byBand := st.unreadCounts(r.PathValue("user"))
+		writeJSON(w, http.StatusOK, unreadResponse{Total: total, ByBand: byBand})
+	})
+	actions := map[string]func(user, id string) error{
+		"read":    st.markRead,
+		"unread":  st.markUnread,
+		"archive": st.archive,
+	}
+	mux.HandleFunc("POST /users/{user}/inbox/{id}/{action}", func(w http.ResponseWriter, r *http.Request) {
+		act, ok := actions[r.PathValue("action")]
+		if !ok {
+			writeJSON(w, http.StatusNotFound, apiError{"unknown action " + r.PathValue("action")})
+			return
+		}
+		err := act(r.PathValue("user"), r.PathValue("id"))
+		switch {
+		case errors.Is(err, errNoMessage):
+			writeJSON(w, http.StatusNotFound, apiError{err.Error()})
+		case err != nil:
+			writeJSON(w, http.StatusInternalServerError, apiError{err.Error()})
+		default:
+			w.WriteHeader(http.StatusNoContent)
+		}
+	})
+	return mux
+}
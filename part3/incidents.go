@@ -0,0 +1,233 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// INCIDENTS
+// A flapping check can fire DB-DOWN every second, people only need to hear it once.
+// Alerts are grouped into incidents by family, the part of the code before the first "-"
+// (DB-DOWN and DB-SLOW are one database incident). An alert only notifies when it opens an incident,
+// brings a new code into it, or its code has been quiet for longer than the dedup window.
+// Nobody acknowledging an open incident escalates it, again every escalateAfter until someone does.
+
+var (
+	errNoIncident     = errors.New("no incident with that id")
+	errIncidentClosed = errors.New("incident is already resolved")
+)
+
+type incidentState string
+
+const (
+	incidentOpen         incidentState = "open"
+	incidentAcknowledged incidentState = "acknowledged"
+	incidentResolved     incidentState = "resolved"
+)
+
+type incident struct {
+	id          int
+	family      string
+	codes       map[string]int // alertCode -> times seen
+	firstSeen   time.Time
+	lastSeen    time.Time
+	count       int
+	last        systemAlert
+	state       incidentState
+	ackedBy     string
+	ackedAt     time.Time
+	resolvedAt  time.Time
+	escalations int
+}
+
+func (inc incident) info() string {
+	var codes []string
+	for code, n := range inc.codes {
+		codes = append(codes, fmt.Sprintf("%v x%v", code, n))
+	}
+	sort.Strings(codes)
+	s := fmt.Sprintf("#%v %v [%v] %v alert(s) %v | %v - %v", inc.id, inc.family, inc.state, inc.count,
+		strings.Join(codes, ", "), inc.firstSeen.Format("15:04:05"), inc.lastSeen.Format("15:04:05"))
+	if inc.ackedBy != "" {
+		s += " | acked by " + inc.ackedBy
+	}
+	if inc.escalations > 0 {
+		s += fmt.Sprintf(" | escalated %v time(s)", inc.escalations)
+	}
+	return s
+}
+
+func (inc incident) copy() incident {
+	codes := make(map[string]int, len(inc.codes))
+	for k, v := range inc.codes {
+		codes[k] = v
+	}
+	inc.codes = codes
+	return inc
+}
+
+func alertFamily(code string) string {
+	family, _, _ := strings.Cut(code, "-")
+	return family
+}
+
+type incidentTracker struct {
+	mu            sync.Mutex
+	clock         func() time.Time
+	window        time.Duration // same code inside this is a duplicate
+	escalateAfter time.Duration // 0 never escalates
+	incidents     map[int]*incident
+	active        map[string]*incident // family -> the unresolved incident
+	lastNotified  map[string]time.Time // alertCode -> last time it got through
+	nextID        int
+}
+
+func newIncidentTracker(window, escalateAfter time.Duration, clock func() time.Time) *incidentTracker {
+	if clock == nil {
+		clock = time.Now
+	}
+	return &incidentTracker{
+		clock: clock, window: window, escalateAfter: escalateAfter,
+		incidents: map[int]*incident{}, active: map[string]*incident{}, lastNotified: map[string]time.Time{},
+	}
+}
+
+// observe files the alert under its incident, notify says whether anybody should hear about it
+func (t *incidentTracker) observe(a systemAlert) (inc incident, notify bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := t.clock()
+	family := alertFamily(a.alertCode)
+	cur, ok := t.active[family]
+	if !ok {
+		t.nextID++
+		cur = &incident{id: t.nextID, family: family, codes: map[string]int{}, firstSeen: now, state: incidentOpen}
+		t.incidents[cur.id] = cur
+		t.active[family] = cur
+		notify = true
+	}
+	if cur.codes[a.alertCode] == 0 {
+		notify = true // something new is going wrong in the same place
+	}
+	if last, seen := t.lastNotified[a.alertCode]; !seen || now.Sub(last) >= t.window {
+		notify = true
+	}
+	cur.codes[a.alertCode]++
+	cur.count++
+	cur.lastSeen = now
+	cur.last = a
+	if notify {
+		t.lastNotified[a.alertCode] = now
+	}
+	return cur.copy(), notify
+}
+
+func (t *incidentTracker) acknowledge(id int, who string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	inc, ok := t.incidents[id]
+	if !ok {
+		return errNoIncident
+	}
+	if inc.state == incidentResolved {
+		return errIncidentClosed
+	}
+	if inc.state == incidentOpen {
+		inc.state, inc.ackedBy, inc.ackedAt = incidentAcknowledged, who, t.clock()
+	}
+	return nil
+}
+
+// resolve closes the incident, the next alert of the family opens a fresh one
+func (t *incidentTracker) resolve(id int) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	inc, ok := t.incidents[id]
+	if !ok {
+		return errNoIncident
+	}
+	if inc.state == incidentResolved {
+		return errIncidentClosed
+	}
+	inc.state, inc.resolvedAt = incidentResolved, t.clock()
+	delete(t.active, inc.family)
+	for code := range inc.codes {
+		delete(t.lastNotified, code)
+	}
+	return nil
+}
+
+func (t *incidentTracker) list(state incidentState) []incident {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var out []incident
+	for _, inc := range t.sortedLocked() {
+		if state == "" || inc.state == state {
+			out = append(out, inc.copy())
+		}
+	}
+	return out
+}
+
+func (t *incidentTracker) sortedLocked() []*incident {
+	out := make([]*incident, 0, len(t.incidents))
+	for _, inc := range t.incidents {
+		out = append(out, inc)
+	}
+	sort.Slice(out, func(a, b int) bool { return out[a].id < out[b].id })
+	return out
+}
+
+// escalate returns an alert for every incident nobody acknowledged in time, each one once per escalateAfter
+func (t *incidentTracker) escalate() []systemAlert {
+	if t.escalateAfter <= 0 {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := t.clock()
+	var out []systemAlert
+	for _, inc := range t.sortedLocked() {
+		if inc.state != incidentOpen {
+			continue
+		}
+		if now.Sub(inc.firstSeen) < t.escalateAfter*time.Duration(inc.escalations+1) {
+			continue
+		}
+		inc.escalations++
+		out = append(out, systemAlert{
+			alertCode:      fmt.Sprintf("ESCALATED-%v-%v", inc.family, inc.id),
+			messageContent: fmt.Sprintf("incident #%v (%v) unacknowledged for %v: %v", inc.id, inc.family, now.Sub(inc.firstSeen).Round(time.Second), inc.last.messageContent),
+		})
+	}
+	return out
+}
+
+// startEscalator checks every tick and hands escalations to send
+func (t *incidentTracker) startEscalator(tick time.Duration, send func(systemAlert)) (stop func()) {
+	done := make(chan struct{})
+	finished := make(chan struct{})
+	go func() {
+		defer close(finished)
+		ticker := time.NewTicker(tick)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				for _, a := range t.escalate() {
+					send(a)
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		<-finished
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestIncidentDedup(t *testing.T) {
+	c := newFakeClock(time.Date(2024, 3, 1, 9, 0, 0, 0, time.UTC))
+	tr := newIncidentTracker(5*time.Minute, 0, c.clock)
+	for i, step := range []struct {
+		after  time.Duration
+		code   string
+		id     int
+		notify bool
+	}{
+		{0, "DB-DOWN", 1, true},
+		{time.Second, "DB-DOWN", 1, false},
+		{time.Minute, "DB-DOWN", 1, false},
+		{time.Second, "DB-SLOW", 1, true}, // same family, new code
+		{time.Second, "DB-SLOW", 1, false},
+		{time.Second, "DISK-FULL", 2, true},   // another family is another incident
+		{4 * time.Minute, "DB-DOWN", 1, true}, // a window since it last got through
+		{time.Second, "DB-DOWN", 1, false},
+	} {
+		c.advance(step.after)
+		inc, notify := tr.observe(systemAlert{step.code, "x"})
+		if inc.id != step.id || notify != step.notify {
+			t.Errorf("step %v %v: incident #%v notify %v, want #%v notify %v", i+1, step.code, inc.id, notify, step.id, step.notify)
+		}
+	}
+	db := tr.list(incidentOpen)[0]
+	if db.count != 7 || db.codes["DB-DOWN"] != 5 || db.codes["DB-SLOW"] != 2 {
+		t.Errorf("db incident: %v", db.info())
+	}
+
+	if err := tr.resolve(1); err != nil {
+		t.Fatal(err)
+	}
+	if err := tr.resolve(1); !errors.Is(err, errIncidentClosed) {
+		t.Errorf("resolving twice: %v", err)
+	}
+	if err := tr.acknowledge(1, "ana"); !errors.Is(err, errIncidentClosed) {
+		t.Errorf("acking a resolved incident: %v", err)
+	}
+	if err := tr.acknowledge(9, "ana"); !errors.Is(err, errNoIncident) {
+		t.Errorf("acking an unknown incident: %v", err)
+	}
+	inc, notify := tr.observe(systemAlert{"DB-DOWN", "again"})
+	if inc.id != 3 || !notify || inc.count != 1 {
+		t.Errorf("after resolving: incident #%v notify %v count %v, want a fresh #3", inc.id, notify, inc.count)
+	}
+}
+
+func TestIncidentEscalation(t *testing.T) {
+	c := newFakeClock(time.Date(2024, 3, 1, 9, 0, 0, 0, time.UTC))
+	tr := newIncidentTracker(time.Minute, 10*time.Minute, c.clock)
+	tr.observe(systemAlert{"DB-DOWN", "primary unreachable"})
+	tr.observe(systemAlert{"DISK-FULL", "/var at 99%"})
+	for _, step := range []struct {
+		after time.Duration
+		ack   int
+		want  []string
+	}{
+		{9 * time.Minute, 0, nil},
+		{time.Minute, 0, []string{"ESCALATED-DB-1", "ESCALATED-DISK-2"}},
+		{time.Minute, 0, nil}, // once per escalateAfter
+		{0, 2, nil},
+		{9 * time.Minute, 0, []string{"ESCALATED-DB-1"}}, // acked incidents stop escalating
+		{10 * time.Minute, 0, []string{"ESCALATED-DB-1"}},
+	} {
+		c.advance(step.after)
+		if step.ack != 0 {
+			if err := tr.acknowledge(step.ack, "ana"); err != nil {
+				t.Fatal(err)
+			}
+		}
+		got := tr.escalate()
+		if len(got) != len(step.want) {
+			t.Fatalf("at %v: escalated %v, want %v", c.now.Format("15:04"), got, step.want)
+		}
+		for i, a := range got {
+			if a.alertCode != step.want[i] {
+				t.Errorf("at %v: escalated %v, want %v", c.now.Format("15:04"), a.alertCode, step.want[i])
+			}
+		}
+	}
+	if db := tr.list(incidentOpen); len(db) != 1 || db[0].escalations != 3 {
+		t.Errorf("open incidents: %v", db)
+	}
+	if acked := tr.list(incidentAcknowledged); len(acked) != 1 || acked[0].ackedBy != "ana" || acked[0].escalations != 1 {
+		t.Errorf("acked incidents: %v", acked)
+	}
+	if got := newIncidentTracker(time.Minute, 0, c.clock).escalate(); got != nil {
+		t.Errorf("escalateAfter 0 escalated %v", got)
+	}
+}
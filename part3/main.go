@@ -1,6 +1,19 @@
 package main
 
-import "fmt"
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
 
 // INTERFACES PRACTICE
 // The length of a string can be obtained using the len function, which returns the number of bytes.
@@ -179,6 +192,7 @@ type groupMessage struct {
 	groupName      string
 	messageContent string
 	priorityLevel  int
+	senderUsername string // who posted it, empty for messages from the group itself
 }
 
 type systemAlert struct {
@@ -262,13 +276,340 @@ func send(C Cargo, destination string) string{
 }
 
 func main(){
+	if len(os.Args) > 1 && os.Args[1] == "dlq"{
+		if err := runDLQCommand(os.Args[2:]); err != nil{
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		return
+	}
 	randomdmfromfrontend := directMessage{"robin", "wassup",22,false}
 	randomdmprocessed,value :=processNotification(randomdmfromfrontend)
 	fmt.Println(randomdmprocessed,value)
-	if value < 50{
-		fmt.Println("Seems like we are getting some spam today...")
+	rules, err := loadScoringConfig("scoring.json")
+	if err != nil{
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	spamFilter, err := newScoreEngine(rules, nil)
+	if err != nil{
+		fmt.Println(err)
+		return
+	}
+	for _, n := range []notification{
+		randomdmfromfrontend,
+		directMessage{"prizebot", "WINNER!! claim your FREE crypto at http://x.example", 10, false},
+		directMessage{"robin", "running late, start without me", 30, true},
+	}{
+		if v := spamFilter.classify(n); v.spam{
+			fmt.Println("Seems like we are getting some spam today...", v.explain())
+		} else{
+			fmt.Println("ok:", v.explain())
+		}
+	}
+	for _, q := range spamFilter.quarantined(){
+		name, _ := processNotification(q.n)
+		fmt.Printf("quarantine #%v from %v\n", q.id, name)
 	}
 	randomContainer := container{"america", "2812 pounds",true, false, 31331.0}
 	fmt.Println(randomContainer.manifest())
 	fmt.Println(send(randomContainer, "Africa"))
+
+	// the queue hands out the important stuff first, ties in arrival order
+	now := time.Date(2024, 1, 1, 9, 0, 0, 0, time.UTC)
+	queue := newPriorityQueue(queueOptions{agingEvery: time.Minute, clock: func() time.Time { return now }})
+	queue.push(groupMessage{"book club", "chapter 3 tonight", 5, "ana"})
+	now = now.Add(2 * time.Hour) // the book club waited long enough to beat a fresh urgent dm
+	queue.push(directMessage{"robin", "call me", 10, true})
+	queue.push(systemAlert{"DB-DOWN", "primary database unreachable"})
+	queue.push(directMessage{"sam", "lunch?", 10, false})
+	fmt.Println(queue.stats().info())
+	queue.close()
+	for{
+		q, ok := queue.pop()
+		if !ok{
+			break
+		}
+		name, value := processNotification(q.n)
+		fmt.Printf("%v (%v) waited %v\n", name, value, q.waited(now))
+	}
+
+	// a few producers and workers at once
+	busy := newPriorityQueue(queueOptions{capacity: 1000})
+	var wg sync.WaitGroup
+	for p := 0; p < 4; p++{
+		wg.Add(1)
+		go func(p int){
+			defer wg.Done()
+			for i := 0; i < 250; i++{
+				busy.push(directMessage{fmt.Sprintf("user%v", p), "hi", i % 60, false})
+			}
+		}(p)
+	}
+	wg.Wait()
+	busy.close()
+	var handled atomic.Int64
+	for w := 0; w < 3; w++{
+		wg.Add(1)
+		go func(){
+			defer wg.Done()
+			for{
+				if _, ok := busy.pop(); !ok{
+					return
+				}
+				handled.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+	fmt.Println("handled:", handled.Load(), "|", busy.stats().info())
+
+	// delivery, all against local fakes so nothing leaves the machine
+	mailbox, err := startFakeSMTP()
+	if err != nil{
+		fmt.Println(err)
+		return
+	}
+	defer mailbox.close()
+	gateway, hooks := startFakeHTTP(), startFakeHTTP()
+	defer gateway.close()
+	defer hooks.close()
+	inboxDir, _ := os.MkdirTemp("", "part3-inbox")
+	defer os.RemoveAll(inboxDir)
+	inbox, err := openInbox(filepath.Join(inboxDir, "inbox.json"), func() time.Time { return now })
+	if err != nil{
+		fmt.Println(err)
+		return
+	}
+	defer inbox.close()
+	routes := newRouter(defaultRoutes,
+		&inboxDeliverer{store: inbox},
+		&smtpDeliverer{addr: mailbox.addr(), from: "noreply@part3.local"},
+		&smsDeliverer{gateway: gateway.url("/send")},
+		&webhookDeliverer{},
+		&consoleDeliverer{w: os.Stdout},
+	)
+	robin := recipient{user: "robin", email: "robin@example.com", phone: "+15550100", webhook: hooks.url("/robin")}
+	for i, n := range []notification{
+		directMessage{"sam", "lunch?", 10, false},
+		directMessage{"sam", "the oven is on fire", 10, true},
+		groupMessage{"book club", "chapter 3 tonight", 5, "ana"},
+		systemAlert{"DB-DOWN", "primary database unreachable"},
+	}{
+		results := routes.dispatch(context.Background(), delivery{id: fmt.Sprintf("d%v", i), to: robin, n: n, at: now})
+		var parts []string
+		for _, r := range results{
+			parts = append(parts, r.info())
+		}
+		fmt.Println(kindOf(n), "->", strings.Join(parts, ", "))
+	}
+	fmt.Printf("emails: %v | texts: %v | webhooks: %v\n", len(mailbox.received()), len(gateway.received()), len(hooks.received()))
+
+	// ana floods the book club, robin gets the first few and the rest as one digest after the hour
+	limits := newRateLimiter(defaultLimits, func() time.Time { return now })
+	passed := 0
+	for i := 0; i < 20; i++{
+		msg := groupMessage{"book club", fmt.Sprintf("page %v!!", i), 5, "ana"}
+		if i%4 == 3{
+			msg = groupMessage{"pizza night", "who's in?", 5, "leo"}
+		}
+		if limits.admit(delivery{id: fmt.Sprintf("g%v", i), to: robin, n: msg, at: now}){
+			passed++
+		}
+		now = now.Add(time.Second)
+	}
+	fmt.Println("alert during the flood gets through:", limits.admit(delivery{to: robin, n: systemAlert{"DB-DOWN", "still down"}}))
+	fmt.Println("passed:", passed, "| digests due yet:", len(limits.dueDigests(false)))
+	now = now.Add(time.Hour)
+	for _, d := range limits.dueDigests(false){
+		routes.dispatch(context.Background(), d)
+	}
+
+	// robin in Berlin sleeps 22:00-07:00 and never wants group chatter by text
+	prefs := newPreferences(func() time.Time { return now })
+	night, err := parseQuietHours("22:00-07:00", "Europe/Berlin")
+	if err != nil{
+		fmt.Println(err)
+		return
+	}
+	prefs.set(userPrefs{user: "robin", minImportance: map[string]int{"sms": 50}, quiet: night})
+	now = time.Date(2024, 1, 1, 23, 30, 0, 0, time.UTC) // 00:30 in Berlin
+	for i, n := range []notification{
+		directMessage{"sam", "see you tomorrow", 10, false},
+		directMessage{"sam", "your car alarm is going off", 10, true},
+		groupMessage{"book club", "night owls?", 5, "ana"},
+	}{
+		results, held := prefs.dispatch(context.Background(), routes, delivery{id: fmt.Sprintf("q%v", i), to: robin, n: n, at: now})
+		fmt.Println(kindOf(n), "at night -> held:", held, "| sent on:", len(results))
+	}
+	fmt.Println("held for robin:", prefs.heldFor("robin"))
+	now = time.Date(2024, 1, 2, 6, 5, 0, 0, time.UTC) // 07:05 in Berlin
+	fmt.Println("released in the morning:", len(prefs.releaseDue(context.Background(), routes)), "| still held:", prefs.heldFor("robin"))
+
+	// a flapping database check: one notification per code per 5 minutes, one incident for the whole family
+	incidents := newIncidentTracker(5*time.Minute, 15*time.Minute, func() time.Time { return now })
+	for i, code := range []string{"DB-DOWN", "DB-DOWN", "DB-DOWN", "DB-SLOW", "DISK-FULL", "DB-DOWN"}{
+		inc, notify := incidents.observe(systemAlert{code, "check failed"})
+		fmt.Printf("%v -> incident #%v notify: %v\n", code, inc.id, notify)
+		now = now.Add(time.Duration(i+1) * time.Minute)
+	}
+	now = now.Add(10 * time.Minute)
+	for _, a := range incidents.escalate(){
+		name, value := processNotification(a)
+		fmt.Println("escalation:", name, value, a.messageContent)
+	}
+	incidents.acknowledge(1, "robin")
+	incidents.resolve(2)
+	for _, inc := range incidents.list(""){
+		fmt.Println(inc.info())
+	}
+
+	// robin's inbox over http: what's unread, read one, search by sender
+	api := httptest.NewServer(inboxHandler(inbox))
+	defer api.Close()
+	for _, call := range [][2]string{
+		{"GET", "/users/robin/inbox/unread"},
+		{"POST", "/users/robin/inbox/d1/read"},
+		{"POST", "/users/robin/inbox/d2/archive"},
+		{"POST", "/users/sam/inbox/d0/read"},
+		{"GET", "/users/robin/inbox?from=sam"},
+		{"GET", "/users/robin/inbox/unread"},
+	}{
+		req, _ := http.NewRequest(call[0], api.URL+call[1], nil)
+		res, err := http.DefaultClient.Do(req)
+		if err != nil{
+			fmt.Println(err)
+			continue
+		}
+		body, _ := io.ReadAll(res.Body)
+		res.Body.Close()
+		fmt.Printf("%v %v -> %v %.160s\n", call[0], call[1], res.StatusCode, strings.TrimSpace(string(body)))
+	}
+	if reopened, err := openInbox(filepath.Join(inboxDir, "inbox.json"), nil); err == nil{
+		total, _ := reopened.unreadCounts("robin")
+		fmt.Println("unread after reopening the file:", total)
+		reopened.close()
+	}
+
+	// groups: every copy takes the same way as a direct message, rate limits, preferences, routes and the inbox
+	groups := newGroupDirectory(func() time.Time { return now })
+	groups.createGroup("pizza night", recipient{user: "leo", email: "leo@example.com"})
+	groups.join("pizza night", robin)
+	groups.join("pizza night", recipient{user: "ana", email: "ana@example.com"})
+	groups.mute("pizza night", "ana", now.Add(2*time.Hour))
+	fmt.Println("member leaves as last admin:", groups.leave("pizza night", "leo"))
+	res, _ := groups.fanOut(context.Background(), "pn1", groupMessage{"pizza night", "friday 8pm?", 20, "leo"}, 2, &pipeline{limits: limits, prefs: prefs, sender: newReliableSender(routes, defaultRetryPolicy, nil)})
+	fmt.Println("pizza night:", res.info())
+
+	// 50k members, some muted, some asleep in California, some only want direct messages.
+	// Each member gets one group message per minute, the second announcement right after the first goes into digests.
+	// The console copy is thrown away here, 50k lines would bury the demo.
+	groups.createGroup("everyone", recipient{user: "admin"})
+	lateNight, _ := parseQuietHours("22:00-07:00", "America/Los_Angeles")
+	crowd := newPreferences(func() time.Time { return now })
+	for i := 0; i < 50000; i++{
+		user := fmt.Sprintf("user%05d", i)
+		groups.join("everyone", recipient{user: user})
+		switch {
+		case i%10 == 0:
+			groups.mute("everyone", user, time.Time{})
+		case i%7 == 0:
+			crowd.set(userPrefs{user: user, quiet: lateNight})
+		case i%13 == 0:
+			crowd.set(userPrefs{user: user, accept: map[string]bool{"direct": true, "alert": true}})
+		}
+	}
+	everyone := &pipeline{
+		limits: newRateLimiter(limiterConfig{perSender: rateLimit{every: time.Second, burst: 5}, perRecipient: rateLimit{every: time.Minute, burst: 1}}, func() time.Time { return now }),
+		prefs:  crowd,
+		sender: newReliableSender(newRouter(defaultRoutes, &inboxDeliverer{store: inbox}, &consoleDeliverer{w: io.Discard}), defaultRetryPolicy, nil),
+	}
+	res, _ = groups.fanOut(context.Background(), "all1", groupMessage{"everyone", "we're closed on monday", 30, "admin"}, 8, everyone)
+	fmt.Println("everyone:", res.info())
+	res, _ = groups.fanOut(context.Background(), "all2", groupMessage{"everyone", "and tuesday", 30, "admin"}, 8, everyone)
+	fmt.Println("everyone again:", res.info())
+	unread, _ := inbox.unreadCounts("user00001")
+	fmt.Println("user00001 unread:", unread, "| held for user00007:", crowd.heldFor("user00007"), "| digests due:", len(everyone.limits.dueDigests(true)))
+
+	// the webhook flakes twice and then works, later it's down for good and the alert ends up a dead letter
+	dead, _ := openDeadLetters(filepath.Join(inboxDir, "dead.json"), func() time.Time { return now })
+	reliable := newReliableSender(newRouter([]routeRule{{channels: []string{"webhook"}}}, &webhookDeliverer{}), retryPolicy{maxAttempts: 4, base: time.Second, maxDelay: time.Minute}, dead)
+	reliable.sleep = func(_ context.Context, d time.Duration) error {
+		now = now.Add(d) // no real waiting in a demo
+		return nil
+	}
+	hooks.fail(500, 503)
+	for _, r := range reliable.send(context.Background(), delivery{id: "w1", to: robin, n: systemAlert{"DB-DOWN", "again"}, at: now}){
+		fmt.Println("flaky webhook:", r.channel, "attempts:", r.attempts, "err:", r.err)
+	}
+	hooks.fail(500, 500, 500, 500)
+	for _, r := range reliable.send(context.Background(), delivery{id: "w2", to: robin, n: systemAlert{"DISK-FULL", "/var at 99%"}, at: now}){
+		fmt.Println("dead webhook:", r.channel, "attempts:", r.attempts, "err:", r.err)
+	}
+	// a 404 won't get better by waiting, one try and it's a dead letter
+	hooks.fail(404)
+	for _, r := range reliable.send(context.Background(), delivery{id: "w3", to: robin, n: systemAlert{"DB-SLOW", "queries over 2s"}, at: now}){
+		fmt.Println("gone webhook:", r.channel, "attempts:", r.attempts, "err:", r.err)
+	}
+	runDLQCommand([]string{"list", filepath.Join(inboxDir, "dead.json")})
+	hooks.fail(500, 500, 500, 500, 404)
+	ok, failed := dead.replayAll(context.Background(), reliable)
+	fmt.Println("replayed while still down:", ok, "failed:", failed, "| letters kept:", len(dead.list()))
+	ok, failed = dead.replayAll(context.Background(), reliable)
+	last := hooks.received()[len(hooks.received())-1]
+	fmt.Println("replayed:", ok, "failed:", failed, "| idempotency key seen by the webhook:", last.header.Get("Idempotency-Key"))
+
+	// the process dies while w4 waits for its second try, the next run finds it in the pending queue
+	pendingPath := filepath.Join(inboxDir, "pending.json")
+	crashing := newReliableSender(reliable.r, reliable.policy, dead)
+	crashing.pending, _ = openDeadLetters(pendingPath, func() time.Time { return now })
+	crashed := make(chan struct{})
+	crashing.sleep = func(context.Context, time.Duration) error {
+		close(crashed)
+		select {} // never wakes up, as good as a crash here
+	}
+	hooks.fail(503)
+	go crashing.send(context.Background(), delivery{id: "w4", to: robin, n: systemAlert{"DB-DOWN", "and again"}, at: now})
+	<-crashed
+	restarted := newReliableSender(reliable.r, reliable.policy, dead)
+	restarted.sleep = reliable.sleep
+	restarted.pending, err = openDeadLetters(pendingPath, func() time.Time { return now })
+	if err != nil{
+		fmt.Println(err)
+		return
+	}
+	fmt.Println("pending after the crash:", len(restarted.pending.list()))
+	ok, failed = restarted.resume(context.Background())
+	fmt.Println("resumed:", ok, "failed:", failed, "| still pending:", len(restarted.pending.list()), "| last webhook key:", hooks.received()[len(hooks.received())-1].header.Get("Idempotency-Key"))
+
+	// templates: the text comes from the notification kind, the channel and the reader's language
+	templates := defaultTemplates()
+	long := directMessage{"sam", strings.Repeat("the delivery van is stuck behind a parade, ", 6), 10, false}
+	for _, try := range []struct{ n notification; channel, lang string }{
+		{systemAlert{"DB-DOWN", "primary database unreachable"}, "email", "de-AT"},
+		{groupMessage{"pizza night", "friday 8pm?", 20, "leo"}, "inbox", "es"},
+		{directMessage{"sam", "lunch?", 10, false}, "email", "pt-BR"},
+		{long, "sms", "en"},
+	}{
+		msg, err := templates.render(try.n, try.channel, try.lang, nil)
+		if err != nil{
+			fmt.Println(err)
+			continue
+		}
+		fmt.Printf("%v/%v in %v: %q | %.70q (%v runes, cut: %v)\n", kindOf(try.n), try.channel, msg.lang, msg.subject, msg.body, len([]rune(msg.body)), msg.truncated)
+	}
+	templates.add("direct", "email", "en", "Order {{.order}} from {{.sender}}", "{{.content}}")
+	_, err = templates.render(directMessage{"sam", "where is it?", 10, false}, "email", "en", nil)
+	fmt.Println("rendered without the order number:", err)
+	routes.templates = templates
+	routes.dispatch(context.Background(), delivery{id: "t1", to: recipient{user: "jonas", lang: "de"}, n: groupMessage{"pizza night", "Freitag 20 Uhr?", 20, "leo"}, at: now})
+	fmt.Println("routed with the order number:", routes.dispatch(context.Background(), delivery{id: "t2", to: robin, n: directMessage{"sam", "where is it?", 10, false}, at: now, vars: map[string]any{"order": "A-1042"}})[0].info(),
+		"| subject:", strings.Contains(mailbox.received()[len(mailbox.received())-1].data, "Subject: Order A-1042 from sam"))
+
+	// no template for a text still gets cut to the sms limit
+	routes.templates = nil
+	routes.dispatchOn(context.Background(), delivery{id: "t3", to: robin, n: long}, []string{"sms"})
+	var text smsPayload
+	json.Unmarshal([]byte(gateway.received()[len(gateway.received())-1].body), &text)
+	fmt.Printf("untemplated text: %v runes, ends %q\n", len([]rune(text.Body)), text.Body[len(text.Body)-6:])
 }
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// PIPELINE
+// The way one delivery goes out: the rate limits first (ratelimit.go), then the recipient's preferences
+// and quiet hours (prefs.go), then the routed channels through the reliable sender (retry.go), so a failing
+// channel is retried and ends up a dead letter like any direct send. Without limits or prefs that step is skipped.
+// Held back by a limit or for quiet hours isn't a failure, the message is in a digest or waits for the morning.
+
+type pipeline struct {
+	limits *rateLimiter
+	prefs  *preferences
+	sender *reliableSender
+}
+
+type outcome int
+
+const (
+	outDelivered outcome = iota
+	outDigested          // over a rate limit, counted into the recipient's digest
+	outHeld              // waiting for the recipient's quiet hours to end
+	outDeclined          // the recipient's preferences leave no channel for it
+	outFailed            // at least one channel failed, the error says which
+)
+
+func (p *pipeline) send(ctx context.Context, d delivery) (outcome, error) {
+	if p.limits != nil && !p.limits.admit(d) {
+		return outDigested, nil
+	}
+	return p.route(ctx, d)
+}
+
+// sendMember is send for one copy of a fan-out, the sender's token was taken once for all of them
+func (p *pipeline) sendMember(ctx context.Context, d delivery, senderPaid bool) (outcome, error) {
+	if p.limits != nil && !p.limits.admitMember(d, senderPaid) {
+		return outDigested, nil
+	}
+	return p.route(ctx, d)
+}
+
+func (p *pipeline) route(ctx context.Context, d delivery) (outcome, error) {
+	var results []deliveryResult
+	if p.prefs != nil {
+		var held bool
+		results, held = p.prefs.dispatch(ctx, p.sender, d)
+		switch {
+		case held:
+			return outHeld, nil
+		case len(results) == 0:
+			return outDeclined, nil
+		}
+	} else {
+		for _, r := range p.sender.send(ctx, d) {
+			results = append(results, deliveryResult{channel: r.channel, err: r.err})
+		}
+	}
+	var errs []error
+	for _, r := range results {
+		if r.err != nil {
+			errs = append(errs, fmt.Errorf("%v: %w", r.channel, r.err))
+		}
+	}
+	if len(errs) > 0 {
+		return outFailed, errors.Join(errs...)
+	}
+	return outDelivered, nil
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// flakyDeliverer fails its first fails sends with err, then works
+type flakyDeliverer struct {
+	name  string
+	fails int
+	err   error
+
+	mu   sync.Mutex
+	sent []delivery
+}
+
+var errFlaky = errors.New("connection reset")
+
+func (f *flakyDeliverer) channel() string { return f.name }
+func (f *flakyDeliverer) deliver(_ context.Context, d delivery) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.fails > 0 {
+		f.fails--
+		return f.err
+	}
+	f.sent = append(f.sent, d)
+	return nil
+}
+
+func noWait(context.Context, time.Duration) error { return nil }
+
+// testSender retries without waiting and buries into an in-memory queue
+func testSender(r *router, attempts int) (*reliableSender, *deadLetters) {
+	dead, _ := openDeadLetters("", nil)
+	rs := newReliableSender(r, retryPolicy{maxAttempts: attempts, base: time.Second, maxDelay: time.Minute}, dead)
+	rs.sleep = noWait
+	return rs, dead
+}
+
+// the routed channels of a pipeline get the same retries and dead letters as a direct send,
+// with and without preferences in front of them
+func TestPipelineRetriesAndBuries(t *testing.T) {
+	for _, withPrefs := range []bool{false, true} {
+		flaky := &flakyDeliverer{name: "email", fails: 2, err: errFlaky}
+		down := &flakyDeliverer{name: "sms", fails: 100, err: errFlaky}
+		rs, dead := testSender(newRouter([]routeRule{{channels: []string{"email", "sms"}}}, flaky, down), 3)
+		p := &pipeline{sender: rs}
+		if withPrefs {
+			p.prefs = newPreferences(nil)
+		}
+		out, err := p.send(context.Background(), delivery{id: "d1", to: recipient{user: "bo"}, n: systemAlert{"DB-DOWN", "down"}})
+		if out != outFailed || !errors.Is(err, errFlaky) {
+			t.Errorf("prefs %v: got %v %v, want outFailed", withPrefs, out, err)
+		}
+		if len(flaky.sent) != 1 {
+			t.Errorf("prefs %v: email went out %v times after two failures, want 1", withPrefs, len(flaky.sent))
+		}
+		letters := dead.list()
+		if len(letters) != 1 || letters[0].Channel != "sms" || letters[0].Attempts != 3 {
+			t.Errorf("prefs %v: dead letters %v", withPrefs, letters)
+		}
+	}
+}
+
+// every copy of a fan-out is retried on its own, what still fails is one dead letter per member
+func TestFanOutCopiesAreRetried(t *testing.T) {
+	gd := newGroupDirectory(nil)
+	gd.createGroup("crew", recipient{user: "admin"})
+	for _, user := range []string{"ana", "bo", "cy"} {
+		gd.join("crew", recipient{user: user})
+	}
+	inbox := &flakyDeliverer{name: "inbox", fails: 2, err: errFlaky}
+	down := &flakyDeliverer{name: "console", fails: 100, err: errFlaky}
+	rs, dead := testSender(newRouter([]routeRule{{channels: []string{"inbox", "console"}}}, inbox, down), 3)
+	res, err := gd.fanOut(context.Background(), "g1", groupMessage{"crew", "shift swap?", 5, "admin"}, 1, &pipeline{sender: rs})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.failed != 3 || len(inbox.sent) != 3 {
+		t.Errorf("failed %v, inbox got %v copies", res.failed, len(inbox.sent))
+	}
+	if n := len(dead.list()); n != 3 {
+		t.Errorf("dead letters: got %v, want one per member", n)
+	}
+}
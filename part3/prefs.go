@@ -0,0 +1,213 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	_ "time/tzdata" // quiet hours need zones even on machines without a zoneinfo database
+)
+
+// PREFERENCES AND QUIET HOURS
+// The router decides which channels a kind of notification can use, the recipient then narrows that down:
+// kinds they don't want at all, a minimum importance per channel, and quiet hours in their own time zone.
+// During quiet hours only urgent direct messages and system alerts get through,
+// everything else is held and released once the quiet hours are over.
+
+var errBadQuietHours = errors.New("quiet hours look like 22:00-07:00")
+
+type quietHours struct {
+	start, end int // minutes after midnight, end before start means it runs over midnight
+	zone       *time.Location
+}
+
+func parseClock(s string) (int, error) {
+	h, m, ok := strings.Cut(strings.TrimSpace(s), ":")
+	hour, err1 := strconv.Atoi(h)
+	minute, err2 := strconv.Atoi(m)
+	if !ok || err1 != nil || err2 != nil || hour < 0 || hour > 23 || minute < 0 || minute > 59 {
+		return 0, fmt.Errorf("%w, got %q", errBadQuietHours, s)
+	}
+	return hour*60 + minute, nil
+}
+
+// parseQuietHours("22:00-07:00", "Europe/Berlin"), an empty zone means UTC
+func parseQuietHours(span, zone string) (*quietHours, error) {
+	from, to, ok := strings.Cut(span, "-")
+	if !ok {
+		return nil, fmt.Errorf("%w, got %q", errBadQuietHours, span)
+	}
+	start, err := parseClock(from)
+	if err != nil {
+		return nil, err
+	}
+	end, err := parseClock(to)
+	if err != nil {
+		return nil, err
+	}
+	loc, err := time.LoadLocation(zone)
+	if err != nil {
+		return nil, err
+	}
+	return &quietHours{start: start, end: end, zone: loc}, nil
+}
+
+func (q *quietHours) active(t time.Time) bool {
+	if q == nil || q.start == q.end {
+		return false
+	}
+	local := t.In(q.zone)
+	minute := local.Hour()*60 + local.Minute()
+	if q.start < q.end {
+		return minute >= q.start && minute < q.end
+	}
+	return minute >= q.start || minute < q.end
+}
+
+// endAfter is when the quiet hours that t falls into are over, in the user's zone so DST is right
+func (q *quietHours) endAfter(t time.Time) time.Time {
+	local := t.In(q.zone)
+	end := time.Date(local.Year(), local.Month(), local.Day(), q.end/60, q.end%60, 0, 0, q.zone)
+	if !end.After(local) {
+		end = end.AddDate(0, 0, 1)
+	}
+	return end
+}
+
+type userPrefs struct {
+	user          string
+	accept        map[string]bool // kind -> wanted, nil accepts every kind
+	minImportance map[string]int  // channel -> lowest importance it may carry
+	quiet         *quietHours     // nil means never quiet
+}
+
+// breaksQuiet is what still wakes people up
+func breaksQuiet(n notification) bool {
+	switch v := n.(type) {
+	case directMessage:
+		return v.isUrgent
+	case systemAlert:
+		return true
+	}
+	return false
+}
+
+type heldDelivery struct {
+	d     delivery
+	until time.Time
+}
+
+type preferences struct {
+	mu    sync.Mutex
+	users map[string]userPrefs
+	held  []heldDelivery
+	clock func() time.Time
+}
+
+func newPreferences(clock func() time.Time) *preferences {
+	if clock == nil {
+		clock = time.Now
+	}
+	return &preferences{users: map[string]userPrefs{}, clock: clock}
+}
+
+func (p *preferences) set(u userPrefs) {
+	p.mu.Lock()
+	p.users[u.user] = u
+	p.mu.Unlock()
+}
+
+// channelsLocked narrows the routed channels for this recipient, quiet hours aside
+func (p *preferences) channelsLocked(d delivery, routed []string) []string {
+	u, ok := p.users[d.to.user]
+	if !ok {
+		return routed
+	}
+	if u.accept != nil && !u.accept[kindOf(d.n)] {
+		return nil
+	}
+	var keep []string
+	for _, ch := range routed {
+		if d.n.importance() >= u.minImportance[ch] {
+			keep = append(keep, ch)
+		}
+	}
+	return keep
+}
+
+// dispatch is router.dispatch with the recipient's say. held is true when it waits for quiet hours to end,
+// no results and not held means the recipient doesn't want it on any channel.
+// dispatcher takes the channels the preferences left, a router sends on each once,
+// a reliableSender (retry.go) retries them and dead-letters what still fails
+type dispatcher interface {
+	channelsFor(n notification) []string
+	dispatchOn(ctx context.Context, d delivery, channels []string) []deliveryResult
+}
+
+func (p *preferences) dispatch(ctx context.Context, r dispatcher, d delivery) (results []deliveryResult, held bool) {
+	p.mu.Lock()
+	channels := p.channelsLocked(d, r.channelsFor(d.n))
+	if len(channels) == 0 {
+		p.mu.Unlock()
+		return nil, false
+	}
+	now := p.clock()
+	if q := p.users[d.to.user].quiet; q.active(now) && !breaksQuiet(d.n) {
+		p.held = append(p.held, heldDelivery{d: d, until: q.endAfter(now)})
+		p.mu.Unlock()
+		return nil, true
+	}
+	p.mu.Unlock()
+	return r.dispatchOn(ctx, d, channels), false
+}
+
+// releaseDue sends what was held for quiet hours that are over now, oldest first.
+// Preferences are looked at again, somebody may have muted a kind overnight.
+func (p *preferences) releaseDue(ctx context.Context, r dispatcher) map[string][]deliveryResult {
+	p.mu.Lock()
+	now := p.clock()
+	var due []heldDelivery
+	kept := p.held[:0]
+	for _, h := range p.held {
+		if h.until.After(now) {
+			kept = append(kept, h)
+		} else {
+			due = append(due, h)
+		}
+	}
+	p.held = kept
+	type send struct {
+		d        delivery
+		channels []string
+	}
+	var sends []send
+	for _, h := range due {
+		if channels := p.channelsLocked(h.d, r.channelsFor(h.d.n)); len(channels) > 0 {
+			sends = append(sends, send{h.d, channels})
+		}
+	}
+	p.mu.Unlock()
+
+	sort.SliceStable(sends, func(a, b int) bool { return sends[a].d.at.Before(sends[b].d.at) })
+	out := map[string][]deliveryResult{}
+	for _, s := range sends {
+		out[s.d.id] = r.dispatchOn(ctx, s.d, s.channels)
+	}
+	return out
+}
+
+func (p *preferences) heldFor(user string) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	n := 0
+	for _, h := range p.held {
+		if h.d.to.user == user {
+			n++
+		}
+	}
+	return n
+}
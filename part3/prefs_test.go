@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestQuietHoursActive(t *testing.T) {
+	for _, tc := range []struct {
+		span, zone string
+		at         time.Time
+		want       bool
+	}{
+		{"22:00-07:00", "", time.Date(2024, 3, 1, 21, 59, 0, 0, time.UTC), false},
+		{"22:00-07:00", "", time.Date(2024, 3, 1, 22, 0, 0, 0, time.UTC), true},
+		{"22:00-07:00", "", time.Date(2024, 3, 1, 23, 59, 0, 0, time.UTC), true},
+		{"22:00-07:00", "", time.Date(2024, 3, 2, 0, 0, 0, 0, time.UTC), true},
+		{"22:00-07:00", "", time.Date(2024, 3, 2, 6, 59, 0, 0, time.UTC), true},
+		{"22:00-07:00", "", time.Date(2024, 3, 2, 7, 0, 0, 0, time.UTC), false},
+		{"12:00-14:00", "", time.Date(2024, 3, 2, 13, 0, 0, 0, time.UTC), true},
+		{"12:00-14:00", "", time.Date(2024, 3, 2, 23, 0, 0, 0, time.UTC), false},
+		{"09:00-09:00", "", time.Date(2024, 3, 2, 9, 0, 0, 0, time.UTC), false},
+		// 21:30 UTC is 22:30 in Berlin in winter, 23:30 in summer
+		{"22:00-07:00", "Europe/Berlin", time.Date(2024, 1, 10, 21, 30, 0, 0, time.UTC), true},
+		{"22:00-07:00", "Europe/Berlin", time.Date(2024, 7, 10, 20, 30, 0, 0, time.UTC), true},
+		{"22:00-07:00", "Europe/Berlin", time.Date(2024, 7, 10, 5, 30, 0, 0, time.UTC), false},
+		{"22:00-07:00", "Europe/Berlin", time.Date(2024, 1, 10, 5, 30, 0, 0, time.UTC), true},
+		// 02:30 happens twice on the night the clocks go back, quiet both times
+		{"01:00-03:00", "Europe/Berlin", time.Date(2024, 10, 27, 0, 30, 0, 0, time.UTC), true},
+		{"01:00-03:00", "Europe/Berlin", time.Date(2024, 10, 27, 1, 30, 0, 0, time.UTC), true},
+		{"01:00-03:00", "Europe/Berlin", time.Date(2024, 10, 27, 2, 30, 0, 0, time.UTC), false},
+	} {
+		q, err := parseQuietHours(tc.span, tc.zone)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := q.active(tc.at); got != tc.want {
+			t.Errorf("%v %v at %v: active %v, want %v", tc.span, tc.zone, tc.at, got, tc.want)
+		}
+	}
+	var none *quietHours
+	if none.active(time.Now()) {
+		t.Error("no quiet hours are active")
+	}
+	for _, bad := range []string{"22:00", "25:00-07:00", "22:00-7", "ten-seven"} {
+		if _, err := parseQuietHours(bad, ""); !errors.Is(err, errBadQuietHours) {
+			t.Errorf("%q: got %v", bad, err)
+		}
+	}
+	if _, err := parseQuietHours("22:00-07:00", "Mars/Olympus"); err == nil {
+		t.Error("unknown zone accepted")
+	}
+}
+
+// the quiet hours end at 07:00 on the user's wall clock, whatever offset that is on the night
+func TestQuietHoursEndAcrossDST(t *testing.T) {
+	q, err := parseQuietHours("22:00-07:00", "Europe/Berlin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		name string
+		at   time.Time
+		want time.Time
+	}{
+		{"winter night", time.Date(2024, 1, 10, 22, 0, 0, 0, time.UTC), time.Date(2024, 1, 11, 6, 0, 0, 0, time.UTC)},
+		{"clocks go forward", time.Date(2024, 3, 30, 22, 0, 0, 0, time.UTC), time.Date(2024, 3, 31, 5, 0, 0, 0, time.UTC)},
+		{"after midnight, clocks go forward", time.Date(2024, 3, 31, 0, 30, 0, 0, time.UTC), time.Date(2024, 3, 31, 5, 0, 0, 0, time.UTC)},
+		{"clocks go back", time.Date(2024, 10, 26, 21, 0, 0, 0, time.UTC), time.Date(2024, 10, 27, 6, 0, 0, 0, time.UTC)},
+		{"in the repeated hour", time.Date(2024, 10, 27, 1, 30, 0, 0, time.UTC), time.Date(2024, 10, 27, 6, 0, 0, 0, time.UTC)},
+		{"summer night", time.Date(2024, 7, 10, 21, 0, 0, 0, time.UTC), time.Date(2024, 7, 11, 5, 0, 0, 0, time.UTC)},
+	} {
+		if !q.active(tc.at) {
+			t.Fatalf("%v: %v isn't in the quiet hours", tc.name, tc.at)
+		}
+		if got := q.endAfter(tc.at); !got.Equal(tc.want) {
+			t.Errorf("%v: ends %v, want %v", tc.name, got.UTC(), tc.want)
+		}
+	}
+}
+
+func TestPreferencesHoldAndRelease(t *testing.T) {
+	c := newFakeClock(time.Date(2024, 3, 1, 23, 0, 0, 0, time.UTC))
+	quiet, err := parseQuietHours("22:00-07:00", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	email := &flakyDeliverer{name: "email"}
+	sms := &flakyDeliverer{name: "sms"}
+	r := newRouter([]routeRule{{channels: []string{"email", "sms"}}}, email, sms)
+	p := newPreferences(c.clock)
+	p.set(userPrefs{user: "bo", quiet: quiet, minImportance: map[string]int{"sms": 50}})
+	p.set(userPrefs{user: "cy", accept: map[string]bool{"alert": true}})
+	ctx := context.Background()
+	for _, tc := range []struct {
+		name     string
+		d        delivery
+		channels []string
+		held     bool
+	}{
+		{"quiet", delivery{id: "d1", to: recipient{user: "bo"}, n: directMessage{senderUsername: "ana", priorityLevel: 30}}, nil, true},
+		{"urgent breaks quiet", delivery{id: "d2", to: recipient{user: "bo"}, n: directMessage{senderUsername: "ana", isUrgent: true}}, []string{"email", "sms"}, false},
+		{"alert breaks quiet", delivery{id: "d3", to: recipient{user: "bo"}, n: systemAlert{"DB-DOWN", "down"}}, []string{"email", "sms"}, false},
+		{"kind not wanted", delivery{id: "d4", to: recipient{user: "cy"}, n: directMessage{senderUsername: "ana"}}, nil, false},
+		{"kind wanted", delivery{id: "d5", to: recipient{user: "cy"}, n: systemAlert{"DB-DOWN", "down"}}, []string{"email", "sms"}, false},
+		{"no preferences", delivery{id: "d6", to: recipient{user: "di"}, n: directMessage{senderUsername: "ana"}}, []string{"email", "sms"}, false},
+	} {
+		res, held := p.dispatch(ctx, r, tc.d)
+		var channels []string
+		for _, r := range res {
+			channels = append(channels, r.channel)
+		}
+		if held != tc.held || fmt.Sprint(channels) != fmt.Sprint(tc.channels) {
+			t.Errorf("%v: sent on %v held %v, want %v held %v", tc.name, channels, held, tc.channels, tc.held)
+		}
+	}
+
+	c.now = time.Date(2024, 3, 2, 6, 59, 0, 0, time.UTC)
+	if out := p.releaseDue(ctx, r); len(out) != 0 || p.heldFor("bo") != 1 {
+		t.Errorf("released before 07:00: %v", out)
+	}
+	// the sms minimum still holds on release, 30 only goes out by email
+	c.now = time.Date(2024, 3, 2, 7, 0, 0, 0, time.UTC)
+	out := p.releaseDue(ctx, r)
+	if len(out["d1"]) != 1 || out["d1"][0].channel != "email" || p.heldFor("bo") != 0 {
+		t.Errorf("released at 07:00: %v, still held %v", out, p.heldFor("bo"))
+	}
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"container/heap"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// PRIORITY QUEUE
+// Any notification goes in, the most important one comes out first, equal importance comes out in arrival order.
+// With aging on, waiting counts too: a message gains one point per agingEvery it sits in the queue,
+// so a priority 5 groupMessage still gets out eventually under a steady stream of urgent ones.
+//
+// Aging is the same for everyone, so comparing two messages at any moment:
+//   a.importance + (now-a.at)/step  vs  b.importance + (now-b.at)/step
+// now cancels out, which means the order never changes while they wait and a plain heap works.
+
+var (
+	errQueueClosed = errors.New("queue is closed")
+	errQueueFull   = errors.New("queue is full")
+)
+
+type queued struct {
+	n          notification
+	seq        uint64 // arrival order, breaks ties
+	enqueuedAt time.Time
+	rank       float64 // importance plus the aging head start, fixed at push
+}
+
+// waited is how long it sat in the queue, as of now
+func (q queued) waited(now time.Time) time.Duration {
+	return now.Sub(q.enqueuedAt)
+}
+
+type queueHeap []*queued
+
+func (h queueHeap) Len() int { return len(h) }
+func (h queueHeap) Less(a, b int) bool {
+	if h[a].rank != h[b].rank {
+		return h[a].rank > h[b].rank
+	}
+	return h[a].seq < h[b].seq
+}
+func (h queueHeap) Swap(a, b int) { h[a], h[b] = h[b], h[a] }
+func (h *queueHeap) Push(x any)   { *h = append(*h, x.(*queued)) }
+func (h *queueHeap) Pop() any {
+	old := *h
+	last := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	return last
+}
+
+type queueOptions struct {
+	agingEvery time.Duration // 0 means strict importance order, no aging
+	capacity   int           // 0 means unbounded
+	clock      func() time.Time
+}
+
+type priorityQueue struct {
+	mu       sync.Mutex
+	nonEmpty *sync.Cond
+	items    queueHeap
+	opts     queueOptions
+	epoch    time.Time // ranks are measured from here, keeps the floats small
+	seq      uint64
+	closed   bool
+
+	enqueued, dequeued, rejected uint64
+	maxDepth                     int
+	totalWait                    time.Duration
+	byBand                       map[string]int
+}
+
+func newPriorityQueue(opts queueOptions) *priorityQueue {
+	if opts.clock == nil {
+		opts.clock = time.Now
+	}
+	q := &priorityQueue{opts: opts, epoch: opts.clock(), byBand: map[string]int{}}
+	q.nonEmpty = sync.NewCond(&q.mu)
+	return q
+}
+
+func (q *priorityQueue) push(n notification) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return errQueueClosed
+	}
+	if q.opts.capacity > 0 && len(q.items) >= q.opts.capacity {
+		q.rejected++
+		return errQueueFull
+	}
+	now := q.opts.clock()
+	rank := float64(n.importance())
+	if q.opts.agingEvery > 0 {
+		// arriving later is the same as having waited less
+		rank -= float64(now.Sub(q.epoch)) / float64(q.opts.agingEvery)
+	}
+	q.seq++
+	heap.Push(&q.items, &queued{n: n, seq: q.seq, enqueuedAt: now, rank: rank})
+	q.enqueued++
+	q.byBand[importanceBand(n.importance())]++
+	q.maxDepth = max(q.maxDepth, len(q.items))
+	q.nonEmpty.Signal()
+	return nil
+}
+
+func (q *priorityQueue) takeLocked() queued {
+	item := heap.Pop(&q.items).(*queued)
+	q.dequeued++
+	q.byBand[importanceBand(item.n.importance())]--
+	q.totalWait += item.waited(q.opts.clock())
+	return *item
+}
+
+// pop waits for a message, ok is false once the queue is closed and drained
+func (q *priorityQueue) pop() (queued, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for len(q.items) == 0 && !q.closed {
+		q.nonEmpty.Wait()
+	}
+	if len(q.items) == 0 {
+		return queued{}, false
+	}
+	return q.takeLocked(), true
+}
+
+// tryPop never waits
+func (q *priorityQueue) tryPop() (queued, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.items) == 0 {
+		return queued{}, false
+	}
+	return q.takeLocked(), true
+}
+
+// close stops new pushes, whatever is queued can still be popped
+func (q *priorityQueue) close() {
+	q.mu.Lock()
+	q.closed = true
+	q.mu.Unlock()
+	q.nonEmpty.Broadcast()
+}
+
+func (q *priorityQueue) len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.items)
+}
+
+type queueStats struct {
+	depth      int
+	maxDepth   int
+	enqueued   uint64
+	dequeued   uint64
+	rejected   uint64
+	oldestWait time.Duration
+	avgWait    time.Duration // of everything dequeued so far
+	byBand     map[string]int
+}
+
+func (st queueStats) info() string {
+	return fmt.Sprintf("depth: %v (max %v) | in: %v out: %v rejected: %v | oldest waiting: %v | avg wait: %v | %v",
+		st.depth, st.maxDepth, st.enqueued, st.dequeued, st.rejected, st.oldestWait, st.avgWait, st.byBand)
+}
+
+func (q *priorityQueue) stats() queueStats {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	st := queueStats{
+		depth: len(q.items), maxDepth: q.maxDepth,
+		enqueued: q.enqueued, dequeued: q.dequeued, rejected: q.rejected,
+		byBand: map[string]int{},
+	}
+	now := q.opts.clock()
+	for _, item := range q.items {
+		st.oldestWait = max(st.oldestWait, item.waited(now))
+	}
+	if q.dequeued > 0 {
+		st.avgWait = q.totalWait / time.Duration(q.dequeued)
+	}
+	for band, n := range q.byBand {
+		if n > 0 {
+			st.byBand[band] = n
+		}
+	}
+	return st
+}
+
+// importanceBand buckets importance() the same way everywhere (queue metrics, inbox counts...)
+func importanceBand(importance int) string {
+	switch {
+	case importance >= 100:
+		return "critical"
+	case importance >= 50:
+		return "high"
+	case importance >= 20:
+		return "normal"
+	}
+	return "low"
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RATE LIMITS AND DIGESTS
+// Every sender and every recipient gets a token bucket. A message needs a token from both,
+// otherwise it is not dropped but counted into the recipient's digest for the current hour (or day),
+// and when that period is over the digest goes out as one low importance notification.
+// A digest covers the held messages of one period, from the first to the last of them.
+// Buckets that filled up again are forgotten, a new one starts full anyway.
+// System alerts never wait for a token.
+// A group fan-out costs the sender one token for the whole message (admitSender), every member's copy
+// then only needs a token from that member's bucket (admitMember).
+
+type rateLimit struct {
+	every time.Duration // one token per every
+	burst int           // bucket size, what can go out back to back
+}
+
+type tokenBucket struct {
+	limit  rateLimit
+	tokens float64
+	last   time.Time
+}
+
+// refill tops the bucket up for the time that passed, a new bucket starts full
+func (b *tokenBucket) refill(now time.Time) {
+	if b.last.IsZero() {
+		b.tokens, b.last = float64(b.limit.burst), now
+		return
+	}
+	b.tokens = min(float64(b.limit.burst), b.tokens+float64(now.Sub(b.last))/float64(b.limit.every))
+	b.last = now
+}
+
+// fullAt is when the bucket will have refilled completely
+func (b *tokenBucket) fullAt() time.Time {
+	return b.last.Add(time.Duration((float64(b.limit.burst) - b.tokens) * float64(b.limit.every)))
+}
+
+type limiterConfig struct {
+	perSender    rateLimit
+	perRecipient rateLimit
+	digestEvery  time.Duration // time.Hour or 24 * time.Hour
+}
+
+var defaultLimits = limiterConfig{
+	perSender:    rateLimit{every: 10 * time.Second, burst: 5},
+	perRecipient: rateLimit{every: 5 * time.Second, burst: 10},
+	digestEvery:  time.Hour,
+}
+
+// digestMessage is a notification of its own, so it travels through routing like any other
+type digestMessage struct {
+	recipient  string
+	period     string // hourly, daily
+	from, to   time.Time
+	total      int
+	byGroup    map[string]int
+	topSenders []senderCount
+}
+
+type senderCount struct {
+	sender string
+	count  int
+}
+
+func (d digestMessage) importance() int { return 5 }
+
+func (d digestMessage) summary() string {
+	var groups []string
+	for g, n := range d.byGroup {
+		groups = append(groups, fmt.Sprintf("%v: %v", g, n))
+	}
+	sort.Strings(groups)
+	var senders []string
+	for _, s := range d.topSenders {
+		senders = append(senders, fmt.Sprintf("%v (%v)", s.sender, s.count))
+	}
+	span := d.from.Format("15:04")
+	if d.to.Format("15:04") != span {
+		span += "-" + d.to.Format("15:04")
+	}
+	return fmt.Sprintf("%v held back %v | groups: %v | top senders: %v",
+		d.total, span, strings.Join(groups, ", "), strings.Join(senders, ", "))
+}
+
+type pendingDigest struct {
+	to          recipient
+	period      time.Time // start of the period the messages were held in
+	first, last time.Time // first and last held message
+	total       int
+	byGroup     map[string]int
+	bySender    map[string]int
+}
+
+type rateLimiter struct {
+	mu      sync.Mutex
+	cfg     limiterConfig
+	clock   func() time.Time
+	buckets map[string]*tokenBucket
+	sweptAt time.Time
+	digests map[string]*pendingDigest // by recipient user
+	closed  []*pendingDigest          // period over, waiting for the flusher
+}
+
+func newRateLimiter(cfg limiterConfig, clock func() time.Time) *rateLimiter {
+	if clock == nil {
+		clock = time.Now
+	}
+	if cfg.digestEvery <= 0 {
+		cfg.digestEvery = time.Hour
+	}
+	return &rateLimiter{cfg: cfg, clock: clock, buckets: map[string]*tokenBucket{}, digests: map[string]*pendingDigest{}}
+}
+
+func (l *rateLimiter) bucketLocked(key string, limit rateLimit) *tokenBucket {
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &tokenBucket{limit: limit}
+		l.buckets[key] = b
+	}
+	return b
+}
+
+// sweepLocked drops the buckets that are full again, at most once per refill time of the slowest limit
+func (l *rateLimiter) sweepLocked(now time.Time) {
+	every := max(time.Duration(l.cfg.perSender.burst)*l.cfg.perSender.every, time.Duration(l.cfg.perRecipient.burst)*l.cfg.perRecipient.every)
+	if now.Sub(l.sweptAt) < every {
+		return
+	}
+	l.sweptAt = now
+	for key, b := range l.buckets {
+		if !now.Before(b.fullAt()) {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// admit says whether d can go out now. When it can't, it's already counted in a digest.
+func (l *rateLimiter) admit(d delivery) bool {
+	if _, alert := d.n.(systemAlert); alert {
+		return true
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.clock()
+	l.sweepLocked(now)
+	sender := l.bucketLocked("sender:"+senderOf(d.n), l.cfg.perSender)
+	rcpt := l.bucketLocked("recipient:"+d.to.user, l.cfg.perRecipient)
+	sender.refill(now)
+	rcpt.refill(now)
+	// both or neither, a message held for the recipient shouldn't cost the sender a token
+	if sender.tokens >= 1 && rcpt.tokens >= 1 {
+		sender.tokens--
+		rcpt.tokens--
+		return true
+	}
+	l.holdLocked(d, now)
+	return false
+}
+
+// admitSender takes the sender's one token for a whole fan-out
+func (l *rateLimiter) admitSender(n notification) bool {
+	if _, alert := n.(systemAlert); alert {
+		return true
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.clock()
+	l.sweepLocked(now)
+	sender := l.bucketLocked("sender:"+senderOf(n), l.cfg.perSender)
+	sender.refill(now)
+	if sender.tokens >= 1 {
+		sender.tokens--
+		return true
+	}
+	return false
+}
+
+// admitMember is admit for one member's copy of a fan-out, senderPaid is what admitSender said.
+// When the sender was out of tokens every copy goes into the members' digests.
+func (l *rateLimiter) admitMember(d delivery, senderPaid bool) bool {
+	if _, alert := d.n.(systemAlert); alert {
+		return true
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.clock()
+	l.sweepLocked(now)
+	rcpt := l.bucketLocked("recipient:"+d.to.user, l.cfg.perRecipient)
+	rcpt.refill(now)
+	if senderPaid && rcpt.tokens >= 1 {
+		rcpt.tokens--
+		return true
+	}
+	l.holdLocked(d, now)
+	return false
+}
+
+// holdLocked counts d into its recipient's digest for the current period
+func (l *rateLimiter) holdLocked(d delivery, now time.Time) {
+	period := now.Truncate(l.cfg.digestEvery)
+	p, ok := l.digests[d.to.user]
+	if ok && !p.period.Equal(period) {
+		// the flusher hasn't come round yet, the old period's digest is done all the same
+		l.closed = append(l.closed, p)
+		ok = false
+	}
+	if !ok {
+		p = &pendingDigest{to: d.to, period: period, first: now, byGroup: map[string]int{}, bySender: map[string]int{}}
+		l.digests[d.to.user] = p
+	}
+	p.last = now
+	p.total++
+	if g, ok := d.n.(groupMessage); ok {
+		p.byGroup[g.groupName]++
+	} else {
+		p.byGroup["(direct)"]++
+	}
+	p.bySender[senderOf(d.n)]++
+}
+
+// dueDigests takes every digest whose period is over, all of them when force is set (shutting down)
+func (l *rateLimiter) dueDigests(force bool) []delivery {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.clock()
+	period := "hourly"
+	if l.cfg.digestEvery >= 24*time.Hour {
+		period = "daily"
+	}
+	done := l.closed
+	l.closed = nil
+	for user, p := range l.digests {
+		if force || !now.Before(p.period.Add(l.cfg.digestEvery)) {
+			delete(l.digests, user)
+			done = append(done, p)
+		}
+	}
+	var out []delivery
+	for _, p := range done {
+		var senders []senderCount
+		for s, n := range p.bySender {
+			senders = append(senders, senderCount{s, n})
+		}
+		sort.Slice(senders, func(a, b int) bool {
+			if senders[a].count != senders[b].count {
+				return senders[a].count > senders[b].count
+			}
+			return senders[a].sender < senders[b].sender
+		})
+		senders = senders[:min(len(senders), 3)]
+		dm := digestMessage{recipient: p.to.user, period: period, from: p.first, to: p.last, total: p.total, byGroup: p.byGroup, topSenders: senders}
+		out = append(out, delivery{id: fmt.Sprintf("digest-%v-%v", p.to.user, p.period.Unix()), to: p.to, n: dm, at: now})
+	}
+	sort.Slice(out, func(a, b int) bool {
+		if out[a].to.user != out[b].to.user {
+			return out[a].to.user < out[b].to.user
+		}
+		return out[a].n.(digestMessage).from.Before(out[b].n.(digestMessage).from)
+	})
+	return out
+}
+
+// startDigestFlusher checks every tick for finished digests and hands them to send, stop flushes the rest
+func (l *rateLimiter) startDigestFlusher(tick time.Duration, send func(delivery)) (stop func()) {
+	done := make(chan struct{})
+	finished := make(chan struct{})
+	go func() {
+		defer close(finished)
+		t := time.NewTicker(tick)
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+				for _, d := range l.dueDigests(false) {
+					send(d)
+				}
+			case <-done:
+				for _, d := range l.dueDigests(true) {
+					send(d)
+				}
+				return
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		<-finished
+	}
+}
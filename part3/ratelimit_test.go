@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// fakeClock is a clock tests move by hand
+type fakeClock struct{ now time.Time }
+
+func newFakeClock(t time.Time) *fakeClock    { return &fakeClock{now: t} }
+func (c *fakeClock) clock() time.Time        { return c.now }
+func (c *fakeClock) advance(d time.Duration) { c.now = c.now.Add(d) }
+
+func dmFrom(sender, to string) delivery {
+	return delivery{to: recipient{user: to}, n: directMessage{senderUsername: sender}}
+}
+
+func groupFrom(group, sender, to string) delivery {
+	return delivery{to: recipient{user: to}, n: groupMessage{groupName: group, senderUsername: sender}}
+}
+
+func TestTokenBuckets(t *testing.T) {
+	c := newFakeClock(time.Date(2024, 3, 1, 9, 0, 0, 0, time.UTC))
+	l := newRateLimiter(limiterConfig{
+		perSender:    rateLimit{every: 10 * time.Second, burst: 2},
+		perRecipient: rateLimit{every: 5 * time.Second, burst: 3},
+	}, c.clock)
+	for i, step := range []struct {
+		after time.Duration
+		d     delivery
+		want  bool
+	}{
+		{0, dmFrom("ana", "bo"), true},
+		{0, dmFrom("ana", "bo"), true},
+		{0, dmFrom("ana", "bo"), false}, // ana's burst of 2 is used up
+		{0, dmFrom("cy", "bo"), true},   // bo has one token left
+		{0, dmFrom("cy", "bo"), false},  // and now none, cy keeps the token it didn't spend
+		{0, dmFrom("cy", "di"), true},
+		{0, delivery{to: recipient{user: "bo"}, n: systemAlert{"DB-DOWN", "down"}}, true},
+		{5 * time.Second, dmFrom("ana", "bo"), false}, // bo got a token back, ana is still half a token short
+		{5 * time.Second, dmFrom("ana", "bo"), true},
+		{time.Minute, dmFrom("ana", "bo"), true},
+		{0, dmFrom("ana", "bo"), true},
+		{0, dmFrom("ana", "bo"), false},
+	} {
+		c.advance(step.after)
+		if got := l.admit(step.d); got != step.want {
+			t.Errorf("step %v, %v to %v: admitted %v, want %v", i+1, senderOf(step.d.n), step.d.to.user, got, step.want)
+		}
+	}
+}
+
+// a fan-out costs the sender one token, every member pays their own
+func TestFanOutTokens(t *testing.T) {
+	c := newFakeClock(time.Date(2024, 3, 1, 9, 0, 0, 0, time.UTC))
+	l := newRateLimiter(limiterConfig{
+		perSender:    rateLimit{every: time.Minute, burst: 1},
+		perRecipient: rateLimit{every: time.Minute, burst: 1},
+	}, c.clock)
+	l.admit(dmFrom("ana", "cy")) // cy has nothing left
+	msg := groupFrom("ops", "bo", "")
+	paid := l.admitSender(msg.n)
+	if !paid {
+		t.Fatal("first fan-out refused")
+	}
+	for _, tc := range []struct {
+		member string
+		want   bool
+	}{{"ana", true}, {"bo", true}, {"cy", false}, {"di", true}} {
+		if got := l.admitMember(groupFrom("ops", "bo", tc.member), paid); got != tc.want {
+			t.Errorf("member %v: admitted %v, want %v", tc.member, got, tc.want)
+		}
+	}
+	if paid := l.admitSender(msg.n); paid {
+		t.Error("second fan-out got a sender token")
+	}
+	if l.admitMember(groupFrom("ops", "bo", "ed"), false) {
+		t.Error("a member with tokens was let through when the sender had none")
+	}
+}
+
+func TestDigests(t *testing.T) {
+	c := newFakeClock(time.Date(2024, 3, 1, 9, 10, 0, 0, time.UTC))
+	l := newRateLimiter(limiterConfig{
+		perSender:    rateLimit{every: time.Hour, burst: 100},
+		perRecipient: rateLimit{every: time.Hour, burst: 1},
+		digestEvery:  time.Hour,
+	}, c.clock)
+	for _, d := range []delivery{dmFrom("ana", "bo"), dmFrom("ana", "bo"), groupFrom("ops", "cy", "bo"), groupFrom("ops", "", "bo"), dmFrom("di", "bo")} {
+		l.admit(d)
+		c.advance(time.Minute)
+	}
+	if due := l.dueDigests(false); len(due) != 0 {
+		t.Fatalf("digest before the hour is over: %v", due)
+	}
+	c.advance(50 * time.Minute) // 10:05, the next hour
+	l.admit(dmFrom("ana", "bo"))
+	due := l.dueDigests(false)
+	if len(due) != 1 {
+		t.Fatalf("due digests: %v", due)
+	}
+	dm := due[0].n.(digestMessage)
+	if dm.total != 4 || dm.period != "hourly" || fmt.Sprint(dm.byGroup) != "map[(direct):2 ops:2]" ||
+		fmt.Sprint(dm.topSenders) != "[{ana 1} {cy 1} {di 1}]" || dm.from.Format("15:04") != "09:11" || dm.to.Format("15:04") != "09:14" {
+		t.Errorf("digest: %+v", dm)
+	}
+	if due := l.dueDigests(true); len(due) != 1 || due[0].n.(digestMessage).total != 1 {
+		t.Errorf("forced digests at shutdown: %v", due)
+	}
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"net/textproto"
+	"sync"
+	"time"
+)
+
+// RETRIES
+// At least once: every routed channel is tried until it works or the attempts run out,
+// waiting base, 2*base, 4*base... (capped at maxDelay) between tries, each wait picked at random
+// below that cap ("full jitter") so a thousand failed sends don't all come back in the same millisecond.
+// A channel that already worked isn't sent again when another one fails.
+// The delivery id doubles as the idempotency key, receivers that saw it already can drop the repeat.
+// What still fails ends up in the dead letter queue (deadletters.go), with everything needed to replay it.
+// While a delivery waits for its next try it is written down in the pending queue (same format as the dead letters),
+// so a crash mid-backoff doesn't lose it: resume sends whatever a previous run left there.
+
+type retryPolicy struct {
+	maxAttempts int
+	base        time.Duration
+	maxDelay    time.Duration
+}
+
+var defaultRetryPolicy = retryPolicy{maxAttempts: 5, base: 200 * time.Millisecond, maxDelay: 30 * time.Second}
+
+// backoff is the wait before try number attempt+1, attempt starts at 1
+func (p retryPolicy) backoff(attempt int, rng *rand.Rand) time.Duration {
+	ceiling := p.base << min(attempt-1, 30)
+	if ceiling <= 0 || ceiling > p.maxDelay {
+		ceiling = p.maxDelay
+	}
+	if ceiling <= 0 {
+		return 0
+	}
+	return time.Duration(rng.Int64N(int64(ceiling) + 1))
+}
+
+// permanent errors don't get better by trying again: nowhere to send it, a 4xx answer (but 408 and 429,
+// those ask to come back later), a 5xx smtp reply, or a rejection before anything was sent
+func permanent(err error) bool {
+	if errors.Is(err, errNoAddress) || errors.Is(err, errUnknownChannel) || errors.Is(err, errNoRoute) {
+		return true
+	}
+	var status *statusError
+	if errors.As(err, &status) {
+		return status.code/100 == 4 && status.code != http.StatusRequestTimeout && status.code != http.StatusTooManyRequests
+	}
+	var reply *textproto.Error
+	if errors.As(err, &reply) {
+		return reply.Code >= 500
+	}
+	return errors.Is(err, errDeliveryRejected)
+}
+
+type reliableSender struct {
+	r       *router
+	policy  retryPolicy
+	dead    *deadLetters // nil drops what can't be delivered, like before
+	pending *deadLetters // deliveries waiting for their next try, nil keeps that in memory only
+	rngMu   sync.Mutex
+	rng     *rand.Rand
+	sleep   func(ctx context.Context, d time.Duration) error // swapped out by demos that shouldn't wait
+}
+
+func newReliableSender(r *router, policy retryPolicy, dead *deadLetters) *reliableSender {
+	return &reliableSender{r: r, policy: policy, dead: dead, rng: rand.New(rand.NewPCG(uint64(time.Now().UnixNano()), 0)), sleep: sleepCtx}
+}
+
+func sleepCtx(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+type attemptResult struct {
+	channel  string
+	attempts int
+	err      error // nil once it went through
+}
+
+// send tries every channel the router picks, each with its own retries
+func (rs *reliableSender) send(ctx context.Context, d delivery) []attemptResult {
+	channels := rs.r.channelsFor(d.n)
+	if len(channels) == 0 {
+		return []attemptResult{{err: errors.Join(errNoRoute, rs.bury(d, "", 0, errNoRoute))}}
+	}
+	results := make([]attemptResult, len(channels))
+	for i, ch := range channels {
+		results[i] = rs.sendOn(ctx, d, ch)
+	}
+	return results
+}
+
+// channelsFor and dispatchOn make a reliableSender a dispatcher (prefs.go), the channels the preferences
+// leave are retried and dead-lettered like any other send
+func (rs *reliableSender) channelsFor(n notification) []string {
+	return rs.r.channelsFor(n)
+}
+
+func (rs *reliableSender) dispatchOn(ctx context.Context, d delivery, channels []string) []deliveryResult {
+	results := make([]deliveryResult, len(channels))
+	for i, ch := range channels {
+		results[i] = deliveryResult{channel: ch, err: rs.sendOn(ctx, d, ch).err}
+	}
+	return results
+}
+
+// sendOn retries one channel and buries the delivery when that runs out
+func (rs *reliableSender) sendOn(ctx context.Context, d delivery, channel string) attemptResult {
+	res := rs.try(ctx, d, channel)
+	if res.err != nil {
+		if err := rs.bury(d, channel, res.attempts, res.err); err != nil {
+			res.err = errors.Join(res.err, err)
+		}
+	}
+	return res
+}
+
+// try is sendOn without the burying, the delivery is in the pending queue while it waits between tries
+func (rs *reliableSender) try(ctx context.Context, d delivery, channel string) attemptResult {
+	res := attemptResult{channel: channel}
+	pendingID := 0
+	defer func() {
+		if pendingID != 0 {
+			if err := rs.pending.remove(pendingID); err != nil {
+				res.err = errors.Join(res.err, fmt.Errorf("pending queue: %w", err))
+			}
+		}
+	}()
+	for {
+		res.attempts++
+		res.err = rs.r.dispatchOn(ctx, d, []string{channel})[0].err
+		if res.err == nil || permanent(res.err) || res.attempts >= rs.policy.maxAttempts || ctx.Err() != nil {
+			break
+		}
+		if rs.pending != nil && pendingID == 0 {
+			id, err := rs.pending.add(d, channel, res.attempts, res.err)
+			if err != nil {
+				res.err = errors.Join(res.err, fmt.Errorf("pending queue: %w", err))
+				break
+			}
+			pendingID = id
+		}
+		rs.rngMu.Lock()
+		wait := rs.policy.backoff(res.attempts, rs.rng)
+		rs.rngMu.Unlock()
+		if err := rs.sleep(ctx, wait); err != nil {
+			res.err = fmt.Errorf("gave up waiting to retry: %w", err)
+			break
+		}
+	}
+	return res
+}
+
+func (rs *reliableSender) bury(d delivery, channel string, attempts int, err error) error {
+	if rs.dead == nil {
+		return nil
+	}
+	if _, derr := rs.dead.add(d, channel, attempts, err); derr != nil {
+		return fmt.Errorf("dead letter queue: %w", derr)
+	}
+	return nil
+}
+
+// resume sends what a previous run left waiting in the pending queue, each from a fresh set of attempts.
+// The old entry goes once its send is over, a crash before that sends it again, which the idempotency key covers.
+func (rs *reliableSender) resume(ctx context.Context) (ok, failed int) {
+	if rs.pending == nil {
+		return 0, 0
+	}
+	for _, dl := range rs.pending.list() {
+		d, err := dl.delivery()
+		if err != nil {
+			failed++ // stays where it is, somebody has to look at it
+			continue
+		}
+		if rs.sendOn(ctx, d, dl.Channel).err != nil {
+			failed++
+		} else {
+			ok++
+		}
+		rs.pending.remove(dl.ID)
+	}
+	return ok, failed
+}
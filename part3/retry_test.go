@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net/textproto"
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+	p := retryPolicy{maxAttempts: 5, base: 200 * time.Millisecond, maxDelay: 30 * time.Second}
+	rng := rand.New(rand.NewPCG(1, 0))
+	for _, tc := range []struct {
+		attempt int
+		ceiling time.Duration
+	}{
+		{1, 200 * time.Millisecond},
+		{2, 400 * time.Millisecond},
+		{3, 800 * time.Millisecond},
+		{8, 25600 * time.Millisecond},
+		{9, 30 * time.Second},
+		{40, 30 * time.Second},   // shifting that far would overflow
+		{1000, 30 * time.Second}, // and this far would wrap
+	} {
+		var longest time.Duration
+		for i := 0; i < 200; i++ {
+			d := p.backoff(tc.attempt, rng)
+			if d < 0 || d > tc.ceiling {
+				t.Fatalf("attempt %v: waited %v, want 0..%v", tc.attempt, d, tc.ceiling)
+			}
+			longest = max(longest, d)
+		}
+		if longest < tc.ceiling/2 {
+			t.Errorf("attempt %v: longest of 200 waits is %v, the jitter doesn't spread up to %v", tc.attempt, longest, tc.ceiling)
+		}
+	}
+	if d := (retryPolicy{}).backoff(3, rng); d != 0 {
+		t.Errorf("no delays configured: waited %v", d)
+	}
+}
+
+func TestPermanent(t *testing.T) {
+	for _, tc := range []struct {
+		err  error
+		want bool
+	}{
+		{errNoAddress, true},
+		{fmt.Errorf("%w %q", errUnknownChannel, "pager"), true},
+		{errNoRoute, true},
+		{&statusError{code: 400}, true},
+		{&statusError{code: 404}, true},
+		{&statusError{code: 408}, false},
+		{&statusError{code: 429}, false},
+		{&statusError{code: 500}, false},
+		{&statusError{code: 503}, false},
+		{&textproto.Error{Code: 550, Msg: "no such user"}, true},
+		{&textproto.Error{Code: 421, Msg: "try later"}, false},
+		{fmt.Errorf("%w: line break in an address", errDeliveryRejected), true},
+		{errFlaky, false},
+		{context.DeadlineExceeded, false},
+	} {
+		if got := permanent(tc.err); got != tc.want {
+			t.Errorf("%v: permanent %v, want %v", tc.err, got, tc.want)
+		}
+	}
+}
+
+// a gateway answering with errors is retried with the same idempotency key until it takes the text,
+// a 4xx gives up at once and the waits in between stay under each attempt's ceiling
+func TestRetriesAgainstGateway(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		answers  []int
+		attempts int
+		ok       bool
+	}{
+		{"works first time", nil, 1, true},
+		{"server errors then ok", []int{500, 503}, 3, true},
+		{"rate limited then ok", []int{429}, 2, true},
+		{"keeps failing", []int{500, 500, 500, 500}, 4, false},
+		{"rejected", []int{400}, 1, false},
+	} {
+		web := startFakeHTTP()
+		web.fail(tc.answers...)
+		rs, dead := testSender(newRouter([]routeRule{{channels: []string{"sms"}}}, &smsDeliverer{gateway: web.url("/sms")}), 4)
+		var waits []time.Duration
+		rs.sleep = func(_ context.Context, d time.Duration) error {
+			waits = append(waits, d)
+			return nil
+		}
+		res := rs.send(context.Background(), delivery{id: "d1", to: recipient{user: "bo", phone: "+15550100"}, n: systemAlert{"DB-DOWN", "down"}})
+		got := web.received()
+		web.close()
+
+		if len(res) != 1 || res[0].attempts != tc.attempts || (res[0].err == nil) != tc.ok {
+			t.Errorf("%v: got %+v, want %v attempts, ok %v", tc.name, res, tc.attempts, tc.ok)
+			continue
+		}
+		if len(waits) != tc.attempts-1 {
+			t.Errorf("%v: waited %v times, want %v", tc.name, len(waits), tc.attempts-1)
+		}
+		for i, w := range waits {
+			if ceiling := rs.policy.base << i; w > ceiling {
+				t.Errorf("%v: wait %v is %v, over %v", tc.name, i+1, w, ceiling)
+			}
+		}
+		if tc.ok {
+			if len(got) != 1 || got[0].header.Get("Idempotency-Key") != "d1" || len(dead.list()) != 0 {
+				t.Errorf("%v: gateway got %v, dead letters %v", tc.name, got, dead.list())
+			}
+			continue
+		}
+		letters := dead.list()
+		if len(letters) != 1 || letters[0].Attempts != tc.attempts || letters[0].Channel != "sms" {
+			t.Errorf("%v: dead letters %+v", tc.name, letters)
+		}
+		var status *statusError
+		if !errors.As(res[0].err, &status) || status.code != tc.answers[len(tc.answers)-1] {
+			t.Errorf("%v: error %v", tc.name, res[0].err)
+		}
+	}
+}
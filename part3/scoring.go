@@ -0,0 +1,340 @@
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+// SPAM SCORING
+// Every rule looks at one thing (who sent it, what it says, how often they send, is it urgent)
+// and adds weight * what it found to the score. At or over the threshold it's spam and goes to quarantine.
+// Rules come from a json file (scoring.json, built into the binary too for when there is none next to it),
+// and every verdict keeps each rule's share so you can see why.
+// System alerts are scored like everything else but never quarantined, nobody wants to miss DB-DOWN.
+
+var (
+	errUnknownRule    = errors.New("unknown scoring rule type")
+	errNotQuarantined = errors.New("no quarantined message with that id")
+)
+
+type scoringRule struct {
+	Name   string  `json:"name"`
+	Type   string  `json:"type"` // reputation, keywords, caps, links, rate, urgent, importance_below
+	Weight float64 `json:"weight"`
+
+	Senders map[string]float64 `json:"senders,omitempty"` // reputation: -1 known spammer .. 1 trusted
+	Words   map[string]float64 `json:"words,omitempty"`   // keywords: points per word found
+	Min     float64            `json:"min,omitempty"`     // caps: share of capital letters that counts as shouting
+	Window  string             `json:"window,omitempty"`  // rate: "1m", "1h"...
+	Limit   int                `json:"limit,omitempty"`   // rate: messages per window before it counts
+	Below   int                `json:"below,omitempty"`   // importance_below
+
+	window time.Duration
+}
+
+type scoringConfig struct {
+	Threshold float64       `json:"threshold"`
+	Rules     []scoringRule `json:"rules"`
+}
+
+// builtinScoring is scoring.json as it was when the program was built, the one copy of the default rules
+//
+//go:embed scoring.json
+var builtinScoring []byte
+
+func parseScoringConfig(data []byte) (scoringConfig, error) {
+	var cfg scoringConfig
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return cfg, err
+	}
+	return cfg, cfg.check()
+}
+
+// check fills in the parsed fields, so a bad file fails at load and not on the first message
+func (cfg *scoringConfig) check() error {
+	for i := range cfg.Rules {
+		r := &cfg.Rules[i]
+		switch r.Type {
+		case "reputation", "keywords", "caps", "links", "urgent", "importance_below":
+		case "rate":
+			d, err := time.ParseDuration(r.Window)
+			if err != nil || d <= 0 {
+				return fmt.Errorf("rule %q: window %q: %v", r.Name, r.Window, err)
+			}
+			r.window = d
+		default:
+			return fmt.Errorf("%w %q in rule %q", errUnknownRule, r.Type, r.Name)
+		}
+	}
+	return nil
+}
+
+// loadScoringConfig reads the rules from path, a missing file means the built in ones.
+// A file that is there but broken is an error, nobody should get the defaults by accident
+func loadScoringConfig(path string) (scoringConfig, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		data, path = builtinScoring, "built in scoring.json"
+	} else if err != nil {
+		return scoringConfig{}, err
+	}
+	cfg, err := parseScoringConfig(data)
+	if err != nil {
+		return cfg, fmt.Errorf("%v: %w", path, err)
+	}
+	return cfg, nil
+}
+
+// senderOf is who to blame: the user for messages, the code for alerts
+func senderOf(n notification) string {
+	switch v := n.(type) {
+	case directMessage:
+		return v.senderUsername
+	case groupMessage:
+		if v.senderUsername != "" {
+			return v.senderUsername
+		}
+		return v.groupName
+	case systemAlert:
+		return v.alertCode
+	}
+	return ""
+}
+
+func isUrgent(n notification) bool {
+	switch v := n.(type) {
+	case directMessage:
+		return v.isUrgent
+	case systemAlert:
+		return true
+	}
+	return false
+}
+
+type contribution struct {
+	rule   string
+	points float64
+	why    string
+}
+
+type verdict struct {
+	score         float64
+	spam          bool
+	contributions []contribution // only the rules that added something
+}
+
+// explain lists the biggest contributions first
+func (v verdict) explain() string {
+	parts := []string{fmt.Sprintf("score %.1f", v.score)}
+	for _, c := range v.contributions {
+		parts = append(parts, fmt.Sprintf("%v %+.1f (%v)", c.rule, c.points, c.why))
+	}
+	if v.spam {
+		parts[0] += " SPAM"
+	}
+	return strings.Join(parts, " | ")
+}
+
+type quarantined struct {
+	id      int
+	n       notification
+	verdict verdict
+	at      time.Time
+}
+
+type scoreEngine struct {
+	mu         sync.Mutex
+	cfg        scoringConfig
+	clock      func() time.Time
+	recent     map[string][]time.Time // per sender, only kept when there is a rate rule
+	window     time.Duration          // the longest rate window, 0 without rate rules
+	sweptAt    time.Time
+	quarantine []quarantined
+	nextID     int
+}
+
+func newScoreEngine(cfg scoringConfig, clock func() time.Time) (*scoreEngine, error) {
+	if err := cfg.check(); err != nil {
+		return nil, err
+	}
+	if clock == nil {
+		clock = time.Now
+	}
+	e := &scoreEngine{cfg: cfg, clock: clock, recent: map[string][]time.Time{}}
+	for _, r := range cfg.Rules {
+		e.window = max(e.window, r.window)
+	}
+	return e, nil
+}
+
+// rememberLocked adds this message to the sender's recent ones and forgets whatever is older than
+// any rate window, senders who went quiet included. Must be called with e.mu held
+func (e *scoreEngine) rememberLocked(sender string, now time.Time) {
+	if e.window == 0 {
+		return
+	}
+	var kept []time.Time
+	for _, t := range e.recent[sender] {
+		if now.Sub(t) < e.window {
+			kept = append(kept, t)
+		}
+	}
+	e.recent[sender] = append(kept, now)
+	if now.Sub(e.sweptAt) < e.window {
+		return
+	}
+	e.sweptAt = now
+	for s, times := range e.recent {
+		if now.Sub(times[len(times)-1]) >= e.window {
+			delete(e.recent, s)
+		}
+	}
+}
+
+// countRecentLocked counts the sender's messages inside the window, this one included, must be called with e.mu held
+func (e *scoreEngine) countRecentLocked(sender string, window time.Duration, now time.Time) int {
+	count := 0
+	for _, t := range e.recent[sender] {
+		if now.Sub(t) < window {
+			count++
+		}
+	}
+	return count
+}
+
+func (e *scoreEngine) ruleLocked(r scoringRule, n notification, now time.Time) (float64, string) {
+	text := contentOf(n)
+	switch r.Type {
+	case "reputation":
+		rep := r.Senders[senderOf(n)]
+		return rep, fmt.Sprintf("%v has %v", senderOf(n), rep)
+	case "keywords":
+		total := 0.0
+		var found []string
+		for _, word := range strings.FieldsFunc(strings.ToLower(text), func(c rune) bool { return !unicode.IsLetter(c) }) {
+			if p, ok := r.Words[word]; ok {
+				total += p
+				found = append(found, word)
+			}
+		}
+		return total, strings.Join(found, ", ")
+	case "caps":
+		letters, upper := 0, 0
+		for _, c := range text {
+			if unicode.IsLetter(c) {
+				letters++
+				if unicode.IsUpper(c) {
+					upper++
+				}
+			}
+		}
+		if letters >= 4 && float64(upper)/float64(letters) >= r.Min {
+			return 1, fmt.Sprintf("%v of %v letters", upper, letters)
+		}
+	case "links":
+		lower := strings.ToLower(text)
+		links := strings.Count(lower, "http://") + strings.Count(lower, "https://") + strings.Count(lower, "www.")
+		return float64(links), fmt.Sprintf("%v link(s)", links)
+	case "rate":
+		count := e.countRecentLocked(senderOf(n), r.window, now)
+		if over := count - r.Limit; over > 0 {
+			return float64(over), fmt.Sprintf("%v in %v", count, r.window)
+		}
+	case "urgent":
+		if isUrgent(n) {
+			return 1, "urgent"
+		}
+	case "importance_below":
+		if n.importance() < r.Below {
+			return 1, fmt.Sprintf("%v < %v", n.importance(), r.Below)
+		}
+	}
+	return 0, ""
+}
+
+// score records the message for rate rules and returns the verdict, classify also quarantines
+func (e *scoreEngine) score(n notification) verdict {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.scoreLocked(n, e.clock())
+}
+
+func (e *scoreEngine) scoreLocked(n notification, now time.Time) verdict {
+	e.rememberLocked(senderOf(n), now)
+
+	var v verdict
+	for _, r := range e.cfg.Rules {
+		value, why := e.ruleLocked(r, n, now)
+		if points := r.Weight * value; points != 0 {
+			v.score += points
+			v.contributions = append(v.contributions, contribution{rule: r.Name, points: points, why: why})
+		}
+	}
+	sort.SliceStable(v.contributions, func(a, b int) bool {
+		return abs(v.contributions[a].points) > abs(v.contributions[b].points)
+	})
+	v.spam = v.score >= e.cfg.Threshold
+	return v
+}
+
+func abs(f float64) float64 {
+	if f < 0 {
+		return -f
+	}
+	return f
+}
+
+// classify scores n and holds it back when it is spam, alerts always go through
+func (e *scoreEngine) classify(n notification) verdict {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	now := e.clock()
+	v := e.scoreLocked(n, now)
+	if _, alert := n.(systemAlert); alert {
+		v.spam = false
+	}
+	if v.spam {
+		e.nextID++
+		e.quarantine = append(e.quarantine, quarantined{id: e.nextID, n: n, verdict: v, at: now})
+	}
+	return v
+}
+
+func (e *scoreEngine) quarantined() []quarantined {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return append([]quarantined(nil), e.quarantine...)
+}
+
+func (e *scoreEngine) takeLocked(id int) (quarantined, error) {
+	for i, q := range e.quarantine {
+		if q.id == id {
+			e.quarantine = append(e.quarantine[:i], e.quarantine[i+1:]...)
+			return q, nil
+		}
+	}
+	return quarantined{}, errNotQuarantined
+}
+
+// release hands a false positive back so the caller can deliver it after all
+func (e *scoreEngine) release(id int) (notification, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	q, err := e.takeLocked(id)
+	return q.n, err
+}
+
+func (e *scoreEngine) discard(id int) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	_, err := e.takeLocked(id)
+	return err
+}
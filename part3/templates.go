@@ -0,0 +1,176 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"text/template"
+)
+
+// TEMPLATES
+// Subjects and bodies come from named templates per notification kind, channel and language.
+// Looking one up falls back step by step: pt-BR -> pt -> the default language, and for each language
+// the channel's own template before the one for any channel (""). Variables are the notification's
+// fields ({{.sender}}, {{.group}}, {{.code}}, {{.content}}, {{.importance}}) plus whatever the caller adds,
+// a variable the template uses but nobody set is an error and not "<no value>".
+// Channels can have a length limit (sms: 160), bodies are cut to it at render time.
+// The sms deliverer cuts to the same limit itself, so a text without a template is no longer than one with.
+
+var errNoTemplate = errors.New("no template for this notification")
+
+const smsLimit = 160 // runes in one text
+
+type templateKey struct {
+	kind    string
+	channel string // "" is any channel
+	lang    string
+}
+
+type messageTemplate struct {
+	subject *template.Template
+	body    *template.Template
+}
+
+type renderedMessage struct {
+	subject   string
+	body      string
+	lang      string // the language that was actually used
+	truncated bool
+}
+
+type templateSet struct {
+	mu          sync.RWMutex
+	templates   map[templateKey]messageTemplate
+	defaultLang string
+	limits      map[string]int // channel -> max runes in the body
+}
+
+func newTemplateSet(defaultLang string) *templateSet {
+	return &templateSet{templates: map[templateKey]messageTemplate{}, defaultLang: defaultLang, limits: map[string]int{"sms": smsLimit}}
+}
+
+func (ts *templateSet) add(kind, channel, lang, subject, body string) error {
+	name := fmt.Sprintf("%v/%v/%v", kind, channel, lang)
+	subj, err := template.New(name + " subject").Option("missingkey=error").Parse(subject)
+	if err != nil {
+		return err
+	}
+	b, err := template.New(name + " body").Option("missingkey=error").Parse(body)
+	if err != nil {
+		return err
+	}
+	ts.mu.Lock()
+	ts.templates[templateKey{kind, channel, strings.ToLower(lang)}] = messageTemplate{subject: subj, body: b}
+	ts.mu.Unlock()
+	return nil
+}
+
+// langChain is pt-br, pt, then the default
+func (ts *templateSet) langChain(lang string) []string {
+	var chain []string
+	lang = strings.ToLower(strings.ReplaceAll(lang, "_", "-"))
+	for lang != "" {
+		chain = append(chain, lang)
+		i := strings.LastIndex(lang, "-")
+		if i < 0 {
+			break
+		}
+		lang = lang[:i]
+	}
+	return append(chain, strings.ToLower(ts.defaultLang))
+}
+
+func (ts *templateSet) find(kind, channel, lang string) (messageTemplate, string, bool) {
+	ts.mu.RLock()
+	defer ts.mu.RUnlock()
+	for _, l := range ts.langChain(lang) {
+		for _, ch := range []string{channel, ""} {
+			if t, ok := ts.templates[templateKey{kind, ch, l}]; ok {
+				return t, l, true
+			}
+		}
+	}
+	return messageTemplate{}, "", false
+}
+
+// templateVars is what every template can use, extra wins over the notification's own fields.
+// Routed deliveries pass their vars as extra.
+func templateVars(n notification, extra map[string]any) map[string]any {
+	name, importance := processNotification(n)
+	vars := map[string]any{"name": name, "sender": senderOf(n), "content": contentOf(n), "importance": importance, "kind": kindOf(n)}
+	switch v := n.(type) {
+	case groupMessage:
+		vars["group"] = v.groupName
+		vars["sender"] = v.senderUsername // the poster, "" for the group's own messages and not its name
+	case systemAlert:
+		vars["code"] = v.alertCode
+	}
+	for k, v := range extra {
+		vars[k] = v
+	}
+	return vars
+}
+
+// truncateRunes cuts on a rune boundary and marks the cut with "...", plain ascii so every gateway takes it
+func truncateRunes(s string, limit int) (string, bool) {
+	r := []rune(s)
+	if limit <= 0 || len(r) <= limit {
+		return s, false
+	}
+	if limit <= 3 {
+		return string(r[:limit]), true
+	}
+	return string(r[:limit-3]) + "...", true
+}
+
+func (ts *templateSet) render(n notification, channel, lang string, extra map[string]any) (renderedMessage, error) {
+	t, used, ok := ts.find(kindOf(n), channel, lang)
+	if !ok {
+		return renderedMessage{}, fmt.Errorf("%w: %v on %v", errNoTemplate, kindOf(n), channel)
+	}
+	vars := templateVars(n, extra)
+	var subject, body strings.Builder
+	if err := t.subject.Execute(&subject, vars); err != nil {
+		return renderedMessage{}, err
+	}
+	if err := t.body.Execute(&body, vars); err != nil {
+		return renderedMessage{}, err
+	}
+	msg := renderedMessage{subject: strings.TrimSpace(subject.String()), body: strings.TrimSpace(body.String()), lang: used}
+	ts.mu.RLock()
+	limit := ts.limits[channel]
+	ts.mu.RUnlock()
+	msg.body, msg.truncated = truncateRunes(msg.body, limit)
+	return msg, nil
+}
+
+func (ts *templateSet) setLimit(channel string, runes int) {
+	ts.mu.Lock()
+	ts.limits[channel] = runes
+	ts.mu.Unlock()
+}
+
+// defaultTemplates covers the three notification kinds in english, spanish and german,
+// with a shorter sms version where the normal one would waste the 160 characters
+func defaultTemplates() *templateSet {
+	ts := newTemplateSet("en")
+	for _, t := range [][5]string{
+		{"direct", "", "en", "Message from {{.sender}}", "{{.sender}} wrote: {{.content}}"},
+		{"direct", "", "es", "Mensaje de {{.sender}}", "{{.sender}} escribió: {{.content}}"},
+		{"direct", "", "de", "Nachricht von {{.sender}}", "{{.sender}} schrieb: {{.content}}"},
+		{"direct", "sms", "en", "", "{{.sender}}: {{.content}}"},
+		{"group", "", "en", "New in {{.group}}", "{{if .sender}}{{.sender}} in {{end}}{{.group}}: {{.content}}"},
+		{"group", "", "es", "Nuevo en {{.group}}", "{{if .sender}}{{.sender}} en {{end}}{{.group}}: {{.content}}"},
+		{"group", "", "de", "Neu in {{.group}}", "{{if .sender}}{{.sender}} in {{end}}{{.group}}: {{.content}}"},
+		{"alert", "", "en", "ALERT {{.code}}", "System alert {{.code}}: {{.content}}"},
+		{"alert", "", "es", "ALERTA {{.code}}", "Alerta del sistema {{.code}}: {{.content}}"},
+		{"alert", "", "de", "ALARM {{.code}}", "Systemalarm {{.code}}: {{.content}}"},
+		{"alert", "sms", "en", "", "ALERT {{.code}}: {{.content}}"},
+	} {
+		if err := ts.add(t[0], t[1], t[2], t[3], t[4]); err != nil {
+			panic(err) // a typo in the built in templates, not something to carry on with
+		}
+	}
+	return ts
+}
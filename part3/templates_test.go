@@ -0,0 +1,109 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestTemplateFallback(t *testing.T) {
+	ts := newTemplateSet("en")
+	for _, tpl := range [][5]string{
+		{"direct", "", "en", "en any", "en any"},
+		{"direct", "sms", "en", "en sms", "en sms"},
+		{"direct", "", "pt", "pt any", "pt any"},
+		{"direct", "email", "pt-BR", "pt-BR email", "pt-BR email"},
+	} {
+		if err := ts.add(tpl[0], tpl[1], tpl[2], tpl[3], tpl[4]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	dm := directMessage{senderUsername: "ana", messageContent: "hi"}
+	for _, tc := range []struct {
+		channel, lang string
+		want, used    string
+	}{
+		{"email", "pt-BR", "pt-BR email", "pt-br"},
+		{"email", "pt_br", "pt-BR email", "pt-br"},
+		{"sms", "pt-BR", "pt any", "pt"},   // the language wins over the channel
+		{"email", "pt-PT", "pt any", "pt"}, // no pt-PT, its parent
+		{"sms", "fr", "en sms", "en"},      // nothing in french, the default
+		{"console", "fr", "en any", "en"},
+		{"console", "", "en any", "en"},
+	} {
+		msg, err := ts.render(dm, tc.channel, tc.lang, nil)
+		if err != nil || msg.subject != tc.want || msg.lang != tc.used {
+			t.Errorf("%v in %q: got %q in %q (%v), want %q in %q", tc.channel, tc.lang, msg.subject, msg.lang, err, tc.want, tc.used)
+		}
+	}
+	if _, err := ts.render(groupMessage{groupName: "ops"}, "email", "en", nil); !errors.Is(err, errNoTemplate) {
+		t.Errorf("kind without templates: got %v", err)
+	}
+}
+
+func TestTemplateVars(t *testing.T) {
+	ts := defaultTemplates()
+	for _, tc := range []struct {
+		name    string
+		n       notification
+		channel string
+		lang    string
+		extra   map[string]any
+		subject string
+		body    string
+	}{
+		{"dm", directMessage{senderUsername: "ana", messageContent: "hi"}, "email", "en", nil, "Message from ana", "ana wrote: hi"},
+		{"dm in german", directMessage{senderUsername: "ana", messageContent: "hi"}, "email", "de-AT", nil, "Nachricht von ana", "ana schrieb: hi"},
+		{"group without a poster", groupMessage{groupName: "ops", messageContent: "deploy"}, "console", "es", nil, "Nuevo en ops", "ops: deploy"},
+		{"group with a poster", groupMessage{groupName: "ops", messageContent: "deploy", senderUsername: "bo"}, "console", "en", nil, "New in ops", "bo in ops: deploy"},
+		{"alert by text", systemAlert{"DB-DOWN", "down"}, "sms", "en", nil, "", "ALERT DB-DOWN: down"},
+		{"extra overrides", directMessage{senderUsername: "ana", messageContent: "hi"}, "email", "en", map[string]any{"sender": "Ana B."}, "Message from Ana B.", "Ana B. wrote: hi"},
+	} {
+		msg, err := ts.render(tc.n, tc.channel, tc.lang, tc.extra)
+		if err != nil || msg.subject != tc.subject || msg.body != tc.body {
+			t.Errorf("%v: got %q / %q (%v), want %q / %q", tc.name, msg.subject, msg.body, err, tc.subject, tc.body)
+		}
+	}
+
+	if err := ts.add("direct", "", "en", "Order {{.order}}", "{{.content}}"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ts.render(directMessage{senderUsername: "ana"}, "email", "en", nil); err == nil {
+		t.Error("a variable nobody set rendered without an error")
+	}
+	if msg, err := ts.render(directMessage{senderUsername: "ana"}, "email", "en", map[string]any{"order": 42}); err != nil || msg.subject != "Order 42" {
+		t.Errorf("with the variable set: %q %v", msg.subject, err)
+	}
+}
+
+func TestSMSLimit(t *testing.T) {
+	ts := defaultTemplates()
+	long := strings.Repeat("ü", 300)
+	msg, err := ts.render(directMessage{senderUsername: "ana", messageContent: long}, "sms", "en", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := utf8.RuneCountInString(msg.body); n != smsLimit || !msg.truncated || !strings.HasSuffix(msg.body, "...") {
+		t.Errorf("sms body: %v runes, truncated %v, ends %q", n, msg.truncated, msg.body[len(msg.body)-6:])
+	}
+	msg, err = ts.render(directMessage{senderUsername: "ana", messageContent: long}, "email", "en", nil)
+	if err != nil || msg.truncated || !strings.HasSuffix(msg.body, long) {
+		t.Errorf("email body was cut: truncated %v %v", msg.truncated, err)
+	}
+	for _, tc := range []struct {
+		in    string
+		limit int
+		want  string
+	}{
+		{"hello", 5, "hello"},
+		{"hello!", 5, "he..."},
+		{"héllo wörld", 8, "héllo..."},
+		{"hello", 2, "he"},
+		{"hello", 0, "hello"},
+	} {
+		if got, _ := truncateRunes(tc.in, tc.limit); got != tc.want {
+			t.Errorf("truncateRunes(%q, %v) = %q, want %q", tc.in, tc.limit, got, tc.want)
+		}
+	}
+}